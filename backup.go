@@ -0,0 +1,224 @@
+package jkv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// 备份文件由若干个 KVList 组成，每个 KVList 前面是 8 字节小端序的长度
+// KVList 中只包含备份时刻每个key的最新版本，value 已经从 vlog 中读取出来，不依赖原库的文件布局
+// 列族中的key带有列族的前缀，导入时写回同名的列族
+
+// backupBatchSize 单个 KVList 的大小上限
+const backupBatchSize = 4 * utils.Mi
+
+// Backup 把一个一致的快照中版本号大于 since 的key写入 w，since 为 0 表示全量备份，包括所有列族中的数据
+// 返回本次备份的读时间戳，作为下一次增量备份的 since
+// 增量备份中，since 之后删除或者过期的key以删除标记的形式写入，导入时会删除之前导入的版本
+func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+
+	bw := bufio.NewWriter(w)
+	list := &pb.KVList{}
+	var size int
+	add := func(kv *pb.KV) error {
+		list.Kv = append(list.Kv, kv)
+		size += len(kv.Key) + len(kv.Value)
+		if size < int(backupBatchSize) {
+			return nil
+		}
+		err := writeKVList(bw, list)
+		list.Kv, size = list.Kv[:0], 0
+		return err
+	}
+	names := make([]string, 0, len(db.opt.ColumnFamilies)+1)
+	names = append(names, "")
+	for name := range db.opt.ColumnFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	for _, name := range names {
+		cf, err := db.ColumnFamily(name)
+		if err != nil {
+			return 0, err
+		}
+		if err := backupColumnFamily(txn, cf, since, add); err != nil {
+			return 0, err
+		}
+	}
+	if len(list.Kv) > 0 {
+		if err := writeKVList(bw, list); err != nil {
+			return 0, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return txn.ReadTs(), nil
+}
+
+// backupColumnFamily 遍历列族中每个key的所有版本，只备份最新的版本
+// 最新版本是删除标记或者已经过期时，增量备份写入一个删除标记，全量备份导入空的DB，不需要删除标记
+func backupColumnFamily(txn *Txn, cf *ColumnFamily, since uint64, add func(*pb.KV) error) error {
+	iter := txn.NewIteratorCF(cf, &utils.Options{IsAsc: true, AllVersions: true})
+	defer iter.Close()
+	var lastKey []byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		// 同一个key的版本从新到旧排列，只处理第一个
+		if lastKey != nil && bytes.Equal(e.Key, lastKey) {
+			continue
+		}
+		lastKey = utils.SafeCopy(lastKey, e.Key)
+		if e.Version <= since {
+			continue
+		}
+		kv := &pb.KV{
+			Key:       cf.key(e.Key),
+			Value:     e.Value,
+			Version:   e.Version,
+			ExpiresAt: e.ExpiresAt,
+			// value 已经读取出来了，不再是值指针
+			Meta: []byte{e.Meta &^ utils.BitValuePointer},
+		}
+		deleted := e.IsDeletedOrExpired()
+		if e.Meta&utils.BitMergeOperand > 0 && !deleted {
+			// 合并操作数需要与更早的版本合并之后再备份
+			merged, err := txn.GetCF(cf, e.Key)
+			switch {
+			case err == utils.ErrKeyNotFound:
+				deleted = true
+			case err != nil:
+				return err
+			default:
+				kv.Value = merged.Value
+				kv.Meta = []byte{merged.Meta &^ (utils.BitValuePointer | utils.BitMergeOperand)}
+			}
+		}
+		if deleted {
+			if since == 0 {
+				continue
+			}
+			kv.Value, kv.Meta = nil, []byte{utils.BitDelete}
+		}
+		if err := add(kv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeKVList(w io.Writer, list *pb.KVList) error {
+	data, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Load 导入 Backup 生成的数据，entry 保留原来的版本号，通过写入管道批量写入
+// 导入完成后，之后分配的时间戳都会大于导入数据中最大的版本号
+// LSM 假设新版本总是写在旧版本之后，因此需要导入到空的DB中，并且先导入全量备份，再按顺序导入增量备份
+// 增量备份中的删除标记会删除之前导入的版本；列族中的数据写回同名的列族，没有配置这个列族时返回 ErrColumnFamilyNotFound
+func (db *DB) Load(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 16<<10)
+	throttle := utils.NewThrottle(16)
+	var (
+		entries     []*utils.Entry
+		count, size int64
+		maxVersion  uint64
+	)
+	send := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		if err := throttle.Do(); err != nil {
+			return err
+		}
+		req, err := db.sendToWriteCh(entries)
+		if err != nil {
+			throttle.Done(err)
+			return err
+		}
+		go func() {
+			throttle.Done(req.Wait())
+		}()
+		entries, count, size = nil, 0, 0
+		return nil
+	}
+	load := func() error {
+		var lenBuf [8]byte
+		var data []byte
+		for {
+			if _, err := io.ReadFull(br, lenBuf[:]); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return errors.Wrap(err, "while reading backup")
+			}
+			sz := binary.LittleEndian.Uint64(lenBuf[:])
+			if uint64(cap(data)) < sz {
+				data = make([]byte, sz)
+			}
+			data = data[:sz]
+			if _, err := io.ReadFull(br, data); err != nil {
+				return errors.Wrap(err, "while reading backup")
+			}
+			list := &pb.KVList{}
+			if err := list.Unmarshal(data); err != nil {
+				return errors.Wrap(err, "while unmarshal backup")
+			}
+			for _, kv := range list.Kv {
+				if len(kv.Key) == 0 {
+					return utils.ErrEmptyKey
+				}
+				if name, ok := lsm.ColumnFamilyName(kv.Key); ok && !db.lsm.HasColumnFamily(name) {
+					return errors.Wrapf(utils.ErrColumnFamilyNotFound, "column family %q", name)
+				}
+				e := &utils.Entry{
+					Key:       utils.KeyWithTs(kv.Key, kv.Version),
+					Value:     kv.Value,
+					ExpiresAt: kv.ExpiresAt,
+				}
+				if len(kv.Meta) > 0 {
+					e.Meta = kv.Meta[0] &^ utils.BitValuePointer
+				}
+				// 与事务的限制保持一致，保证一个请求不会超过 MaxBatchCount/MaxBatchSize
+				esz := int64(e.EstimateSize(int(db.opt.ValueThreshold))) + 10
+				if count+1 >= db.opt.MaxBatchCount || size+esz >= db.opt.MaxBatchSize {
+					if err := send(); err != nil {
+						return err
+					}
+				}
+				entries = append(entries, e)
+				count, size = count+1, size+esz
+				if kv.Version > maxVersion {
+					maxVersion = kv.Version
+				}
+			}
+		}
+	}
+	err := load()
+	if err == nil {
+		err = send()
+	}
+	if ferr := throttle.Finish(); err == nil {
+		err = ferr
+	}
+	// 即使导入失败，已经写入的数据也需要对之后的读可见
+	db.orc.advanceTs(maxVersion)
+	return err
+}
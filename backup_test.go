@@ -0,0 +1,145 @@
+package jkv
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestBackupAndLoad(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	require.NoError(t, db.Del([]byte("key000")))
+
+	var full bytes.Buffer
+	since, err := db.Backup(&full, 0)
+	require.NoError(t, err)
+
+	// 增量备份只包含 since 之后写入和删除的key
+	for i := 90; i < 110; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("new%03d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	require.NoError(t, db.Del([]byte("key001")))
+	var incr bytes.Buffer
+	_, err = db.Backup(&incr, since)
+	require.NoError(t, err)
+	require.Less(t, incr.Len(), full.Len())
+	require.NoError(t, db.Close())
+
+	restoreOpt := *opt
+	restoreOpt.WorkDir = filepath.Join(opt.WorkDir, "restore")
+	restored, err := Open(&restoreOpt)
+	require.NoError(t, err)
+	require.NoError(t, restored.Load(&full))
+	require.Equal(t, 99, countKeys(restored))
+	require.NoError(t, restored.Load(&incr))
+
+	check := func(db *DB) {
+		require.Equal(t, 108, countKeys(db))
+		for _, key := range []string{"key000", "key001"} {
+			_, err := db.Get([]byte(key))
+			require.Equal(t, utils.ErrKeyNotFound, err)
+		}
+		for i := 2; i < 110; i++ {
+			val := fmt.Sprintf("val%03d", i)
+			if i >= 90 {
+				val = fmt.Sprintf("new%03d", i)
+			}
+			e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(val), e.Value)
+		}
+	}
+	check(restored)
+
+	// 导入之后新写入的版本号大于导入的数据
+	require.NoError(t, restored.Set(utils.NewEntry([]byte("key002"), []byte("after-load"))))
+	e, err := restored.Get([]byte("key002"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("after-load"), e.Value)
+	require.NoError(t, restored.Set(utils.NewEntry([]byte("key002"), []byte("val002"))))
+
+	require.NoError(t, restored.Close())
+	restored, err = Open(&restoreOpt)
+	require.NoError(t, err)
+	defer func() { _ = restored.Close() }()
+	check(restored)
+}
+
+func TestBackupColumnFamilies(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ColumnFamilies = map[string]*lsm.Options{"meta": {}}
+	db, err := Open(&o)
+	require.NoError(t, err)
+	meta, err := db.ColumnFamily("meta")
+	require.NoError(t, err)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("default"))))
+	require.NoError(t, meta.Set(utils.NewEntry([]byte("key"), []byte("meta"))))
+	require.NoError(t, meta.Set(utils.NewEntry([]byte("gone"), []byte("meta"))))
+	var full bytes.Buffer
+	since, err := db.Backup(&full, 0)
+	require.NoError(t, err)
+	require.NoError(t, meta.Del([]byte("gone")))
+	var incr bytes.Buffer
+	_, err = db.Backup(&incr, since)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// 没有配置列族的DB不能导入列族中的数据
+	plain := *opt
+	plain.WorkDir = filepath.Join(opt.WorkDir, "plain")
+	restored, err := Open(&plain)
+	require.NoError(t, err)
+	require.Equal(t, utils.ErrColumnFamilyNotFound, errors.Cause(restored.Load(bytes.NewReader(full.Bytes()))))
+	require.NoError(t, restored.Close())
+
+	restoreOpt := o
+	restoreOpt.WorkDir = filepath.Join(opt.WorkDir, "restore")
+	restored, err = Open(&restoreOpt)
+	require.NoError(t, err)
+	defer func() { _ = restored.Close() }()
+	require.NoError(t, restored.Load(&full))
+	require.NoError(t, restored.Load(&incr))
+	e, err := restored.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("default"), e.Value)
+	meta, err = restored.ColumnFamily("meta")
+	require.NoError(t, err)
+	e, err = meta.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("meta"), e.Value)
+	_, err = meta.Get([]byte("gone"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+func TestLoadCorrupted(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.Error(t, db.Load(bytes.NewReader([]byte{1, 2, 3})))
+	require.Error(t, db.Load(bytes.NewReader([]byte{8, 0, 0, 0, 0, 0, 0, 0, 0xff})))
+}
+
+func countKeys(db *DB) int {
+	iter := db.NewIterator(&utils.Options{IsAsc: true})
+	defer func() { _ = iter.Close() }()
+	var n int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		n++
+	}
+	return n
+}
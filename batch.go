@@ -0,0 +1,134 @@
+package jkv
+
+import (
+	"sync"
+
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// WriteBatch 批量写入接口，面向大批量导入数据的场景
+// 写入的数据先缓存在一个只写事务中，超过 MaxBatchCount/MaxBatchSize 时自动拆分，
+// 已满的事务异步提交给 doWrites 做 group commit，不会返回 ErrTxnTooBig
+type WriteBatch struct {
+	sync.Mutex
+	txn      *Txn
+	db       *DB
+	throttle *utils.Throttle
+	finished bool
+
+	errLock sync.Mutex
+	err     error
+}
+
+// NewWriteBatch 创建一个 WriteBatch，写入完成后需要调用 Flush 或 Commit
+func (db *DB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		db:       db,
+		txn:      db.newTransaction(true, true),
+		throttle: utils.NewThrottle(16),
+	}
+}
+
+// SetEntry 向 batch 中写入一个entry
+func (wb *WriteBatch) SetEntry(e *utils.Entry) error {
+	wb.Lock()
+	defer wb.Unlock()
+	return wb.handleEntry(e)
+}
+
+// Set 向 batch 中写入一个kv
+func (wb *WriteBatch) Set(key, value []byte) error {
+	return wb.SetEntry(utils.NewEntry(key, value))
+}
+
+// Delete 在 batch 中删除一个key
+func (wb *WriteBatch) Delete(key []byte) error {
+	wb.Lock()
+	defer wb.Unlock()
+	return wb.handleEntry(&utils.Entry{
+		Key:  key,
+		Meta: utils.BitDelete,
+	})
+}
+
+func (wb *WriteBatch) handleEntry(e *utils.Entry) error {
+	if wb.finished {
+		return utils.ErrCommitAfterFinish
+	}
+	if err := wb.txn.modify(e); err != utils.ErrTxnTooBig {
+		return err
+	}
+	// 当前事务已经写满，异步提交后写入新的事务
+	if err := wb.commit(); err != nil {
+		return err
+	}
+	// 如果单个entry就超过了一次请求的限制，这里依然会返回 ErrTxnTooBig
+	return wb.txn.modify(e)
+}
+
+// commit 异步提交当前事务并创建一个新的事务，调用方需要持有锁
+func (wb *WriteBatch) commit() error {
+	if err := wb.Error(); err != nil {
+		return err
+	}
+	if wb.finished {
+		return utils.ErrCommitAfterFinish
+	}
+	// 限制同时在途的事务数量
+	if err := wb.throttle.Do(); err != nil {
+		wb.setErr(err)
+		return err
+	}
+	wb.txn.CommitWith(wb.callback)
+	wb.txn = wb.db.newTransaction(true, true)
+	return nil
+}
+
+func (wb *WriteBatch) callback(err error) {
+	// sync.WaitGroup is thread-safe, so it doesn't need to be run inside wb.Lock.
+	defer wb.throttle.Done(err)
+	if err != nil {
+		wb.setErr(err)
+	}
+}
+
+func (wb *WriteBatch) setErr(err error) {
+	wb.errLock.Lock()
+	defer wb.errLock.Unlock()
+	if wb.err == nil {
+		wb.err = err
+	}
+}
+
+// Error 返回异步提交过程中遇到的第一个错误
+func (wb *WriteBatch) Error() error {
+	wb.errLock.Lock()
+	defer wb.errLock.Unlock()
+	return wb.err
+}
+
+// Flush 提交剩余的数据，并等待所有写入完成，调用之后 batch 不能再使用
+func (wb *WriteBatch) Flush() error {
+	wb.Lock()
+	err := wb.commit()
+	if err != nil {
+		wb.Unlock()
+		return err
+	}
+	wb.finished = true
+	wb.txn.Discard()
+	wb.Unlock()
+
+	if err := wb.throttle.Finish(); err != nil {
+		return err
+	}
+	return wb.Error()
+}
+
+// Commit Flush 的异步版本，所有写入完成后在另一个协程中调用 cb
+func (wb *WriteBatch) Commit(cb func(error)) {
+	utils.CondPanic(cb == nil, utils.ErrInvalidRequest)
+	go func() {
+		cb(wb.Flush())
+	}()
+}
@@ -0,0 +1,65 @@
+package jkv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestWriteBatch(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	// 写入的数量远超过 MaxBatchCount，需要自动拆分成多个事务
+	n := int(opt.MaxBatchCount) * 10
+	wb := db.NewWriteBatch()
+	for i := 0; i < n; i++ {
+		key, val := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		require.NoError(t, wb.Set([]byte(key), []byte(val)))
+	}
+	for i := 0; i < n; i += 2 {
+		require.NoError(t, wb.Delete([]byte(fmt.Sprintf("key%d", i))))
+	}
+	require.NoError(t, wb.Flush())
+	require.Equal(t, utils.ErrCommitAfterFinish, wb.Set([]byte("key"), []byte("val")))
+
+	for i := 0; i < n; i++ {
+		key, val := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		e, err := db.Get([]byte(key))
+		if i%2 == 0 {
+			require.Equal(t, utils.ErrKeyNotFound, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, []byte(val), e.Value)
+	}
+}
+
+func TestWriteBatchCommit(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	wb := db.NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		require.NoError(t, wb.SetEntry(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	done := make(chan error, 1)
+	wb.Commit(func(err error) {
+		done <- err
+	})
+	require.NoError(t, <-done)
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		e, err := db.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(val), e.Value)
+	}
+}
@@ -0,0 +1,51 @@
+package jkv
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
+
+// Checkpoint 在 dir 中生成当前数据库的一致快照，生成的目录可以直接用 Open 打开
+// sst 和已经写完的 vlog 文件以硬链接的方式共享，dir 必须与数据目录在同一个文件系统上
+// 执行期间所有的写入都会返回 ErrBlockedWrites，压缩和 vlog GC 会暂停
+func (db *DB) Checkpoint(dir string) error {
+	if db.opt.InMemory {
+		return utils.ErrInMemory
+	}
+	if err := checkEmptyDir(db.opt.fs(), dir); err != nil {
+		return err
+	}
+	resume, err := db.pauseWrites()
+	if err != nil {
+		return err
+	}
+	defer resume()
+	// 暂停 vlog GC，防止链接的vlog文件和它们的数据密钥在 KEYREGISTRY 写入之前被删除
+	db.vlog.garbageCh <- struct{}{}
+	defer func() { <-db.vlog.garbageCh }()
+
+	// LSM 最后写入 MANIFEST，因此先链接 vlog 文件
+	if err := db.vlog.checkpoint(dir); err != nil {
+		return errors.Wrap(err, "Checkpoint")
+	}
+	if err := db.lsm.Checkpoint(dir); err != nil {
+		return errors.Wrap(err, "Checkpoint")
+	}
+	return nil
+}
+
+// checkEmptyDir 创建 dir，如果 dir 已经存在则必须为空
+func checkEmptyDir(fs vfs.FS, dir string) error {
+	if err := fs.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return errors.Errorf("checkpoint dir %s is not empty", dir)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package jkv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestCheckpoint(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	require.NoError(t, db.Del([]byte("key000")))
+
+	dir := filepath.Join(opt.WorkDir, "checkpoint")
+	require.NoError(t, db.Checkpoint(dir))
+	require.Error(t, db.Checkpoint(dir))
+
+	// checkpoint 之后的写入对快照不可见
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key001"), []byte("after"))))
+
+	cpOpt := *opt
+	cpOpt.WorkDir = dir
+	cp, err := Open(&cpOpt)
+	require.NoError(t, err)
+	check := func(db *DB) {
+		require.Equal(t, 99, countKeys(db))
+		_, err := db.Get([]byte("key000"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		for i := 1; i < 100; i++ {
+			e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), e.Value)
+		}
+	}
+	check(cp)
+
+	// 快照中的写入不会影响原库
+	for i := 0; i < 50; i++ {
+		require.NoError(t, cp.Set(utils.NewEntry([]byte(fmt.Sprintf("cp%03d", i)), []byte("cp"))))
+	}
+	require.NoError(t, cp.Close())
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.Equal(t, 99, countKeys(db))
+	e, err := db.Get([]byte("key001"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), e.Value)
+
+	cp, err = Open(&cpOpt)
+	require.NoError(t, err)
+	defer func() { _ = cp.Close() }()
+	require.Equal(t, 149, countKeys(cp))
+	e, err = cp.Get([]byte("key001"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val001"), e.Value)
+}
+
+// 原库删除sst和vlog文件之后，checkpoint 中硬链接的文件不受影响
+func TestCheckpointAfterDropAll(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	dir := filepath.Join(opt.WorkDir, "checkpoint")
+	require.NoError(t, db.Checkpoint(dir))
+	require.NoError(t, db.DropAll())
+	require.NoError(t, db.Close())
+
+	cpOpt := *opt
+	cpOpt.WorkDir = dir
+	cp, err := Open(&cpOpt)
+	require.NoError(t, err)
+	defer func() { _ = cp.Close() }()
+	require.Equal(t, 200, countKeys(cp))
+	for i := 0; i < 200; i++ {
+		e, err := cp.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), e.Value)
+	}
+}
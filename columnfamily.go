@@ -0,0 +1,139 @@
+package jkv
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// ColumnFamily 列族的句柄，通过 DB.ColumnFamily 获取
+// 列族中的key在共用的 wal 和 vlog 中带有列族的前缀，对外读写时使用不带前缀的key
+type ColumnFamily struct {
+	db     *DB
+	name   string
+	prefix []byte // 默认列族为nil
+}
+
+// ColumnFamily 返回名称为 name 的列族，name 为空表示默认列族，列族需要在 Options.ColumnFamilies 中配置
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	if !db.lsm.HasColumnFamily(name) {
+		return nil, errors.Wrapf(utils.ErrColumnFamilyNotFound, "column family %q", name)
+	}
+	return &ColumnFamily{db: db, name: name, prefix: lsm.ColumnFamilyPrefix(name)}, nil
+}
+
+// Name 返回列族的名称，默认列族为空字符串
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Set 在列族中写入一个entry
+func (cf *ColumnFamily) Set(e *utils.Entry) error {
+	if e == nil || len(e.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	txn := cf.db.NewTransaction(true)
+	defer txn.Discard()
+	if err := txn.SetEntryCF(cf, e); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// Get 读取列族中key的最新版本
+func (cf *ColumnFamily) Get(key []byte) (*utils.Entry, error) {
+	txn := cf.db.NewTransaction(false)
+	defer txn.Discard()
+	return txn.GetCF(cf, key)
+}
+
+// Del 删除列族中的key
+func (cf *ColumnFamily) Del(key []byte) error {
+	txn := cf.db.NewTransaction(true)
+	defer txn.Discard()
+	if err := txn.DeleteCF(cf, key); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// NewIterator 创建只包含列族中数据的迭代器，返回的key不带列族前缀
+func (cf *ColumnFamily) NewIterator(opt *utils.Options) utils.Iterator {
+	iter := cf.db.NewTransaction(false).NewIteratorCF(cf, opt).(*DBIterator)
+	iter.ownTxn = true
+	return iter
+}
+
+// key 返回key在LSM中的形式，默认列族的key保持不变
+func (cf *ColumnFamily) key(key []byte) []byte {
+	if cf.prefix == nil {
+		return key
+	}
+	res := make([]byte, 0, len(cf.prefix)+len(key))
+	return append(append(res, cf.prefix...), key...)
+}
+
+// iteratorOptions 把迭代选项中的前缀和上下界转换为LSM中的key，并且把迭代范围限制在列族之内
+func (cf *ColumnFamily) iteratorOptions(opt *utils.Options) utils.Options {
+	res := *opt
+	if cf.prefix == nil {
+		return res
+	}
+	res.Prefix = cf.key(opt.Prefix)
+	if len(opt.LowerBound) > 0 {
+		res.LowerBound = cf.key(opt.LowerBound)
+	}
+	if len(opt.UpperBound) > 0 {
+		res.UpperBound = cf.key(opt.UpperBound)
+	}
+	return res
+}
+
+// SetEntryCF 在事务中向列族写入一个entry，同一个事务可以写入多个列族，提交时所有的写入一起生效
+func (txn *Txn) SetEntryCF(cf *ColumnFamily, e *utils.Entry) error {
+	if len(e.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	ne := *e
+	ne.Key = cf.key(e.Key)
+	return txn.modify(&ne)
+}
+
+// DeleteCF 在事务中删除列族中的key
+func (txn *Txn) DeleteCF(cf *ColumnFamily, key []byte) error {
+	if len(key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	return txn.Delete(cf.key(key))
+}
+
+// GetCF 读取事务快照中列族里key的最新版本，返回的key不带列族前缀
+func (txn *Txn) GetCF(cf *ColumnFamily, key []byte) (*utils.Entry, error) {
+	if len(key) == 0 {
+		return nil, utils.ErrEmptyKey
+	}
+	e, err := txn.Get(cf.key(key))
+	if err != nil {
+		return nil, err
+	}
+	e.Key = key
+	return e, nil
+}
+
+// NewIteratorCF 创建基于事务快照、只包含列族中数据的迭代器，返回的key不带列族前缀
+func (txn *Txn) NewIteratorCF(cf *ColumnFamily, opt *utils.Options) utils.Iterator {
+	return txn.newIterator(cf, opt)
+}
+
+// expiresAt 返回写入时使用的过期时间，没有设置过期时间的key使用所属列族的 TTL
+func (db *DB) expiresAt(e *utils.Entry) uint64 {
+	if e.ExpiresAt != 0 || e.Meta&utils.BitDelete > 0 {
+		return e.ExpiresAt
+	}
+	if ttl := db.lsm.TTL(e.Key); ttl > 0 {
+		return uint64(time.Now().Add(ttl).Unix())
+	}
+	return 0
+}
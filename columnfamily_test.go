@@ -0,0 +1,105 @@
+package jkv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestColumnFamily(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ColumnFamilies = map[string]*lsm.Options{
+		"meta":  {BlockSize: 4 * 1024, BloomFalsePositive: 0.01},
+		"cache": {TTL: time.Second},
+	}
+	db, err := Open(&o)
+	require.NoError(t, err)
+
+	_, err = db.ColumnFamily("missing")
+	require.Equal(t, utils.ErrColumnFamilyNotFound, errors.Cause(err))
+	def, err := db.ColumnFamily("")
+	require.NoError(t, err)
+	meta, err := db.ColumnFamily("meta")
+	require.NoError(t, err)
+	cache, err := db.ColumnFamily("cache")
+	require.NoError(t, err)
+
+	// 同一个事务原子地写入多个列族，相同的key在不同列族中互不影响
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		txn := db.NewTransaction(true)
+		require.NoError(t, txn.SetEntryCF(def, utils.NewEntry(key, []byte(fmt.Sprintf("default%d", i)))))
+		require.NoError(t, txn.SetEntryCF(meta, utils.NewEntry(key, []byte(fmt.Sprintf("meta%d", i)))))
+		require.NoError(t, txn.Commit())
+	}
+	require.NoError(t, meta.Set(utils.NewEntry([]byte("only-meta"), []byte("v"))))
+	require.NoError(t, meta.Del([]byte("key000")))
+	require.NoError(t, cache.Set(utils.NewEntry([]byte("session"), []byte("v"))))
+
+	check := func(db *DB, meta *ColumnFamily) {
+		e, err := db.Get([]byte("key001"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("default1"), e.Value)
+		e, err = meta.Get([]byte("key001"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("key001"), e.Key)
+		require.Equal(t, []byte("meta1"), e.Value)
+		_, err = db.Get([]byte("only-meta"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		_, err = meta.Get([]byte("key000"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		e, err = db.Get([]byte("key000"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("default0"), e.Value)
+
+		// 迭代器只能看到自己列族中的数据
+		count := 0
+		iter := db.NewIterator(&utils.Options{IsAsc: true})
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			require.Equal(t, fmt.Sprintf("default%d", count), string(iter.Item().Entry().Value))
+			count++
+		}
+		require.NoError(t, iter.Close())
+		require.Equal(t, 100, count)
+
+		var keys []string
+		iter = meta.NewIterator(&utils.Options{IsAsc: true, Prefix: []byte("key"), LowerBound: []byte("key050")})
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Item().Entry().Key))
+		}
+		require.Len(t, keys, 50)
+		require.Equal(t, "key050", keys[0])
+		iter.Seek([]byte("key098"))
+		require.True(t, iter.Valid())
+		require.Equal(t, []byte("meta98"), iter.Item().Entry().Value)
+		require.NoError(t, iter.Close())
+	}
+	check(db, meta)
+
+	// 列族的 TTL 只作用于该列族
+	time.Sleep(1100 * time.Millisecond)
+	_, err = cache.Get([]byte("session"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+	_, err = meta.Get([]byte("only-meta"))
+	require.NoError(t, err)
+
+	// 重新打开后从 wal 和 manifest 中恢复每个列族的数据
+	require.NoError(t, db.Close())
+	db, err = Open(&o)
+	require.NoError(t, err)
+	meta, err = db.ColumnFamily("meta")
+	require.NoError(t, err)
+	check(db, meta)
+	require.NoError(t, db.Close())
+
+	// 已经有sst的列族必须继续配置
+	o.ColumnFamilies = nil
+	_, err = Open(&o)
+	require.Equal(t, utils.ErrColumnFamilyNotFound, errors.Cause(err))
+}
@@ -0,0 +1,76 @@
+package jkv
+
+import (
+	"bytes"
+
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// writeCondition 条件写入的前置条件，在写入协程中检查，检查与写入之间不会有其他写入
+type writeCondition struct {
+	key []byte
+	// readTs 检查条件时读取的版本，提交时设置为提交时间戳的前一个
+	readTs uint64
+	// check 判断当前值是否满足条件，cur 为nil表示key不存在、已经删除或者过期
+	check func(cur *utils.Entry) bool
+}
+
+// CompareAndSwap 只有key当前的值等于 old 时才写入 new，否则返回 utils.ErrConditionFailed
+// old 为nil时要求key不存在
+func (db *DB) CompareAndSwap(key, old, new []byte) error {
+	// value 为nil的entry会被当作删除
+	if new == nil {
+		new = []byte{}
+	}
+	return db.updateIf(utils.NewEntry(key, new), func(cur *utils.Entry) bool {
+		if old == nil {
+			return cur == nil
+		}
+		return cur != nil && bytes.Equal(cur.Value, old)
+	})
+}
+
+// SetIfAbsent 只有key不存在时才写入 e，否则返回 utils.ErrConditionFailed
+// 已经删除或者过期的key被当作不存在，配合 ExpiresAt 可以实现带超时的分布式锁
+func (db *DB) SetIfAbsent(e *utils.Entry) error {
+	if e == nil || len(e.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	return db.updateIf(e, func(cur *utils.Entry) bool {
+		return cur == nil
+	})
+}
+
+// DeleteIf 只有key当前的值等于 expected 时才删除，否则返回 utils.ErrConditionFailed
+func (db *DB) DeleteIf(key, expected []byte) error {
+	return db.updateIf(&utils.Entry{Key: key, Meta: utils.BitDelete}, func(cur *utils.Entry) bool {
+		return cur != nil && bytes.Equal(cur.Value, expected)
+	})
+}
+
+// updateIf 在只写事务中写入 e，由写入协程在写入之前检查条件
+// 检查的是写入时最新的值，而不是事务开始时的快照，因此不需要冲突检测
+func (db *DB) updateIf(e *utils.Entry, check func(cur *utils.Entry) bool) error {
+	txn := db.newTransaction(true, true)
+	defer txn.Discard()
+	if err := txn.modify(e); err != nil {
+		return err
+	}
+	txn.cond = &writeCondition{key: e.Key, check: check}
+	return txn.Commit()
+}
+
+// checkCondition 在写入协程中检查条件，只能在 writeRequests 中调用
+func (db *DB) checkCondition(cond *writeCondition) error {
+	cur, err := db.get(cond.key, cond.readTs)
+	switch {
+	case err == utils.ErrKeyNotFound:
+		cur = nil
+	case err != nil:
+		return err
+	}
+	if !cond.check(cur) {
+		return utils.ErrConditionFailed
+	}
+	return nil
+}
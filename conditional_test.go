@@ -0,0 +1,67 @@
+package jkv
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	lock := []byte("lock")
+	require.NoError(t, db.SetIfAbsent(utils.NewEntry(lock, []byte("owner1"))))
+	require.Equal(t, utils.ErrConditionFailed, db.SetIfAbsent(utils.NewEntry(lock, []byte("owner2"))))
+	require.Equal(t, utils.ErrConditionFailed, db.DeleteIf(lock, []byte("owner2")))
+	require.NoError(t, db.DeleteIf(lock, []byte("owner1")))
+	_, err = db.Get(lock)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	// 过期的key被当作不存在
+	e := utils.NewEntry(lock, []byte("owner2")).WithTTL(time.Second)
+	require.NoError(t, db.SetIfAbsent(e))
+	time.Sleep(1100 * time.Millisecond)
+	require.NoError(t, db.SetIfAbsent(utils.NewEntry(lock, []byte("owner3"))))
+
+	key := []byte("cas")
+	require.Equal(t, utils.ErrConditionFailed, db.CompareAndSwap(key, []byte("0"), []byte("1")))
+	require.NoError(t, db.CompareAndSwap(key, nil, []byte("0")))
+	require.Equal(t, utils.ErrConditionFailed, db.CompareAndSwap(key, nil, []byte("0")))
+
+	// 并发的 CompareAndSwap 中每次只有一个能成功
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				e, err := db.Get(key)
+				require.NoError(t, err)
+				n, err := strconv.Atoi(string(e.Value))
+				require.NoError(t, err)
+				err = db.CompareAndSwap(key, e.Value, []byte(strconv.Itoa(n+1)))
+				if err == utils.ErrConditionFailed {
+					continue
+				}
+				require.NoError(t, err)
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	e, err = db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(succeeded), string(e.Value))
+	require.Greater(t, succeeded, 0)
+}
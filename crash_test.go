@@ -0,0 +1,272 @@
+package jkv
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
+
+// crashSeed 崩溃测试使用的随机种子，失败时用报告的种子复现：go test -run TestCrashRecovery -crash.seed=N
+var crashSeed = flag.Int64("crash.seed", 1, "random seed of TestCrashRecovery")
+
+// crashKV 一次写入中的一个key，val为nil表示删除
+type crashKV struct {
+	key string
+	val []byte
+}
+
+// crashModel 记录崩溃测试中每个key的状态，value为nil表示key不存在
+type crashModel struct {
+	sync.Mutex
+	acked   map[string][]byte   // 已经确认写入成功的值
+	pending map[string][][]byte // 确认之后又发出、但是没有确认的写入，崩溃之后可能落盘也可能丢失
+	txns    map[int][]crashKV   // 没有确认的多key写入，崩溃之后要么全部落盘，要么全部丢失
+	nextTxn int
+}
+
+func newCrashModel() *crashModel {
+	return &crashModel{
+		acked:   make(map[string][]byte),
+		pending: make(map[string][][]byte),
+		txns:    make(map[int][]crashKV),
+	}
+}
+
+// write 原子地写入或者删除 kvs 中的key，返回成功之后才更新确认的值
+// 只有一个key时使用 Set/Del，多个key时 batch 为 true 使用 WriteBatch，否则使用事务
+func (m *crashModel) write(db *DB, kvs []crashKV, batch bool) error {
+	m.Lock()
+	for _, kv := range kvs {
+		m.pending[kv.key] = append(m.pending[kv.key], kv.val)
+	}
+	id := m.nextTxn
+	if len(kvs) > 1 {
+		m.nextTxn++
+		m.txns[id] = kvs
+	}
+	m.Unlock()
+	var err error
+	switch {
+	case len(kvs) == 1 && kvs[0].val == nil:
+		err = db.Del([]byte(kvs[0].key))
+	case len(kvs) == 1:
+		err = db.Set(utils.NewEntry([]byte(kvs[0].key), kvs[0].val))
+	case batch:
+		// 数据量远小于 MaxBatchSize，WriteBatch 不会拆分，只提交一个事务
+		wb := db.NewWriteBatch()
+		for _, kv := range kvs {
+			if kv.val == nil {
+				err = wb.Delete([]byte(kv.key))
+			} else {
+				err = wb.Set([]byte(kv.key), kv.val)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if ferr := wb.Flush(); err == nil {
+			err = ferr
+		}
+	default:
+		txn := db.NewTransaction(true)
+		for _, kv := range kvs {
+			if kv.val == nil {
+				err = txn.Delete([]byte(kv.key))
+			} else {
+				err = txn.Set([]byte(kv.key), kv.val)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = txn.Commit()
+		}
+		txn.Discard()
+	}
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	for _, kv := range kvs {
+		m.acked[kv.key] = kv.val
+		delete(m.pending, kv.key)
+	}
+	delete(m.txns, id)
+	m.Unlock()
+	return nil
+}
+
+// verify 检查重启之后每个key的值是最后一次确认的值或者之后没有确认的某个值，然后以读到的值为准继续测试
+func (m *crashModel) verify(t *testing.T, db *DB, msg string) {
+	keys := make(map[string]struct{})
+	for key := range m.acked {
+		keys[key] = struct{}{}
+	}
+	for key := range m.pending {
+		keys[key] = struct{}{}
+	}
+	gots := make(map[string][]byte, len(keys))
+	for key := range keys {
+		var got []byte
+		e, err := db.Get([]byte(key))
+		if err != utils.ErrKeyNotFound {
+			require.NoError(t, err, "%s: get %s", msg, key)
+			got = e.Value
+		}
+		ok := bytes.Equal(got, m.acked[key])
+		for _, v := range m.pending[key] {
+			ok = ok || bytes.Equal(got, v)
+		}
+		require.True(t, ok, "%s: key %s got %q, acked %q, pending %q", msg, key, got, m.acked[key], m.pending[key])
+		gots[key] = got
+	}
+	// 没有确认的多key写入只能全部落盘或者全部丢失，与确认的值相同的key无法区分，不参与检查
+	for _, kvs := range m.txns {
+		var applied, n int
+		for _, kv := range kvs {
+			if bytes.Equal(kv.val, m.acked[kv.key]) {
+				continue
+			}
+			n++
+			if bytes.Equal(gots[kv.key], kv.val) {
+				applied++
+			}
+		}
+		require.True(t, applied == 0 || applied == n, "%s: partially applied txn %q", msg, kvs)
+	}
+	var live int
+	for key, got := range gots {
+		m.acked[key] = got
+		if got != nil {
+			live++
+		}
+	}
+	m.pending = make(map[string][][]byte)
+	m.txns = make(map[int][]crashKV)
+	// 不能出现从来没有写入过的key
+	iter := db.NewIterator(&utils.Options{IsAsc: true})
+	defer func() { _ = iter.Close() }()
+	var n int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Item().Entry().Key)
+		require.NotNil(t, m.acked[key], "%s: unexpected key %s", msg, key)
+		n++
+	}
+	require.Equal(t, live, n, msg)
+}
+
+// TestCrashRecovery 在会丢弃未同步数据的文件系统上随机写入、注入错误并模拟掉电，检查重启之后没有丢失确认过的写入，
+// 多key的事务和 WriteBatch 没有部分生效
+// 掉电时wal、vlog和manifest的尾部会被随机截断或者撕裂，覆盖 WalFile.Iterate、ReplayManifestFile 和 replayLog 的恢复过程
+func TestCrashRecovery(t *testing.T) {
+	seed := *crashSeed
+	rnd := rand.New(rand.NewSource(seed))
+	mem := vfs.NewStrictMem()
+	fs := vfs.NewErrorFS(mem)
+	o := *opt
+	o.WorkDir = filepath.Join(opt.WorkDir, "crash")
+	o.FS = fs
+	o.SyncWrites = true
+	o.MemTableSize = 16 << 10
+	o.ValueLogFileSize = 16 << 10
+	o.ValueThreshold = 64
+	o.ValueLogMaxEntries = 1000
+
+	const numWriters, numKeys = 4, 200
+	patterns := []string{"", "*.wal", "*.vlog", "*.sst", "MANIFEST"}
+	m := newCrashModel()
+	var seq int64
+	for round := 0; round < 30; round++ {
+		msg := fmt.Sprintf("seed %d round %d", seed, round)
+		db, err := Open(&o)
+		require.NoError(t, err, msg)
+		m.verify(t, db, msg)
+
+		// 随机让之后某个文件的一次写入或者同步失败，出错之后DB的状态不再可信，直接掉电
+		// manifest 只在刷盘时写入，单独注入才能在写入之后、同步之前掉电
+		pattern := patterns[rnd.Intn(len(patterns))]
+		switch rnd.Intn(3) {
+		case 0:
+			fs.FailWrite(1+rnd.Intn(50), pattern)
+		case 1:
+			fs.FailSync(1+rnd.Intn(10), pattern)
+		}
+		// 多个协程并发写入，写入次数达到 target 时掉电，这时通常还有写入没有完成
+		var (
+			ops, stop, failed int32
+			wg                sync.WaitGroup
+			target            = int32(1 + rnd.Intn(400))
+			reached           = make(chan struct{})
+			exited            = make(chan struct{})
+		)
+		for w := 0; w < numWriters; w++ {
+			wg.Add(1)
+			go func(w int, rnd *rand.Rand) {
+				defer wg.Done()
+				for atomic.LoadInt32(&stop) == 0 {
+					if atomic.AddInt32(&ops, 1) == target {
+						close(reached)
+					}
+					// 每个协程只写自己的key，同一个key的写入是串行的；三分之一的写入在一个事务中写多个key
+					num := 1
+					if rnd.Intn(3) == 0 {
+						num = 2 + rnd.Intn(3)
+					}
+					n := atomic.AddInt64(&seq, 1)
+					kvs := make([]crashKV, 0, num)
+					for _, i := range rnd.Perm(numKeys / numWriters)[:num] {
+						kv := crashKV{key: fmt.Sprintf("key%03d", i*numWriters+w)}
+						if rnd.Intn(10) > 0 {
+							// 一半的value大于 ValueThreshold，写入vlog
+							kv.val = bytes.Repeat([]byte(fmt.Sprintf("%s-%d.", kv.key, n)), 1+rnd.Intn(10))
+						}
+						kvs = append(kvs, kv)
+					}
+					if err := m.write(db, kvs, rnd.Intn(2) == 0); err != nil {
+						atomic.StoreInt32(&failed, 1)
+						return
+					}
+				}
+			}(w, rand.New(rand.NewSource(rnd.Int63())))
+		}
+		go func() {
+			wg.Wait()
+			close(exited)
+		}()
+		select {
+		case <-reached:
+		case <-exited:
+		}
+
+		if atomic.LoadInt32(&failed) == 0 && rnd.Intn(5) == 0 {
+			atomic.StoreInt32(&stop, 1)
+			<-exited
+			if atomic.LoadInt32(&failed) == 0 {
+				fs.FailWrite(0, "")
+				fs.FailSync(0, "")
+				require.NoError(t, db.Close(), msg)
+				continue
+			}
+		}
+		mem.Crash()
+		<-exited
+		fs.FailWrite(0, "")
+		fs.FailSync(0, "")
+		_ = db.Close()
+		mem.Reset(rnd)
+	}
+	db, err := Open(&o)
+	require.NoError(t, err)
+	m.verify(t, db, fmt.Sprintf("seed %d", seed))
+	require.NoError(t, db.Close())
+}
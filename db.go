@@ -1,15 +1,17 @@
 package jkv
 
 import (
-	"expvar"
 	"fmt"
-	"math"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/file"
 	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/metrics"
 	"github.com/vvvvjvvvv/jkv/utils"
 )
 
@@ -30,17 +32,30 @@ type (
 		opt         *Options
 		lsm         *lsm.LSM
 		vlog        *valueLog
-		stats       *Stats
+		orc         *oracle
 		flushChan   chan flushTask // For flushing memtables.
 		writeCh     chan *request
 		blockWrites int32
+		// writeErr 写入vlog或者LSM失败时的错误，之后的写入都返回这个错误，只在写入协程中访问
+		writeErr   error
 		vhead       *utils.ValuePtr
 		logRotates  int32
+		metrics     *metrics.Metrics
+		registry    *file.KeyRegistry // 未启用加密时为nil
+		pub         *publisher
+		// managedDiscardTs 托管模式下通过 SetDiscardTs 设置
+		managedDiscardTs uint64
+
+		dirLockGuard  *file.DirLockGuard
+		valueDirGuard *file.DirLockGuard // vlog 与 LSM 不在同一个目录时单独加锁
 	}
 )
 
 var (
-	head = []byte("!corekv!head") // For storing value offset for replay.
+	jkvPrefix = lsm.InternalKeyPrefix                             // 内部使用的key前缀，迭代时对外不可见
+	head      = append(append([]byte{}, jkvPrefix...), "head"...) // For storing value offset for replay.
+	// legacyHead 旧版本使用的head key，没有 head 时读取它，兼容已有的数据目录
+	legacyHead = []byte("!corekv!head")
 )
 
 /**
@@ -57,100 +72,230 @@ MaxLevelNum:         7,
 NumCompactors:       3,
 */
 // Open DB
-// TODO 这里是不是要上一个目录锁比较好，防止多个进程打开同一个目录?
-func Open(opt *Options) *DB {
+// 打开时会对 WorkDir 和 ValueDir 加目录锁，目录已被其他实例打开时返回 ErrDirLocked
+// manifest、wal、vlog、sst 文件加载失败时返回 *utils.FileError，已经打开的资源会被释放
+func Open(opt *Options) (_ *DB, err error) {
 	c := utils.NewCloser()
-	db := &DB{opt: opt}
+	db := &DB{opt: opt, metrics: opt.Metrics}
+	if db.metrics == nil {
+		db.metrics = &metrics.Metrics{}
+	}
+	if opt.InMemory && (opt.ReadOnly || len(opt.EncryptionKey) > 0) {
+		return nil, errors.Wrap(utils.ErrInMemory, "ReadOnly and EncryptionKey are not supported")
+	}
+	// 加目录锁，防止多个进程同时打开同一个目录
+	if err = db.acquireDirLocks(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			db.cleanup()
+		}
+	}()
+	// 数据密钥需要在打开任何数据文件之前加载
+	if db.registry, err = file.OpenKeyRegistry(opt.FS, opt.WorkDir, opt.EncryptionKey, opt.ReadOnly); err != nil {
+		return nil, err
+	}
 	// 初始化vlog结构
 	db.initVLog()
-	// 初始化LSM结构
-	db.lsm = lsm.NewLSM(&lsm.Options{
-		WorkDir:             opt.WorkDir,
-		MemTableSize:        opt.MemTableSize,
-		SSTableMaxSz:        opt.SSTableMaxSz,
-		BlockSize:           8 * 1024,
-		BloomFalsePositive:  0, //0.01,
-		BaseLevelSize:       10 << 20,
-		LevelSizeMultiplier: 10,
-		BaseTableSize:       5 << 20,
-		TableSizeMultiplier: 2,
-		NumLevelZeroTables:  15,
-		MaxLevelNum:         7,
-		NumCompactors:       1,
-		DiscardStatsCh:      &(db.vlog.lfDiscardStats.flushChan),
-	})
-	// 初始化统计信息
-	db.stats = newStats(opt)
-	// 启动 sstable 的合并压缩过程
-	go db.lsm.StartCompacter()
+	// 初始化LSM结构，vlog重放需要写入LSM，因此必须先于vlog打开
+	if db.lsm, err = lsm.NewLSM(&lsm.Options{
+		WorkDir:              opt.WorkDir,
+		MemTableSize:         opt.MemTableSize,
+		SSTableMaxSz:         opt.SSTableMaxSz,
+		BlockSize:            8 * 1024,
+		BloomFalsePositive:   0, //0.01,
+		Compression:          opt.Compression,
+		ZSTDCompressionLevel: opt.ZSTDCompressionLevel,
+		BaseLevelSize:        10 << 20,
+		LevelSizeMultiplier:  10,
+		BaseTableSize:        5 << 20,
+		TableSizeMultiplier:  2,
+		NumLevelZeroTables:   15,
+		MaxLevelNum:          7,
+		NumCompactors:        1,
+		DiscardStatsCh:       &(db.vlog.lfDiscardStats.flushChan),
+		CompactionFilter:     opt.CompactionFilter,
+		MergeOperator:        opt.MergeOperator,
+		NumVersionsToKeep:    opt.NumVersionsToKeep,
+		DiscardTs:            db.discardTs,
+		Metrics:              db.metrics,
+		KeyRegistry:          db.registry,
+		ColumnFamilies:       opt.ColumnFamilies,
+		ReadOnly:             opt.ReadOnly,
+		InMemory:             opt.InMemory,
+		FS:                   opt.FS,
+	}); err != nil {
+		return nil, err
+	}
+	// 打开vlog并重放尚未写入LSM的数据
+	vp, err := db.getHead()
+	if err != nil {
+		return nil, utils.NewFileError(utils.FileKindVlog, opt.valueDir(), err)
+	}
+	if err = db.vlog.open(db, vp, db.replayFunction()); err != nil {
+		return nil, err
+	}
+	// 从已持久化的最大版本号开始分配事务时间戳
+	db.orc = newOracle(db.lsm.MaxVersion() + 1)
+	// 启动 sstable 的合并压缩过程，只读模式下不压缩
+	if !opt.ReadOnly {
+		db.lsm.StartCompacter()
+	}
 	// 准备vlog gc
 	c.Add(1)
 	db.writeCh = make(chan *request)
 	db.flushChan = make(chan flushTask, 16)
+	db.pub = newPublisher()
 	go db.doWrites(c)
-	// 启动 info 统计过程
-	go db.stats.StartStats()
-	return db
+	return db, nil
+}
+
+// cleanup Open 失败时释放已经打开的资源，vlog 打开失败时会自己关闭文件
+func (db *DB) cleanup() {
+	if db.lsm != nil {
+		_ = db.lsm.Close()
+	}
+	_ = db.registry.Close()
+	_ = db.releaseDirLocks()
 }
 
 func (db *DB) Close() error {
+	db.pub.close()
 	db.vlog.lfDiscardStats.closer.Close()
-	if err := db.lsm.Close(); err != nil {
+	// 某一步出错时仍然关闭其余部分并释放目录锁，返回第一个错误
+	err := db.lsm.Close()
+	if verr := db.vlog.close(); err == nil {
+		err = verr
+	}
+	if rerr := db.registry.Close(); err == nil {
+		err = rerr
+	}
+	if lerr := db.releaseDirLocks(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// acquireDirLocks 对 WorkDir 加锁，ValueDir 与 WorkDir 不同时对 ValueDir 单独加锁，内存模式下不需要加锁
+func (db *DB) acquireDirLocks() (err error) {
+	if db.opt.InMemory {
+		return nil
+	}
+	for _, dir := range []string{db.opt.WorkDir, db.opt.valueDir()} {
+		// 只读模式不修改文件系统，数据目录必须已经存在
+		if db.opt.ReadOnly {
+			if _, err = db.opt.fs().Stat(dir); err != nil {
+				return errors.Wrapf(err, "cannot open %q in read-only mode", dir)
+			}
+			continue
+		}
+		if err = db.opt.fs().MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	absDir, err := filepath.Abs(db.opt.WorkDir)
+	if err != nil {
+		return err
+	}
+	absValueDir, err := filepath.Abs(db.opt.valueDir())
+	if err != nil {
 		return err
 	}
-	if err := db.vlog.close(); err != nil {
+	if db.dirLockGuard, err = file.AcquireDirectoryLock(db.opt.FS, db.opt.WorkDir, db.opt.ReadOnly); err != nil {
 		return err
 	}
-	if err := db.stats.close(); err != nil {
+	if absValueDir == absDir {
+		return nil
+	}
+	if db.valueDirGuard, err = file.AcquireDirectoryLock(db.opt.FS, db.opt.valueDir(), db.opt.ReadOnly); err != nil {
+		_ = db.releaseDirLocks()
 		return err
 	}
 	return nil
 }
 
+// releaseDirLocks 释放 acquireDirLocks 中获取的目录锁
+func (db *DB) releaseDirLocks() error {
+	var err error
+	if db.valueDirGuard != nil {
+		err = db.valueDirGuard.Release()
+		db.valueDirGuard = nil
+	}
+	if db.dirLockGuard != nil {
+		if rerr := db.dirLockGuard.Release(); err == nil {
+			err = rerr
+		}
+		db.dirLockGuard = nil
+	}
+	return err
+}
+
 func (db *DB) Del(key []byte) error {
-	// 写入一个值为nil的entry 作为墓碑消息实现删除
-	return db.Set(&utils.Entry{
-		Key:       key,
-		Value:     nil,
-		ExpiresAt: 0,
-	})
+	// 写入一个带有删除标记的entry 作为墓碑消息实现删除
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	return txn.Commit()
 }
 func (db *DB) Set(data *utils.Entry) error {
 	if data == nil || len(data.Key) == 0 {
 		return utils.ErrEmptyKey
 	}
-	// 做一些必要性的检查
-	// 如果value 大于一个阈值 则创建值指针，并将其写入vlog中
-	var (
-		vp  *utils.ValuePtr
-		err error
-	)
-	data.Key = utils.KeyWithTs(data.Key, math.MaxUint32)
-	// 如果value不应该直接写入LSM 则先写入 vlog文件，这时必须保证vlog具有重放功能
-	// 以便于崩溃后恢复数据
-	if !db.shouldWriteValueToLSM(data) {
-		if vp, err = db.vlog.newValuePtr(data); err != nil {
-			return err
-		}
-		data.Meta |= utils.BitValuePointer
-		data.Value = vp.Encode()
+	// 单个写入也作为一个事务提交，由oracle分配版本号
+	// 如果value 大于一个阈值 则在写入时放入vlog，LSM中只保存值指针
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	if err := txn.SetEntry(data); err != nil {
+		return err
 	}
-	return db.lsm.Set(data)
+	return txn.Commit()
 }
 func (db *DB) Get(key []byte) (*utils.Entry, error) {
 	if len(key) == 0 {
 		return nil, utils.ErrEmptyKey
 	}
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	return txn.Get(key)
+}
+
+// GetAt 读取key在时间戳 ts 时刻可见的版本，即版本号不超过 ts 的最新版本，ts 大于当前的读时间戳时与 Get 相同
+// 压缩会按照 NumVersionsToKeep 清理不再被读事务使用的旧版本，过早的版本可能已经不存在了
+// 托管模式下直接读取版本号不超过 ts 的最新版本
+func (db *DB) GetAt(key []byte, ts uint64) (*utils.Entry, error) {
+	if len(key) == 0 {
+		return nil, utils.ErrEmptyKey
+	}
+	if db.opt.ManagedTxns {
+		return db.get(key, ts)
+	}
+	// 读事务保证 readTs 之前的写入都已经完成
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	if ts > txn.readTs {
+		ts = txn.readTs
+	}
+	return db.get(key, ts)
+}
 
-	originKey := key
+// get 读取key在readTs时刻可见的最新版本
+func (db *DB) get(key []byte, readTs uint64) (*utils.Entry, error) {
+	db.metrics.Gets.Inc()
+	defer db.metrics.GetLatency.Since(time.Now())
 	var (
 		entry *utils.Entry
 		err   error
 	)
-	key = utils.KeyWithTs(key, math.MaxUint32)
 	// 从LSM中查询entry，这时不确定entry是不是值指针
-	if entry, err = db.lsm.Get(key); err != nil {
-		return entry, err
+	if entry, err = db.lsm.Get(utils.KeyWithTs(key, readTs)); err != nil {
+		return nil, err
+	}
+	// 合并操作数需要与更早的版本合并之后才是完整的值
+	if entry != nil && entry.Meta&utils.BitMergeOperand > 0 {
+		return db.getMerged(key, readTs)
 	}
 	// 检查从lsm拿到的value是否是value ptr,是则从vlog中拿值
 	if entry != nil && utils.IsValuePtr(entry) {
@@ -167,13 +312,13 @@ func (db *DB) Get(key []byte) (*utils.Entry, error) {
 	if lsm.IsDeletedOrExpired(entry) {
 		return nil, utils.ErrKeyNotFound
 	}
-	entry.Key = originKey
+	entry.Key = key
 	return entry, nil
 }
 
+// Info 返回当前的统计信息快照
 func (db *DB) Info() *Stats {
-	// 读取stats结构，打包数据并返回
-	return db.stats
+	return newStats(db)
 }
 
 // RunValueLogGC triggers a value log garbage collection.
@@ -181,35 +326,36 @@ func (db *DB) RunValueLogGC(discardRatio float64) error {
 	if discardRatio >= 1.0 || discardRatio <= 0.0 {
 		return utils.ErrInvalidRequest
 	}
+	if db.opt.ReadOnly {
+		return utils.ErrReadOnly
+	}
+	db.metrics.VlogGCRuns.Inc()
+	defer db.metrics.VlogGCLatency.Since(time.Now())
 	// Find head on disk
-	headKey := utils.KeyWithTs(head, math.MaxUint64)
-	val, err := db.lsm.Get(headKey)
+	head, err := db.getHead()
 	if err != nil {
-		if err == utils.ErrKeyNotFound {
-			val = &utils.Entry{
-				Key:   headKey,
-				Value: []byte{},
-			}
-		} else {
-			return errors.Wrap(err, "Retrieving head from on-disk LSM")
-		}
-	}
-
-	// 内部key head 一定是value ptr 不需要检查内容
-	var head utils.ValuePtr
-	if len(val.Value) > 0 {
-		head.Decode(val.Value)
+		return err
 	}
 
 	// Pick a log file and run GC
-	return db.vlog.runGC(discardRatio, &head)
+	return db.vlog.runGC(discardRatio, head)
 }
 
+// shouldWriteValueToLSM 合并操作数总是写入LSM，压缩时才能把它们合并
 func (db *DB) shouldWriteValueToLSM(e *utils.Entry) bool {
-	return int64(len(e.Value)) < db.opt.ValueThreshold
+	return e.Meta&utils.BitMergeOperand > 0 || int64(len(e.Value)) < db.opt.ValueThreshold
 }
 
 func (db *DB) sendToWriteCh(entries []*utils.Entry) (*request, error) {
+	return db.sendRequest(entries, nil, false)
+}
+
+// sendRequest 发送一个写请求，cond 不为nil时由写入协程检查条件之后再写入
+// skipPublish 为 true 时不通知订阅者，用于 vlog GC 等不改变数据的内部写入
+func (db *DB) sendRequest(entries []*utils.Entry, cond *writeCondition, skipPublish bool) (*request, error) {
+	if db.opt.ReadOnly {
+		return nil, utils.ErrReadOnly
+	}
 	if atomic.LoadInt32(&db.blockWrites) == 1 {
 		return nil, utils.ErrBlockedWrites
 	}
@@ -226,6 +372,9 @@ func (db *DB) sendToWriteCh(entries []*utils.Entry) (*request, error) {
 	req := requestPool.Get().(*request)
 	req.reset()
 	req.Entries = entries
+	req.cond = cond
+	req.skipPublish = skipPublish
+	req.enqueuedAt = time.Now()
 	req.Wg.Add(1)
 	req.IncrRef()     // for db write
 	db.writeCh <- req // Handled in doWrites.
@@ -234,7 +383,8 @@ func (db *DB) sendToWriteCh(entries []*utils.Entry) (*request, error) {
 
 //   Check(kv.BatchSet(entries))
 func (db *DB) batchSet(entries []*utils.Entry) error {
-	req, err := db.sendToWriteCh(entries)
+	// 只在 vlog GC 时使用，重写的数据对订阅者来说没有变化
+	req, err := db.sendRequest(entries, nil, true)
 	if err != nil {
 		return err
 	}
@@ -253,9 +403,6 @@ func (db *DB) doWrites(lc *utils.Closer) {
 		<-pendingCh
 	}
 
-	// This variable tracks the number of pending writes.
-	reqLen := new(expvar.Int)
-
 	reqs := make([]*request, 0, 10)
 	for {
 		var r *request
@@ -267,7 +414,7 @@ func (db *DB) doWrites(lc *utils.Closer) {
 
 		for {
 			reqs = append(reqs, r)
-			reqLen.Set(int64(len(reqs)))
+			db.metrics.PendingWrites.Set(int64(len(reqs)))
 
 			if len(reqs) >= 3*utils.KVWriteChCapacity {
 				pendingCh <- struct{}{} // blocking.
@@ -301,27 +448,73 @@ func (db *DB) doWrites(lc *utils.Closer) {
 	writeCase:
 		go writeRequests(reqs)
 		reqs = make([]*request, 0, 10)
-		reqLen.Set(0)
+		db.metrics.PendingWrites.Set(0)
 	}
 }
 
 // writeRequests is called serially by only one goroutine.
+// 条件写入的请求会把一批请求分成多段依次写入
 func (db *DB) writeRequests(reqs []*request) error {
+	batch := make([]*request, 0, len(reqs))
+	for i, r := range reqs {
+		if r.cond != nil {
+			// 条件写入需要看到之前所有请求的写入，先把它们写入LSM
+			if err := db.writeBatch(batch); err != nil {
+				db.finishRequests(reqs[i:], err)
+				return err
+			}
+			batch = batch[:0]
+			if err := db.checkCondition(r.cond); err != nil {
+				db.finishRequests([]*request{r}, err)
+				continue
+			}
+		}
+		batch = append(batch, r)
+	}
+	return db.writeBatch(batch)
+}
+
+// finishRequests 设置请求的结果并唤醒等待的协程
+func (db *DB) finishRequests(reqs []*request, err error) {
+	for _, r := range reqs {
+		// DropAll 等内部使用的空请求不计入写入指标
+		if err == nil && len(r.Entries) > 0 {
+			db.metrics.Sets.Add(uint64(len(r.Entries)))
+			db.metrics.SetLatency.Since(r.enqueuedAt)
+		}
+		r.Err = err
+		r.Wg.Done()
+	}
+}
+
+// writeBatch 把一批请求写入vlog和LSM
+// 写入失败时vlog或者LSM中可能留下了只写入一部分的事务，重启时只有它是最后的写入才能通过重放vlog补全或者丢弃，
+// 因此之后的写入全部返回之前的错误，需要重新打开DB
+func (db *DB) writeBatch(reqs []*request) (err error) {
 	if len(reqs) == 0 {
 		return nil
 	}
-
-	done := func(err error) {
-		for _, r := range reqs {
-			r.Err = err
-			r.Wg.Done()
+	if db.writeErr != nil {
+		db.finishRequests(reqs, db.writeErr)
+		return db.writeErr
+	}
+	defer func() {
+		if err != nil {
+			db.writeErr = errors.Wrap(err, "a previous write failed, reopen the DB")
 		}
+	}()
+
+	err = db.vlog.write(reqs)
+	if err == nil && db.opt.SyncWrites {
+		// LSM中的值指针落盘之前，它指向的vlog数据必须先落盘
+		err = db.vlog.sync(atomic.LoadUint32(&db.vlog.maxFid))
 	}
-	err := db.vlog.write(reqs)
 	if err != nil {
-		done(err)
+		db.finishRequests(reqs, err)
 		return err
 	}
+	// 写入LSM时大的value会被替换为值指针，需要在这之前复制给订阅者
+	kvs := db.pub.collect(reqs)
 	var count int
 	for _, b := range reqs {
 		if len(b.Entries) == 0 {
@@ -329,18 +522,25 @@ func (db *DB) writeRequests(reqs []*request) error {
 		}
 		count += len(b.Entries)
 		if err != nil {
-			done(err)
+			db.finishRequests(reqs, err)
 			return errors.Wrap(err, "writeRequests")
 		}
 		if err := db.writeToLSM(b); err != nil {
-			done(err)
+			db.finishRequests(reqs, err)
 			return errors.Wrap(err, "writeRequests")
 		}
 		db.Lock()
 		db.updateHead(b.Ptrs)
 		db.Unlock()
 	}
-	done(nil)
+	if db.opt.SyncWrites {
+		if err := db.lsm.Sync(); err != nil {
+			db.finishRequests(reqs, err)
+			return errors.Wrap(err, "writeRequests")
+		}
+	}
+	db.pub.send(kvs)
+	db.finishRequests(reqs, nil)
 	return nil
 }
 func (db *DB) writeToLSM(b *request) error {
@@ -355,7 +555,9 @@ func (db *DB) writeToLSM(b *request) error {
 			entry.Meta = entry.Meta | utils.BitValuePointer
 			entry.Value = b.Ptrs[i].Encode()
 		}
-		db.lsm.Set(entry)
+		if err := db.lsm.Set(entry); err != nil {
+			return err
+		}
 	}
 	return nil
 }
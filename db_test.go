@@ -2,15 +2,21 @@ package jkv
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
 	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
 )
 
 func TestAPI(t *testing.T) {
 	clearDir()
-	db := Open(opt)
+	db, err := Open(opt)
+	require.NoError(t, err)
 	defer func() { _ = db.Close() }()
 	// 写入
 	for i := 0; i < 50; i++ {
@@ -66,3 +72,135 @@ func TestAPI(t *testing.T) {
 	}
 
 }
+
+func TestDirLock(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(opt.WorkDir, utils.LockFileName))
+	require.NoError(t, err)
+
+	// 同一个目录不能被打开两次
+	_, err = Open(opt)
+	require.Equal(t, utils.ErrDirLocked, errors.Cause(err))
+
+	// 关闭之后锁被释放，可以重新打开，LOCK文件保留在目录中
+	require.NoError(t, db.Close())
+	_, err = os.Stat(filepath.Join(opt.WorkDir, utils.LockFileName))
+	require.NoError(t, err)
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// vlog 使用单独的目录时，两个目录都会加锁
+	vopt := *opt
+	vopt.ValueDir = filepath.Join(opt.WorkDir, "vlog")
+	db, err = Open(&vopt)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("val"))))
+	_, err = os.Stat(filepath.Join(vopt.ValueDir, utils.LockFileName))
+	require.NoError(t, err)
+	vlogs, err := filepath.Glob(filepath.Join(vopt.ValueDir, "*.vlog"))
+	require.NoError(t, err)
+	require.NotEmpty(t, vlogs)
+
+	// 另一个实例使用相同的 ValueDir 也会失败
+	other := vopt
+	other.WorkDir = filepath.Join(opt.WorkDir, "other")
+	_, err = Open(&other)
+	require.Equal(t, utils.ErrDirLocked, errors.Cause(err))
+	require.NoError(t, db.Close())
+
+	db, err = Open(&vopt)
+	require.NoError(t, err)
+	e, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), e.Value)
+	require.NoError(t, db.Close())
+}
+
+func TestOpenCorruptFiles(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	require.NoError(t, db.Close())
+
+	// sst 的footer被破坏
+	ssts, err := filepath.Glob(filepath.Join(opt.WorkDir, "*.sst"))
+	require.NoError(t, err)
+	require.NotEmpty(t, ssts)
+	fi, err := os.Stat(ssts[0])
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(ssts[0], fi.Size()-1))
+
+	var fileErr *utils.FileError
+	_, err = Open(opt)
+	require.True(t, errors.As(err, &fileErr), "%v", err)
+	require.Equal(t, utils.FileKindSST, fileErr.Kind)
+	// 打开失败时目录锁已经被释放，再次打开得到的依然是文件损坏的错误
+	_, err = Open(opt)
+	require.True(t, errors.As(err, &fileErr), "%v", err)
+
+	// 长度为0以及内容全为0的sst返回错误而不是panic，打开时也不会扩展文件
+	for _, size := range []int{0, 1 << 10} {
+		require.NoError(t, os.WriteFile(ssts[0], make([]byte, size), 0666))
+		_, err = Open(opt)
+		require.True(t, errors.As(err, &fileErr), "%v", err)
+		require.Equal(t, utils.FileKindSST, fileErr.Kind)
+		require.Equal(t, utils.ErrChecksumMismatch, errors.Cause(err))
+		fi, err = os.Stat(ssts[0])
+		require.NoError(t, err)
+		require.Equal(t, int64(size), fi.Size())
+	}
+
+	// manifest 的magic被破坏
+	manifest := filepath.Join(opt.WorkDir, utils.ManifestFilename)
+	require.NoError(t, os.WriteFile(manifest, []byte("corrupted"), 0666))
+	_, err = Open(opt)
+	require.True(t, errors.As(err, &fileErr), "%v", err)
+	require.Equal(t, utils.FileKindManifest, fileErr.Kind)
+	require.Equal(t, utils.ErrBadMagic, errors.Cause(err))
+}
+
+func TestOpenCorruptHead(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("val"))))
+	// head 的值不是一个完整的值指针
+	require.NoError(t, db.lsm.Set(&utils.Entry{Key: utils.KeyWithTs(head, 1), Value: []byte("bad")}))
+	require.NoError(t, db.Close())
+
+	var fileErr *utils.FileError
+	_, err = Open(opt)
+	require.True(t, errors.As(err, &fileErr), "%v", err)
+	require.Equal(t, utils.FileKindVlog, fileErr.Kind)
+	require.Equal(t, utils.ErrBadChecksum, errors.Cause(err))
+}
+
+// 写入失败之后拒绝之后所有的写入，重新打开之后恢复
+func TestWriteErrorBlocksWrites(t *testing.T) {
+	fs := vfs.NewErrorFS(vfs.NewMem())
+	o := *opt
+	o.FS = fs
+	o.SyncWrites = true
+	db, err := Open(&o)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("k1"), []byte("v1"))))
+	fs.FailWrite(1, "*.wal")
+	require.True(t, errors.Is(db.Set(utils.NewEntry([]byte("k2"), []byte("v2"))), vfs.ErrInjected))
+	require.True(t, errors.Is(db.Set(utils.NewEntry([]byte("k3"), []byte("v3"))), vfs.ErrInjected))
+	require.NoError(t, db.Close())
+
+	db, err = Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.NoError(t, db.Set(utils.NewEntry([]byte("k3"), []byte("v3"))))
+	e, err := db.Get([]byte("k1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), e.Value)
+}
@@ -0,0 +1,98 @@
+package jkv
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// DropAll 删除数据库中的全部数据
+// 执行期间所有的写入都会返回 ErrBlockedWrites，vlog中的数据会在之后的GC中回收
+func (db *DB) DropAll() error {
+	resume, err := db.pauseWrites()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	if _, err := db.lsm.DropAll(); err != nil {
+		return errors.Wrap(err, "DropAll")
+	}
+	if err := db.writeDropMarker(); err != nil {
+		return err
+	}
+	// 除了正在写入的文件，其余vlog文件中的数据都已经失效了
+	db.vlog.discardAll()
+	return nil
+}
+
+// DropPrefix 删除默认列族和所有列族中以 prefixes 中任意一个为前缀的key
+// 执行期间所有的写入都会返回 ErrBlockedWrites
+func (db *DB) DropPrefix(prefixes ...[]byte) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	for _, prefix := range prefixes {
+		if len(prefix) == 0 {
+			// 空前缀会匹配所有的key，应该使用 DropAll
+			return utils.ErrEmptyKey
+		}
+	}
+	resume, err := db.pauseWrites()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	if err := db.lsm.DropPrefix(prefixes); err != nil {
+		return errors.Wrap(err, "DropPrefix")
+	}
+	return db.writeDropMarker()
+}
+
+// pauseWrites 阻塞新的写入，并等待已经进入 writeCh 的请求全部写完，用于 Drop 和 Checkpoint
+// 返回的函数用于恢复写入
+func (db *DB) pauseWrites() (func(), error) {
+	// 只读模式下 Drop、IngestExternalFiles 和 Checkpoint 都需要修改数据目录
+	if db.opt.ReadOnly {
+		return nil, utils.ErrReadOnly
+	}
+	// 持有 writeChLock，保证已经分配了提交时间戳的事务都已经进入了 writeCh
+	db.orc.writeChLock.Lock()
+	if !atomic.CompareAndSwapInt32(&db.blockWrites, 0, 1) {
+		db.orc.writeChLock.Unlock()
+		return nil, utils.ErrBlockedWrites
+	}
+	// 发送一个空的请求，它完成时之前的请求都已经写完了
+	req := requestPool.Get().(*request)
+	req.reset()
+	req.Wg.Add(1)
+	req.IncrRef()
+	db.writeCh <- req
+	db.orc.writeChLock.Unlock()
+
+	resume := func() {
+		atomic.StoreInt32(&db.blockWrites, 0)
+	}
+	if err := req.Wait(); err != nil {
+		resume()
+		return nil, err
+	}
+	return resume, nil
+}
+
+// writeDropMarker 以一个新分配的提交时间戳写入vlog head
+// 重启时LSM中的最大版本号大于所有被删除的数据，被删除的数据不会从vlog中重放回来
+func (db *DB) writeDropMarker() error {
+	ts := db.orc.nextTs()
+	defer db.orc.doneCommit(ts)
+
+	db.RLock()
+	val := db.vhead.Encode()
+	db.RUnlock()
+	return db.lsm.Set(&utils.Entry{
+		Key:   utils.KeyWithTs(head, ts),
+		Value: val,
+	})
+}
@@ -0,0 +1,174 @@
+package jkv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestDropPrefix(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	// 写入足够多的数据，保证一部分数据已经刷到sst中
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("%s%03d", prefix, i)
+			require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte("v-"+key))))
+		}
+	}
+	require.NoError(t, db.DropPrefix([]byte("b"), []byte("c01")))
+
+	check := func(db *DB) {
+		iter := db.NewIterator(&utils.Options{})
+		iter.Rewind()
+		keys := collectKeys(iter)
+		require.NoError(t, iter.Close())
+		require.Len(t, keys, 90)
+		for _, key := range keys {
+			require.NotEqual(t, byte('b'), key[0])
+			require.NotContains(t, key, "c01")
+		}
+		_, err := db.Get([]byte("b010"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		e, err := db.Get([]byte("c020"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("v-c020"), e.Value)
+	}
+	check(db)
+
+	// 删除之后可以正常写入
+	require.NoError(t, db.Set(utils.NewEntry([]byte("b001"), []byte("new"))))
+	e, err := db.Get([]byte("b001"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), e.Value)
+	require.NoError(t, db.Del([]byte("b001")))
+
+	// 重启之后被删除的数据不会从vlog中恢复
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	check(db)
+}
+
+func TestDropAll(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	require.NoError(t, db.DropAll())
+
+	check := func(db *DB) {
+		iter := db.NewIterator(&utils.Options{})
+		iter.Rewind()
+		require.Empty(t, collectKeys(iter))
+		require.NoError(t, iter.Close())
+		_, err := db.Get([]byte("key1"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+	}
+	check(db)
+
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	check(db)
+
+	// 时间戳不会回退，新写入的数据可见
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key1"), []byte("new"))))
+	e, err := db.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), e.Value)
+}
+
+func TestDropColumnFamilies(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ColumnFamilies = map[string]*lsm.Options{"cf": {}}
+	db, err := Open(&o)
+	require.NoError(t, err)
+	cf, err := db.ColumnFamily("cf")
+	require.NoError(t, err)
+
+	// 足够多的数据使列族中的一部分数据刷到sst中
+	for _, prefix := range []string{"a", "b"} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%s%03d", prefix, i))
+			require.NoError(t, db.Set(utils.NewEntry(key, []byte("default"))))
+			require.NoError(t, cf.Set(utils.NewEntry(key, []byte("cf"))))
+		}
+	}
+	cfKeys := func(cf *ColumnFamily) []string {
+		iter := cf.NewIterator(&utils.Options{})
+		defer func() { require.NoError(t, iter.Close()) }()
+		iter.Rewind()
+		return collectKeys(iter)
+	}
+
+	// 列族中以 b 为前缀的key也会被删除
+	require.NoError(t, db.DropPrefix([]byte("b")))
+	check := func(db *DB, cf *ColumnFamily) {
+		keys := cfKeys(cf)
+		require.Len(t, keys, 100)
+		for _, key := range keys {
+			require.Equal(t, byte('a'), key[0])
+		}
+		_, err := cf.Get([]byte("b010"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		_, err = db.Get([]byte("b010"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		e, err := cf.Get([]byte("a010"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("cf"), e.Value)
+	}
+	check(db, cf)
+	require.NoError(t, db.Close())
+	db, err = Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	cf, err = db.ColumnFamily("cf")
+	require.NoError(t, err)
+	check(db, cf)
+
+	// DropAll 同样删除列族中的全部数据
+	require.NoError(t, db.DropAll())
+	require.Empty(t, cfKeys(cf))
+	_, err = cf.Get([]byte("a010"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+func TestLegacyHead(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	vp, err := db.getHead()
+	require.NoError(t, err)
+	require.True(t, vp.IsZero())
+
+	// 旧版本的数据目录中只有 legacyHead
+	legacy := utils.ValuePtr{Fid: 0, Offset: 10, Len: 20}
+	require.NoError(t, db.lsm.Set(&utils.Entry{Key: utils.KeyWithTs(legacyHead, 1), Value: legacy.Encode()}))
+	vp, err = db.getHead()
+	require.NoError(t, err)
+	require.Equal(t, legacy, *vp)
+
+	// 写入新的head之后优先使用它
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("val"))))
+	require.NoError(t, db.DropAll())
+	vp, err = db.getHead()
+	require.NoError(t, err)
+	db.RLock()
+	require.Equal(t, *db.vhead, *vp)
+	db.RUnlock()
+}
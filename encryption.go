@@ -0,0 +1,18 @@
+package jkv
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/file"
+)
+
+// RotateEncryptionKey 把 opt.WorkDir 中数据密钥的主密钥从 opt.EncryptionKey 更换为 newKey
+// 只会重写 KEYREGISTRY，数据文件不需要重新加密；数据库需要处于关闭状态，否则返回 ErrDirLocked
+// 成功之后需要使用 newKey 打开数据库
+func RotateEncryptionKey(opt *Options, newKey []byte) error {
+	guard, err := file.AcquireDirectoryLock(opt.FS, opt.WorkDir, false)
+	if err != nil {
+		return err
+	}
+	defer guard.Release()
+	return errors.Wrap(file.RotateKeyRegistry(opt.FS, opt.WorkDir, opt.EncryptionKey, newKey), "RotateEncryptionKey")
+}
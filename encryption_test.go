@@ -0,0 +1,108 @@
+package jkv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestEncryption(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ValueThreshold = 64
+	o.Compression = pb.CompressionType_SNAPPY
+	o.EncryptionKey = bytes.Repeat([]byte{'k'}, 32)
+	db, err := Open(&o)
+	require.NoError(t, err)
+	// 小的value写入LSM，大的value写入vlog
+	value := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("secret-val%03d", i))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("secret-val%03d", i)), 16)
+	}
+	for i := 0; i < 200; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("secret-key%03d", i)), value(i))))
+	}
+	check := func(db *DB) {
+		for i := 0; i < 200; i++ {
+			e, err := db.Get([]byte(fmt.Sprintf("secret-key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i), e.Value)
+		}
+	}
+	check(db)
+	dir := filepath.Join(o.WorkDir, "checkpoint")
+	require.NoError(t, db.Checkpoint(dir))
+	require.NoError(t, db.Close())
+
+	// sst、wal 和 vlog 中都不能出现明文
+	files, err := ioutil.ReadDir(o.WorkDir)
+	require.NoError(t, err)
+	var sst, wal, vlog int
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		switch filepath.Ext(f.Name()) {
+		case ".sst":
+			sst++
+		case ".wal":
+			wal++
+		case ".vlog":
+			vlog++
+		}
+		data, err := ioutil.ReadFile(filepath.Join(o.WorkDir, f.Name()))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, []byte("secret")), f.Name())
+	}
+	require.Greater(t, sst, 0)
+	require.Greater(t, wal, 0)
+	require.Greater(t, vlog, 0)
+
+	db, err = Open(&o)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	// 没有主密钥或者主密钥错误时无法打开
+	noKey := o
+	noKey.EncryptionKey = nil
+	_, err = Open(&noKey)
+	require.True(t, errors.Is(err, utils.ErrEncryptionKeyMismatch))
+	wrongKey := o
+	wrongKey.EncryptionKey = bytes.Repeat([]byte{'w'}, 32)
+	_, err = Open(&wrongKey)
+	require.True(t, errors.Is(err, utils.ErrEncryptionKeyMismatch))
+	badKey := o
+	badKey.EncryptionKey = []byte("short")
+	_, err = Open(&badKey)
+	require.Equal(t, utils.ErrInvalidEncryptionKey, err)
+
+	// 更换主密钥之后只能使用新的主密钥打开
+	newKey := bytes.Repeat([]byte{'n'}, 16)
+	require.NoError(t, RotateEncryptionKey(&o, newKey))
+	_, err = Open(&o)
+	require.True(t, errors.Is(err, utils.ErrEncryptionKeyMismatch))
+	o.EncryptionKey = newKey
+	db, err = Open(&o)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	// checkpoint 使用原来的主密钥
+	cpOpt := o
+	cpOpt.WorkDir = dir
+	cpOpt.EncryptionKey = bytes.Repeat([]byte{'k'}, 32)
+	cp, err := Open(&cpOpt)
+	require.NoError(t, err)
+	defer func() { _ = cp.Close() }()
+	check(cp)
+}
@@ -1,5 +1,7 @@
 package file
 
+import "github.com/vvvvjvvvv/jkv/vfs"
+
 type Options struct {
 	FID      uint64
 	FileName string
@@ -7,4 +9,20 @@ type Options struct {
 	Path     string
 	Flag     int
 	MaxSz    int
+	DataKey  *DataKey // 文件的数据密钥，为nil时不加密
+	InMemory bool     // 为true时只在内存中创建文件，见 OpenMemFile
+	FS       vfs.FS   // 访问文件使用的文件系统，为nil时使用 vfs.OS
+}
+
+// fs 返回打开文件使用的文件系统
+func (opt *Options) fs() vfs.FS {
+	return vfs.Default(opt.FS)
+}
+
+// openMmapFile 根据 opt 打开磁盘文件或者创建内存文件
+func openMmapFile(opt *Options) (*MmapFile, error) {
+	if opt.InMemory {
+		return OpenMemFile(opt.FileName, opt.MaxSz), nil
+	}
+	return OpenMmapFileFS(opt.fs(), opt.FileName, opt.Flag, opt.MaxSz)
 }
@@ -0,0 +1,469 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
+
+// KEYREGISTRY 文件的布局
+// +-------+---------+-----------+-------------+---------+---------+-----+
+// | magic | version | sanity iv | sanity text | record1 | record2 | ... |
+// +-------+---------+-----------+-------------+---------+---------+-----+
+// 每条记录与 MANIFEST 一样由 len、crc32 和内容组成，内容为
+// | op | kind len | kind | fid | key iv | base iv | encrypted data key |
+// 删除记录只包含前四项；sanity text 使用主密钥加密，用于检查主密钥是否正确
+
+const (
+	keyRegistryCreate byte = iota
+	keyRegistryDelete
+)
+
+var sanityText = []byte("!jvvvv!keyregistry")
+
+// DataKey 单个文件的数据密钥，文件中的数据使用 AES-CTR 加密
+type DataKey struct {
+	Key   []byte
+	IV    []byte // 文件的基础IV，与数据在文件中的偏移一起生成每段数据的IV
+	block cipher.Block
+}
+
+func newDataKey(key, iv []byte) (*DataKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{Key: key, IV: iv, block: block}, nil
+}
+
+// XOR 加密或者解密 src，返回新分配的结果，offset 为 src 在文件中的偏移
+// 同一个文件中不同偏移处的数据使用的计数器区间不会重叠；dk 为nil时表示文件没有加密，原样返回 src
+func (dk *DataKey) XOR(src []byte, offset uint32) []byte {
+	if dk == nil {
+		return src
+	}
+	var iv [aes.BlockSize]byte
+	copy(iv[:12], dk.IV)
+	binary.BigEndian.PutUint32(iv[12:], offset)
+	dst := make([]byte, len(src))
+	cipher.NewCTR(dk.block, iv[:]).XORKeyStream(dst, src)
+	return dst
+}
+
+type fileID struct {
+	kind string
+	fid  uint64
+}
+
+// KeyRegistry 保存每个加密文件的数据密钥，数据密钥使用主密钥加密后写入 KEYREGISTRY 文件
+// 更换主密钥时只需要重写 KEYREGISTRY，数据文件不需要重新加密
+// 没有设置主密钥时 KeyRegistry 为nil，所有的方法都可以在nil上调用，表示不加密
+type KeyRegistry struct {
+	lock      sync.RWMutex
+	fs        vfs.FS
+	dir       string
+	masterKey []byte
+	fp        vfs.File
+	keys      map[fileID]*DataKey
+	creations int
+	deletions int
+}
+
+// OpenKeyRegistry 打开 dir 中的 KEYREGISTRY，不存在时新建一个
+// masterKey 为空时不启用加密，如果 dir 中已经有 KEYREGISTRY 则返回 ErrEncryptionKeyMismatch
+// readOnly 为 true 时只读打开，KEYREGISTRY 不存在时返回错误；fs 为nil时使用 vfs.OS
+func OpenKeyRegistry(fs vfs.FS, dir string, masterKey []byte, readOnly bool) (*KeyRegistry, error) {
+	fs = vfs.Default(fs)
+	path := filepath.Join(dir, utils.KeyRegistryFileName)
+	if len(masterKey) == 0 {
+		if _, err := fs.Stat(path); err == nil {
+			return nil, utils.NewFileError(utils.FileKindKeyRegistry, path,
+				errors.Wrap(utils.ErrEncryptionKeyMismatch, "encryption key is required"))
+		}
+		return nil, nil
+	}
+	if err := validateKeyLen(masterKey); err != nil {
+		return nil, err
+	}
+	kr := &KeyRegistry{
+		fs:        fs,
+		dir:       dir,
+		masterKey: masterKey,
+		keys:      make(map[fileID]*DataKey),
+	}
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := fs.Open(path, flag, 0)
+	if err != nil {
+		if !os.IsNotExist(err) || readOnly {
+			return nil, utils.NewFileError(utils.FileKindKeyRegistry, path, err)
+		}
+		if err := kr.rewrite(); err != nil {
+			return nil, utils.NewFileError(utils.FileKindKeyRegistry, path, err)
+		}
+		return kr, nil
+	}
+	truncOffset, err := kr.replay(f)
+	if err == nil && !readOnly {
+		// 截断最后一条没有写完的记录
+		err = f.Truncate(truncOffset)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, utils.NewFileError(utils.FileKindKeyRegistry, path, err)
+	}
+	kr.fp = f
+	return kr, nil
+}
+
+func validateKeyLen(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return utils.ErrInvalidEncryptionKey
+}
+
+// NewDataKey 为文件生成一个新的数据密钥，返回之前已经持久化到 KEYREGISTRY 中
+func (kr *KeyRegistry) NewDataKey(kind string, fid uint64) (*DataKey, error) {
+	dk, err := kr.GenerateDataKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := kr.AddDataKey(kind, fid, dk); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+// GenerateDataKey 生成一个还没有关联到文件的数据密钥，用于写入时还不知道fid的sst
+// 使用这个密钥写入的文件在对外可见之前需要通过 AddDataKey 持久化
+func (kr *KeyRegistry) GenerateDataKey() (*DataKey, error) {
+	if kr == nil {
+		return nil, nil
+	}
+	key := make([]byte, len(kr.masterKey))
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	iv, err := newIV()
+	if err != nil {
+		return nil, err
+	}
+	return newDataKey(key, iv)
+}
+
+// AddDataKey 把 dk 作为文件的数据密钥写入 KEYREGISTRY 并同步到磁盘
+func (kr *KeyRegistry) AddDataKey(kind string, fid uint64, dk *DataKey) error {
+	if kr == nil || dk == nil {
+		return nil
+	}
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	id := fileID{kind: kind, fid: fid}
+	rec, err := kr.encodeRecord(keyRegistryCreate, id, dk)
+	if err != nil {
+		return err
+	}
+	if err := kr.append(rec); err != nil {
+		return err
+	}
+	kr.keys[id] = dk
+	kr.creations++
+	return nil
+}
+
+// DataKey 返回文件的数据密钥，文件没有加密时返回nil
+func (kr *KeyRegistry) DataKey(kind string, fid uint64) *DataKey {
+	if kr == nil {
+		return nil
+	}
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+	return kr.keys[fileID{kind: kind, fid: fid}]
+}
+
+// Delete 文件被删除之后移除它的数据密钥
+func (kr *KeyRegistry) Delete(kind string, fid uint64) error {
+	if kr == nil {
+		return nil
+	}
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	id := fileID{kind: kind, fid: fid}
+	if _, ok := kr.keys[id]; !ok {
+		return nil
+	}
+	delete(kr.keys, id)
+	kr.deletions++
+	// 与 MANIFEST 使用相同的重写策略
+	if kr.deletions > utils.ManifestDeletionsRewriteThreshold &&
+		kr.deletions > utils.ManifestDeletionsRatio*(kr.creations-kr.deletions) {
+		if err := kr.fp.Close(); err != nil {
+			return err
+		}
+		return kr.rewrite()
+	}
+	rec, err := kr.encodeRecord(keyRegistryDelete, id, nil)
+	if err != nil {
+		return err
+	}
+	return kr.append(rec)
+}
+
+// Checkpoint 在 dir 中写入当前所有数据密钥的副本
+func (kr *KeyRegistry) Checkpoint(dir string) error {
+	if kr == nil {
+		return nil
+	}
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+	cp := &KeyRegistry{fs: kr.fs, dir: dir, masterKey: kr.masterKey, keys: kr.keys}
+	if err := cp.rewrite(); err != nil {
+		return utils.NewFileError(utils.FileKindKeyRegistry, filepath.Join(dir, utils.KeyRegistryFileName), err)
+	}
+	return cp.fp.Close()
+}
+
+// Close 关闭 KEYREGISTRY 文件
+func (kr *KeyRegistry) Close() error {
+	if kr == nil {
+		return nil
+	}
+	return kr.fp.Close()
+}
+
+// RotateKeyRegistry 使用 newKey 重新加密 dir 中 KEYREGISTRY 保存的数据密钥，调用时数据库需要处于关闭状态
+func RotateKeyRegistry(fs vfs.FS, dir string, oldKey, newKey []byte) error {
+	if err := validateKeyLen(newKey); err != nil {
+		return err
+	}
+	fs = vfs.Default(fs)
+	if _, err := fs.Stat(filepath.Join(dir, utils.KeyRegistryFileName)); err != nil {
+		return err
+	}
+	kr, err := OpenKeyRegistry(fs, dir, oldKey, false)
+	if err != nil {
+		return err
+	}
+	if err := kr.fp.Close(); err != nil {
+		return err
+	}
+	kr.masterKey = newKey
+	if err := kr.rewrite(); err != nil {
+		return err
+	}
+	return kr.fp.Close()
+}
+
+// append 写入一条记录并同步到磁盘，调用方需要持有锁
+func (kr *KeyRegistry) append(rec []byte) error {
+	var lenCrcBuf [8]byte
+	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(rec)))
+	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(rec, utils.CastagnoliCrcTable))
+	if _, err := kr.fp.Write(append(lenCrcBuf[:], rec...)); err != nil {
+		return err
+	}
+	return kr.fp.Sync()
+}
+
+// rewrite 把当前所有的数据密钥写入一个新的文件，再原子地替换 KEYREGISTRY
+func (kr *KeyRegistry) rewrite() error {
+	rewritePath := filepath.Join(kr.dir, utils.KeyRegistryRewriteFileName)
+	fp, err := kr.fs.Open(rewritePath, utils.DefaultFileFlag|os.O_TRUNC, utils.DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	iv, err := newIV()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	sanity, err := xorWithMasterKey(kr.masterKey, iv, sanityText)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	buf := make([]byte, 8)
+	copy(buf[0:4], utils.MagicText[:])
+	binary.BigEndian.PutUint32(buf[4:8], uint32(utils.MagicVersion))
+	buf = append(buf, iv...)
+	buf = append(buf, sanity...)
+	for id, dk := range kr.keys {
+		rec, err := kr.encodeRecord(keyRegistryCreate, id, dk)
+		if err != nil {
+			fp.Close()
+			return err
+		}
+		var lenCrcBuf [8]byte
+		binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(rec)))
+		binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(rec, utils.CastagnoliCrcTable))
+		buf = append(buf, lenCrcBuf[:]...)
+		buf = append(buf, rec...)
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(kr.dir, utils.KeyRegistryFileName)
+	if err := kr.fs.Rename(rewritePath, path); err != nil {
+		return err
+	}
+	if kr.fp, err = kr.fs.Open(path, utils.DefaultFileFlag, utils.DefaultFileMode); err != nil {
+		return err
+	}
+	if err := kr.fs.Sync(kr.dir); err != nil {
+		kr.fp.Close()
+		return err
+	}
+	kr.creations = len(kr.keys)
+	kr.deletions = 0
+	return nil
+}
+
+// replay 读取 KEYREGISTRY 中的全部记录，返回最后一条完整记录的结束位置
+func (kr *KeyRegistry) replay(fp io.Reader) (int64, error) {
+	r := &bufReader{reader: bufio.NewReader(fp)}
+	header := make([]byte, 8+aes.BlockSize+len(sanityText))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, utils.ErrBadMagic
+	}
+	if !bytes.Equal(header[0:4], utils.MagicText[:]) {
+		return 0, utils.ErrBadMagic
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != uint32(utils.MagicVersion) {
+		return 0, fmt.Errorf("key registry has unsupported version: %d (we support %d)", version, utils.MagicVersion)
+	}
+	iv := header[8 : 8+aes.BlockSize]
+	sanity, err := xorWithMasterKey(kr.masterKey, iv, header[8+aes.BlockSize:])
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(sanity, sanityText) {
+		return 0, utils.ErrEncryptionKeyMismatch
+	}
+
+	var offset int64
+	for {
+		offset = r.count
+		var lenCrcBuf [8]byte
+		if _, err := io.ReadFull(r, lenCrcBuf[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(lenCrcBuf[0:4])
+		rec := make([]byte, length)
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return 0, err
+		}
+		if crc32.Checksum(rec, utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenCrcBuf[4:8]) {
+			return 0, utils.ErrBadChecksum
+		}
+		if err := kr.applyRecord(rec); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+func (kr *KeyRegistry) encodeRecord(op byte, id fileID, dk *DataKey) ([]byte, error) {
+	rec := []byte{op, byte(len(id.kind))}
+	rec = append(rec, id.kind...)
+	rec = append(rec, utils.U64ToBytes(id.fid)...)
+	if op == keyRegistryDelete {
+		return rec, nil
+	}
+	keyIV, err := newIV()
+	if err != nil {
+		return nil, err
+	}
+	encKey, err := xorWithMasterKey(kr.masterKey, keyIV, dk.Key)
+	if err != nil {
+		return nil, err
+	}
+	rec = append(rec, keyIV...)
+	rec = append(rec, dk.IV...)
+	return append(rec, encKey...), nil
+}
+
+func (kr *KeyRegistry) applyRecord(rec []byte) error {
+	if len(rec) < 2 || len(rec) < 2+int(rec[1])+8 {
+		return utils.ErrBadChecksum
+	}
+	op, kindLen := rec[0], int(rec[1])
+	id := fileID{kind: string(rec[2 : 2+kindLen]), fid: utils.BytesToU64(rec[2+kindLen : 10+kindLen])}
+	rec = rec[10+kindLen:]
+	switch op {
+	case keyRegistryDelete:
+		if _, ok := kr.keys[id]; ok {
+			delete(kr.keys, id)
+			kr.deletions++
+		}
+		return nil
+	case keyRegistryCreate:
+		// 数据密钥的长度由生成时的主密钥决定，更换主密钥之后可能与当前主密钥的长度不同
+		if validateKeyLen(rec[2*aes.BlockSize:]) != nil {
+			return utils.ErrBadChecksum
+		}
+		key, err := xorWithMasterKey(kr.masterKey, rec[:aes.BlockSize], rec[2*aes.BlockSize:])
+		if err != nil {
+			return err
+		}
+		dk, err := newDataKey(key, append([]byte{}, rec[aes.BlockSize:2*aes.BlockSize]...))
+		if err != nil {
+			return err
+		}
+		kr.keys[id] = dk
+		kr.creations++
+		return nil
+	}
+	return errors.Errorf("unknown key registry operation %d", op)
+}
+
+func xorWithMasterKey(masterKey, iv, src []byte) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, len(src))
+	cipher.NewCTR(block, iv).XORKeyStream(dst, src)
+	return dst, nil
+}
+
+func newIV() ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	return iv, nil
+}
@@ -0,0 +1,51 @@
+package file
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
+
+// DirLockGuard 持有数据目录和目录下LOCK文件的锁，防止多个DB实例同时打开同一个目录
+type DirLockGuard struct {
+	locks []io.Closer
+}
+
+// AcquireDirectoryLock 通过 fs 锁住 dirPath 目录本身和其中的LOCK文件，readOnly 为 true 时加共享锁，可以与其他只读实例同时打开目录
+// 只读时不会创建LOCK文件(比如只读介质上的拷贝)，这时只锁住目录，之后读写打开的实例依然会因为目录上的锁而失败
+// 目录已经被其他实例锁住时返回 utils.ErrDirLocked
+func AcquireDirectoryLock(fs vfs.FS, dirPath string, readOnly bool) (*DirLockGuard, error) {
+	fs = vfs.Default(fs)
+	guard := &DirLockGuard{}
+	for _, name := range []string{dirPath, filepath.Join(dirPath, utils.LockFileName)} {
+		lock, err := fs.Lock(name, readOnly)
+		if readOnly && name != dirPath && os.IsNotExist(errors.Cause(err)) {
+			break
+		}
+		if err != nil {
+			_ = guard.Release()
+			if errors.Cause(err) == vfs.ErrLocked {
+				return nil, errors.Wrapf(utils.ErrDirLocked, "dir: %s", dirPath)
+			}
+			return nil, errors.Wrapf(err, "cannot acquire directory lock on %q", dirPath)
+		}
+		guard.locks = append(guard.locks, lock)
+	}
+	return guard, nil
+}
+
+// Release 释放锁，LOCK文件保留在目录中
+func (guard *DirLockGuard) Release() error {
+	var err error
+	for i := len(guard.locks) - 1; i >= 0; i-- {
+		if closeErr := guard.locks[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	guard.locks = nil
+	return err
+}
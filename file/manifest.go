@@ -14,13 +14,14 @@ import (
 	"github.com/pkg/errors"
 	"github.com/vvvvjvvvv/jkv/pb"
 	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
 )
 
 // ManifestFile 维护 sst 文件元信息的文推荐
 // manifest 比较特殊，不能使用 mmap， 需要保证实时写入
 type ManifestFile struct {
 	opt                      *Options
-	f                        *os.File
+	f                        vfs.File
 	lock                     sync.Mutex
 	deletionRewriteThreshold int
 	manifest                 *Manifest
@@ -38,6 +39,8 @@ type Manifest struct {
 type TableManifest struct {
 	Level    uint8
 	CheckSum []byte // 方便今后扩展
+	// ColumnFamily sst 所属的列族，为空表示默认列族
+	ColumnFamily string
 }
 
 type levelManifest struct {
@@ -46,29 +49,40 @@ type levelManifest struct {
 
 // TableMeta sst 的一些元信息
 type TableMeta struct {
-	ID       uint64
-	CheckSum []byte
+	ID           uint64
+	CheckSum     []byte
+	ColumnFamily string
 }
 
 // OpenManifestFile 打开manifest文件
+// opt.Flag 为 os.O_RDONLY 时只读打开，不会新建或者截断文件
+// opt.InMemory 为 true 时不创建文件，变更只记录在内存中
 func OpenManifestFile(opt *Options) (*ManifestFile, error) {
 	mf := &ManifestFile{
 		lock: sync.Mutex{},
 		opt:  opt,
 	}
+	if opt.InMemory {
+		mf.manifest = createManifest()
+		return mf, nil
+	}
 
+	readOnly := opt.Flag == os.O_RDONLY
 	path := filepath.Join(opt.Dir, utils.ManifestFilename)
-	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := opt.fs().Open(path, flag, 0)
 	if err != nil { // 如果打开失败，则尝试新建一个 manifest file
-		if !os.IsNotExist(err) {
-			return mf, err
+		if !os.IsNotExist(err) || readOnly {
+			return mf, utils.NewFileError(utils.FileKindManifest, path, err)
 		}
 
 		m := createManifest()
-		fp, netCreations, err := helpRewrite(opt.Dir, m)
-		utils.CondPanic(netCreations == 0, errors.Wrapf(err, utils.ErrRewriteFailure.Error()))
+		fp, _, err := helpRewrite(opt.fs(), opt.Dir, m)
 		if err != nil {
-			return mf, err
+			return mf, utils.NewFileError(utils.FileKindManifest, path, errors.Wrap(err, utils.ErrRewriteFailure.Error()))
 		}
 
 		mf.f = fp
@@ -81,17 +95,22 @@ func OpenManifestFile(opt *Options) (*ManifestFile, error) {
 	manifest, truncOffset, err := ReplayManifestFile(f)
 	if err != nil {
 		_ = f.Close()
-		return mf, err
+		return mf, utils.NewFileError(utils.FileKindManifest, path, err)
 	}
 
+	if readOnly {
+		mf.f = f
+		mf.manifest = manifest
+		return mf, nil
+	}
 	// Truncate file so we don't have a half-written entry at the end
 	if err := f.Truncate(truncOffset); err != nil {
 		_ = f.Close()
-		return mf, err
+		return mf, utils.NewFileError(utils.FileKindManifest, path, err)
 	}
 	if _, err = f.Seek(0, io.SeekEnd); err != nil {
 		_ = f.Close()
-		return mf, err
+		return mf, utils.NewFileError(utils.FileKindManifest, path, err)
 	}
 
 	mf.f = f
@@ -100,7 +119,7 @@ func OpenManifestFile(opt *Options) (*ManifestFile, error) {
 }
 
 // ReplayManifestFile 对已经存在的 manifest 文件重新应用所有状态变更
-func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err error) {
+func ReplayManifestFile(fp io.Reader) (ret *Manifest, truncOffset int64, err error) {
 	r := &bufReader{reader: bufio.NewReader(fp)}
 	var magicBuf [8]byte
 	if _, err := io.ReadFull(r, magicBuf[:]); err != nil {
@@ -136,7 +155,11 @@ func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err erro
 			return &Manifest{}, 0, err
 		}
 		if crc32.Checksum(buf, utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenCrcBuf[4:8]) {
-			return &Manifest{}, 0, err
+			// 掉电时最后一条记录可能只写入了一部分，后面没有完整的记录时当作截断处理
+			if hasValidRecord(r) {
+				return &Manifest{}, 0, utils.ErrBadChecksum
+			}
+			break
 		}
 
 		var changeSet pb.ManifestChangeSet
@@ -150,6 +173,23 @@ func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err erro
 	return build, offset, err
 }
 
+// hasValidRecord 检查 r 中接下来是否是一条完整并且校验通过的记录，全0的数据不算记录
+func hasValidRecord(r io.Reader) bool {
+	var lenCrcBuf [8]byte
+	if _, err := io.ReadFull(r, lenCrcBuf[:]); err != nil {
+		return false
+	}
+	length := binary.BigEndian.Uint32(lenCrcBuf[0:4])
+	if length == 0 {
+		return false
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return false
+	}
+	return crc32.Checksum(buf, utils.CastagnoliCrcTable) == binary.BigEndian.Uint32(lenCrcBuf[4:8])
+}
+
 // This is not a "recoverable" error -- opening the KV store fails because the MANIFEST file is
 // just plain broken
 func applyChangeSet(build *Manifest, changeSet *pb.ManifestChangeSet) error {
@@ -169,8 +209,9 @@ func applyManifestChange(build *Manifest, tc *pb.ManifestChange) error {
 			return fmt.Errorf("MANIFEST invalid, table %d exists", tc.Id)
 		}
 		build.Tables[tc.Id] = TableManifest{
-			Level:    uint8(tc.Level),
-			CheckSum: append([]byte{}, tc.Checksum...),
+			Level:        uint8(tc.Level),
+			CheckSum:     append([]byte{}, tc.Checksum...),
+			ColumnFamily: tc.ColumnFamily,
 		}
 
 		for len(build.Levels) <= int(tc.Level) {
@@ -216,17 +257,18 @@ func createManifest() *Manifest {
 func (m *Manifest) asChanges() []*pb.ManifestChange {
 	changes := make([]*pb.ManifestChange, 0, len(m.Tables))
 	for id, tm := range m.Tables {
-		changes = append(changes, newCreateChange(id, int(tm.Level), tm.CheckSum))
+		changes = append(changes, newCreateChange(id, int(tm.Level), tm.CheckSum, tm.ColumnFamily))
 	}
 	return changes
 }
 
-func newCreateChange(id uint64, level int, chechSum []byte) *pb.ManifestChange {
+func newCreateChange(id uint64, level int, chechSum []byte, cf string) *pb.ManifestChange {
 	return &pb.ManifestChange{
-		Id:       id,
-		Op:       pb.ManifestChange_CREATE,
-		Level:    uint32(level),
-		Checksum: chechSum,
+		Id:           id,
+		Op:           pb.ManifestChange_CREATE,
+		Level:        uint32(level),
+		Checksum:     chechSum,
+		ColumnFamily: cf,
 	}
 }
 
@@ -236,7 +278,7 @@ func (mf *ManifestFile) rewrite() error {
 	if err := mf.f.Close(); err != nil {
 		return err
 	}
-	fp, nextCreations, err := helpRewrite(mf.opt.Dir, mf.manifest)
+	fp, nextCreations, err := helpRewrite(mf.opt.fs(), mf.opt.Dir, mf.manifest)
 	if err != nil {
 		return err
 	}
@@ -246,10 +288,10 @@ func (mf *ManifestFile) rewrite() error {
 	return nil
 }
 
-func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
+func helpRewrite(fs vfs.FS, dir string, m *Manifest) (vfs.File, int, error) {
 	rewritePath := filepath.Join(dir, utils.ManifestRewriteFilename)
 	// We explicitly sync.
-	fp, err := os.OpenFile(rewritePath, utils.DefaultFileFlag, utils.DefaultFileMode)
+	fp, err := fs.Open(rewritePath, utils.DefaultFileFlag, utils.DefaultFileMode)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -286,10 +328,10 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 		return nil, 0, err
 	}
 	manifestPath := filepath.Join(dir, utils.ManifestFilename)
-	if err := os.Rename(rewritePath, manifestPath); err != nil {
+	if err := fs.Rename(rewritePath, manifestPath); err != nil {
 		return nil, 0, err
 	}
-	fp, err = os.OpenFile(manifestPath, utils.DefaultFileFlag, utils.DefaultFileMode)
+	fp, err = fs.Open(manifestPath, utils.DefaultFileFlag, utils.DefaultFileMode)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -297,7 +339,7 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 		fp.Close()
 		return nil, 0, err
 	}
-	if err := utils.SyncDir(dir); err != nil {
+	if err := fs.Sync(dir); err != nil {
 		fp.Close()
 		return nil, 0, err
 	}
@@ -307,6 +349,9 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 
 // Close 关闭文件
 func (mf *ManifestFile) Close() error {
+	if mf.f == nil {
+		return nil
+	}
 	if err := mf.f.Close(); err != nil {
 		return err
 	}
@@ -330,6 +375,9 @@ func (mf *ManifestFile) addChanges(changesParam []*pb.ManifestChange) error {
 	if err := applyChangeSet(mf.manifest, &changes); err != nil {
 		return err
 	}
+	if mf.opt.InMemory {
+		return nil
+	}
 	// Rewrite manifest if it'd shrink by 1/10 and it's big enough to care
 	if mf.manifest.Deletions > utils.ManifestDeletionsRewriteThreshold &&
 		mf.manifest.Deletions > utils.ManifestDeletionsRatio*(mf.manifest.Creations-mf.manifest.Deletions) {
@@ -349,12 +397,22 @@ func (mf *ManifestFile) addChanges(changesParam []*pb.ManifestChange) error {
 	return err
 }
 
+// Checkpoint 在 dir 中写入一个只包含当前存活sst的 MANIFEST
+func (mf *ManifestFile) Checkpoint(dir string) error {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	fp, _, err := helpRewrite(mf.opt.fs(), dir, mf.manifest)
+	if err != nil {
+		return utils.NewFileError(utils.FileKindManifest, filepath.Join(dir, utils.ManifestFilename), err)
+	}
+	return fp.Close()
+}
+
 // AddTableMeta 存储level表到manifest的level中
 func (mf *ManifestFile) AddTableMeta(levelNum int, t *TableMeta) (err error) {
-	mf.addChanges([]*pb.ManifestChange{
-		newCreateChange(t.ID, levelNum, t.CheckSum),
+	return mf.addChanges([]*pb.ManifestChange{
+		newCreateChange(t.ID, levelNum, t.CheckSum, t.ColumnFamily),
 	})
-	return err
 }
 
 // RevertToManifest checks that all necessary table files exist and removes all table files not
@@ -373,7 +431,7 @@ func (mf *ManifestFile) RevertToManifest(idMap map[uint64]struct{}) error {
 		if _, ok := mf.manifest.Tables[id]; !ok {
 			utils.Err(fmt.Errorf("Table file %d  not referenced in MANIFEST", id))
 			filename := utils.FileNameSSTable(mf.opt.Dir, id)
-			if err := os.Remove(filename); err != nil {
+			if err := mf.opt.fs().Remove(filename); err != nil {
 				return errors.Wrapf(err, "While removing table %d", id)
 			}
 		}
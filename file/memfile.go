@@ -0,0 +1,196 @@
+package file
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
+
+// OpenMmapFile opens an existing file or creates a new file. If the file is
+// created, it would truncate the file to maxSz. In both cases, it would mmap
+// the file to maxSz and returned it. In case the file is created, z.NewFile is
+// returned
+func OpenMmapFile(filename string, flag int, maxSz int) (*MmapFile, error) {
+	return OpenMmapFileFS(vfs.OS, filename, flag, maxSz)
+}
+
+// OpenMmapFileFS 通过 fs 打开文件，打开的文件为 *os.File 时与 OpenMmapFile 相同
+// 其他文件系统的文件不能mmap，打开时把文件内容读到 Data 中，Sync、Truncature 和 Close 时把 AppendBuffer 修改过的部分写回文件
+// 这类文件只能通过 AppendBuffer 修改，直接修改 Data 不会写回
+func OpenMmapFileFS(fs vfs.FS, filename string, flag int, maxSz int) (*MmapFile, error) {
+	f, err := fs.Open(filename, flag, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open: %s", filename)
+	}
+	writable := true
+	if flag == os.O_RDONLY {
+		writable = false
+	}
+	if fd, ok := f.(*os.File); ok {
+		mf, err := OpenMmapFileUsing(fd, maxSz, writable)
+		if err != nil {
+			return nil, err
+		}
+		mf.fs = fs
+		return mf, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "cannot stat file: %s", filename)
+	}
+	fileSize := fi.Size()
+	if writable && maxSz > 0 && fileSize == 0 {
+		if err := f.Truncate(int64(maxSz)); err != nil {
+			_ = f.Close()
+			return nil, errors.Wrapf(err, "err while truncation")
+		}
+		fileSize = int64(maxSz)
+	}
+	data := make([]byte, fileSize)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "while reading %s with size: %d", filename, fileSize)
+	}
+	return &MmapFile{Data: data, name: f.Name(), vf: f, fs: fs, writable: writable}, nil
+}
+
+// OpenMemFile 创建一个只保存在内存中的文件，用于 InMemory 模式
+// 内存文件没有对应的磁盘文件，Sync 不做任何事情，Close 和 Delete 之后数据随之释放
+func OpenMemFile(filename string, maxSz int) *MmapFile {
+	return &MmapFile{Data: make([]byte, maxSz), name: filename}
+}
+
+// InMemory 是否为内存文件
+func (m *MmapFile) InMemory() bool {
+	return m.Fd == nil && m.vf == nil
+}
+
+// Name 返回文件名
+func (m *MmapFile) Name() string {
+	if m.Fd == nil {
+		return m.name
+	}
+	return m.Fd.Name()
+}
+
+// Size 返回文件的尺寸，内存文件的尺寸就是数据的长度
+func (m *MmapFile) Size() (int64, error) {
+	if m.InMemory() {
+		return int64(len(m.Data)), nil
+	}
+	fi, err := m.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Stat 返回文件的元信息，内存文件没有元信息
+func (m *MmapFile) Stat() (os.FileInfo, error) {
+	switch {
+	case m.Fd != nil:
+		return m.Fd.Stat()
+	case m.vf != nil:
+		return m.vf.Stat()
+	}
+	return nil, errors.Errorf("in-memory file %s has no file info", m.name)
+}
+
+// ReaderAt 返回从 offset 开始顺序读取文件内容的reader
+func (m *MmapFile) ReaderAt(offset int64) (io.Reader, error) {
+	if m.Fd == nil {
+		if offset > int64(len(m.Data)) {
+			offset = int64(len(m.Data))
+		}
+		return bytes.NewReader(m.Data[offset:]), nil
+	}
+	if _, err := m.Fd.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return m.Fd, nil
+}
+
+// markDirty 记录 Data 中 [lo, hi) 被修改过，只有不能mmap的文件需要记录
+func (m *MmapFile) markDirty(lo, hi int) {
+	if m.vf == nil || lo >= hi {
+		return
+	}
+	if m.dirtyLo == m.dirtyHi {
+		m.dirtyLo, m.dirtyHi = lo, hi
+		return
+	}
+	if lo < m.dirtyLo {
+		m.dirtyLo = lo
+	}
+	if hi > m.dirtyHi {
+		m.dirtyHi = hi
+	}
+}
+
+// syncBuffered 把 Data 中修改过的部分写回不能mmap的文件，内存文件不需要刷盘
+func (m *MmapFile) syncBuffered() error {
+	if m.vf == nil || !m.writable {
+		return nil
+	}
+	if m.dirtyLo < m.dirtyHi {
+		if _, err := m.vf.WriteAt(m.Data[m.dirtyLo:m.dirtyHi], int64(m.dirtyLo)); err != nil {
+			return errors.Wrapf(err, "while writing back file: %s", m.name)
+		}
+		m.dirtyLo, m.dirtyHi = 0, 0
+	}
+	return m.vf.Sync()
+}
+
+// truncateBuffered 与mmap文件一样，先写回数据再调整文件的尺寸
+func (m *MmapFile) truncateBuffered(maxSz int64) error {
+	if m.vf != nil {
+		if err := m.syncBuffered(); err != nil {
+			return err
+		}
+		if err := m.vf.Truncate(maxSz); err != nil {
+			return errors.Wrapf(err, "while truncate file: %s", m.name)
+		}
+	}
+	m.resizeInMemory(maxSz)
+	return nil
+}
+
+func (m *MmapFile) closeBuffered() error {
+	if m.vf == nil {
+		return nil
+	}
+	if err := m.syncBuffered(); err != nil {
+		return err
+	}
+	return m.vf.Close()
+}
+
+func (m *MmapFile) deleteBuffered() error {
+	if m.vf == nil {
+		return nil
+	}
+	if err := m.vf.Close(); err != nil {
+		return errors.Wrapf(err, "while close file: %s", m.name)
+	}
+	m.Data = nil
+	return m.fs.Remove(m.name)
+}
+
+// resizeInMemory 调整内存文件的尺寸，扩大的部分填充0
+func (m *MmapFile) resizeInMemory(maxSz int64) {
+	if int64(cap(m.Data)) >= maxSz {
+		old := len(m.Data)
+		m.Data = m.Data[:maxSz]
+		for i := old; i < len(m.Data); i++ {
+			m.Data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, maxSz)
+	copy(data, m.Data)
+	m.Data = data
+}
@@ -8,11 +8,20 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/vvvvjvvvv/jkv/utils/mmap"
+	"github.com/vvvvjvvvv/jkv/vfs"
 )
 
 type MmapFile struct {
 	Data []byte
-	Fd   *os.File
+	Fd   *os.File // 内存文件以及其他文件系统中的文件为nil
+	name string   // 内存文件的名称
+
+	fs vfs.FS // 打开文件使用的文件系统，为nil时为 vfs.OS
+	// 不能mmap的文件，例如 vfs.NewMem 创建的文件系统中的文件，见 OpenMmapFileFS
+	vf       vfs.File
+	writable bool
+	// Data 中还没有写回 vf 的范围 [dirtyLo, dirtyHi)，Sync 时只写回这一段
+	dirtyLo, dirtyHi int
 }
 
 // OpenMmapFileUsing os
@@ -25,6 +34,10 @@ func OpenMmapFileUsing(fd *os.File, sz int, writable bool) (*MmapFile, error) {
 
 	var rerr error
 	fileSize := fi.Size()
+	if fileSize == 0 && (!writable || sz <= 0) {
+		// 只读打开或者不需要扩展的空文件，长度为0时不能mmap
+		return &MmapFile{Fd: fd}, nil
+	}
 	if sz > 0 && fileSize == 0 {
 		// if the file is empty, truncate it to sz
 		if err := fd.Truncate(int64(sz)); err != nil {
@@ -49,35 +62,18 @@ func OpenMmapFileUsing(fd *os.File, sz int, writable bool) (*MmapFile, error) {
 	}, rerr
 }
 
-// OpenMmapFile opens an existing file or creates a new file. If the file is
-// created, it would truncate the file to maxSz. In both cases, it would mmap
-// the file to maxSz and returned it. In case the file is created, z.NewFile is
-// returned
-func OpenMmapFile(filename string, flag int, maxSz int) (*MmapFile, error) {
-	// fmt.Printf("opening file %s with flag: %v\n", filename, flag)
-	fd, err := os.OpenFile(filename, flag, 0666)
-	if err != nil {
-		return nil, errors.Wrapf(err, "unable to open: %s", filename)
-	}
-	writable := true
-	if flag == os.O_RDONLY {
-		writable = false
-	}
-	return OpenMmapFileUsing(fd, maxSz, writable)
-}
-
 type mmapReader struct {
 	Date   []byte
 	offset int
 }
 
 func (mr *mmapReader) Read(buf []byte) (int, error) {
-	if mr.offset > len(mr.Date) {
+	if mr.offset >= len(mr.Date) {
 		return 0, io.EOF
 	}
 
 	n := copy(buf, mr.Date[mr.offset:])
-	mr.offset = n
+	mr.offset += n
 	if n < len(buf) {
 		return n, io.EOF
 	}
@@ -124,6 +120,7 @@ func (m *MmapFile) AppendBuffer(offset uint32, buf []byte) error {
 	if dLen != needSize {
 		return errors.Errorf("dLen != needSize AppendBuffer failed")
 	}
+	m.markDirty(int(offset), end)
 	return nil
 }
 
@@ -131,41 +128,45 @@ func (m *MmapFile) Sync() error {
 	if m == nil {
 		return nil
 	}
+	if m.Fd == nil {
+		return m.syncBuffered()
+	}
+	if len(m.Data) == 0 {
+		return nil
+	}
 	return mmap.Msync(m.Data)
 }
 
 func (m *MmapFile) Delete() error {
 	if m.Fd == nil {
-		return nil
+		return m.deleteBuffered()
 	}
 
-	if err := mmap.Munmap(m.Data); err != nil {
+	if err := m.unmap(); err != nil {
 		return fmt.Errorf("while munmap file: %s, error: %v\n", m.Fd.Name(), err)
 	}
-	m.Data = nil
-	if err := m.Fd.Truncate(0); err != nil {
-		return fmt.Errorf("while truncate file: %s, error: %v\n", m.Fd.Name(), err)
-	}
+	// 只删除文件名，不能截断文件：checkpoint 硬链接的文件与这里共享数据
 	if err := m.Fd.Close(); err != nil {
 		return fmt.Errorf("while close file: %s, error: %v\n", m.Fd.Name(), err)
 	}
-	return os.Remove(m.Fd.Name())
+	return vfs.Default(m.fs).Remove(m.Fd.Name())
 }
 
 // Close would close the file. It would also truncate the file if maxSz >= 0
 func (m *MmapFile) Close() error {
 	if m.Fd == nil {
-		return nil
+		return m.closeBuffered()
 	}
 	if err := m.Sync(); err != nil {
 		return fmt.Errorf("while sync file: %s, error: %v\n", m.Fd.Name(), err)
 	}
-	if err := mmap.Munmap(m.Data); err != nil {
+	if err := m.unmap(); err != nil {
 		return fmt.Errorf("while munmap file: %s, error: %v\n", m.Fd.Name(), err)
 	}
 	return m.Fd.Close()
 }
 
+// SyncDir 打开目录并调用 fsync，保证目录项(新建/删除的文件)落盘
 func SyncDir(dir string) error {
 	df, err := os.Open(dir)
 	if err != nil {
@@ -173,6 +174,7 @@ func SyncDir(dir string) error {
 	}
 
 	if err := df.Sync(); err != nil {
+		_ = df.Close()
 		return errors.Wrapf(err, "while syncing: %s", dir)
 	}
 
@@ -183,20 +185,34 @@ func SyncDir(dir string) error {
 	return nil
 }
 
-// Truncature 兼容接口
+// Truncature 调整文件大小，并重新映射整个文件
 func (m *MmapFile) Truncature(maxSz int64) error {
+	if m.Fd == nil {
+		return m.truncateBuffered(maxSz)
+	}
 	if err := m.Sync(); err != nil {
 		return fmt.Errorf("while sync file: %s, error: %v\n", m.Fd.Name(), err)
 	}
-	if err := mmap.Munmap(m.Data); err != nil {
-		return fmt.Errorf("while munmap file: %s, error: %v\n", m.Fd.Name(), err)
-	}
 	if err := m.Fd.Truncate(maxSz); err != nil {
 		return fmt.Errorf("while truncate file: %s, error: %v\n", m.Fd.Name(), err)
 	}
-	var err error
-	m.Data, err = mmap.Mmap(m.Fd, true, maxSz) // Mmap up to max size.
-	return err
+	if maxSz == 0 {
+		// 长度为0的文件不能映射，直接解除映射即可
+		return m.unmap()
+	}
+	return m.remap(maxSz)
+}
+
+// unmap 解除映射，空文件不需要 munmap
+func (m *MmapFile) unmap() error {
+	if len(m.Data) == 0 {
+		return nil
+	}
+	if err := mmap.Munmap(m.Data); err != nil {
+		return err
+	}
+	m.Data = nil
+	return nil
 }
 
 // ReName 兼容接口
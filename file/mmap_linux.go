@@ -0,0 +1,14 @@
+package file
+
+import "github.com/vvvvjvvvv/jkv/utils/mmap"
+
+// remap 通过 mremap 扩展或者收缩映射，避免 munmap + mmap 的开销
+func (m *MmapFile) remap(maxSz int64) error {
+	var err error
+	if len(m.Data) == 0 {
+		m.Data, err = mmap.Mmap(m.Fd, true, maxSz)
+	} else {
+		m.Data, err = mmap.Mremap(m.Data, int(maxSz)) // Mmap up to max size.
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd netbsd openbsd solaris
+
+package file
+
+import (
+	"fmt"
+
+	"github.com/vvvvjvvvv/jkv/utils/mmap"
+)
+
+// remap 这些平台没有 mremap，解除映射之后重新映射整个文件
+func (m *MmapFile) remap(maxSz int64) error {
+	if err := m.unmap(); err != nil {
+		return fmt.Errorf("while munmap file: %s, error: %v\n", m.Fd.Name(), err)
+	}
+	var err error
+	m.Data, err = mmap.Mmap(m.Fd, true, maxSz) // Mmap up to max size.
+	return err
+}
@@ -0,0 +1,223 @@
+package file
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// SSTable 文件的内存封装
+type SSTable struct {
+	lock           *sync.RWMutex
+	f              *MmapFile
+	maxKey         []byte
+	minKey         []byte
+	idxTables      *pb.TableIndex
+	hasBloomFilter bool
+	idxLen         int
+	idxStart       int
+	fid            uint64
+	createdAt      time.Time
+	size           int64 // sst写入之后不再修改，Init 时读取一次
+	dataKey        *DataKey
+}
+
+// OpenSStable 打开一个 sst文件
+func OpenSStable(opt *Options) (*SSTable, error) {
+	omf, err := openMmapFile(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &SSTable{f: omf, fid: opt.FID, lock: &sync.RWMutex{}, dataKey: opt.DataKey}, nil
+}
+
+// Init 初始化
+func (ss *SSTable) Init() error {
+	var ko *pb.BlockOffset
+	var err error
+	if ko, err = ss.initTable(); err != nil {
+		return err
+	}
+	if ss.size, err = ss.f.Size(); err != nil {
+		return errors.Wrapf(err, "cannot get size of table: %s", ss.f.Name())
+	}
+	// 内存文件没有文件的元信息，使用打开的时间
+	if ss.f.InMemory() {
+		ss.createdAt = time.Now()
+	} else {
+		stat, err := ss.f.Stat()
+		if err != nil {
+			return err
+		}
+		ss.createdAt = createdAt(stat)
+	}
+	// init min key
+	keyBytes := ko.GetKey()
+	minKey := make([]byte, len(keyBytes))
+	copy(minKey, keyBytes)
+	ss.minKey = minKey
+	ss.maxKey = minKey
+	return nil
+}
+
+// DataKey 返回sst的数据密钥，sst没有加密时返回nil
+func (ss *SSTable) DataKey() *DataKey {
+	return ss.dataKey
+}
+
+// SetMaxKey max 需要使用table的迭代器，来获取最后一个block的最后一个key
+func (ss *SSTable) SetMaxKey(maxKey []byte) {
+	ss.maxKey = maxKey
+}
+func (ss *SSTable) initTable() (bo *pb.BlockOffset, err error) {
+	readPos := len(ss.f.Data)
+
+	// Read checksum len from the last 4 bytes.
+	readPos -= 4
+	if readPos < 0 {
+		return nil, errors.Wrapf(utils.ErrChecksumMismatch, "table %s is too small: %d bytes", ss.f.Name(), len(ss.f.Data))
+	}
+	buf, err := ss.readCheckError(readPos, 4)
+	if err != nil {
+		return nil, err
+	}
+	// footer 中的长度都来自文件，损坏的文件(比如全为0)在这里返回错误，而不是在之后越界
+	checksumLen := int(utils.BytesToU32(buf))
+	if checksumLen != 8 {
+		return nil, errors.Wrapf(utils.ErrChecksumMismatch, "table %s has invalid checksum length: %d", ss.f.Name(), checksumLen)
+	}
+
+	// Read checksum.
+	readPos -= checksumLen
+	expectedChk, err := ss.readCheckError(readPos, checksumLen)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read index size from the footer.
+	readPos -= 4
+	if buf, err = ss.readCheckError(readPos, 4); err != nil {
+		return nil, err
+	}
+	ss.idxLen = int(utils.BytesToU32(buf))
+
+	// Read index.
+	readPos -= ss.idxLen
+	if ss.idxLen <= 0 || readPos < 0 {
+		return nil, errors.Wrapf(utils.ErrChecksumMismatch, "table %s has invalid index length: %d", ss.f.Name(), ss.idxLen)
+	}
+	ss.idxStart = readPos
+	data, err := ss.readCheckError(readPos, ss.idxLen)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.VerifyChecksum(data, expectedChk); err != nil {
+		return nil, errors.Wrapf(err, "failed to verify checksum for table: %s", ss.f.Name())
+	}
+	// checksum 是对加密后的数据计算的，校验之后再解密
+	data = ss.dataKey.XOR(data, uint32(ss.idxStart))
+	indexTable := &pb.TableIndex{}
+	if err := proto.Unmarshal(data, indexTable); err != nil {
+		return nil, err
+	}
+	ss.idxTables = indexTable
+
+	ss.hasBloomFilter = len(indexTable.BloomFilter) > 0
+	if len(indexTable.GetOffsets()) > 0 {
+		return indexTable.GetOffsets()[0], nil
+	}
+	return nil, errors.New("read index fail, offset is nil")
+}
+
+// Close 关闭
+func (ss *SSTable) Close() error {
+	return ss.f.Close()
+}
+
+// Sync 把写入的sst数据刷盘，manifest 记录这个sst之前调用
+func (ss *SSTable) Sync() error {
+	return ss.f.Sync()
+}
+
+// Indexs _
+func (ss *SSTable) Indexs() *pb.TableIndex {
+	return ss.idxTables
+}
+
+// MaxKey 当前最大的key
+func (ss *SSTable) MaxKey() []byte {
+	return ss.maxKey
+}
+
+// MinKey 当前最小的key
+func (ss *SSTable) MinKey() []byte {
+	return ss.minKey
+}
+
+// FID 获取fid
+func (ss *SSTable) FID() uint64 {
+	return ss.fid
+}
+
+func (ss *SSTable) read(off, sz int) ([]byte, error) {
+	if len(ss.f.Data) > 0 {
+		if len(ss.f.Data[off:]) < sz {
+			return nil, io.EOF
+		}
+		return ss.f.Data[off : off+sz], nil
+	}
+
+	res := make([]byte, sz)
+	_, err := ss.f.Fd.ReadAt(res, int64(off))
+	return res, err
+}
+
+// readCheckError 读取sst的footer，越界时说明文件已经损坏
+func (ss *SSTable) readCheckError(off, sz int) ([]byte, error) {
+	if off < 0 || sz < 0 || off+sz > len(ss.f.Data) {
+		return nil, errors.Wrapf(utils.ErrBadChecksum,
+			"table %s is corrupted, read offset: %d, size: %d", ss.f.Name(), off, sz)
+	}
+	return ss.read(off, sz)
+}
+
+// HasBloomFilter _
+func (ss *SSTable) HasBloomFilter() bool {
+	return ss.hasBloomFilter
+}
+
+// Bytes returns data starting from offset off of size sz. If there's not enough data, it would
+// return nil slice and io.EOF.
+func (ss *SSTable) Bytes(off, sz int) ([]byte, error) {
+	return ss.f.Bytes(off, sz)
+}
+
+// WriteAt 在 off 处写入 buf，写入新建的sst时使用；不能直接修改 Bytes 返回的数据，否则不能mmap的文件不会写回
+func (ss *SSTable) WriteAt(buf []byte, off int) error {
+	return ss.f.AppendBuffer(uint32(off), buf)
+}
+
+// Size 返回底层文件的尺寸，Init 之后才有效
+func (ss *SSTable) Size() int64 {
+	return ss.size
+}
+
+// GetCreatedAt _
+func (ss *SSTable) GetCreatedAt() *time.Time {
+	return &ss.createdAt
+}
+
+// SetCreatedAt _
+func (ss *SSTable) SetCreatedAt(t *time.Time) {
+	ss.createdAt = *t
+}
+
+// Detele _
+func (ss *SSTable) Detele() error {
+	return ss.f.Delete()
+}
@@ -0,0 +1,15 @@
+package file
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// createdAt 从文件中获取创建时间，其他文件系统的文件没有 Stat_t 时使用修改时间
+func createdAt(stat os.FileInfo) time.Time {
+	if statType, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(statType.Atim.Sec, statType.Atim.Nsec)
+	}
+	return stat.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build dragonfly || freebsd || netbsd || openbsd || solaris
+// +build dragonfly freebsd netbsd openbsd solaris
+
+package file
+
+import (
+	"os"
+	"time"
+)
+
+// createdAt 各平台 Stat_t 的字段不统一，这里退化为使用修改时间
+func createdAt(stat os.FileInfo) time.Time {
+	return stat.ModTime()
+}
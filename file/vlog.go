@@ -20,23 +20,29 @@ type LogFile struct {
 	FID  uint32
 	size uint32
 	f    *MmapFile
+
+	dataKey *DataKey // 为nil时不加密
 }
 
 func (lf *LogFile) Open(opt *Options) error {
 	var err error
 	lf.FID = uint32(opt.FID)
 	lf.Lock = sync.RWMutex{}
-	lf.f, err = OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
-	utils.Panic2(nil, err)
-	fi, err := lf.f.Fd.Stat()
+	lf.dataKey = opt.DataKey
+	lf.f, err = openMmapFile(opt)
 	if err != nil {
-		return utils.WarpErr("Unable to run file.Stat", err)
+		return err
 	}
-
 	// 获取文件尺寸
-	sz := fi.Size()
-	utils.CondPanic(sz > math.MaxUint32, fmt.Errorf("file size: %d greater than %d",
-		uint32(sz), uint32(math.MaxUint32)))
+	sz, err := lf.f.Size()
+	if err != nil {
+		_ = lf.f.Close()
+		return utils.WarpErr("Unable to run file.Stat", err)
+	}
+	if sz > math.MaxUint32 {
+		_ = lf.f.Close()
+		return fmt.Errorf("file size: %d greater than %d", sz, uint32(math.MaxUint32))
+	}
 	lf.size = uint32(sz)
 	// TODO 是否需要在这里弄一个header放一些元素
 	return nil
@@ -113,11 +119,10 @@ func (lf *LogFile) Bootstrap() error {
 }
 
 func (lf *LogFile) Init() error {
-	fstat, err := lf.f.Fd.Stat()
+	sz, err := lf.f.Size()
 	if err != nil {
 		return errors.Wrapf(err, "Unable to check stat for %q", lf.FileName())
 	}
-	sz := fstat.Size()
 	if sz == 0 {
 		// File is empty. We don't need to mmap it. Return.
 		return nil
@@ -127,7 +132,7 @@ func (lf *LogFile) Init() error {
 	return nil
 }
 func (lf *LogFile) FileName() string {
-	return lf.f.Fd.Name()
+	return lf.f.Name()
 }
 
 func (lf *LogFile) Seek(offset int64, whence int) (ret int64, err error) {
@@ -138,6 +143,16 @@ func (lf *LogFile) FD() *os.File {
 	return lf.f.Fd
 }
 
+// NewReader 返回从 offset 开始顺序读取文件内容的reader，内存文件也可以使用
+func (lf *LogFile) NewReader(offset int64) (io.Reader, error) {
+	return lf.f.ReaderAt(offset)
+}
+
+// InMemory 是否为内存文件
+func (lf *LogFile) InMemory() bool {
+	return lf.f.InMemory()
+}
+
 // You must hold lf.lock to sync()
 func (lf *LogFile) Sync() error {
 	return lf.f.Sync()
@@ -163,9 +178,15 @@ func (lf *LogFile) EncodeEntry(e *utils.Entry, buf *bytes.Buffer, offset uint32)
 	var headerEnc [utils.MaxHeaderSize]byte
 	sz := h.Encode(headerEnc[:])
 	utils.Panic2(writer.Write(headerEnc[:sz]))
-	// Encryption is disabled so writing directly to the buffer.
-	utils.Panic2(writer.Write(e.Key))
-	utils.Panic2(writer.Write(e.Value))
+	if lf.dataKey == nil {
+		utils.Panic2(writer.Write(e.Key))
+		utils.Panic2(writer.Write(e.Value))
+	} else {
+		// 以记录在文件中的偏移作为计数器的起点，crc 针对密文计算
+		kv := make([]byte, 0, len(e.Key)+len(e.Value))
+		kv = append(append(kv, e.Key...), e.Value...)
+		utils.Panic2(writer.Write(lf.dataKey.XOR(kv, offset)))
+	}
 	// write crc32 hash.
 	var crcBuf [crc32.Size]byte
 	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
@@ -176,9 +197,9 @@ func (lf *LogFile) EncodeEntry(e *utils.Entry, buf *bytes.Buffer, offset uint32)
 func (lf *LogFile) DecodeEntry(buf []byte, offset uint32) (*utils.Entry, error) {
 	var h utils.Header
 	hlen := h.Decode(buf)
-	kv := buf[hlen:]
+	kv := lf.DecryptKV(buf[hlen:hlen+int(h.KLen+h.VLen)], offset)
 	e := &utils.Entry{
-		Meta:      h.Meta,
+		Meta:      h.Meta &^ (utils.BitTxn | utils.BitFinTxn), // 事务的标记只在重放vlog时使用
 		ExpiresAt: h.ExpiresAt,
 		Offset:    offset,
 		Key:       kv[:h.KLen],
@@ -186,3 +207,8 @@ func (lf *LogFile) DecodeEntry(buf []byte, offset uint32) (*utils.Entry, error)
 	}
 	return e, nil
 }
+
+// DecryptKV 解密从 offset 处的记录中读取的key和value，返回新分配的内存，文件没有加密时原样返回 kv
+func (lf *LogFile) DecryptKV(kv []byte, offset uint32) []byte {
+	return lf.dataKey.XOR(kv, offset)
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
-	"os"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -27,18 +26,33 @@ func (wf *WalFile) Fid() uint64 {
 	return wf.opts.FID
 }
 
-// Close _
+// Close 关闭wal文件并保留内容，重启时用于恢复memtable
 func (wf *WalFile) Close() error {
-	fileName := wf.f.Fd.Name()
+	return wf.f.Close()
+}
+
+// Delete 关闭并删除wal文件，memtable成功刷盘后调用
+func (wf *WalFile) Delete() error {
+	fileName := wf.f.Name()
 	if err := wf.f.Close(); err != nil {
 		return err
 	}
-	return os.Remove(fileName)
+	if wf.f.InMemory() {
+		return nil
+	}
+	return wf.opts.fs().Remove(fileName)
+}
+
+// Sync 把已经写入的日志刷盘
+func (wf *WalFile) Sync() error {
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	return wf.f.Sync()
 }
 
 // Name _
 func (wf *WalFile) Name() string {
-	return wf.f.Fd.Name()
+	return wf.f.Name()
 }
 
 // Size 当前已经被写入的数据
@@ -47,8 +61,11 @@ func (wf *WalFile) Size() uint32 {
 }
 
 // OpenWalFile _
-func OpenWalFile(opt *Options) *WalFile {
-	omf, err := OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
+func OpenWalFile(opt *Options) (*WalFile, error) {
+	omf, err := openMmapFile(opt)
+	if err != nil {
+		return nil, err
+	}
 
 	wf := &WalFile{
 		f:    omf,
@@ -57,21 +74,30 @@ func OpenWalFile(opt *Options) *WalFile {
 		buf:  &bytes.Buffer{},
 	}
 	wf.size = uint32(len(wf.f.Data))
-
-	utils.Err(err)
-
-	return wf
+	return wf, nil
 }
 
 func (wf *WalFile) Write(entry *utils.Entry) error {
 	// 落预写日志简单的同步写即可
 	// 序列化为磁盘结构
 	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	if dk := wf.opts.DataKey; dk != nil {
+		// 加密key和value的副本，memtable中保存的仍然是明文；crc 针对密文计算
+		kv := dk.XOR(append(append(make([]byte, 0, len(entry.Key)+len(entry.Value)), entry.Key...), entry.Value...), wf.writeAt)
+		entry = &utils.Entry{
+			Key:       kv[:len(entry.Key)],
+			Value:     kv[len(entry.Key):],
+			Meta:      entry.Meta,
+			ExpiresAt: entry.ExpiresAt,
+		}
+	}
 	plen := utils.WalCodec(wf.buf, entry)
 	buf := wf.buf.Bytes()
-	utils.Panic(wf.f.AppendBuffer(wf.writeAt, buf))
+	if err := wf.f.AppendBuffer(wf.writeAt, buf); err != nil {
+		return err
+	}
 	wf.writeAt += uint32(plen)
-	wf.lock.Unlock()
 	return nil
 }
 
@@ -120,9 +146,9 @@ func (wf *WalFile) Truncate(end int64) error {
 	if end <= 0 {
 		return nil
 	}
-	if fi, err := wf.f.Fd.Stat(); err != nil {
+	if sz, err := wf.f.Size(); err != nil {
 		return fmt.Errorf("while file.stat on file: %s, error: %v\n", wf.Name(), err)
-	} else if fi.Size() == end {
+	} else if sz == end {
 		return nil
 	}
 
@@ -182,6 +208,12 @@ func (r *SafeRead) MakeEntry(reader io.Reader) (*utils.Entry, error) {
 	if crc != tee.Sum32() {
 		return nil, utils.ErrTruncate
 	}
+	if dk := r.LF.opts.DataKey; dk != nil {
+		buf = dk.XOR(buf, r.RecordOffset)
+		e.Key = buf[:h.KeyLen]
+		e.Value = buf[h.KeyLen:]
+	}
 	e.ExpiresAt = h.ExpiresAt
+	e.Meta = h.Meta
 	return e, nil
 }
@@ -5,6 +5,8 @@ go 1.17
 require (
 	github.com/cespare/xxhash v1.1.0
 	github.com/golang/protobuf v1.5.2
+	github.com/golang/snappy v1.0.0
+	github.com/klauspost/compress v1.15.12
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.8.1
 	golang.org/x/sys v0.2.0
@@ -0,0 +1,37 @@
+package jkv
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// NewSSTWriter 创建一个 SSTWriter，用于在数据库之外生成可以通过 IngestExternalFiles 导入的sst文件
+func NewSSTWriter(path string) *lsm.SSTWriter {
+	return lsm.NewSSTWriter(path, &lsm.Options{BlockSize: 8 * 1024})
+}
+
+// IngestExternalFiles 把 SSTWriter 生成的sst文件导入数据库，导入的key共用一个新分配的版本号
+// 导入的数据不经过 WAL、内存表和vlog，每个sst会放到与其key范围不重叠的最深的一层
+// 执行期间所有的写入都会返回 ErrBlockedWrites，导入的key不参与事务的冲突检测
+func (db *DB) IngestExternalFiles(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if db.opt.InMemory {
+		return utils.ErrInMemory
+	}
+	resume, err := db.pauseWrites()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	// 在导入完成之前，读时间戳不小于 ts 的读事务会等待
+	ts := db.orc.nextTs()
+	defer db.orc.doneCommit(ts)
+	if err := db.lsm.IngestExternalFiles(paths, ts); err != nil {
+		return errors.Wrap(err, "IngestExternalFiles")
+	}
+	return nil
+}
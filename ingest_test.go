@@ -0,0 +1,137 @@
+package jkv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestIngestExternalFiles(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+
+	// 覆盖 key040-key049，删除 key000，并新增 key050-key099
+	path := filepath.Join(opt.WorkDir, "external.sst")
+	w := NewSSTWriter(path)
+	require.NoError(t, w.Delete([]byte("key000")))
+	for i := 40; i < 100; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("ext%03d", i)
+		require.NoError(t, w.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	require.NoError(t, w.Finish())
+	require.NoError(t, db.IngestExternalFiles([]string{path}))
+
+	check := func(db *DB) {
+		require.Equal(t, 99, countKeys(db))
+		_, err := db.Get([]byte("key000"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		for i := 1; i < 100; i++ {
+			val := fmt.Sprintf("val%03d", i)
+			if i >= 40 {
+				val = fmt.Sprintf("ext%03d", i)
+			}
+			e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(val), e.Value)
+		}
+	}
+	check(db)
+
+	// 导入之后的写入版本号更大
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key050"), []byte("after"))))
+	e, err := db.Get([]byte("key050"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), e.Value)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key050"), []byte("ext050"))))
+
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	check(db)
+}
+
+func TestIngestCorruptedFile(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	path := filepath.Join(opt.WorkDir, "external.sst")
+	w := NewSSTWriter(path)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, w.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("val"))))
+	}
+	require.NoError(t, w.Finish())
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[10] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+
+	require.Error(t, db.IngestExternalFiles([]string{path}))
+	require.Error(t, db.IngestExternalFiles([]string{filepath.Join(opt.WorkDir, "missing.sst")}))
+	require.Equal(t, 0, countKeys(db))
+	// 失败之后写入恢复正常
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("val"))))
+}
+
+func TestIngestWhileWritingColumnFamily(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ColumnFamilies = map[string]*lsm.Options{"cf": {}}
+	db, err := Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	cf, err := db.ColumnFamily("cf")
+	require.NoError(t, err)
+
+	// 列族持续写入，内存表刷盘和压缩与导入同时进行
+	const n = 2000
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			e := utils.NewEntry([]byte(fmt.Sprintf("cf%04d", i)), []byte(fmt.Sprintf("val%04d", i)))
+			err := cf.Set(e)
+			for errors.Cause(err) == utils.ErrBlockedWrites {
+				err = cf.Set(e)
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(o.WorkDir, fmt.Sprintf("external%d.sst", i))
+		w := NewSSTWriter(path)
+		for j := 0; j < 50; j++ {
+			require.NoError(t, w.Set(utils.NewEntry([]byte(fmt.Sprintf("key%d-%03d", i, j)), []byte("ext"))))
+		}
+		require.NoError(t, w.Finish())
+		require.NoError(t, db.IngestExternalFiles([]string{path}))
+	}
+	require.NoError(t, <-done)
+
+	for i := 0; i < n; i++ {
+		e, err := cf.Get([]byte(fmt.Sprintf("cf%04d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%04d", i)), e.Value)
+	}
+	for i := 0; i < 10; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%d-%03d", i, 0)))
+		require.NoError(t, err)
+		require.Equal(t, []byte("ext"), e.Value)
+	}
+}
@@ -0,0 +1,60 @@
+package jkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestInMemory(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.WorkDir = filepath.Join(opt.WorkDir, "inmemory")
+	o.InMemory = true
+	db, err := Open(&o)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	// 写入足够多的数据，内存表会刷成内存中的sst
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			require.NoError(t, db.Set(utils.NewEntry(key, []byte(fmt.Sprintf("val%d-%d", i, round)))))
+		}
+	}
+	for i := 0; i < 1000; i += 10 {
+		require.NoError(t, db.Del([]byte(fmt.Sprintf("key%04d", i))))
+	}
+	require.NotZero(t, db.Info().Levels[0].NumTables)
+
+	for i := 0; i < 1000; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if i%10 == 0 {
+			require.Equal(t, utils.ErrKeyNotFound, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%d-2", i)), e.Value)
+	}
+	count := 0
+	iter := db.NewIterator(&utils.Options{IsAsc: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, 900, count)
+
+	// 不会创建任何文件
+	_, err = os.Stat(o.WorkDir)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, utils.ErrInMemory, db.Checkpoint(filepath.Join(opt.WorkDir, "checkpoint")))
+
+	o.ReadOnly = true
+	_, err = Open(&o)
+	require.Equal(t, utils.ErrInMemory, errors.Cause(err))
+}
@@ -1,13 +1,28 @@
 package jkv
 
 import (
+	"bytes"
+	"time"
+
 	"github.com/vvvvjvvvv/jkv/lsm"
 	"github.com/vvvvjvvvv/jkv/utils"
 )
 
+// DBIterator 对外提供的迭代器，基于事务的读时间戳返回每个key可见的最新版本，AllVersions 时返回所有可见的版本
+// 目前只支持按照key升序迭代
 type DBIterator struct {
 	iitr utils.Iterator
 	vlog *valueLog
+	opt  utils.Options
+
+	txn     *Txn
+	ownTxn  bool // 迭代器关闭时是否需要丢弃事务
+	item    *Item
+	lastKey []byte
+	// prefix 列族的key前缀，返回的key会去掉这个前缀，opt 中的前缀和上下界已经加上了这个前缀
+	prefix []byte
+	// advanced 合并操作数时 iitr 已经移动到了下一个没有参与合并的位置
+	advanced bool
 }
 type Item struct {
 	e *utils.Entry
@@ -17,35 +32,101 @@ func (it *Item) Entry() *utils.Entry {
 	return it.e
 }
 func (db *DB) NewIterator(opt *utils.Options) utils.Iterator {
-	iters := make([]utils.Iterator, 0)
-	iters = append(iters, db.lsm.NewIterators(opt)...)
+	iter := db.NewTransaction(false).NewIterator(opt).(*DBIterator)
+	iter.ownTxn = true
+	return iter
+}
+
+// NewIterator 创建一个基于事务快照的迭代器，只能看到读时间戳之前提交的数据，只包含默认列族中的数据
+func (txn *Txn) NewIterator(opt *utils.Options) utils.Iterator {
+	return txn.newIterator(&ColumnFamily{db: txn.db}, opt)
+}
 
+func (txn *Txn) newIterator(cf *ColumnFamily, opt *utils.Options) utils.Iterator {
+	iopt := cf.iteratorOptions(opt)
+	iters, err := txn.db.lsm.NewColumnFamilyIterators(cf.name, &iopt)
+	// 列族的句柄只能通过 DB.ColumnFamily 获取，一定是存在的
+	utils.Panic(err)
+
+	txn.db.metrics.Iterators.Inc()
 	res := &DBIterator{
-		vlog: db.vlog,
-		iitr: lsm.NewMergeIterator(iters, opt.IsAsc),
+		vlog:   txn.db.vlog,
+		opt:    iopt,
+		txn:    txn,
+		prefix: cf.prefix,
+		iitr:   lsm.NewMergeIterator(iters, false),
 	}
 	return res
 }
 
 func (iter *DBIterator) Next() {
-	iter.iitr.Next()
-	for ; iter.Valid() && iter.Item() == nil; iter.iitr.Next() {
+	if !iter.advanced {
+		iter.iitr.Next()
 	}
+	iter.findValid()
 }
 func (iter *DBIterator) Valid() bool {
-	return iter.iitr.Valid()
+	return iter.item != nil
 }
 func (iter *DBIterator) Rewind() {
-	iter.iitr.Rewind()
-	for ; iter.Valid() && iter.Item() == nil; iter.iitr.Next() {
+	defer iter.txn.db.metrics.IteratorSeekLatency.Since(time.Now())
+	iter.lastKey = iter.lastKey[:0]
+	if start := iter.opt.SeekStart(); len(start) > 0 {
+		iter.iitr.Seek(utils.KeyWithTs(start, iter.txn.readTs))
+	} else {
+		iter.iitr.Rewind()
 	}
+	iter.findValid()
 }
-func (iter *DBIterator) Item() utils.Item {
-	// 检查从lsm拿到的value是否是value ptr,是则从vlog中拿值
-	e := iter.iitr.Item().Entry()
-	var value []byte
 
-	if e != nil && utils.IsValuePtr(e) {
+// findValid 从当前位置开始找到第一个可见的key
+// 跳过读时间戳之后写入的版本、同一个key的旧版本以及已经删除或过期的key，AllVersions 时只跳过读时间戳之后写入的版本
+func (iter *DBIterator) findValid() {
+	iter.item, iter.advanced = nil, false
+	for ; iter.iitr.Valid(); iter.iitr.Next() {
+		e := iter.iitr.Item().Entry()
+		key := utils.ParseKey(e.Key)
+		if !iter.opt.KeyInRange(key) {
+			// 升序迭代，超出上界或前缀范围后不会再有满足条件的key
+			return
+		}
+		if utils.ParseTs(e.Key) > iter.txn.readTs || bytes.HasPrefix(key[len(iter.prefix):], jkvPrefix) {
+			continue
+		}
+		if iter.opt.AllVersions {
+			// 原样返回每个版本，合并操作数也不会合并
+			if item := iter.parseItem(e); item != nil {
+				iter.item = item
+				return
+			}
+			continue
+		}
+		if len(iter.lastKey) > 0 && bytes.Equal(key, iter.lastKey) {
+			continue
+		}
+		iter.lastKey = utils.SafeCopy(iter.lastKey, key)
+		if e.IsDeletedOrExpired() {
+			continue
+		}
+		if e.Meta&utils.BitMergeOperand > 0 {
+			// 出错时 iitr 仍然停在当前key上，继续向后查找即可
+			if item := iter.mergeItem(key, e); item != nil {
+				iter.item, iter.advanced = item, true
+				return
+			}
+			continue
+		}
+		if item := iter.parseItem(e); item != nil {
+			iter.item = item
+			return
+		}
+	}
+}
+
+func (iter *DBIterator) parseItem(e *utils.Entry) *Item {
+	// 检查从lsm拿到的value是否是value ptr,是则从vlog中拿值
+	value := e.Value
+	if utils.IsValuePtr(e) {
 		var vp utils.ValuePtr
 		vp.Decode(e.Value)
 		result, cb, err := iter.vlog.read(&vp)
@@ -53,27 +134,62 @@ func (iter *DBIterator) Item() utils.Item {
 		if err != nil {
 			return nil
 		}
-		value = utils.SafeCopy(nil, result)
-	}
-
-	if e.IsDeletedOrExpired() || value == nil {
-		return nil
+		value = result
 	}
 
 	res := &utils.Entry{
-		Key:          e.Key,
-		Value:        value,
+		Key:          utils.SafeCopy(nil, utils.ParseKey(e.Key)[len(iter.prefix):]),
+		Value:        utils.SafeCopy(nil, value),
 		ExpiresAt:    e.ExpiresAt,
 		Meta:         e.Meta,
-		Version:      e.Version,
+		Version:      utils.ParseTs(e.Key),
 		Offset:       e.Offset,
 		Hlen:         e.Hlen,
 		ValThreshold: e.ValThreshold,
 	}
-	return res
+	return &Item{e: res}
+}
+
+// mergeItem 把从 e 开始的合并操作数与更早的版本合并，成功时 iitr 会停在下一个没有参与合并的位置
+func (iter *DBIterator) mergeItem(key []byte, e *utils.Entry) *Item {
+	res := &utils.Entry{
+		Key:       utils.SafeCopy(nil, key[len(iter.prefix):]),
+		ExpiresAt: e.ExpiresAt,
+		Meta:      e.Meta &^ (utils.BitValuePointer | utils.BitMergeOperand),
+		Version:   utils.ParseTs(e.Key),
+	}
+	value, err := iter.txn.db.readMerged(utils.SafeCopy(nil, key), iter.iitr)
+	if err != nil {
+		return nil
+	}
+	res.Value = value
+	return &Item{e: res}
+}
+
+func (iter *DBIterator) Item() utils.Item {
+	if iter.item == nil {
+		return nil
+	}
+	return iter.item
 }
 func (iter *DBIterator) Close() error {
-	return iter.iitr.Close()
+	err := iter.iitr.Close()
+	if iter.ownTxn {
+		iter.txn.Discard()
+	}
+	return err
 }
+
+// Seek 定位到第一个 >= key 的可见key，key 会被限制在 LowerBound 和 Prefix 的范围内
 func (iter *DBIterator) Seek(key []byte) {
+	defer iter.txn.db.metrics.IteratorSeekLatency.Since(time.Now())
+	if len(iter.prefix) > 0 {
+		key = append(append([]byte{}, iter.prefix...), key...)
+	}
+	if start := iter.opt.SeekStart(); bytes.Compare(key, start) < 0 {
+		key = start
+	}
+	iter.lastKey = iter.lastKey[:0]
+	iter.iitr.Seek(utils.KeyWithTs(key, iter.txn.readTs))
+	iter.findValid()
 }
@@ -0,0 +1,144 @@
+package jkv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func collectKeys(iter utils.Iterator) []string {
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Item().Entry().Key))
+	}
+	return keys
+}
+
+func TestIteratorSeekAndBounds(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	// 写入足够多的数据，保证一部分数据已经刷到sst中
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("%s%03d", prefix, i)
+			require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte("v-"+key))))
+		}
+	}
+	// 覆盖写和删除，迭代器只能看到最新的版本
+	require.NoError(t, db.Set(utils.NewEntry([]byte("b010"), []byte("new"))))
+	require.NoError(t, db.Del([]byte("b011")))
+
+	iter := db.NewIterator(&utils.Options{Prefix: []byte("b")})
+	iter.Rewind()
+	keys := collectKeys(iter)
+	require.NoError(t, iter.Close())
+	require.Len(t, keys, 49)
+	require.Equal(t, "b000", keys[0])
+	require.Equal(t, "b049", keys[48])
+	require.NotContains(t, keys, "b011")
+
+	iter = db.NewIterator(&utils.Options{})
+	iter.Seek([]byte("b010"))
+	require.True(t, iter.Valid())
+	require.Equal(t, []byte("b010"), iter.Item().Entry().Key)
+	require.Equal(t, []byte("new"), iter.Item().Entry().Value)
+	iter.Next()
+	require.Equal(t, []byte("b012"), iter.Item().Entry().Key)
+	iter.Seek([]byte("c049"))
+	require.Equal(t, []string{"c049"}, collectKeys(iter))
+	iter.Seek([]byte("d"))
+	require.False(t, iter.Valid())
+	require.NoError(t, iter.Close())
+
+	iter = db.NewIterator(&utils.Options{
+		LowerBound: []byte("a045"),
+		UpperBound: []byte("b003"),
+	})
+	iter.Rewind()
+	require.Equal(t, []string{"a045", "a046", "a047", "a048", "a049", "b000", "b001", "b002"}, collectKeys(iter))
+	// Seek 不能越过下界
+	iter.Seek([]byte("a"))
+	require.Equal(t, []byte("a045"), iter.Item().Entry().Key)
+	require.NoError(t, iter.Close())
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	require.NoError(t, db.Set(utils.NewEntry([]byte("k1"), []byte("v1"))))
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	require.NoError(t, db.Set(utils.NewEntry([]byte("k1"), []byte("v2"))))
+	require.NoError(t, db.Set(utils.NewEntry([]byte("k2"), []byte("v2"))))
+
+	iter := txn.NewIterator(&utils.Options{})
+	defer func() { _ = iter.Close() }()
+	iter.Rewind()
+	require.True(t, iter.Valid())
+	require.Equal(t, []byte("k1"), iter.Item().Entry().Key)
+	require.Equal(t, []byte("v1"), iter.Item().Entry().Value)
+	iter.Next()
+	require.False(t, iter.Valid())
+}
+
+func TestMultiVersionReads(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	key := []byte("versioned")
+	var versions []uint64
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Set(utils.NewEntry(key, []byte(fmt.Sprintf("v%d", i)))))
+		e, err := db.Get(key)
+		require.NoError(t, err)
+		versions = append(versions, e.Version)
+		// 写入其他key，让一部分版本刷到sst中
+		for j := 0; j < 20; j++ {
+			require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("other%d-%02d", i, j)), []byte("v"))))
+		}
+	}
+	require.NoError(t, db.Del(key))
+
+	for i, version := range versions {
+		e, err := db.GetAt(key, version)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("v%d", i)), e.Value)
+		require.Equal(t, version, e.Version)
+	}
+	_, err = db.GetAt(key, versions[0]-1)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+	_, err = db.GetAt(key, versions[2]+1000)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	// AllVersions 按照从新到旧的顺序返回包括删除标记在内的所有版本
+	iter := db.NewIterator(&utils.Options{IsAsc: true, Prefix: key, AllVersions: true})
+	var entries []*utils.Entry
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		entries = append(entries, iter.Item().Entry())
+	}
+	require.NoError(t, iter.Close())
+	require.Len(t, entries, 4)
+	require.NotZero(t, entries[0].Meta&utils.BitDelete)
+	require.Greater(t, entries[0].Version, versions[2])
+	for i := 1; i < 4; i++ {
+		require.Equal(t, key, entries[i].Key)
+		require.Equal(t, versions[3-i], entries[i].Version)
+		require.Equal(t, []byte(fmt.Sprintf("v%d", 3-i)), entries[i].Value)
+	}
+
+	// 默认只返回最新的版本，被删除的key不可见
+	iter = db.NewIterator(&utils.Options{IsAsc: true, Prefix: key})
+	iter.Rewind()
+	require.False(t, iter.Valid())
+	require.NoError(t, iter.Close())
+}
@@ -8,6 +8,7 @@ import (
 	"math"
 	"os"
 	"sort"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/vvvvjvvvv/jkv/file"
@@ -26,6 +27,9 @@ type tableBuilder struct {
 	baseKey       []byte
 	staleDataSize int
 	estimateSz    int64
+	dataKey       *file.DataKey // 为nil时不加密
+	dataSize      uint32        // 已经完成的block的总大小，也就是下一个block在文件中的偏移
+	err           error         // 压缩block时的第一个错误，flush 和 SSTWriter.Finish 时返回
 }
 type buildData struct {
 	blockList []*block
@@ -113,16 +117,17 @@ func (tb *tableBuilder) add(e *utils.Entry, isStale bool) {
 	val.EncodeValue(dst)
 }
 func newTableBuilerWithSSTSize(opt *Options, size int64) *tableBuilder {
+	// 此时还不知道sst的fid，数据密钥在 flush 时才写入 KEYREGISTRY
+	dk, err := opt.KeyRegistry.GenerateDataKey()
+	utils.Panic(err)
 	return &tableBuilder{
 		opt:     opt,
 		sstSize: size,
+		dataKey: dk,
 	}
 }
 func newTableBuiler(opt *Options) *tableBuilder {
-	return &tableBuilder{
-		opt:     opt,
-		sstSize: opt.SSTableMaxSz,
-	}
+	return newTableBuilerWithSSTSize(opt, opt.SSTableMaxSz)
 }
 
 // Empty returns whether it's empty.
@@ -177,16 +182,38 @@ func (tb *tableBuilder) finishBlock() {
 	if tb.curBlock == nil || len(tb.curBlock.entryOffsets) == 0 {
 		return
 	}
+	// 出错之后的block不再需要，sst不会被写入
+	if tb.err != nil {
+		tb.curBlock = nil
+		return
+	}
 	// Append the entryOffsets and its length.
 	tb.append(utils.U32SliceToBytes(tb.curBlock.entryOffsets))
 	tb.append(utils.U32ToBytes(uint32(len(tb.curBlock.entryOffsets))))
 
+	// checksum 针对压缩后的数据计算，读取时先校验再解压
+	if tb.opt.Compression != pb.CompressionType_NONE {
+		data, err := compressBlock(tb.opt.Compression, tb.opt.ZSTDCompressionLevel, tb.curBlock.data[:tb.curBlock.end])
+		if err != nil {
+			tb.err = fmt.Errorf("while compressing block: %w", err)
+			tb.curBlock = nil
+			return
+		}
+		tb.curBlock.data, tb.curBlock.end = data, len(data)
+		// 按压缩后的大小估算sst的大小
+		tb.curBlock.estimateSz = int64(len(data))
+	}
+	// 先压缩再加密，以block在文件中的偏移作为计数器的起点
+	if tb.dataKey != nil {
+		tb.curBlock.data = tb.dataKey.XOR(tb.curBlock.data[:tb.curBlock.end], tb.dataSize)
+	}
 	checksum := tb.calculateChecksum(tb.curBlock.data[:tb.curBlock.end])
 
 	// Append the block checksum and its length.
 	tb.append(checksum)
 	tb.append(utils.U32ToBytes(uint32(len(checksum))))
 	tb.estimateSz += tb.curBlock.estimateSz
+	tb.dataSize += uint32(tb.curBlock.end)
 	tb.blockList = append(tb.blockList, tb.curBlock)
 	// TODO: 预估整理builder写入磁盘后，sst文件的大小
 	tb.keyCount += uint32(len(tb.curBlock.entryOffsets))
@@ -234,21 +261,39 @@ func (tb *tableBuilder) keyDiff(newKey []byte) []byte {
 // TODO: 这里存在多次的用户空间拷贝过程，需要优化
 func (tb *tableBuilder) flush(lm *levelManager, tableName string) (t *table, err error) {
 	bd := tb.done()
+	if tb.err != nil {
+		return nil, tb.err
+	}
 	t = &table{lm: lm, fid: utils.FID(tableName)}
+	// 数据密钥需要在sst写入之前持久化，否则崩溃后无法读取这个sst
+	if err = lm.opt.KeyRegistry.AddDataKey(utils.FileKindSST, t.fid, tb.dataKey); err != nil {
+		return nil, err
+	}
 	// 如果没有builder 则创打开一个已经存在的sst文件
-	t.ss = file.OpenSStable(&file.Options{
+	if t.ss, err = file.OpenSStable(&file.Options{
+		FID:      t.fid,
 		FileName: tableName,
 		Dir:      lm.opt.WorkDir,
 		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(bd.size)})
+		MaxSz:    int(bd.size),
+		DataKey:  tb.dataKey,
+		InMemory: lm.opt.InMemory,
+		FS:       lm.opt.FS}); err != nil {
+		return nil, err
+	}
 	buf := make([]byte, bd.size)
 	written := bd.Copy(buf)
 	utils.CondPanic(written != len(buf), fmt.Errorf("tableBuilder.flush written != len(buf)"))
-	dst, err := t.ss.Bytes(0, bd.size)
-	if err != nil {
+	if err = t.ss.WriteAt(buf, 0); err != nil {
+		_ = t.ss.Close()
+		return nil, err
+	}
+	// manifest 记录这个sst之前数据必须落盘，否则掉电之后 manifest 引用的是一个不完整的文件
+	if err = t.ss.Sync(); err != nil {
+		_ = t.ss.Close()
 		return nil, err
 	}
-	copy(dst, buf)
+	atomic.AddUint64(&lm.lsm.stats.bytesWritten, uint64(bd.size))
 	return t, nil
 }
 
@@ -281,6 +326,8 @@ func (tb *tableBuilder) done() buildData {
 	}
 	// TODO 构建 sst的索引
 	index, dataSize := tb.buildIndex(f)
+	// index 紧跟在所有block之后
+	index = tb.dataKey.XOR(index, dataSize)
 	checksum := tb.calculateChecksum(index)
 	bd.index = index
 	bd.checksum = checksum
@@ -295,6 +342,7 @@ func (tb *tableBuilder) buildIndex(bloom []byte) ([]byte, uint32) {
 	}
 	tableIndex.KeyCount = tb.keyCount
 	tableIndex.MaxVersion = tb.maxVersion
+	tableIndex.Compression = tb.opt.Compression
 	tableIndex.Offsets = tb.writeBlockOffsets(tableIndex)
 	var dataSize uint32
 	for i := range tb.blockList {
@@ -441,6 +489,7 @@ func (itr *blockIterator) setIdx(i int) {
 	e.Value = val.Value
 	e.ExpiresAt = val.ExpiresAt
 	e.Meta = val.Meta
+	e.Version = utils.ParseTs(itr.key)
 	itr.it = &Item{e: e}
 }
 
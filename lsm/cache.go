@@ -1,11 +1,12 @@
 package lsm
 
 import (
+	"github.com/vvvvjvvvv/jkv/pb"
 	coreCache "github.com/vvvvjvvvv/jkv/utils/cache"
 )
 
 type cache struct {
-	indexs *coreCache.Cache // key fid, value table
+	indexs *coreCache.Cache // key fid, value *pb.TableIndex
 	blocks *coreCache.Cache // key fid_blockOffset, value block []byte
 }
 
@@ -29,6 +30,6 @@ func newCache(opt *Options) *cache {
 }
 
 // TODO fid 使用字符串是不是会有性能损耗
-func (c *cache) addIndex(fid uint32, t *table) {
-	c.indexs.Set(fid, t)
+func (c *cache) addIndex(fid uint64, index *pb.TableIndex) {
+	c.indexs.Set(fid, index)
 }
@@ -0,0 +1,37 @@
+package lsm
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// Checkpoint 把内存表刷盘后，将所有存活的sst硬链接到 dir，并写入只包含这些sst的 MANIFEST
+// 启用加密时还会写入 KEYREGISTRY 的副本，调用方需要保证在此期间没有写入，并且其他数据文件不会被删除
+func (lsm *LSM) Checkpoint(dir string) error {
+	lm := lsm.levels
+	// 暂停所有列族的压缩，保证链接的sst与 MANIFEST 一致，并且不会在链接之前被删除
+	defer lsm.pauseCompactions()()
+
+	if err := lsm.flushMemTables(); err != nil {
+		return err
+	}
+	for _, clm := range lsm.levelManagers() {
+		for _, lh := range clm.levels {
+			lh.RLock()
+			tables := lh.tables
+			lh.RUnlock()
+			for _, t := range tables {
+				src := utils.FileNameSSTable(lm.opt.WorkDir, t.fid)
+				if err := lm.opt.fs().Link(src, utils.FileNameSSTable(dir, t.fid)); err != nil {
+					return errors.Wrapf(err, "while linking table %d", t.fid)
+				}
+			}
+		}
+	}
+	// 压缩暂停期间数据密钥与链接的sst一致
+	if err := lm.opt.KeyRegistry.Checkpoint(dir); err != nil {
+		return err
+	}
+	// 最后写入 MANIFEST，没有 MANIFEST 的目录说明 checkpoint 没有完成
+	return lm.manifestFile.Checkpoint(dir)
+}
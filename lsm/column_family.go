@@ -0,0 +1,244 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// columnFamilyKeyPrefix 列族的key在共享的 wal 和 vlog 中使用的前缀，后面是列族的名称和 '/'
+var columnFamilyKeyPrefix = append(append([]byte{}, InternalKeyPrefix...), "cf/"...)
+
+// columnFamily 列族拥有独立的跳表和 levelManager，与默认列族共享 wal、manifest 和 fid
+// 列族的跳表保存在每个 memTable 中，memTable 写满时所有列族一起刷盘，之后才能删除 wal
+type columnFamily struct {
+	name   string
+	prefix []byte
+	levels *levelManager
+}
+
+// ColumnFamilyPrefix 返回列族 name 中的key在LSM中的前缀，默认列族没有前缀
+func ColumnFamilyPrefix(name string) []byte {
+	if name == "" {
+		return nil
+	}
+	prefix := append([]byte{}, columnFamilyKeyPrefix...)
+	prefix = append(prefix, name...)
+	return append(prefix, '/')
+}
+
+// keyPrefixes 返回 prefixes 在列族中对应的key前缀
+func (cf *columnFamily) keyPrefixes(prefixes [][]byte) [][]byte {
+	res := make([][]byte, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		res = append(res, append(append([]byte{}, cf.prefix...), prefix...))
+	}
+	return res
+}
+
+// ColumnFamilyName 返回带有列族前缀的key所属列族的名称，默认列族的key返回 false
+func ColumnFamilyName(key []byte) (string, bool) {
+	if !bytes.HasPrefix(key, columnFamilyKeyPrefix) {
+		return "", false
+	}
+	rest := key[len(columnFamilyKeyPrefix):]
+	i := bytes.IndexByte(rest, '/')
+	if i <= 0 {
+		return "", false
+	}
+	return string(rest[:i]), true
+}
+
+// ValidateColumnFamilyName 列族名称不能为空，也不能包含 '/'，否则一个列族的前缀可能是另一个列族的前缀
+func ValidateColumnFamilyName(name string) error {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return errors.Wrapf(utils.ErrInvalidColumnFamily, "name %q", name)
+	}
+	return nil
+}
+
+// columnFamilyOptions 返回列族使用的配置
+// wal、vlog、manifest 相关的配置以及 MergeOperator、DiscardTs 总是与默认列族相同
+// 其余为零值的字段使用默认列族的配置，CompactionFilter 和 TTL 只对设置它们的列族生效
+func (opt *Options) columnFamilyOptions(cf *Options) *Options {
+	o := *cf
+	o.WorkDir = opt.WorkDir
+	o.MemTableSize = opt.MemTableSize
+	o.DiscardStatsCh = opt.DiscardStatsCh
+	o.MergeOperator = opt.MergeOperator
+	o.DiscardTs = opt.DiscardTs
+	o.Metrics = opt.Metrics
+	o.KeyRegistry = opt.KeyRegistry
+	o.ReadOnly = opt.ReadOnly
+	o.InMemory = opt.InMemory
+	o.FS = opt.FS
+	o.ColumnFamilies = nil
+	inheritInt64 := func(v *int64, parent int64) {
+		if *v == 0 {
+			*v = parent
+		}
+	}
+	inheritInt := func(v *int, parent int) {
+		if *v == 0 {
+			*v = parent
+		}
+	}
+	inheritInt64(&o.SSTableMaxSz, opt.SSTableMaxSz)
+	inheritInt64(&o.BaseLevelSize, opt.BaseLevelSize)
+	inheritInt64(&o.BaseTableSize, opt.BaseTableSize)
+	inheritInt(&o.BlockSize, opt.BlockSize)
+	inheritInt(&o.ZSTDCompressionLevel, opt.ZSTDCompressionLevel)
+	inheritInt(&o.NumCompactors, opt.NumCompactors)
+	inheritInt(&o.LevelSizeMultiplier, opt.LevelSizeMultiplier)
+	inheritInt(&o.TableSizeMultiplier, opt.TableSizeMultiplier)
+	inheritInt(&o.NumLevelZeroTables, opt.NumLevelZeroTables)
+	inheritInt(&o.MaxLevelNum, opt.MaxLevelNum)
+	inheritInt(&o.NumVersionsToKeep, opt.NumVersionsToKeep)
+	if o.BloomFalsePositive == 0 {
+		o.BloomFalsePositive = opt.BloomFalsePositive
+	}
+	if o.Compression == 0 {
+		o.Compression = opt.Compression
+	}
+	return &o
+}
+
+// initColumnFamilies 加载所有列族的sst，需要在默认列族的 levelManager 初始化之后、恢复 wal 之前调用
+// 失败时关闭已经加载的列族
+func (lsm *LSM) initColumnFamilies() (err error) {
+	defer func() {
+		if err != nil {
+			for _, cf := range lsm.families {
+				_ = cf.levels.close()
+			}
+			lsm.families = nil
+		}
+	}()
+	// manifest 中记录的列族必须全部配置，否则这些数据无法读取，写入也会被当作默认列族的数据
+	for fid, tm := range lsm.levels.manifestFile.GetManifest().Tables {
+		if _, ok := lsm.option.ColumnFamilies[tm.ColumnFamily]; tm.ColumnFamily != "" && !ok {
+			return errors.Wrapf(utils.ErrColumnFamilyNotFound,
+				"table %d belongs to column family %q", fid, tm.ColumnFamily)
+		}
+	}
+	for name, cfOpt := range lsm.option.ColumnFamilies {
+		if err := ValidateColumnFamilyName(name); err != nil {
+			return err
+		}
+		lm, err := lsm.initColumnFamilyLevels(name, lsm.option.columnFamilyOptions(cfOpt))
+		if err != nil {
+			return err
+		}
+		lsm.families = append(lsm.families, &columnFamily{name: name, prefix: lm.prefix, levels: lm})
+	}
+	return nil
+}
+
+// initColumnFamilyLevels 创建列族的 levelManager，与默认列族共用 manifest
+func (lsm *LSM) initColumnFamilyLevels(name string, opt *Options) (*levelManager, error) {
+	lm := &levelManager{
+		lsm:          lsm,
+		opt:          opt,
+		cf:           name,
+		prefix:       ColumnFamilyPrefix(name),
+		manifestFile: lsm.levels.manifestFile,
+		compactState: newCompactStatus(opt.MaxLevelNum),
+	}
+	if err := lm.build(); err != nil {
+		_ = lm.close()
+		return nil, err
+	}
+	return lm, nil
+}
+
+// columnFamily 返回key所属的列族，默认列族返回nil，key 可以带有版本号
+func (lsm *LSM) columnFamily(key []byte) (int, *columnFamily) {
+	if len(lsm.families) == 0 || !bytes.HasPrefix(key, columnFamilyKeyPrefix) {
+		return -1, nil
+	}
+	for i, cf := range lsm.families {
+		if bytes.HasPrefix(key, cf.prefix) {
+			return i, cf
+		}
+	}
+	return -1, nil
+}
+
+func (lsm *LSM) columnFamilyByName(name string) *columnFamily {
+	for _, cf := range lsm.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// levelManagers 返回默认列族和所有列族的 levelManager
+func (lsm *LSM) levelManagers() []*levelManager {
+	lms := []*levelManager{lsm.levels}
+	for _, cf := range lsm.families {
+		lms = append(lms, cf.levels)
+	}
+	return lms
+}
+
+// levelsOf 返回key所属列族的 levelManager
+func (lsm *LSM) levelsOf(key []byte) *levelManager {
+	if _, cf := lsm.columnFamily(key); cf != nil {
+		return cf.levels
+	}
+	return lsm.levels
+}
+
+// pauseCompactions 暂停所有列族的压缩，返回恢复压缩的函数
+func (lsm *LSM) pauseCompactions() func() {
+	lms := lsm.levelManagers()
+	for _, lm := range lms {
+		lm.compactLock.Lock()
+	}
+	return func() {
+		for _, lm := range lms {
+			lm.compactLock.Unlock()
+		}
+	}
+}
+
+// ColumnFamilyOf 返回key所属列族的名称，默认列族返回空字符串
+func (lsm *LSM) ColumnFamilyOf(key []byte) string {
+	if _, cf := lsm.columnFamily(key); cf != nil {
+		return cf.name
+	}
+	return ""
+}
+
+// HasColumnFamily 判断是否配置了名称为 name 的列族，空字符串表示默认列族
+func (lsm *LSM) HasColumnFamily(name string) bool {
+	return name == "" || lsm.columnFamilyByName(name) != nil
+}
+
+// TTL 返回key所属列族的 TTL，为0表示不过期
+func (lsm *LSM) TTL(key []byte) time.Duration {
+	return lsm.levelsOf(key).opt.TTL
+}
+
+// NewColumnFamilyIterators 与 NewIterators 相同，但是只返回列族 name 的迭代器，name 为空表示默认列族
+func (lsm *LSM) NewColumnFamilyIterators(name string, opt *utils.Options) ([]utils.Iterator, error) {
+	if name == "" {
+		return lsm.NewIterators(opt), nil
+	}
+	for i, cf := range lsm.families {
+		if cf.name != name {
+			continue
+		}
+		iters := []utils.Iterator{lsm.memTable.newIterator(lsm.memTable.cfs[i])}
+		for j := len(lsm.immutables) - 1; j >= 0; j-- {
+			iters = append(iters, lsm.immutables[j].newIterator(lsm.immutables[j].cfs[i]))
+		}
+		return append(iters, cf.levels.iterators(opt)...), nil
+	}
+	return nil, errors.Wrap(utils.ErrColumnFamilyNotFound, fmt.Sprintf("column family %q", name))
+}
@@ -90,6 +90,8 @@ func (lm *levelManager) runCompacter(id int) {
 
 // runOnce
 func (lm *levelManager) runOnce(id int) bool {
+	lm.compactLock.RLock()
+	defer lm.compactLock.RUnlock()
 	prios := lm.pickCompactLevels()
 	if id == 0 {
 		// 0号协程 总是倾向于压缩0层
@@ -424,6 +426,10 @@ func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (err error) {
 		return err
 	}
 
+	atomic.AddUint64(&lm.lsm.stats.numCompactions, 1)
+	lm.opt.Metrics.Compactions.Inc()
+	lm.opt.Metrics.CompactionLatency.Since(timeStart)
+
 	from := append(tablesToString(cd.top), tablesToString(cd.bot)...)
 	to := tablesToString(newTables)
 	if dur := time.Since(timeStart); dur > 2*time.Second {
@@ -454,7 +460,7 @@ func tablesToString(tables []*table) []string {
 func buildChangeSet(cd *compactDef, newTables []*table) pb.ManifestChangeSet {
 	changes := []*pb.ManifestChange{}
 	for _, table := range newTables {
-		changes = append(changes, newCreateChange(table.fid, cd.nextLevel.levelNum))
+		changes = append(changes, cd.nextLevel.lm.newCreateChange(table.fid, cd.nextLevel.levelNum))
 	}
 	for _, table := range cd.top {
 		changes = append(changes, newDeleteChange(table.fid))
@@ -472,12 +478,13 @@ func newDeleteChange(id uint64) *pb.ManifestChange {
 	}
 }
 
-// newCreateChange
-func newCreateChange(id uint64, level int) *pb.ManifestChange {
+// newCreateChange 记录sst所属的列族
+func (lm *levelManager) newCreateChange(id uint64, level int) *pb.ManifestChange {
 	return &pb.ManifestChange{
-		Id:    id,
-		Op:    pb.ManifestChange_CREATE,
-		Level: uint32(level),
+		Id:           id,
+		Op:           pb.ManifestChange_CREATE,
+		Level:        uint32(level),
+		ColumnFamily: lm.cf,
 	}
 }
 
@@ -536,9 +543,9 @@ func (lm *levelManager) compactBuildTables(lev int, cd compactDef) ([]*table, fu
 	// 等待所有的builder刷到磁盘
 	wg.Wait()
 
-	if err == nil {
+	if err == nil && !lm.opt.InMemory {
 		// 同步刷盘，保证数据一定落盘
-		err = utils.SyncDir(lm.opt.WorkDir)
+		err = lm.opt.fs().Sync(lm.opt.WorkDir)
 	}
 
 	if err != nil {
@@ -837,6 +844,15 @@ func (lm *levelManager) updateDiscardStats(discardStats map[uint32]int64) {
 	}
 }
 
+// addDiscardStats 如果e是值指针，将其在vlog中占用的空间计入 discardStats
+func addDiscardStats(discardStats map[uint32]int64, e *utils.Entry) {
+	if e.Meta&utils.BitValuePointer > 0 {
+		var vp utils.ValuePtr
+		vp.Decode(e.Value)
+		discardStats[vp.Fid] += int64(vp.Len)
+	}
+}
+
 // 真正执行并行压缩的子压缩文件
 func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef,
 	inflightBuilders *utils.Throttle, res chan<- *table) {
@@ -847,19 +863,84 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 		lm.updateDiscardStats(discardStats)
 	}()
 	updateStats := func(e *utils.Entry) {
-		if e.Meta&utils.BitValuePointer > 0 {
-			var vp utils.ValuePtr
-			vp.Decode(e.Value)
-			discardStats[vp.Fid] += int64(vp.Len)
+		addDiscardStats(discardStats, e)
+	}
+	addEntry := func(builder *tableBuilder, e *utils.Entry) {
+		// TODO 这里要区分值的指针
+		// 判断是否是过期内容，是的话就删除
+		if IsDeletedOrExpired(e) {
+			updateStats(e)
+			builder.AddStaleKey(e)
+			return
+		}
+		ne, dropped := lm.applyCompactionFilter(cd.nextLevel.levelNum, e)
+		if !dropped {
+			builder.AddKey(e)
+			return
+		}
+		// 原来的值已经不再被引用
+		updateStats(e)
+		if IsDeletedOrExpired(ne) {
+			builder.AddStaleKey(ne)
+		} else {
+			builder.AddKey(ne)
+		}
+	}
+	// discardTs 及之前的版本中，每个key只有最新的 NumVersionsToKeep 个版本还可能被读取
+	// 遇到删除标记之后更早的版本对所有读事务都不可见，也可以直接丢弃
+	discardTs := lm.discardTs()
+	var (
+		numVersions int
+		skipKey     bool
+	)
+	countVersion := func(e *utils.Entry) {
+		// 没有合并的操作数还需要更早的版本才能读出完整的值
+		if utils.ParseTs(e.Key) > discardTs || e.Meta&utils.BitMergeOperand > 0 {
+			return
+		}
+		numVersions++
+		if IsDeletedOrExpired(e) || numVersions >= lm.opt.NumVersionsToKeep {
+			skipKey = true
+		}
+	}
+	// 一个key最新的若干个版本是合并操作数时，找到更早的完整值之后把它们合并为一个完整的值
+	// 合并后的值使用最新的操作数的版本号，更早的版本仍然保留给旧的快照读取
+	var run *mergeRun
+	// finishRun base 为操作数之前的版本，为nil表示压缩的数据中没有更早的版本
+	finishRun := func(builder *tableBuilder, base *utils.Entry) {
+		if run == nil {
+			return
+		}
+		var e *utils.Entry
+		switch {
+		case base == nil && cd.nextLevel.isLastLevel(), base != nil && IsDeletedOrExpired(base):
+			e = run.collapse(lm.opt.MergeOperator, nil, true)
+		case base != nil && !utils.IsValuePtr(base):
+			e = run.collapse(lm.opt.MergeOperator, base.Value, true)
+		}
+		if e == nil {
+			// 更早的值在vlog中或者在更低的层中，LSM无法合并，保留原来的操作数
+			for _, op := range run.entries {
+				builder.AddKey(op)
+			}
+		} else {
+			addEntry(builder, e)
+			for _, op := range run.entries[1:] {
+				builder.AddStaleKey(op)
+			}
+			// 合并后是一个完整的值，可以计入保留的版本数
+			countVersion(e)
 		}
+		run = nil
 	}
 	addKeys := func(builder *tableBuilder) {
 		var tableKr keyRange
+		defer finishRun(builder, nil)
 		for ; it.Valid(); it.Next() {
 			key := it.Item().Entry().Key
 			//version := utils.ParseTs(key)
-			isExpired := IsDeletedOrExpired(it.Item().Entry())
-			if !utils.SameKey(key, lastKey) {
+			isNewKey := !utils.SameKey(key, lastKey)
+			if isNewKey {
 				// 如果迭代器返回的key大于当前key的范围就不用执行了
 				if len(kr.right) > 0 && utils.CompareKeys(key, kr.right) >= 0 {
 					break
@@ -868,6 +949,8 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 					// 如果超过预估的sst文件大小，则直接结束
 					break
 				}
+				finishRun(builder, nil)
+				numVersions, skipKey = 0, false
 				// 把当前的key变为 lastKey
 				lastKey = utils.SafeCopy(lastKey, key)
 				//umVersions = 0
@@ -878,15 +961,31 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 				// 更新右边界
 				tableKr.right = lastKey
 			}
-			// TODO 这里要区分值的指针
-			// 判断是否是过期内容，是的话就删除
-			switch {
-			case isExpired:
-				updateStats(it.Item().Entry())
-				builder.AddStaleKey(it.Item().Entry())
-			default:
-				builder.AddKey(it.Item().Entry())
+			e := it.Item().Entry()
+			if skipKey {
+				// 更新的版本已经满足所有的读事务，这个版本不会再被读取
+				updateStats(e)
+				continue
+			}
+			if lm.opt.MergeOperator != nil && e.Meta&utils.BitMergeOperand > 0 && (isNewKey || run != nil) {
+				if run == nil {
+					run = &mergeRun{}
+				}
+				run.add(e)
+				continue
 			}
+			finishRun(builder, e)
+			if skipKey {
+				updateStats(e)
+				continue
+			}
+			countVersion(e)
+			if skipKey && IsDeletedOrExpired(e) && cd.nextLevel.isLastLevel() {
+				// 最后一层之下没有更早的版本，删除标记本身也不再需要
+				updateStats(e)
+				continue
+			}
+			addEntry(builder, e)
 		}
 	} // End of function: addKeys
 
@@ -923,14 +1022,14 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 		}
 		// 充分发挥 ssd的并行 写入特性
 		go func(builder *tableBuilder) {
-			defer inflightBuilders.Done(nil)
+			var err error
+			defer func() { inflightBuilders.Done(err) }()
 			defer builder.Close()
 			var tbl *table
-			newFID := atomic.AddUint64(&lm.maxFID, 1) // compact的时候是没有memtable的，这里自增maxFID即可。
+			newFID := lm.nextFID() // compact的时候是没有memtable的，这里自增maxFID即可。
 			// TODO 这里的sst文件需要根据level大小变化
 			sstName := utils.FileNameSSTable(lm.opt.WorkDir, newFID)
-			tbl = openTable(lm, sstName, builder)
-			if tbl == nil {
+			if tbl, err = openTable(lm, sstName, builder); err != nil {
 				return
 			}
 			res <- tbl
@@ -938,9 +1037,17 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 	}
 }
 
+// discardTs 返回压缩时可以清理旧版本的时间戳，不需要清理时返回0
+func (lm *levelManager) discardTs() uint64 {
+	if lm.opt.DiscardTs == nil || lm.opt.NumVersionsToKeep <= 0 {
+		return 0
+	}
+	return lm.opt.DiscardTs()
+}
+
 // 判断是否过期 是可删除
 func IsDeletedOrExpired(e *utils.Entry) bool {
-	if e.Value == nil {
+	if e.Value == nil || e.Meta&utils.BitDelete > 0 {
 		return true
 	}
 	if e.ExpiresAt == 0 {
@@ -957,12 +1064,12 @@ type compactStatus struct {
 	tables map[uint64]struct{}	// 记录处于压缩状态的tables
 }
 
-func (lsm *LSM) newCompactStatus() *compactStatus {
+func newCompactStatus(maxLevelNum int) *compactStatus {
 	cs := &compactStatus{
 		levels: make([]*levelCompactStatus, 0),
 		tables: make(map[uint64]struct{}),
 	}
-	for i := 0; i < lsm.option.MaxLevelNum; i++ {
+	for i := 0; i < maxLevelNum; i++ {
 		cs.levels = append(cs.levels, &levelCompactStatus{})
 	}
 	return cs
@@ -0,0 +1,69 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestNumVersionsToKeep(t *testing.T) {
+	clearDir()
+	c := make(chan map[uint32]int64, 16)
+	o := *opt
+	o.DiscardStatsCh = &c
+	o.NumVersionsToKeep = 2
+	o.DiscardTs = func() uint64 { return 10 }
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer func() { _ = lsm.Close() }()
+
+	set := func(key string, ts uint64, meta byte) {
+		e := utils.NewEntry(utils.KeyWithTs([]byte(key), ts), []byte(fmt.Sprintf("%s@%d", key, ts)))
+		if meta&utils.BitDelete > 0 {
+			e.Value = nil
+		}
+		e.Meta = meta
+		require.NoError(t, lsm.Set(e))
+	}
+	for i := 0; i < 50; i++ {
+		// discardTs 之前有多个版本的key、discardTs 之后的版本、以及在 discardTs 之前被删除的key
+		old, recent, deleted := fmt.Sprintf("old%03d", i), fmt.Sprintf("recent%03d", i), fmt.Sprintf("deleted%03d", i)
+		for ts := uint64(1); ts <= 5; ts++ {
+			set(old, ts, 0)
+		}
+		for ts := uint64(9); ts <= 13; ts++ {
+			set(recent, ts, 0)
+		}
+		set(deleted, 1, 0)
+		set(deleted, 2, 0)
+		set(deleted, 3, utils.BitDelete)
+	}
+	require.NoError(t, lsm.flushMemTables())
+	for lsm.levels.levels[0].numTables() > 0 {
+		cd := buildCompactDef(lsm, 0, 0, 6)
+		require.True(t, lsm.levels.fillTables(cd))
+		require.NoError(t, lsm.levels.runCompactDef(0, 0, *cd))
+		lsm.levels.compactState.delete(*cd)
+	}
+
+	versions := make(map[string][]uint64)
+	iter := NewMergeIterator(lsm.NewIterators(&utils.Options{IsAsc: true}), false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(utils.ParseKey(iter.Item().Entry().Key))
+		versions[key] = append(versions[key], utils.ParseTs(iter.Item().Entry().Key))
+	}
+	require.NoError(t, iter.Close())
+	for i := 0; i < 50; i++ {
+		// discardTs 之前只保留最新的两个版本，之后的版本全部保留
+		require.Equal(t, []uint64{5, 4}, versions[fmt.Sprintf("old%03d", i)])
+		require.Equal(t, []uint64{13, 12, 11, 10, 9}, versions[fmt.Sprintf("recent%03d", i)])
+		// 最后一层的删除标记和更早的版本全部清理
+		require.NotContains(t, versions, fmt.Sprintf("deleted%03d", i))
+
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("old%03d", i)), 4))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("old%03d@4", i)), e.Value)
+	}
+}
@@ -0,0 +1,68 @@
+package lsm
+
+import (
+	"bytes"
+
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// CompactionFilterDecision 压缩过滤器对一个key的处理结果
+type CompactionFilterDecision int
+
+const (
+	// CompactionFilterKeep 保留原来的数据
+	CompactionFilterKeep CompactionFilterDecision = iota
+	// CompactionFilterRemove 删除这个版本，压缩后会写入一个相同版本号的删除标记，保证更低层的旧版本不会重新可见
+	CompactionFilterRemove
+	// CompactionFilterChangeValue 使用返回的新值替换原来的值，新值直接存储在sst中
+	CompactionFilterChangeValue
+)
+
+// CompactionFilter 在压缩时对每个key调用，用于按照业务规则清理或者改写数据，例如删除已经注销的租户、迁移数据格式
+// 已经删除或者过期的key以及内部使用的key不会传给过滤器，列族的过滤器收到的是不带列族前缀的key
+// 多个压缩协程会并发调用同一个过滤器，实现需要是并发安全的
+type CompactionFilter interface {
+	// Filter 中 level 为压缩输出的层，e.Key 为不带版本号的key，版本号在 e.Version 中
+	// e.Meta 带有 utils.BitValuePointer 时 e.Value 是编码后的vlog值指针，而不是真实的值
+	// e 只在调用期间有效，返回的新值在 decision 为 CompactionFilterChangeValue 时才会使用
+	Filter(level int, e *utils.Entry) (decision CompactionFilterDecision, newValue []byte)
+}
+
+// InternalKeyPrefix jkv 内部使用的key的前缀，这类key迭代时对外不可见，也不会交给压缩过滤器
+var InternalKeyPrefix = []byte("!jvvvv!")
+
+// applyCompactionFilter 对 e 执行压缩过滤器，返回写入sst的entry，以及原来的数据是否已经被丢弃
+func (lm *levelManager) applyCompactionFilter(level int, e *utils.Entry) (*utils.Entry, bool) {
+	filter := lm.opt.CompactionFilter
+	if filter == nil || IsDeletedOrExpired(e) {
+		return e, false
+	}
+	// 列族中的key去掉列族的前缀之后再交给过滤器
+	key := bytes.TrimPrefix(utils.ParseKey(e.Key), lm.prefix)
+	if bytes.HasPrefix(key, InternalKeyPrefix) {
+		return e, false
+	}
+	decision, newValue := filter.Filter(level, &utils.Entry{
+		Key:       key,
+		Value:     e.Value,
+		Meta:      e.Meta,
+		ExpiresAt: e.ExpiresAt,
+		Version:   utils.ParseTs(e.Key),
+	})
+	switch decision {
+	case CompactionFilterRemove:
+		return &utils.Entry{Key: e.Key, Meta: utils.BitDelete}, true
+	case CompactionFilterChangeValue:
+		// value 为nil的entry会被当作删除
+		if newValue == nil {
+			newValue = []byte{}
+		}
+		return &utils.Entry{
+			Key:       e.Key,
+			Value:     newValue,
+			Meta:      e.Meta &^ utils.BitValuePointer,
+			ExpiresAt: e.ExpiresAt,
+		}, true
+	}
+	return e, false
+}
@@ -0,0 +1,77 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// tenantFilter 删除 tenant1 的数据，并把 v1 格式的值迁移为 v2
+type tenantFilter struct{}
+
+func (tenantFilter) Filter(level int, e *utils.Entry) (CompactionFilterDecision, []byte) {
+	switch {
+	case bytes.HasPrefix(e.Key, []byte("tenant1/")):
+		return CompactionFilterRemove, nil
+	case bytes.HasPrefix(e.Value, []byte("v1:")):
+		return CompactionFilterChangeValue, append([]byte("v2:"), e.Value[3:]...)
+	}
+	return CompactionFilterKeep, nil
+}
+
+func TestCompactionFilter(t *testing.T) {
+	clearDir()
+	c := make(chan map[uint32]int64, 16)
+	o := *opt
+	o.DiscardStatsCh = &c
+	o.CompactionFilter = tenantFilter{}
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer func() { _ = lsm.Close() }()
+
+	for i := 0; i < 50; i++ {
+		for _, tenant := range []string{"tenant1", "tenant2"} {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("%s/key%03d", tenant, i)), 1)
+			require.NoError(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("v1:%03d", i)))))
+		}
+	}
+	// 被删除的值指针需要计入 discard stats
+	vp := &utils.ValuePtr{Fid: 7, Len: 100, Offset: 10}
+	require.NoError(t, lsm.Set(&utils.Entry{
+		Key:   utils.KeyWithTs([]byte("tenant1/vptr"), 1),
+		Value: vp.Encode(),
+		Meta:  utils.BitValuePointer,
+	}))
+	// 内部使用的key不会传给过滤器
+	internal := utils.KeyWithTs([]byte(string(InternalKeyPrefix)+"tenant1/"), 1)
+	require.NoError(t, lsm.Set(utils.NewEntry(internal, []byte("v1:internal"))))
+	require.NoError(t, lsm.flushMemTables())
+	// L0 中key范围不重叠的sst需要分多次压缩
+	for lsm.levels.levels[0].numTables() > 0 {
+		cd := buildCompactDef(lsm, 0, 0, 6)
+		require.True(t, lsm.levels.fillTables(cd))
+		require.NoError(t, lsm.levels.runCompactDef(0, 0, *cd))
+		lsm.levels.compactState.delete(*cd)
+	}
+
+	for i := 0; i < 50; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("tenant1/key%03d", i)), 1))
+		require.NoError(t, err)
+		require.True(t, IsDeletedOrExpired(e))
+		e, err = lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("tenant2/key%03d", i)), 1))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("v2:%03d", i)), e.Value)
+	}
+	e, err := lsm.Get(internal)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1:internal"), e.Value)
+
+	var discarded int64
+	for len(c) > 0 {
+		discarded += (<-c)[vp.Fid]
+	}
+	require.Equal(t, int64(vp.Len), discarded)
+}
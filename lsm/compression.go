@@ -0,0 +1,73 @@
+package lsm
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/pb"
+)
+
+// zstd 的编码器和解码器创建的开销较大，EncodeAll/DecodeAll 可以并发调用，按压缩级别复用
+var (
+	zstdEncoders sync.Map // int -> *zstd.Encoder
+	zstdDecoder  struct {
+		once sync.Once
+		dec  *zstd.Decoder
+		err  error
+	}
+)
+
+func zstdEncoder(level int) (*zstd.Encoder, error) {
+	if enc, ok := zstdEncoders.Load(level); ok {
+		return enc.(*zstd.Encoder), nil
+	}
+	// 0 表示使用默认级别
+	encLevel := zstd.SpeedDefault
+	if level != 0 {
+		encLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encLevel))
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := zstdEncoders.LoadOrStore(level, enc)
+	return actual.(*zstd.Encoder), nil
+}
+
+// compressBlock 使用 ct 压缩block的数据，level 只对 zstd 有效
+func compressBlock(ct pb.CompressionType, level int, data []byte) ([]byte, error) {
+	switch ct {
+	case pb.CompressionType_NONE:
+		return data, nil
+	case pb.CompressionType_SNAPPY:
+		return snappy.Encode(nil, data), nil
+	case pb.CompressionType_ZSTD:
+		enc, err := zstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	}
+	return nil, errors.Errorf("unsupported compression type %s", ct)
+}
+
+// decompressBlock 解压 compressBlock 压缩的数据
+func decompressBlock(ct pb.CompressionType, data []byte) ([]byte, error) {
+	switch ct {
+	case pb.CompressionType_NONE:
+		return data, nil
+	case pb.CompressionType_SNAPPY:
+		return snappy.Decode(nil, data)
+	case pb.CompressionType_ZSTD:
+		zstdDecoder.once.Do(func() {
+			zstdDecoder.dec, zstdDecoder.err = zstd.NewReader(nil)
+		})
+		if zstdDecoder.err != nil {
+			return nil, zstdDecoder.err
+		}
+		return zstdDecoder.dec.DecodeAll(data, nil)
+	}
+	return nil, errors.Errorf("unsupported compression type %s", ct)
+}
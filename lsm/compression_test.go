@@ -0,0 +1,66 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestCompression(t *testing.T) {
+	clearDir()
+	c := make(chan map[uint32]int64, 16)
+	o := *opt
+	o.DiscardStatsCh = &c
+	o.MemTableSize = 64 << 10
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("val%03d", i)), 16)
+	}
+	// 依次使用不同的压缩算法写入，之前生成的sst需要保持可读
+	codecs := []pb.CompressionType{pb.CompressionType_NONE, pb.CompressionType_SNAPPY, pb.CompressionType_ZSTD}
+	sizes := make(map[pb.CompressionType]int64)
+	for round, ct := range codecs {
+		o.Compression = ct
+		lsm, err := NewLSM(&o)
+		require.NoError(t, err)
+		for i := round * 100; i < (round+1)*100; i++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1)
+			require.NoError(t, lsm.Set(utils.NewEntry(key, value(i))))
+		}
+		require.NoError(t, lsm.flushMemTables())
+		require.Greater(t, lsm.levels.levels[0].numTables(), round)
+
+		for _, tbl := range lsm.levels.levels[0].tables {
+			if tbl.ss.Indexs().GetCompression() == ct {
+				sizes[ct] += tbl.Size()
+			}
+		}
+		for i := 0; i < (round+1)*100; i++ {
+			e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1))
+			require.NoError(t, err)
+			require.Equal(t, value(i), e.Value)
+		}
+		require.Greater(t, sizes[ct], int64(0))
+		require.NoError(t, lsm.Close())
+	}
+	require.Less(t, sizes[pb.CompressionType_SNAPPY], sizes[pb.CompressionType_NONE])
+	require.Less(t, sizes[pb.CompressionType_ZSTD], sizes[pb.CompressionType_NONE])
+}
+
+// 压缩失败时 builder 返回错误而不是panic，也不会生成sst
+func TestCompressionError(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.Compression = pb.CompressionType(100)
+	path := filepath.Join(o.WorkDir, "bad.sst")
+	w := NewSSTWriter(path, &o)
+	require.NoError(t, w.Set(utils.NewEntry([]byte("a"), []byte("v"))))
+	require.Error(t, w.Finish())
+	_, err := os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,235 @@
+package lsm
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// DropAll 删除LSM中所有列族的全部数据，返回被删除的sst数量
+// 调用方需要保证在此期间没有写入
+func (lsm *LSM) DropAll() (int, error) {
+	// 暂停压缩，防止压缩过程中生成的新sst漏删
+	defer lsm.pauseCompactions()()
+
+	// 内存表中的数据直接丢弃，wal一并删除
+	mt, err := lsm.NewMemTable()
+	if err != nil {
+		return 0, err
+	}
+	for _, imm := range lsm.immutables {
+		if err := imm.delete(); err != nil {
+			return 0, err
+		}
+	}
+	if err := lsm.memTable.delete(); err != nil {
+		return 0, err
+	}
+	lsm.immutables = make([]*memTable, 0)
+	lsm.memTable = mt
+	lsm.updateMemStats()
+
+	var dropped int
+	for _, lm := range lsm.levelManagers() {
+		n, err := lm.dropTree()
+		dropped += n
+		if err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
+
+// DropPrefix 删除LSM所有列族中以 prefixes 中任意一个为前缀的key，列族中的前缀不包含列族自身的前缀
+// 调用方需要保证在此期间没有写入
+func (lsm *LSM) DropPrefix(prefixes [][]byte) error {
+	// 内存表刷盘时会为列族生成新的sst，因此需要暂停所有列族的压缩
+	defer lsm.pauseCompactions()()
+
+	// 当前的内存表也可能包含需要删除的key，先刷盘再处理sst
+	if err := lsm.flushMemTables(prefixes...); err != nil {
+		return err
+	}
+	if err := lsm.levels.dropPrefixes(prefixes); err != nil {
+		return err
+	}
+	for _, cf := range lsm.families {
+		if err := cf.levels.dropPrefixes(cf.keyPrefixes(prefixes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushMemTables 把当前的内存表和所有不可变内存表刷到L0，匹配 dropPrefixes 的key会被丢弃
+// 调用方需要保证在此期间没有写入
+func (lsm *LSM) flushMemTables(dropPrefixes ...[]byte) error {
+	if !lsm.memTable.empty() {
+		if err := lsm.Rotato(); err != nil {
+			return err
+		}
+	}
+	for _, immutable := range lsm.immutables {
+		if err := lsm.flushMemTable(immutable, dropPrefixes...); err != nil {
+			return err
+		}
+	}
+	lsm.immutables = make([]*memTable, 0)
+	lsm.updateMemStats()
+	return nil
+}
+
+// dropTree 删除所有层的全部sst
+func (lm *levelManager) dropTree() (int, error) {
+	var all []*table
+	for _, lh := range lm.levels {
+		lh.RLock()
+		all = append(all, lh.tables...)
+		lh.RUnlock()
+	}
+	if len(all) == 0 {
+		return 0, nil
+	}
+
+	// 先更新manifest，再删除文件
+	changes := make([]*pb.ManifestChange, 0, len(all))
+	for _, t := range all {
+		changes = append(changes, newDeleteChange(t.fid))
+	}
+	if err := lm.manifestFile.AddChanges(changes); err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	for _, lh := range lm.levels {
+		lh.RLock()
+		toDel := lh.tables
+		lh.RUnlock()
+		if err := lh.deleteTables(toDel); err != nil {
+			return deleted, err
+		}
+		deleted += len(toDel)
+	}
+	return deleted, nil
+}
+
+// dropPrefixes 处理每一层中与 prefixes 有交集的sst
+// 全部key都匹配前缀的sst直接删除，部分匹配的sst重写为一个不包含这些key的新sst
+func (lm *levelManager) dropPrefixes(prefixes [][]byte) error {
+	for _, lh := range lm.levels {
+		lh.RLock()
+		tables := make([]*table, len(lh.tables))
+		copy(tables, lh.tables)
+		lh.RUnlock()
+
+		var toDel, toAdd []*table
+		var changes []*pb.ManifestChange
+		for _, t := range tables {
+			minKey, maxKey := utils.ParseKey(t.ss.MinKey()), utils.ParseKey(t.ss.MaxKey())
+			overlap, covered := false, false
+			for _, prefix := range prefixes {
+				opt := &utils.Options{Prefix: prefix}
+				if !opt.RangeMayOverlap(minKey, maxKey) {
+					continue
+				}
+				overlap = true
+				// 最小和最大的key都有这个前缀，那么sst中所有的key都有这个前缀
+				if bytes.HasPrefix(minKey, prefix) && bytes.HasPrefix(maxKey, prefix) {
+					covered = true
+					break
+				}
+			}
+			if !overlap {
+				continue
+			}
+			toDel = append(toDel, t)
+			changes = append(changes, newDeleteChange(t.fid))
+			if covered {
+				lm.updateDiscardStats(tableDiscardStats(t))
+				continue
+			}
+			nt, err := lm.rewriteTable(t, prefixes)
+			if err != nil {
+				_ = decrRefs(toAdd)
+				return err
+			}
+			if nt != nil {
+				toAdd = append(toAdd, nt)
+				changes = append(changes, lm.newCreateChange(nt.fid, lh.levelNum))
+			}
+		}
+		if len(toDel) == 0 {
+			continue
+		}
+
+		if err := lm.manifestFile.AddChanges(changes); err != nil {
+			_ = decrRefs(toAdd)
+			return err
+		}
+		if err := lh.replaceTables(toDel, toAdd); err != nil {
+			return err
+		}
+		// replaceTables 已经为新表增加了引用，这里释放构建时的引用
+		if err := decrRefs(toAdd); err != nil {
+			return err
+		}
+		// l0 层需要按照fid排序
+		lh.Sort()
+	}
+	return nil
+}
+
+// rewriteTable 将t中不匹配 prefixes 的key写入一个新的sst，如果所有的key都被删除了则返回nil
+func (lm *levelManager) rewriteTable(t *table, prefixes [][]byte) (*table, error) {
+	builder := newTableBuilerWithSSTSize(lm.opt, t.Size())
+	discardStats := make(map[uint32]int64)
+	iter := t.NewIterator(&utils.Options{IsAsc: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		entry := iter.Item().Entry()
+		if hasAnyPrefix(entry.Key, prefixes) {
+			addDiscardStats(discardStats, entry)
+			continue
+		}
+		builder.AddKey(entry)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	if len(discardStats) > 0 {
+		lm.updateDiscardStats(discardStats)
+	}
+	if builder.empty() {
+		return nil, nil
+	}
+
+	fid := lm.nextFID()
+	nt, err := openTable(lm, utils.FileNameSSTable(lm.opt.WorkDir, fid), builder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to rewrite table %d", t.fid)
+	}
+	return nt, nil
+}
+
+// tableDiscardStats 统计t中所有值指针所占用的vlog空间
+func tableDiscardStats(t *table) map[uint32]int64 {
+	discardStats := make(map[uint32]int64)
+	iter := t.NewIterator(&utils.Options{IsAsc: true})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		addDiscardStats(discardStats, iter.Item().Entry())
+	}
+	return discardStats
+}
+
+// hasAnyPrefix 判断带版本号的key是否以 prefixes 中的任意一个为前缀
+func hasAnyPrefix(key []byte, prefixes [][]byte) bool {
+	userKey := utils.ParseKey(key)
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(userKey, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/file"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// IngestExternalFiles 把 SSTWriter 生成的sst文件以 version 为版本号导入LSM，原文件保持不变
+// 每个文件会先校验key的顺序和checksum，再重写到工作目录中，文件之间的key范围不能重叠
+// 调用方需要保证在此期间没有写入，并且 version 大于LSM中已有的所有版本号
+func (lsm *LSM) IngestExternalFiles(paths []string, version uint64) error {
+	lm := lsm.levels
+	// 内存表刷盘时会为列族生成新的sst，因此需要暂停所有列族的压缩
+	defer lsm.pauseCompactions()()
+
+	// lsm.Get 优先查找内存表，内存表中的旧版本会遮盖导入的数据，因此先刷盘
+	if err := lsm.flushMemTables(); err != nil {
+		return err
+	}
+	tables := make([]*table, 0, len(paths))
+	for _, path := range paths {
+		t, err := lm.ingestTable(path, version)
+		if err != nil {
+			_ = decrRefs(tables)
+			return errors.Wrapf(err, "while ingesting %s", path)
+		}
+		tables = append(tables, t)
+	}
+	// 同一个版本号的key只能出现在一个sst中
+	sort.Slice(tables, func(i, j int) bool {
+		return utils.CompareKeys(tables[i].ss.MinKey(), tables[j].ss.MinKey()) < 0
+	})
+	for i := 1; i < len(tables); i++ {
+		prev, cur := utils.ParseKey(tables[i-1].ss.MaxKey()), utils.ParseKey(tables[i].ss.MinKey())
+		if bytes.Compare(prev, cur) >= 0 {
+			_ = decrRefs(tables)
+			return errors.Errorf("external files overlap at key %q", cur)
+		}
+	}
+	for i, t := range tables {
+		level := lm.ingestLevel(getKeyRange(t))
+		if err := lm.manifestFile.AddTableMeta(level, &file.TableMeta{
+			ID:       t.fid,
+			CheckSum: []byte{'m', 'o', 'c', 'k'},
+		}); err != nil {
+			// 已经写入 manifest 的sst保留在LSM中
+			_ = decrRefs(tables[i:])
+			return err
+		}
+		lm.levels[level].add(t)
+		lm.levels[level].Sort()
+	}
+	return nil
+}
+
+// ingestTable 校验外部的sst文件，并把其中的key以 version 为版本号重写为一个新的sst
+func (lm *levelManager) ingestTable(path string, version uint64) (*table, error) {
+	fi, err := lm.opt.fs().Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, errors.Wrap(utils.ErrBadChecksum, "empty sst file")
+	}
+	// 外部文件使用一个单独的fid，避免与LSM中的sst共用block缓存
+	// 只读打开外部文件，重写的数据写入新的sst，调用方的文件不会被修改
+	src := &table{lm: lm, fid: lm.nextFID()}
+	if src.ss, err = file.OpenSStable(&file.Options{
+		FileName: path,
+		Flag:     os.O_RDONLY,
+		MaxSz:    int(fi.Size()),
+		FS:       lm.opt.FS}); err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range src.ss.Indexs().GetOffsets() {
+			lm.cache.blocks.Del(src.blockCacheKey(i))
+		}
+		_ = src.ss.Close()
+	}()
+	if err = src.init(); err != nil {
+		return nil, err
+	}
+	// 读取每个block时都会校验checksum
+	for i := range src.ss.Indexs().GetOffsets() {
+		if _, err = src.block(i); err != nil {
+			return nil, err
+		}
+	}
+
+	builder := newTableBuilerWithSSTSize(lm.opt, src.Size())
+	iter := src.NewIterator(&utils.Options{IsAsc: true})
+	var lastKey []byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		entry := iter.Item().Entry()
+		key := utils.ParseKey(entry.Key)
+		if len(lastKey) > 0 && bytes.Compare(key, lastKey) <= 0 {
+			err = errors.Errorf("key %q is not greater than previous key %q", key, lastKey)
+			break
+		}
+		if entry.Meta&utils.BitValuePointer > 0 {
+			err = errors.Errorf("key %q has a value pointer", key)
+			break
+		}
+		lastKey = append(lastKey[:0], key...)
+		builder.AddKey(&utils.Entry{
+			Key:       utils.KeyWithTs(key, version),
+			Value:     entry.Value,
+			Meta:      entry.Meta,
+			ExpiresAt: entry.ExpiresAt,
+		})
+	}
+	if cerr := iter.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fid := lm.nextFID()
+	return openTable(lm, utils.FileNameSSTable(lm.opt.WorkDir, fid), builder)
+}
+
+// ingestLevel 返回与 kr 不重叠的最深的一层，它上面的层也都不能与 kr 重叠，否则导入的新版本会被旧版本遮盖
+// L0 中有重叠时只能放到L0，L0 查询时会比较所有sst中的版本号
+func (lm *levelManager) ingestLevel(kr keyRange) int {
+	level := 0
+	for i, lh := range lm.levels {
+		if lh.overlapsWith(kr) {
+			break
+		}
+		level = i
+	}
+	return level
+}
+
+// overlapsWith 判断当前层是否有sst与 kr 重叠，L0 的sst之间没有按key排序，因此逐个比较
+func (lh *levelHandler) overlapsWith(kr keyRange) bool {
+	lh.RLock()
+	defer lh.RUnlock()
+	for _, t := range lh.tables {
+		if getKeyRange(t).overlapsWith(kr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestIngestExternalFiles(t *testing.T) {
+	clearDir()
+	c := make(chan map[uint32]int64, 16)
+	o := *opt
+	o.DiscardStatsCh = &c
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer lsm.Close()
+
+	writeSST := func(name string, from, to int, val string) string {
+		path := filepath.Join(o.WorkDir, name)
+		w := NewSSTWriter(path, &o)
+		for i := from; i < to; i++ {
+			require.NoError(t, w.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte(val))))
+		}
+		require.NoError(t, w.Finish())
+		return path
+	}
+	levelOf := func(key string) int {
+		for _, lh := range lsm.levels.levels {
+			for _, tbl := range lh.tables {
+				kr := getKeyRange(tbl)
+				if kr.overlapsWith(keyRange{left: utils.KeyWithTs([]byte(key), 10), right: utils.KeyWithTs([]byte(key), 0)}) {
+					return lh.levelNum
+				}
+			}
+		}
+		return -1
+	}
+
+	// 没有重叠时放到最后一层，只读的外部文件也可以导入，并且不会被修改
+	src := writeSST("a.sst", 0, 50, "ingest")
+	require.NoError(t, os.Chmod(src, 0444))
+	data, err := ioutil.ReadFile(src)
+	require.NoError(t, err)
+	require.NoError(t, lsm.IngestExternalFiles([]string{src}, 1))
+	require.Equal(t, o.MaxLevelNum-1, levelOf("key010"))
+	after, err := ioutil.ReadFile(src)
+	require.NoError(t, err)
+	require.Equal(t, data, after)
+
+	// 内存表中的数据会先刷到L0，与之重叠的sst只能放到L0
+	require.NoError(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("key060"), 2), []byte("set"))))
+	require.NoError(t, lsm.IngestExternalFiles([]string{writeSST("b.sst", 50, 100, "ingest")}, 3))
+	require.Equal(t, 0, levelOf("key070"))
+	e, err := lsm.Get(utils.KeyWithTs([]byte("key060"), 3))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ingest"), e.Value)
+	e, err = lsm.Get(utils.KeyWithTs([]byte("key060"), 2))
+	require.NoError(t, err)
+	require.Equal(t, []byte("set"), e.Value)
+
+	// 导入的文件之间不能重叠
+	overlap := []string{writeSST("c.sst", 100, 120, "x"), writeSST("d.sst", 110, 130, "x")}
+	require.Error(t, lsm.IngestExternalFiles(overlap, 4))
+	_, err = lsm.Get(utils.KeyWithTs([]byte("key100"), 4))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+func TestIngestPausesColumnFamilyCompactions(t *testing.T) {
+	clearDir()
+	c := make(chan map[uint32]int64, 16)
+	o := *opt
+	o.DiscardStatsCh = &c
+	o.ColumnFamilies = map[string]*Options{"cf": {}}
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer lsm.Close()
+
+	// 列族的内存表中有数据，导入时会刷到列族的L0，此时列族正在压缩
+	key := utils.KeyWithTs(append(append([]byte{}, ColumnFamilyPrefix("cf")...), "key"...), 1)
+	require.NoError(t, lsm.Set(utils.NewEntry(key, []byte("val"))))
+	cf := lsm.columnFamilyByName("cf")
+	cf.levels.compactLock.RLock()
+
+	path := filepath.Join(o.WorkDir, "a.sst")
+	w := NewSSTWriter(path, &o)
+	require.NoError(t, w.Set(utils.NewEntry([]byte("key"), []byte("ingest"))))
+	require.NoError(t, w.Finish())
+	done := make(chan error, 1)
+	go func() { done <- lsm.IngestExternalFiles([]string{path}, 2) }()
+	select {
+	case err := <-done:
+		t.Fatalf("ingest finished during a column family compaction: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cf.levels.compactLock.RUnlock()
+	require.NoError(t, <-done)
+
+	e, err := lsm.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), e.Value)
+	e, err = lsm.Get(utils.KeyWithTs([]byte("key"), 2))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ingest"), e.Value)
+}
+
+func TestSSTWriterKeyOrder(t *testing.T) {
+	clearDir()
+	w := NewSSTWriter(filepath.Join(opt.WorkDir, "bad.sst"), opt)
+	require.NoError(t, w.Set(utils.NewEntry([]byte("b"), []byte("v"))))
+	require.Error(t, w.Set(utils.NewEntry([]byte("b"), []byte("v"))))
+	require.Error(t, w.Set(utils.NewEntry([]byte("a"), []byte("v"))))
+	require.Error(t, NewSSTWriter(filepath.Join(opt.WorkDir, "empty.sst"), opt).Finish())
+}
@@ -0,0 +1,49 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestInMemory(t *testing.T) {
+	clearDir()
+	c := make(chan map[uint32]int64, 16)
+	o := *opt
+	o.WorkDir = "../work_test/inmemory"
+	o.InMemory = true
+	o.DiscardStatsCh = &c
+	o.NumVersionsToKeep = 1
+	o.DiscardTs = func() uint64 { return 3 }
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer func() { _ = lsm.Close() }()
+
+	for i := 0; i < 200; i++ {
+		for ts := uint64(1); ts <= 3; ts++ {
+			e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), ts), []byte(fmt.Sprintf("val%d@%d", i, ts)))
+			require.NoError(t, lsm.Set(e))
+		}
+	}
+	// 刷盘和压缩生成的sst都只在内存中
+	require.NoError(t, lsm.flushMemTables())
+	require.NotZero(t, lsm.levels.levels[0].numTables())
+	for lsm.levels.levels[0].numTables() > 0 {
+		cd := buildCompactDef(lsm, 0, 0, 6)
+		require.True(t, lsm.levels.fillTables(cd))
+		require.NoError(t, lsm.levels.runCompactDef(0, 0, *cd))
+		lsm.levels.compactState.delete(*cd)
+	}
+	require.NotZero(t, lsm.levels.levels[6].numTables())
+
+	for i := 0; i < 200; i++ {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 3))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%d@3", i)), e.Value)
+	}
+	_, err = os.Stat(o.WorkDir)
+	require.True(t, os.IsNotExist(err))
+}
@@ -20,25 +20,28 @@ func (it *Item) Entry() *utils.Entry {
 	return it.e
 }
 
-// 创建迭代器
+// 创建迭代器，按照从新到旧的顺序返回活跃内存表、不变内存表以及各层sst的迭代器
+// 与 opt 中 Prefix/LowerBound/UpperBound 没有交集的sst会被直接跳过
 func (lsm *LSM) NewIterators(opt *utils.Options) []utils.Iterator {
 	iter := &Iterator{}
 	iter.iters = make([]utils.Iterator, 0)
 	iter.iters = append(iter.iters, lsm.memTable.NewIterator(opt))
-	for _, imm := range lsm.immutables {
-		iter.iters = append(iter.iters, imm.NewIterator(opt))
+	for i := len(lsm.immutables) - 1; i >= 0; i-- {
+		iter.iters = append(iter.iters, lsm.immutables[i].NewIterator(opt))
 	}
-	iter.iters = append(iter.iters, lsm.levels.iterators()...)
+	iter.iters = append(iter.iters, lsm.levels.iterators(opt)...)
 	return iter.iters
 }
 func (iter *Iterator) Next() {
 	iter.iters[0].Next()
 }
 func (iter *Iterator) Valid() bool {
-	return iter.iters[0].Valid()
+	return len(iter.iters) > 0 && iter.iters[0].Valid()
 }
 func (iter *Iterator) Rewind() {
-	iter.iters[0].Rewind()
+	if len(iter.iters) > 0 {
+		iter.iters[0].Rewind()
+	}
 }
 func (iter *Iterator) Item() utils.Item {
 	return iter.iters[0].Item()
@@ -48,6 +51,9 @@ func (iter *Iterator) Close() error {
 }
 
 func (iter *Iterator) Seek(key []byte) {
+	if len(iter.iters) > 0 {
+		iter.iters[0].Seek(key)
+	}
 }
 
 // 内存表迭代器
@@ -56,7 +62,11 @@ type memIterator struct {
 }
 
 func (m *memTable) NewIterator(opt *utils.Options) utils.Iterator {
-	return &memIterator{innerIter: m.sl.NewSkipListIterator()}
+	return m.newIterator(m.sl)
+}
+
+func (m *memTable) newIterator(sl *utils.Skiplist) utils.Iterator {
+	return &memIterator{innerIter: sl.NewSkipListIterator()}
 }
 func (iter *memIterator) Next() {
 	iter.innerIter.Next()
@@ -74,33 +84,35 @@ func (iter *memIterator) Close() error {
 	return iter.innerIter.Close()
 }
 func (iter *memIterator) Seek(key []byte) {
+	iter.innerIter.Seek(key)
 }
 
-// levelManager上的迭代器
+// levelManager上的迭代器，将所有层的迭代器合并为一个有序的迭代器
 type levelIterator struct {
-	it    *utils.Item
-	iters []*Iterator
+	iter utils.Iterator
 }
 
 func (lm *levelManager) NewIterators(options *utils.Options) []utils.Iterator {
-	return lm.iterators()
+	return []utils.Iterator{&levelIterator{iter: NewMergeIterator(lm.iterators(options), false)}}
 }
 func (iter *levelIterator) Next() {
+	iter.iter.Next()
 }
 func (iter *levelIterator) Valid() bool {
-	return false
+	return iter.iter.Valid()
 }
 func (iter *levelIterator) Rewind() {
-
+	iter.iter.Rewind()
 }
 func (iter *levelIterator) Item() utils.Item {
-	return &Item{}
+	return iter.iter.Item()
 }
 func (iter *levelIterator) Close() error {
-	return nil
+	return iter.iter.Close()
 }
 
 func (iter *levelIterator) Seek(key []byte) {
+	iter.iter.Seek(key)
 }
 
 // ConcatIterator 将table 数组链接成一个迭代器，这样迭代效率更高
@@ -140,7 +152,7 @@ func (s *ConcatIterator) Rewind() {
 	if len(s.iters) == 0 {
 		return
 	}
-	if !s.options.IsAsc {
+	if s.options.IsAsc {
 		s.setIdx(0)
 	} else {
 		s.setIdx(len(s.iters) - 1)
@@ -189,7 +201,7 @@ func (s *ConcatIterator) Next() {
 		return
 	}
 	for { // In case there are empty tables.
-		if !s.options.IsAsc {
+		if s.options.IsAsc {
 			s.setIdx(s.idx + 1)
 		} else {
 			s.setIdx(s.idx - 1)
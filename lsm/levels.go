@@ -1,53 +1,69 @@
 package lsm
 
 import (
-	"bytes"
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/vvvvjvvvv/jkv/file"
 	"github.com/vvvvjvvvv/jkv/utils"
 )
 
 // initLevelManager 初始化函数
-func (lsm *LSM) initLevelManager(opt *Options) *levelManager {
+func (lsm *LSM) initLevelManager(opt *Options) (*levelManager, error) {
 	lm := &levelManager{lsm: lsm} // 反引用
-	lm.compactState = lsm.newCompactStatus()
+	lm.compactState = newCompactStatus(opt.MaxLevelNum)
 	lm.opt = opt
 	// 读取 manifest 文件构建管理器
 	if err := lm.loadManifest(); err != nil {
-		panic(err)
+		return nil, err
 	}
-	_ = lm.build() // 把 sst 文件的索引加载到内存，以便db加载和访问
-	return lm
+	// 把 sst 文件的索引加载到内存，以便db加载和访问
+	if err := lm.build(); err != nil {
+		_ = lm.close()
+		return nil, err
+	}
+	return lm, nil
 }
 
 type levelManager struct {
-	maxFID       uint64
+	maxFID       uint64 // 所有列族共用默认列族的 maxFID，分配fid需要使用 nextFID
 	opt          *Options
+	cf           string // 列族的名称，默认列族为空
+	prefix       []byte // 列族的key前缀，默认列族为空
 	cache        *cache
 	manifestFile *file.ManifestFile
 	levels       []*levelHandler
 	lsm          *LSM
 	compactState *compactStatus
+	// compactLock 压缩过程持有读锁，DropAll/DropPrefix 持有写锁以暂停所有的压缩
+	compactLock sync.RWMutex
 }
 
-func (lm *levelManager) iterators() []utils.Iterator {
+func (lm *levelManager) iterators(opt *utils.Options) []utils.Iterator {
 
 	itrs := make([]utils.Iterator, 0, len(lm.levels))
 	for _, level := range lm.levels {
-		itrs = append(itrs, level.iterators()...)
+		itrs = append(itrs, level.iterators(opt)...)
 	}
 	return itrs
 }
 
+// nextFID 分配一个新的fid，wal 和所有列族的sst共用同一个fid序列
+func (lm *levelManager) nextFID() uint64 {
+	return atomic.AddUint64(&lm.lsm.levels.maxFID, 1)
+}
+
 func (lm *levelManager) close() error {
 	if err := lm.cache.close(); err != nil {
 		return err
 	}
-	if err := lm.manifestFile.Close(); err != nil {
-		return err
+	// manifest 由默认列族负责关闭
+	if lm.cf == "" {
+		if err := lm.manifestFile.Close(); err != nil {
+			return err
+		}
 	}
 	for i := range lm.levels {
 		if err := lm.levels[i].close(); err != nil {
@@ -79,7 +95,12 @@ func (lm *levelManager) Get(key []byte) (*utils.Entry, error) {
 func (lm *levelManager) loadCache() {}
 
 func (lm *levelManager) loadManifest() (err error) {
-	lm.manifestFile, err = file.OpenManifestFile(&file.Options{Dir: lm.opt.WorkDir})
+	lm.manifestFile, err = file.OpenManifestFile(&file.Options{
+		Dir:      lm.opt.WorkDir,
+		Flag:     lm.opt.fileFlag(),
+		InMemory: lm.opt.InMemory,
+		FS:       lm.opt.FS,
+	})
 	return err
 }
 
@@ -94,9 +115,12 @@ func (lm *levelManager) build() error {
 	}
 
 	manifest := lm.manifestFile.GetManifest()
-	// 对比manifest 文件的正确性
-	if err := lm.manifestFile.RevertToManifest(utils.LoadIDMap(lm.opt.WorkDir)); err != nil {
-		return err
+	// 对比manifest 文件的正确性，所有列族共用一个manifest，只需要检查一次
+	// 只读模式下不删除多余的sst，manifest 中缺失的sst在打开时报错
+	if lm.cf == "" && !lm.opt.ReadOnly && !lm.opt.InMemory {
+		if err := lm.manifestFile.RevertToManifest(utils.LoadIDMap(lm.opt.FS, lm.opt.WorkDir)); err != nil {
+			return err
+		}
 	}
 	// 逐一加载sstable 的index block 构建cache
 	lm.cache = newCache(lm.opt)
@@ -107,9 +131,14 @@ func (lm *levelManager) build() error {
 		if fID > maxFID {
 			maxFID = fID
 		}
-		t := openTable(lm, fileName, nil)
-		lm.levels[tableInfo.Level].add(t)
-		lm.levels[tableInfo.Level].addSize(t) // 记录一个level的文件总大小
+		if tableInfo.ColumnFamily != lm.cf {
+			continue
+		}
+		t, err := openTable(lm, fileName, nil)
+		if err != nil {
+			return err
+		}
+		lm.levels[tableInfo.Level].add(t) // 同时记录一个level的文件总大小
 	}
 	// 对每一层进行排序
 	for i := 0; i < lm.opt.MaxLevelNum; i++ {
@@ -120,30 +149,57 @@ func (lm *levelManager) build() error {
 	return nil
 }
 
-// 向L0层flush一个sstable
-func (lm *levelManager) flush(immutable *memTable) (err error) {
-	// 分配一个fid
-	fid := immutable.wal.Fid()
+// 把一个跳表flush为L0层的sstable，匹配 dropPrefixes 的key会被直接丢弃
+func (lm *levelManager) flush(sl *utils.Skiplist, fid uint64, dropPrefixes ...[]byte) (err error) {
+	start := time.Now()
 	sstName := utils.FileNameSSTable(lm.opt.WorkDir, fid)
 
 	// 构建一个 builder
 	builder := newTableBuiler(lm.opt)
-	iter := immutable.sl.NewSkipListIterator()
+	discardStats := make(map[uint32]int64)
+	iter := sl.NewSkipListIterator()
+	defer iter.Close()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		entry := iter.Item().Entry()
+		if hasAnyPrefix(entry.Key, dropPrefixes) {
+			addDiscardStats(discardStats, entry)
+			continue
+		}
 		builder.add(entry, false)
 	}
+	if len(discardStats) > 0 {
+		lm.updateDiscardStats(discardStats)
+	}
+	if builder.empty() {
+		// 所有的key都被丢弃了，不需要生成sst
+		return nil
+	}
 	// 创建一个 table 对象
-	table := openTable(lm, sstName, builder)
-	err = lm.manifestFile.AddTableMeta(0, &file.TableMeta{
-		ID:       fid,
-		CheckSum: []byte{'m', 'o', 'c', 'k'},
-	})
-	// manifest写入失败直接panic
-	utils.Panic(err)
+	table, err := openTable(lm, sstName, builder)
+	if err != nil {
+		return err
+	}
+	// 新建的sst的目录项落盘之后才能记录到manifest中
+	if !lm.opt.InMemory {
+		if err = lm.opt.fs().Sync(lm.opt.WorkDir); err != nil {
+			_ = table.DecrRef()
+			return err
+		}
+	}
 	// 更新manifest文件
+	if err = lm.manifestFile.AddTableMeta(0, &file.TableMeta{
+		ID:           fid,
+		CheckSum:     []byte{'m', 'o', 'c', 'k'},
+		ColumnFamily: lm.cf,
+	}); err != nil {
+		// manifest 没有记录这个sst，删除文件
+		_ = table.DecrRef()
+		return err
+	}
 	lm.levels[0].add(table)
-	return
+	lm.opt.Metrics.Flushes.Inc()
+	lm.opt.Metrics.FlushLatency.Since(start)
+	return nil
 }
 
 // --------- level 处理器 ----------
@@ -168,6 +224,7 @@ func (lh *levelHandler) add(t *table) {
 	lh.Lock()
 	defer lh.Unlock()
 	lh.tables = append(lh.tables, t)
+	lh.addSize(t)
 }
 
 func (lh *levelHandler) getTotalSize() int64 {
@@ -195,6 +252,8 @@ func (lh *levelHandler) numTables() int {
 }
 
 func (lh *levelHandler) Get(key []byte) (*utils.Entry, error) {
+	lh.RLock()
+	defer lh.RUnlock()
 	// 如果是第0层文件则进行特殊处理
 	if lh.levelNum == 0 {
 		// TODO: logic...
@@ -223,14 +282,22 @@ func (lh *levelHandler) Sort() {
 	}
 }
 
+// searchL0SST L0层的sst之间key范围可能重叠，vlog gc 还会把旧版本重新写入新的sst，
+// 因此需要查遍所有sst，返回不超过查询版本的最新版本
 func (lh *levelHandler) searchL0SST(key []byte) (*utils.Entry, error) {
-	var version uint64
+	var (
+		version uint64
+		found   *utils.Entry
+	)
 	for _, table := range lh.tables {
 		if entry, err := table.Serach(key, &version); err == nil {
-			return entry, nil
+			found = entry
 		}
 	}
-	return nil, utils.ErrKeyNotFound
+	if found == nil {
+		return nil, utils.ErrKeyNotFound
+	}
+	return found, nil
 }
 
 func (lh *levelHandler) searchLNSST(key []byte) (*utils.Entry, error) {
@@ -245,18 +312,15 @@ func (lh *levelHandler) searchLNSST(key []byte) (*utils.Entry, error) {
 	return nil, utils.ErrKeyNotFound
 }
 
+// getTable 返回第一个 MaxKey >= key 的sst，带版本的key在该sst中seek即可得到不超过查询版本的最新版本
 func (lh *levelHandler) getTable(key []byte) *table {
-	if len(lh.tables) > 0 && (bytes.Compare(key, lh.tables[0].ss.MinKey()) < 0 || bytes.Compare(key, lh.tables[len(lh.tables)-1].ss.MaxKey()) > 0) {
+	idx := sort.Search(len(lh.tables), func(i int) bool {
+		return utils.CompareKeys(lh.tables[i].ss.MaxKey(), key) >= 0
+	})
+	if idx >= len(lh.tables) {
 		return nil
-	} else {
-		for i := len(lh.tables) - 1; i >= 0; i-- {
-			if bytes.Compare(key, lh.tables[i].ss.MinKey()) > -1 &&
-				bytes.Compare(key, lh.tables[i].ss.MaxKey()) < 1 {
-				return lh.tables[i]
-			}
-		}
 	}
-	return nil
+	return lh.tables[idx]
 }
 
 func (lh *levelHandler) isLastLevel() bool {
@@ -313,7 +377,7 @@ func (lh *levelHandler) replaceTables(toDel, toAdd []*table) error {
 	// Assign tables.
 	lh.tables = newTables
 	sort.Slice(lh.tables, func(i, j int) bool {
-		return utils.CompareKeys(lh.tables[i].ss.MinKey(), lh.tables[i].ss.MinKey()) < 0
+		return utils.CompareKeys(lh.tables[i].ss.MinKey(), lh.tables[j].ss.MinKey()) < 0
 	})
 	lh.Unlock() // s.Unlock before we DecrRef tables -- that can be slow.
 	return decrRefs(toDel)
@@ -345,16 +409,23 @@ func (lh *levelHandler) deleteTables(toDel []*table) error {
 	return decrRefs(toDel)
 }
 
-func (lh *levelHandler) iterators() []utils.Iterator {
+func (lh *levelHandler) iterators(opt *utils.Options) []utils.Iterator {
 	lh.RLock()
 	defer lh.RUnlock()
 	topt := &utils.Options{IsAsc: true}
+	// 跳过key范围与迭代范围没有交集的sst
+	tables := make([]*table, 0, len(lh.tables))
+	for _, t := range lh.tables {
+		if opt.RangeMayOverlap(utils.ParseKey(t.ss.MinKey()), utils.ParseKey(t.ss.MaxKey())) {
+			tables = append(tables, t)
+		}
+	}
 	if lh.levelNum == 0 {
-		return iteratorsReversed(lh.tables, topt)
+		return iteratorsReversed(tables, topt)
 	}
 
-	if len(lh.tables) == 0 {
+	if len(tables) == 0 {
 		return nil
 	}
-	return []utils.Iterator{NewConcatIterator(lh.tables, topt)}
+	return []utils.Iterator{NewConcatIterator(tables, topt)}
 }
@@ -1,16 +1,26 @@
 package lsm
 
 import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/vvvvjvvvv/jkv/file"
+	"github.com/vvvvjvvvv/jkv/metrics"
+	"github.com/vvvvjvvvv/jkv/pb"
 	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
 )
 
 type LSM struct {
 	memTable   *memTable
 	immutables []*memTable
 	levels     *levelManager
+	families   []*columnFamily // 除默认列族外的所有列族
 	option     *Options
 	closer     *utils.Closer
 	maxMemFID  uint32
+	stats      statCounters
 }
 
 type Options struct {
@@ -20,6 +30,10 @@ type Options struct {
 	BlockSize          int     // BlockSize is the size of each block inside SSTable in bytes.
 	BloomFalsePositive float64 // false positive probability of bloom filter
 
+	// Compression 新生成的sst中block的压缩算法，读取时以sst中记录的算法为准
+	Compression          pb.CompressionType
+	ZSTDCompressionLevel int // zstd 的压缩级别，0 表示使用 zstd 的默认级别
+
 	// compact
 	NumCompactors       int
 	BaseLevelSize       int64
@@ -30,6 +44,49 @@ type Options struct {
 	MaxLevelNum         int
 
 	DiscardStatsCh *chan map[uint32]int64
+
+	// CompactionFilter 为空时压缩只根据删除标记和过期时间处理数据
+	CompactionFilter CompactionFilter
+	// MergeOperator 不为空时压缩会把合并操作数合并为完整的值
+	MergeOperator MergeOperator
+	// NumVersionsToKeep 压缩时每个key最多保留的版本数，只清理 DiscardTs 及之前的版本，小于等于0时保留所有版本
+	NumVersionsToKeep int
+	// DiscardTs 返回不再有读事务需要读取更早版本的时间戳，为空时不清理旧版本
+	DiscardTs func() uint64
+
+	// Metrics 为空时不统计
+	Metrics *metrics.Metrics
+
+	// KeyRegistry 为空时不加密
+	KeyRegistry *file.KeyRegistry
+
+	// TTL 大于0时，写入时没有设置过期时间的key在 TTL 之后过期
+	TTL time.Duration
+	// ColumnFamilies 列族的名称和配置，列族与默认列族共用 wal、vlog 和 manifest
+	// 列族配置中为零值的字段使用默认列族的配置，WorkDir、MemTableSize 等共享资源的配置总是与默认列族相同
+	ColumnFamilies map[string]*Options
+
+	// ReadOnly 只读打开，不会新建、截断或删除任何文件，wal 中的数据只重放到内存表中
+	// 只读模式下不能写入，也不能启动压缩
+	ReadOnly bool
+	// InMemory 内存表、wal 和 sst 都只保存在内存中，不会创建任何文件，关闭之后数据随之丢失
+	// 刷盘和压缩仍然与磁盘上的引擎一样执行
+	InMemory bool
+	// FS 访问文件使用的文件系统，为nil时使用 vfs.OS
+	FS vfs.FS
+}
+
+// fs 返回访问文件使用的文件系统
+func (opt *Options) fs() vfs.FS {
+	return vfs.Default(opt.FS)
+}
+
+// fileFlag 返回打开已有文件时使用的flag
+func (opt *Options) fileFlag() int {
+	if opt.ReadOnly {
+		return os.O_RDONLY
+	}
+	return os.O_CREATE | os.O_RDWR
 }
 
 // Close _
@@ -48,30 +105,56 @@ func (lsm *LSM) Close() error {
 			return err
 		}
 	}
+	for _, cf := range lsm.families {
+		if err := cf.levels.close(); err != nil {
+			return err
+		}
+	}
+	// 默认列族最后关闭，同时关闭共用的manifest
 	if err := lsm.levels.close(); err != nil {
 		return err
 	}
 	return nil
 }
 
-// NewLSM _
-func NewLSM(opt *Options) *LSM {
+// NewLSM 加载manifest、sst和wal，任何一个文件损坏都会返回 utils.FileError 并关闭已经打开的文件
+func NewLSM(opt *Options) (*LSM, error) {
+	if opt.Metrics == nil {
+		opt.Metrics = &metrics.Metrics{}
+	}
 	lsm := &LSM{option: opt}
+	var err error
 	// 初始化levelManager
-	lsm.levels = lsm.initLevelManager(opt)
+	if lsm.levels, err = lsm.initLevelManager(opt); err != nil {
+		return nil, err
+	}
+	// 恢复wal时需要根据key的前缀找到列族，因此先加载列族
+	if err = lsm.initColumnFamilies(); err != nil {
+		_ = lsm.levels.close()
+		return nil, err
+	}
 	// 启动DB恢复过程加载val，如果没有回复哪痛则创建新的内存表
-	lsm.memTable, lsm.immutables = lsm.recovery()
+	if lsm.memTable, lsm.immutables, err = lsm.recovery(); err != nil {
+		for _, cf := range lsm.families {
+			_ = cf.levels.close()
+		}
+		_ = lsm.levels.close()
+		return nil, err
+	}
+	lsm.updateMemStats()
 	// 初始化closer 用于资源回收的信号控制
 	lsm.closer = utils.NewCloser()
-	return lsm
+	return lsm, nil
 }
 
-// StartCompacter _
+// StartCompacter 每个列族使用各自的压缩协程
 func (lsm *LSM) StartCompacter() {
-	n := lsm.option.NumCompactors
-	lsm.closer.Add(n)
-	for i := 0; i < n; i++ {
-		go lsm.levels.runCompacter(i)
+	for _, lm := range lsm.levelManagers() {
+		n := lm.opt.NumCompactors
+		lsm.closer.Add(n)
+		for i := 0; i < n; i++ {
+			go lm.runCompacter(i)
+		}
 	}
 }
 
@@ -80,6 +163,9 @@ func (lsm *LSM) Set(entry *utils.Entry) (err error) {
 	if entry == nil || len(entry.Key) == 0 {
 		return utils.ErrEmptyKey
 	}
+	if lsm.option.ReadOnly {
+		return utils.ErrReadOnly
+	}
 
 	// graceful shutdown
 	lsm.closer.Add(1)
@@ -89,21 +175,28 @@ func (lsm *LSM) Set(entry *utils.Entry) (err error) {
 	// 否则写到当前memtable中
 	if int64(lsm.memTable.wal.Size())+int64(utils.EstimateWalCodecSize(entry)) >
 		lsm.option.MemTableSize {
-		lsm.Rotato()
+		if err = lsm.Rotato(); err != nil {
+			return err
+		}
 	}
 
 	if err = lsm.memTable.set(entry); err != nil {
 		return err
 	}
 
-	// 检查是否存在immutable需要刷盘.
+	// 检查是否存在immutable需要刷盘，刷盘期间写入被阻塞，计入写停顿时间
+	defer lsm.updateMemStats()
+	if len(lsm.immutables) != 0 {
+		start := time.Now()
+		defer func() {
+			atomic.AddInt64(&lsm.stats.writeStall, int64(time.Since(start)))
+		}()
+	}
 	for _, immutable := range lsm.immutables {
-		if err = lsm.levels.flush(immutable); err != nil {
+		// TODO 这里问题很大，应该用引用计数的方式回收
+		if err = lsm.flushMemTable(immutable); err != nil {
 			return err
 		}
-		// TODO 这里问题很大，应该用引用计数的方式回收
-		err = immutable.close()
-		utils.Panic(err)
 	}
 	if len(lsm.immutables) != 0 {
 		// TODO 将lsm的immutable队列置空，这里可以优化一下节省内存空间，还可以限制一下immutable的大小为固定值
@@ -112,6 +205,14 @@ func (lsm *LSM) Set(entry *utils.Entry) (err error) {
 	return err
 }
 
+// Sync 把活跃内存表的wal刷盘，不可变内存表在 Set 中已经刷成了sst
+func (lsm *LSM) Sync() error {
+	if lsm.memTable == nil || lsm.memTable.wal == nil {
+		return nil
+	}
+	return lsm.memTable.wal.Sync()
+}
+
 // Get _
 func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
 	if len(key) == 0 {
@@ -134,8 +235,50 @@ func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
 			return entry, err
 		}
 	}
-	// 从level manager查询
-	return lsm.levels.Get(key)
+	// 从key所属列族的level manager查询
+	return lsm.levelsOf(key).Get(key)
+}
+
+// flushMemTable 把不可变内存表中所有列族的数据刷到各自的L0，全部成功之后才删除共用的wal
+// 默认列族的sst使用wal的fid，列族的sst分配新的fid，每个列族丢弃以列族前缀加上 dropPrefixes 为前缀的key
+// 默认列族最后刷盘，manifest 中存在wal的fid时说明整个内存表都已经刷盘，见 recovery
+func (lsm *LSM) flushMemTable(mt *memTable, dropPrefixes ...[]byte) error {
+	for i, cf := range lsm.families {
+		if mt.cfs[i].Empty() {
+			continue
+		}
+		if err := cf.levels.flush(mt.cfs[i], cf.levels.nextFID(), cf.keyPrefixes(dropPrefixes)...); err != nil {
+			return err
+		}
+	}
+	if err := lsm.levels.flush(mt.sl, mt.wal.Fid(), dropPrefixes...); err != nil {
+		return err
+	}
+	return mt.delete()
+}
+
+// MaxVersion 返回LSM中已经持久化的最大版本号，用于在重启时恢复事务时间戳
+func (lsm *LSM) MaxVersion() uint64 {
+	var maxVersion uint64
+	update := func(v uint64) {
+		if v > maxVersion {
+			maxVersion = v
+		}
+	}
+	update(lsm.memTable.maxVersion)
+	for _, mt := range lsm.immutables {
+		update(mt.maxVersion)
+	}
+	for _, lm := range lsm.levelManagers() {
+		for _, lh := range lm.levels {
+			lh.RLock()
+			for _, t := range lh.tables {
+				update(t.ss.Indexs().MaxVersion)
+			}
+			lh.RUnlock()
+		}
+	}
+	return maxVersion
 }
 
 func (lsm *LSM) MemSize() int64 {
@@ -150,7 +293,12 @@ func (lsm *LSM) GetSkipListFromMemTable() *utils.Skiplist {
 	return lsm.memTable.sl
 }
 
-func (lsm *LSM) Rotato() {
+func (lsm *LSM) Rotato() error {
+	mt, err := lsm.NewMemTable()
+	if err != nil {
+		return err
+	}
 	lsm.immutables = append(lsm.immutables, lsm.memTable)
-	lsm.memTable = lsm.NewMemTable()
+	lsm.memTable = mt
+	return nil
 }
@@ -260,7 +260,8 @@ func buildLSM() *LSM {
 	// init DB Basic Test
 	c := make(chan map[uint32]int64, 16)
 	opt.DiscardStatsCh = &c
-	lsm := NewLSM(opt)
+	lsm, err := NewLSM(opt)
+	utils.Panic(err)
 	return lsm
 }
 
@@ -35,11 +35,38 @@ func TestManifestChecksum(t *testing.T) {
 	helpTestManifestFileCorruption(t, 15, "bad check sum")
 }
 
+// TestManifestTornTail 最后一条记录只写入了一部分时截断这条记录，之前的记录仍然有效
+func TestManifestTornTail(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	baseTest(t, lsm, 128)
+	tables := len(lsm.levels.manifestFile.GetManifest().Tables)
+	require.NoError(t, lsm.Close())
+
+	path := filepath.Join(opt.WorkDir, utils.ManifestFilename)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	require.NoError(t, err)
+	// 长度完整但是内容没有写完的记录
+	_, err = fp.Write([]byte{0, 0, 0, 16, 1, 2, 3, 4, 'X', 'X', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	lsm = buildLSM()
+	require.Equal(t, tables, len(lsm.levels.manifestFile.GetManifest().Tables))
+	require.NoError(t, lsm.Close())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), info.Size())
+}
+
 func helpTestManifestFileCorruption(t *testing.T, off int64, errorContent string) {
 	clearDir()
-	// 创建lsm，然后再将其关闭
+	// 创建lsm，写入足够多的数据生成sst，使被破坏的记录之后还有完整的记录，然后再将其关闭
 	{
 		lsm := buildLSM()
+		baseTest(t, lsm, 128)
 		require.NoError(t, lsm.Close())
 	}
 	fp, err := os.OpenFile(filepath.Join(opt.WorkDir, utils.ManifestFilename), os.O_RDWR, 0)
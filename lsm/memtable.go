@@ -3,13 +3,11 @@ package lsm
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"sync/atomic"
 
 	"github.com/pkg/errors"
 	"github.com/vvvvjvvvv/jkv/file"
@@ -19,51 +17,116 @@ import (
 const walFileExt string = ".wal"
 
 type memTable struct {
-	lsm        *LSM
-	wal        *file.WalFile
-	sl         *utils.Skiplist
+	lsm *LSM
+	wal *file.WalFile
+	sl  *utils.Skiplist
+	// cfs 列族的跳表，与 lsm.families 一一对应，所有列族共用一个wal
+	cfs        []*utils.Skiplist
 	buf        *bytes.Buffer
 	maxVersion uint64
 }
 
 // NewMemTable _
-func (lsm *LSM) NewMemTable() *memTable {
-	newFid := atomic.AddUint64(&(lsm.levels.maxFID), 1)
+func (lsm *LSM) NewMemTable() (*memTable, error) {
+	newFid := lsm.levels.nextFID()
+	dk, err := lsm.option.KeyRegistry.NewDataKey(utils.FileKindWAL, newFid)
+	if err != nil {
+		return nil, err
+	}
 	fileOpt := &file.Options{
 		Dir:      lsm.option.WorkDir,
 		Flag:     os.O_CREATE | os.O_RDWR,
 		MaxSz:    int(lsm.option.MemTableSize),
 		FID:      newFid,
 		FileName: mtFilePath(lsm.option.WorkDir, newFid),
+		DataKey:  dk,
+		InMemory: lsm.option.InMemory,
+		FS:       lsm.option.FS,
+	}
+	wal, err := file.OpenWalFile(fileOpt)
+	if err != nil {
+		return nil, utils.NewFileError(utils.FileKindWAL, fileOpt.FileName, err)
+	}
+	// 新建的wal的目录项需要落盘，否则掉电之后整个wal连同其中已经同步的数据一起丢失
+	if !lsm.option.InMemory {
+		if err := lsm.option.fs().Sync(lsm.option.WorkDir); err != nil {
+			_ = wal.Delete()
+			return nil, utils.NewFileError(utils.FileKindWAL, fileOpt.FileName, err)
+		}
 	}
 	return &memTable{
-		wal: file.OpenWalFile(fileOpt),
+		wal: wal,
 		sl:  utils.NewSkipList(int64(1 << 20)),
+		cfs: lsm.newColumnFamilySkipLists(),
 		lsm: lsm,
+	}, nil
+}
+
+func (lsm *LSM) newColumnFamilySkipLists() []*utils.Skiplist {
+	cfs := make([]*utils.Skiplist, 0, len(lsm.families))
+	for range lsm.families {
+		cfs = append(cfs, utils.NewSkipList(int64(1<<20)))
+	}
+	return cfs
+}
+
+// skiplist 返回key所属列族的跳表
+func (m *memTable) skiplist(key []byte) *utils.Skiplist {
+	if i, _ := m.lsm.columnFamily(key); i >= 0 {
+		return m.cfs[i]
 	}
+	return m.sl
 }
 
-// Close
+// empty 所有列族的跳表都为空时返回true
+func (m *memTable) empty() bool {
+	if !m.sl.Empty() {
+		return false
+	}
+	for _, sl := range m.cfs {
+		if !sl.Empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close 关闭wal文件，保留其中的数据用于重启恢复
 func (m *memTable) close() error {
+	// 只读模式下活跃的内存表没有wal
+	if m.wal == nil {
+		return nil
+	}
 	if err := m.wal.Close(); err != nil {
 		return err
 	}
 	return nil
 }
+
+// delete memtable已经刷盘成为sst，删除对应的wal文件
+func (m *memTable) delete() error {
+	if err := m.wal.Delete(); err != nil {
+		return err
+	}
+	return m.lsm.option.KeyRegistry.Delete(utils.FileKindWAL, m.wal.Fid())
+}
 func (m *memTable) set(entry *utils.Entry) error {
 	// 写到wal 日志中，防止崩溃
 	if err := m.wal.Write(entry); err != nil {
 		return err
 	}
 	// 写到memtable中
-	m.sl.Add(entry)
+	m.skiplist(entry.Key).Add(entry)
+	if ts := utils.ParseTs(entry.Key); ts > m.maxVersion {
+		m.maxVersion = ts
+	}
 	return nil
 }
 
 func (m *memTable) Get(key []byte) (*utils.Entry, error) {
 	// 索引检查当前的key是否在表中 O(1) 的时间复杂度
 	// 从内存表中获取数据
-	vs := m.sl.Search(key)
+	vs := m.skiplist(key).Search(key)
 
 	e := &utils.Entry{
 		Key:       key,
@@ -78,16 +141,24 @@ func (m *memTable) Get(key []byte) (*utils.Entry, error) {
 }
 
 func (m *memTable) Size() int64 {
-	return m.sl.MemSize()
+	size := m.sl.MemSize()
+	for _, sl := range m.cfs {
+		size += sl.MemSize()
+	}
+	return size
 }
 
-// recover
-func (lsm *LSM) recovery() (*memTable, []*memTable) {
+// recover 从wal文件中恢复memtable，失败时关闭已经打开的wal
+func (lsm *LSM) recovery() (*memTable, []*memTable, error) {
+	// 内存模式下没有可以恢复的wal
+	if lsm.option.InMemory {
+		mt, err := lsm.NewMemTable()
+		return mt, nil, err
+	}
 	// 从工作目录中获取所有文件
-	files, err := ioutil.ReadDir(lsm.option.WorkDir)
+	files, err := lsm.option.fs().ReadDir(lsm.option.WorkDir)
 	if err != nil {
-		utils.Panic(err)
-		return nil, nil
+		return nil, nil, err
 	}
 
 	var fids []uint64
@@ -100,14 +171,13 @@ func (lsm *LSM) recovery() (*memTable, []*memTable) {
 
 		fsz := len(file.Name())
 		fid, err := strconv.ParseUint(file.Name()[:fsz-len(walFileExt)], 10, 64)
+		if err != nil {
+			return nil, nil, utils.NewFileError(utils.FileKindWAL, file.Name(), err)
+		}
 		// 考虑wal文件的存在。更新maxFid
 		if maxFid < fid {
 			maxFid = fid
 		}
-		if err != nil {
-			utils.Panic(err)
-			return nil, nil
-		}
 		fids = append(fids, fid)
 	}
 
@@ -116,12 +186,44 @@ func (lsm *LSM) recovery() (*memTable, []*memTable) {
 		return fids[i] < fids[j]
 	})
 	imms := []*memTable{}
+	closeAll := func() {
+		for _, mt := range imms {
+			_ = mt.close()
+		}
+	}
 	// 遍历fid做处理
+	tables := lsm.levels.manifestFile.GetManifest().Tables
 	for _, fid := range fids {
+		// 内存表刷成的sst使用wal的fid，manifest已经记录了这个sst说明wal在删除之前发生了崩溃，其中的数据都已经在sst中
+		if _, ok := tables[fid]; ok {
+			if lsm.option.ReadOnly {
+				continue
+			}
+			if err := lsm.option.fs().Remove(mtFilePath(lsm.option.WorkDir, fid)); err != nil {
+				closeAll()
+				return nil, nil, utils.NewFileError(utils.FileKindWAL, mtFilePath(lsm.option.WorkDir, fid), err)
+			}
+			if err := lsm.option.KeyRegistry.Delete(utils.FileKindWAL, fid); err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			continue
+		}
 		mt, err := lsm.openMemTable(fid)
-		utils.CondPanic(err != nil, err)
-		if mt.sl.MemSize() == 0 {
-			// mt.DecrRef()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		if mt.empty() {
+			// 空的wal文件没有恢复的价值，直接删除，只读模式下只关闭文件
+			if lsm.option.ReadOnly {
+				_ = mt.close()
+				continue
+			}
+			if err := mt.delete(); err != nil {
+				closeAll()
+				return nil, nil, err
+			}
 			continue
 		}
 		// RODO 如果最后一个跳表没有写满会怎么样？这不就浪费空间了吗
@@ -129,27 +231,49 @@ func (lsm *LSM) recovery() (*memTable, []*memTable) {
 	}
 	// 更新最终的maxfid，初始化一定是串行执行的，因此不需要原子操作
 	lsm.levels.maxFID = maxFid
-	return lsm.NewMemTable(), imms
+	if lsm.option.ReadOnly {
+		// 只读模式下不会写入，活跃的内存表不需要wal
+		return &memTable{
+			sl:  utils.NewSkipList(int64(1 << 20)),
+			cfs: lsm.newColumnFamilySkipLists(),
+			lsm: lsm,
+		}, imms, nil
+	}
+	mt, err := lsm.NewMemTable()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return mt, imms, nil
 }
 
 func (lsm *LSM) openMemTable(fid uint64) (*memTable, error) {
 	fileOpt := &file.Options{
 		Dir:      lsm.option.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
+		Flag:     lsm.option.fileFlag(),
 		MaxSz:    int(lsm.option.MemTableSize),
 		FID:      fid,
 		FileName: mtFilePath(lsm.option.WorkDir, fid),
+		DataKey:  lsm.option.KeyRegistry.DataKey(utils.FileKindWAL, fid),
+		FS:       lsm.option.FS,
+	}
+	wal, err := file.OpenWalFile(fileOpt)
+	if err != nil {
+		return nil, utils.NewFileError(utils.FileKindWAL, fileOpt.FileName, err)
 	}
 	s := utils.NewSkipList(1 << 20)
 	mt := &memTable{
 		sl:  s,
+		cfs: lsm.newColumnFamilySkipLists(),
 		buf: &bytes.Buffer{},
 		lsm: lsm,
-		wal: file.OpenWalFile(fileOpt),
+		wal: wal,
+	}
+	if err := mt.UpdateSkipList(); err != nil {
+		_ = mt.close()
+		return nil, utils.NewFileError(utils.FileKindWAL, fileOpt.FileName,
+			errors.WithMessage(err, "while updating skiplist"))
 	}
-	mt.wal = file.OpenWalFile(fileOpt)
-	err := mt.UpdateSkipList()
-	utils.CondPanic(err != nil, errors.WithMessage(err, "while updating skiplist"))
 	return mt, nil
 }
 
@@ -170,6 +294,9 @@ func (m *memTable) UpdateSkipList() error {
 	// if endOff < m.wal.Size() {
 	// 	return errors.WithMessage(utils.ErrTruncate, fmt.Sprintf("end offset: %d < size: %d", endOff, m.wal.Size()))
 	// }
+	if m.lsm.option.ReadOnly {
+		return nil
+	}
 	return m.wal.Truncate(int64(endOff))
 }
 
@@ -178,7 +305,7 @@ func (m *memTable) replayFunction(opt *Options) func(*utils.Entry, *utils.ValueP
 		if ts := utils.ParseTs(e.Key); ts > m.maxVersion {
 			m.maxVersion = ts
 		}
-		m.sl.Add(e)
+		m.skiplist(e.Key).Add(e)
 		return nil
 	}
 }
@@ -0,0 +1,65 @@
+package lsm
+
+import (
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// MergeOperator 合并操作，需要满足结合律，即 Merge(Merge(a, b), c) 与 Merge(a, Merge(b, c)) 的结果相同
+// 满足结合律时可以先把多个操作数合并为一个操作数，再合并到完整的值上，压缩时会利用这一点提前合并
+// 多个读请求和压缩协程会并发调用，实现需要是并发安全的
+type MergeOperator interface {
+	// Merge 把 operand 合并到 existing 上并返回新的值，existing 为nil表示key不存在或者已经被删除
+	// existing 和 operand 只在调用期间有效，不能被修改
+	Merge(key, existing, operand []byte) []byte
+}
+
+// MergeValues 依次把 operands 合并到 existing 上，operands 按照版本从新到旧排列
+func MergeValues(op MergeOperator, key, existing []byte, operands [][]byte) []byte {
+	value := existing
+	for i := len(operands) - 1; i >= 0; i-- {
+		value = op.Merge(key, value, operands[i])
+	}
+	// value 为nil的entry会被当作删除
+	if value == nil {
+		value = []byte{}
+	}
+	return value
+}
+
+// mergeRun 压缩时同一个key从最新版本开始连续的合并操作数，按照版本从新到旧排列
+type mergeRun struct {
+	entries []*utils.Entry
+}
+
+func (r *mergeRun) add(e *utils.Entry) {
+	r.entries = append(r.entries, &utils.Entry{
+		Key:       utils.SafeCopy(nil, e.Key),
+		Value:     append([]byte{}, e.Value...),
+		Meta:      e.Meta,
+		ExpiresAt: e.ExpiresAt,
+	})
+}
+
+// collapse 把所有操作数合并为一个与最新的操作数版本号相同的entry
+// full 为 true 时把操作数合并到更早的完整值 base 上（nil表示没有更早的值），结果是一个完整的值
+// 否则只把操作数合并为一个新的操作数，读取时仍然需要与更早的版本合并
+func (r *mergeRun) collapse(op MergeOperator, base []byte, full bool) *utils.Entry {
+	top := r.entries[0]
+	operands := make([][]byte, len(r.entries))
+	for i, e := range r.entries {
+		operands[i] = e.Value
+	}
+	if !full {
+		last := len(operands) - 1
+		base, operands = operands[last], operands[:last]
+	}
+	e := &utils.Entry{
+		Key:   top.Key,
+		Value: MergeValues(op, utils.ParseKey(top.Key), base, operands),
+		Meta:  top.Meta,
+	}
+	if full {
+		e.Meta &^= utils.BitMergeOperand
+	}
+	return e
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// appendOperator 使用逗号把操作数追加到已有的值后面
+type appendOperator struct{}
+
+func (appendOperator) Merge(key, existing, operand []byte) []byte {
+	if len(existing) == 0 {
+		return append([]byte{}, operand...)
+	}
+	res := append([]byte{}, existing...)
+	res = append(res, ',')
+	return append(res, operand...)
+}
+
+func TestMergeCompaction(t *testing.T) {
+	clearDir()
+	c := make(chan map[uint32]int64, 16)
+	o := *opt
+	o.DiscardStatsCh = &c
+	o.MergeOperator = appendOperator{}
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer func() { _ = lsm.Close() }()
+
+	operand := func(key string, ts uint64, value string) *utils.Entry {
+		return &utils.Entry{
+			Key:   utils.KeyWithTs([]byte(key), ts),
+			Value: []byte(value),
+			Meta:  utils.BitMergeOperand,
+		}
+	}
+	for i := 0; i < 50; i++ {
+		// 有完整值、被删除以及只有操作数的key
+		based, deleted, bare := fmt.Sprintf("based%03d", i), fmt.Sprintf("deleted%03d", i), fmt.Sprintf("bare%03d", i)
+		require.NoError(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(based), 1), []byte("a"))))
+		require.NoError(t, lsm.Set(&utils.Entry{Key: utils.KeyWithTs([]byte(deleted), 1), Meta: utils.BitDelete}))
+		for ts, v := range []string{"b", "c"} {
+			for _, key := range []string{based, deleted, bare} {
+				require.NoError(t, lsm.Set(operand(key, uint64(ts+2), v)))
+			}
+		}
+	}
+	require.NoError(t, lsm.flushMemTables())
+	for lsm.levels.levels[0].numTables() > 0 {
+		cd := buildCompactDef(lsm, 0, 0, 6)
+		require.True(t, lsm.levels.fillTables(cd))
+		require.NoError(t, lsm.levels.runCompactDef(0, 0, *cd))
+		lsm.levels.compactState.delete(*cd)
+	}
+
+	for i := 0; i < 50; i++ {
+		for key, want := range map[string][2]string{
+			fmt.Sprintf("based%03d", i):   {"a,b", "a,b,c"},
+			fmt.Sprintf("deleted%03d", i): {"b", "b,c"},
+			fmt.Sprintf("bare%03d", i):    {"b", "b,c"},
+		} {
+			e, err := lsm.Get(utils.KeyWithTs([]byte(key), 3))
+			require.NoError(t, err)
+			require.Equal(t, []byte(want[1]), e.Value, key)
+			require.Zero(t, e.Meta&utils.BitMergeOperand, key)
+			// 更早的版本保留给旧的快照，L0 的sst分多次压缩时也可能已经被合并
+			e, err = lsm.Get(utils.KeyWithTs([]byte(key), 2))
+			require.NoError(t, err)
+			if e.Meta&utils.BitMergeOperand > 0 {
+				require.Equal(t, []byte("b"), e.Value, key)
+			} else {
+				require.Equal(t, []byte(want[0]), e.Value, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
+
+// SSTWriter 在LSM之外生成独立的sst文件，之后可以通过 IngestExternalFiles 导入
+// key 需要按升序写入并且不能重复，文件中key的版本号都为0，导入时会统一替换为新分配的版本号
+type SSTWriter struct {
+	fs      vfs.FS
+	path    string
+	builder *tableBuilder
+	lastKey []byte
+}
+
+// NewSSTWriter 创建一个写入 path 的 SSTWriter，只使用 opt 中 block、布隆过滤器和 FS 相关的配置
+func NewSSTWriter(path string, opt *Options) *SSTWriter {
+	return &SSTWriter{
+		fs:      opt.fs(),
+		path:    path,
+		builder: newTableBuiler(opt),
+	}
+}
+
+// Set 写入一个kv，e.Key 为不带版本号的key，value 直接存储在sst中
+func (w *SSTWriter) Set(e *utils.Entry) error {
+	if len(e.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	if e.Meta&utils.BitValuePointer > 0 {
+		return errors.New("SSTWriter: value pointer is not allowed in external sst")
+	}
+	if len(w.lastKey) > 0 && bytes.Compare(e.Key, w.lastKey) <= 0 {
+		return errors.Errorf("SSTWriter: key %q is not greater than previous key %q", e.Key, w.lastKey)
+	}
+	w.lastKey = append(w.lastKey[:0], e.Key...)
+	w.builder.AddKey(&utils.Entry{
+		Key:       utils.KeyWithTs(e.Key, 0),
+		Value:     e.Value,
+		Meta:      e.Meta,
+		ExpiresAt: e.ExpiresAt,
+	})
+	return nil
+}
+
+// Delete 写入一个删除标记，导入后会删除LSM中这个key的旧版本
+func (w *SSTWriter) Delete(key []byte) error {
+	return w.Set(&utils.Entry{Key: key, Meta: utils.BitDelete})
+}
+
+// Finish 把数据写入文件并同步到磁盘，path 不能已经存在
+func (w *SSTWriter) Finish() error {
+	if w.builder.empty() {
+		return errors.New("SSTWriter: no keys were written")
+	}
+	bd := w.builder.done()
+	if w.builder.err != nil {
+		return w.builder.err
+	}
+	buf := make([]byte, bd.size)
+	written := bd.Copy(buf)
+	utils.CondPanic(written != len(buf), fmt.Errorf("SSTWriter.Finish written != len(buf)"))
+
+	f, err := w.fs.Open(w.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "while writing %s", w.path)
+}
@@ -0,0 +1,117 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LevelStats 单层的统计信息
+type LevelStats struct {
+	Level     int
+	NumTables int
+	NumKeys   uint64 // sst中记录的key数量，包含旧版本和删除标记
+	Size      int64  // sst文件的总大小
+	StaleSize int64  // 已经过期、等待压缩回收的数据大小
+}
+
+// Stats LSM 的统计信息快照
+type Stats struct {
+	Levels []LevelStats
+
+	MemTableSize  int64 // 活跃内存表的大小
+	NumImmutables int   // 等待刷盘的不变内存表数量
+	ImmutableSize int64 // 不变内存表的总大小
+
+	BlockCacheHits   uint64
+	BlockCacheMisses uint64
+	IndexCacheHits   uint64
+	IndexCacheMisses uint64
+
+	BloomUseful        uint64 // 布隆过滤器判定key不存在，省去一次sst查找
+	BloomFalsePositive uint64 // 布隆过滤器判定key可能存在，但sst中并没有这个key
+
+	NumCompactions uint64
+	BytesRead      uint64        // 从sst中读取的block字节数，不包含缓存命中
+	BytesWritten   uint64        // flush和压缩写入sst的字节数
+	WriteStall     time.Duration // 写入等待不变内存表刷盘的总时间
+}
+
+// statCounters LSM 运行过程中累计的计数器，全部使用原子操作读写，统计时不需要加锁
+type statCounters struct {
+	memTableSize  int64
+	numImmutables int64
+	immutableSize int64
+
+	bloomUseful        uint64
+	bloomFalsePositive uint64
+
+	numCompactions uint64
+	bytesRead      uint64
+	bytesWritten   uint64
+	writeStall     int64 // 纳秒
+}
+
+// updateMemStats 记录内存表的大小，只在写协程中调用，Stats 读取时不需要访问 memTable 指针
+func (lsm *LSM) updateMemStats() {
+	var size int64
+	for _, mt := range lsm.immutables {
+		size += mt.Size()
+	}
+	atomic.StoreInt64(&lsm.stats.memTableSize, lsm.memTable.Size())
+	atomic.StoreInt64(&lsm.stats.numImmutables, int64(len(lsm.immutables)))
+	atomic.StoreInt64(&lsm.stats.immutableSize, size)
+}
+
+// Stats 返回LSM的统计信息，各层的数据和缓存命中数是所有列族之和
+// 各层的数据在 levelHandler 的读锁下收集，其余的计数都是原子读取，不会阻塞读写
+func (lsm *LSM) Stats() *Stats {
+	c := &lsm.stats
+	s := &Stats{
+		MemTableSize:       atomic.LoadInt64(&c.memTableSize),
+		NumImmutables:      int(atomic.LoadInt64(&c.numImmutables)),
+		ImmutableSize:      atomic.LoadInt64(&c.immutableSize),
+		BloomUseful:        atomic.LoadUint64(&c.bloomUseful),
+		BloomFalsePositive: atomic.LoadUint64(&c.bloomFalsePositive),
+		NumCompactions:     atomic.LoadUint64(&c.numCompactions),
+		BytesRead:          atomic.LoadUint64(&c.bytesRead),
+		BytesWritten:       atomic.LoadUint64(&c.bytesWritten),
+		WriteStall:         time.Duration(atomic.LoadInt64(&c.writeStall)),
+	}
+	for _, lm := range lsm.levelManagers() {
+		hits, misses := lm.cache.blocks.Metrics()
+		s.BlockCacheHits += hits
+		s.BlockCacheMisses += misses
+		hits, misses = lm.cache.indexs.Metrics()
+		s.IndexCacheHits += hits
+		s.IndexCacheMisses += misses
+		// 列族的层数可能不同，相同层号的数据累加
+		for i, lh := range lm.levels {
+			ls := lh.stats()
+			if i == len(s.Levels) {
+				s.Levels = append(s.Levels, ls)
+				continue
+			}
+			s.Levels[i].NumTables += ls.NumTables
+			s.Levels[i].NumKeys += ls.NumKeys
+			s.Levels[i].Size += ls.Size
+			s.Levels[i].StaleSize += ls.StaleSize
+		}
+	}
+	return s
+}
+
+// stats 统计当前层的信息
+func (lh *levelHandler) stats() LevelStats {
+	lh.RLock()
+	defer lh.RUnlock()
+	ls := LevelStats{
+		Level:     lh.levelNum,
+		NumTables: len(lh.tables),
+		Size:      lh.totalSize,
+		StaleSize: lh.totalStaleSize,
+	}
+	for _, t := range lh.tables {
+		ls.NumKeys += uint64(t.ss.Indexs().KeyCount)
+	}
+	return ls
+}
@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestStats(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.BloomFalsePositive = 0.01
+	c := make(chan map[uint32]int64, 16)
+	o.DiscardStatsCh = &c
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer lsm.Close()
+
+	for i := 0; i < 200; i++ {
+		key := utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1)
+		require.NoError(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("val%03d", i)))))
+	}
+	s := lsm.Stats()
+	require.Len(t, s.Levels, o.MaxLevelNum)
+	require.Greater(t, s.Levels[0].NumTables, 0)
+	require.Greater(t, s.Levels[0].NumKeys, uint64(0))
+	require.Greater(t, s.Levels[0].Size, int64(0))
+	require.Greater(t, s.MemTableSize, int64(0))
+	require.Greater(t, s.BytesWritten, uint64(0))
+	require.Greater(t, int64(s.WriteStall), int64(0))
+
+	// 第一次读取sst未命中缓存，再次读取命中缓存
+	key := utils.KeyWithTs([]byte("key000"), 1)
+	for i := 0; i < 2; i++ {
+		e, err := lsm.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("val000"), e.Value)
+	}
+	// 不存在的key会被布隆过滤器拦截
+	_, err = lsm.Get(utils.KeyWithTs([]byte("missing"), 1))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	s = lsm.Stats()
+	require.Greater(t, s.BlockCacheMisses, uint64(0))
+	require.Greater(t, s.BlockCacheHits, uint64(0))
+	require.Greater(t, s.IndexCacheMisses, uint64(0))
+	require.Greater(t, s.IndexCacheHits, uint64(0))
+	require.Greater(t, s.BytesRead, uint64(0))
+	require.Greater(t, s.BloomUseful, uint64(0))
+}
+
+func TestStatsColumnFamilies(t *testing.T) {
+	clearDir()
+	o := *opt
+	c := make(chan map[uint32]int64, 16)
+	o.DiscardStatsCh = &c
+	o.ColumnFamilies = map[string]*Options{"cf": {}}
+	lsm, err := NewLSM(&o)
+	require.NoError(t, err)
+	defer lsm.Close()
+
+	// 只写入列族，默认列族中没有数据
+	prefix := ColumnFamilyPrefix("cf")
+	for i := 0; i < 200; i++ {
+		key := utils.KeyWithTs(append(append([]byte{}, prefix...), fmt.Sprintf("key%03d", i)...), 1)
+		require.NoError(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("val%03d", i)))))
+	}
+	key := utils.KeyWithTs(append(append([]byte{}, prefix...), "key000"...), 1)
+	_, err = lsm.Get(key)
+	require.NoError(t, err)
+
+	s := lsm.Stats()
+	require.Len(t, s.Levels, o.MaxLevelNum)
+	require.Greater(t, s.Levels[0].NumTables, 0)
+	require.Greater(t, s.Levels[0].NumKeys, uint64(0))
+	require.Greater(t, s.Levels[0].Size, int64(0))
+	require.Greater(t, s.BlockCacheMisses, uint64(0))
+	require.Greater(t, s.IndexCacheMisses, uint64(0))
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"os"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -25,11 +24,8 @@ type table struct {
 }
 
 // openTable sst文件在内存中的一个句柄
-func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table {
-	sstSize := int(lm.opt.SSTableMaxSz)
-	if builder != nil {
-		sstSize = int(builder.done().size)
-	}
+// 失败时返回 utils.FileError，已经打开的文件会被关闭但不会被删除
+func openTable(lm *levelManager, tableName string, builder *tableBuilder) (*table, error) {
 	var (
 		t   *table
 		err error
@@ -38,36 +34,54 @@ func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table
 	// 对builder存在的情况 把buf flush到磁盘
 	if builder != nil {
 		if t, err = builder.flush(lm, tableName); err != nil {
-			utils.Err(err)
-			return nil
+			return nil, utils.NewFileError(utils.FileKindSST, tableName, err)
 		}
 	} else {
 		t = &table{lm: lm, fid: fid}
 		// 如果没有builder 则创打开一个已经存在的sst文件
-		t.ss = file.OpenSStable(&file.Options{
+		if t.ss, err = file.OpenSStable(&file.Options{
+			FID:      fid,
 			FileName: tableName,
 			Dir:      lm.opt.WorkDir,
-			Flag:     os.O_CREATE | os.O_RDWR,
-			MaxSz:    int(sstSize)})
+			Flag:     lm.opt.fileFlag(),
+			MaxSz:    0, // 按原大小打开，空文件或者损坏的文件不能被扩展到 SSTableMaxSz
+			DataKey:  lm.opt.KeyRegistry.DataKey(utils.FileKindSST, fid),
+			FS:       lm.opt.FS}); err != nil {
+			return nil, utils.NewFileError(utils.FileKindSST, tableName, err)
+		}
 	}
-	// 先要引用一下，否则后面使用迭代器会导致引用状态错误
-	t.IncrRef()
+	if err = t.init(); err != nil {
+		// 这里只关闭文件，DecrRef 会把文件删掉
+		_ = t.ss.Close()
+		return nil, utils.NewFileError(utils.FileKindSST, tableName, err)
+	}
+	return t, nil
+}
+
+// init 加载sst的index，并通过迭代器获取最大的key
+func (t *table) init() error {
 	//  初始化sst文件，把index加载进来
 	if err := t.ss.Init(); err != nil {
-		utils.Err(err)
-		return nil
+		return err
 	}
 
 	// 获取sst的最大key 需要使用迭代器
-	itr := t.NewIterator(&utils.Options{}) // 默认是降序
-	defer itr.Close()
+	// 迭代器关闭时会减少引用，这里不能使用 NewIterator 否则引用归零会删除文件
+	itr := &tableIterator{opt: &utils.Options{}, t: t, bi: &blockIterator{}} // 默认是降序
+	defer itr.bi.Close()
 	// 定位到初始位置就是最大的key
 	itr.Rewind()
-	utils.CondPanic(!itr.Valid(), errors.Errorf("failed to read index, form maxKey"))
+	if itr.err != nil || itr.Item() == nil {
+		if itr.err == nil || itr.err == io.EOF {
+			return errors.Errorf("failed to read index, form maxKey")
+		}
+		return itr.err
+	}
 	maxKey := itr.Item().Entry().Key
 	t.ss.SetMaxKey(maxKey)
-
-	return t
+	// 初始化成功后持有一个引用，引用归零时删除sst文件
+	t.IncrRef()
+	return nil
 }
 
 // Serach 从table中查找key
@@ -75,25 +89,27 @@ func (t *table) Serach(key []byte, maxVs *uint64) (entry *utils.Entry, err error
 	t.IncrRef()
 	defer t.DecrRef()
 	// 获取索引
-	idx := t.ss.Indexs()
+	idx := t.index()
 	// 检查key是否存在
 	bloomFilter := utils.Filter(idx.BloomFilter)
-	if t.ss.HasBloomFilter() && !bloomFilter.MayContainKey(key) {
+	if t.ss.HasBloomFilter() && !bloomFilter.MayContainKey(utils.ParseKey(key)) {
+		atomic.AddUint64(&t.lm.lsm.stats.bloomUseful, 1)
 		return nil, utils.ErrKeyNotFound
 	}
 	iter := t.NewIterator(&utils.Options{})
 	defer iter.Close()
 
 	iter.Seek(key)
-	if !iter.Valid() {
+	if !iter.Valid() || !utils.SameKey(key, iter.Item().Entry().Key) {
+		if t.ss.HasBloomFilter() {
+			atomic.AddUint64(&t.lm.lsm.stats.bloomFalsePositive, 1)
+		}
 		return nil, utils.ErrKeyNotFound
 	}
 
-	if utils.SameKey(key, iter.Item().Entry().Key) {
-		if version := utils.ParseTs(iter.Item().Entry().Key); *maxVs < version {
-			*maxVs = version
-			return iter.Item().Entry(), nil
-		}
+	if version := utils.ParseTs(iter.Item().Entry().Key); *maxVs < version {
+		*maxVs = version
+		return iter.Item().Entry(), nil
 	}
 	return nil, utils.ErrKeyNotFound
 }
@@ -101,6 +117,16 @@ func (t *table) Serach(key []byte, maxVs *uint64) (entry *utils.Entry, err error
 func (t *table) indexKey() uint64 {
 	return t.fid
 }
+
+// index 通过索引缓存获取sst的索引，未命中时把sst中的索引放入缓存
+func (t *table) index() *pb.TableIndex {
+	if idx, ok := t.lm.cache.indexs.Get(t.indexKey()); ok {
+		return idx.(*pb.TableIndex)
+	}
+	idx := t.ss.Indexs()
+	t.lm.cache.addIndex(t.indexKey(), idx)
+	return idx
+}
 func (t *table) getEntry(key, block []byte, idx int) (entry *utils.Entry, err error) {
 	if len(block) == 0 {
 		return nil, utils.ErrKeyNotFound
@@ -126,9 +152,11 @@ func (t *table) block(idx int) (*block, error) {
 	key := t.blockCacheKey(idx)
 	blk, ok := t.lm.cache.blocks.Get(key)
 	if ok && blk != nil {
+		t.lm.opt.Metrics.BlockCacheHits.Inc()
 		b, _ = blk.(*block)
 		return b, nil
 	}
+	t.lm.opt.Metrics.BlockCacheMisses.Inc()
 
 	var ko pb.BlockOffset
 	utils.CondPanic(!t.offsets(&ko, idx), fmt.Errorf("block t.offset id=%d", idx))
@@ -142,11 +170,15 @@ func (t *table) block(idx int) (*block, error) {
 			"failed to read from sstable: %d at offset: %d, len: %d",
 			t.ss.FID(), b.offset, ko.GetLen())
 	}
+	atomic.AddUint64(&t.lm.lsm.stats.bytesRead, uint64(len(b.data)))
 
 	readPos := len(b.data) - 4 // First read checksum length.
+	if readPos < 0 {
+		return nil, errors.Wrapf(utils.ErrBadChecksum, "block %d of sstable %d is too short", idx, t.fid)
+	}
 	b.chkLen = int(utils.BytesToU32(b.data[readPos : readPos+4]))
 
-	if b.chkLen > len(b.data) {
+	if b.chkLen > readPos {
 		return nil, errors.New("invalid checksum length. Either the data is " +
 			"corrupted or the table options are incorrectly set")
 	}
@@ -159,6 +191,15 @@ func (t *table) block(idx int) (*block, error) {
 	if err = b.verifyCheckSum(); err != nil {
 		return nil, err
 	}
+	// 解密时会分配新的内存，不会修改mmap中的数据
+	b.data = t.ss.DataKey().XOR(b.data, uint32(b.offset))
+	// 缓存中保存的是解压后的block
+	if ct := t.ss.Indexs().GetCompression(); ct != pb.CompressionType_NONE {
+		if b.data, err = decompressBlock(ct, b.data); err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress block %d of sstable %d", idx, t.fid)
+		}
+		readPos = len(b.data)
+	}
 
 	readPos -= 4
 	numEntries := int(utils.BytesToU32(b.data[readPos : readPos+4]))
@@ -225,6 +266,7 @@ func (it *tableIterator) Next() {
 		it.bi.blockID = it.blockPos
 		it.bi.setBlock(block)
 		it.bi.seekToFirst()
+		it.it = it.bi.Item()
 		it.err = it.bi.Error()
 		return
 	}
@@ -315,6 +357,10 @@ func (it *tableIterator) Seek(key []byte) {
 		return
 	}
 	it.seekHelper(idx-1, key)
+	if it.err == io.EOF && idx < len(it.t.ss.Indexs().GetOffsets()) {
+		// key 大于 idx-1 这个block中所有的key，那么第一个 >= key 的元素就是 idx 这个block的首个元素
+		it.seekHelper(idx, key)
+	}
 }
 
 func (it *tableIterator) seekHelper(blockIdx int, key []byte) {
@@ -352,7 +398,10 @@ func (t *table) GetCreatedAt() *time.Time {
 	return t.ss.GetCreatedAt()
 }
 func (t *table) Delete() error {
-	return t.ss.Detele()
+	if err := t.ss.Detele(); err != nil {
+		return err
+	}
+	return t.lm.opt.KeyRegistry.Delete(utils.FileKindSST, t.fid)
 }
 
 // StaleDataSize is the amount of stale data (that can be dropped by a compaction )in this SST.
@@ -363,6 +412,7 @@ func (t *table) DecrRef() error {
 	newRef := atomic.AddInt32(&t.ref, -1)
 	if newRef == 0 {
 		// TODO 从缓存中删除
+		t.lm.cache.indexs.Del(t.indexKey())
 		for i := 0; i < len(t.ss.Indexs().GetOffsets()); i++ {
 			t.lm.cache.blocks.Del(t.blockCacheKey(i))
 		}
@@ -0,0 +1,70 @@
+package jkv
+
+import (
+	"sync/atomic"
+
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// 托管模式下版本号由调用方分配，例如复制层使用主节点的提交时间戳
+// 写入只能通过 SetAt，读取通过 GetAt、NewTransactionAt 和 NewIteratorAt 指定读取的版本
+// 哪些旧版本不再被读取也由调用方决定，通过 SetDiscardTs 告诉压缩过程
+
+// SetAt 使用调用方指定的版本号写入一个entry，只能在托管模式下使用
+// e.Meta 带有 utils.BitDelete 时写入一个删除标记，写入不经过事务的冲突检测
+func (db *DB) SetAt(e *utils.Entry, version uint64) error {
+	switch {
+	case !db.opt.ManagedTxns:
+		return utils.ErrNotManagedTxn
+	case e == nil || len(e.Key) == 0:
+		return utils.ErrEmptyKey
+	case version == 0:
+		return utils.ErrInvalidRequest
+	}
+	entry := &utils.Entry{
+		Key:       utils.KeyWithTs(e.Key, version),
+		Value:     e.Value,
+		ExpiresAt: db.expiresAt(e),
+		Meta:      e.Meta,
+	}
+	req, err := db.sendToWriteCh([]*utils.Entry{entry})
+	if err != nil {
+		return err
+	}
+	if err := req.Wait(); err != nil {
+		return err
+	}
+	// 写入完成之后 Get 和 NewIterator 的读时间戳才会包含这个版本
+	db.orc.advanceTs(version)
+	return nil
+}
+
+// NewTransactionAt 创建读时间戳为 readTs 的只读事务，只能在托管模式下使用
+// 事务不会阻止压缩清理旧版本，调用方需要保证 readTs 不小于 SetDiscardTs 设置的时间戳
+func (db *DB) NewTransactionAt(readTs uint64) *Txn {
+	utils.CondPanic(!db.opt.ManagedTxns, utils.ErrNotManagedTxn)
+	txn := db.newTransaction(false, true)
+	txn.readTs = readTs
+	return txn
+}
+
+// NewIteratorAt 创建读时间戳为 readTs 的迭代器，只能在托管模式下使用
+func (db *DB) NewIteratorAt(opt *utils.Options, readTs uint64) utils.Iterator {
+	iter := db.NewTransactionAt(readTs).NewIterator(opt).(*DBIterator)
+	iter.ownTxn = true
+	return iter
+}
+
+// SetDiscardTs 设置托管模式下可以清理旧版本的时间戳，不大于 ts 的版本中每个key只保留最新的 NumVersionsToKeep 个
+// 非托管模式下由事务的读时间戳决定，设置的值会被忽略
+func (db *DB) SetDiscardTs(ts uint64) {
+	atomic.StoreUint64(&db.managedDiscardTs, ts)
+}
+
+// discardTs 返回压缩时可以清理旧版本的时间戳
+func (db *DB) discardTs() uint64 {
+	if db.opt.ManagedTxns {
+		return atomic.LoadUint64(&db.managedDiscardTs)
+	}
+	return db.orc.discardAtOrBelow()
+}
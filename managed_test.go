@@ -0,0 +1,103 @@
+package jkv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestManagedMode(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.Equal(t, utils.ErrNotManagedTxn, db.SetAt(utils.NewEntry([]byte("k"), []byte("v")), 1))
+	require.NoError(t, db.Close())
+
+	o := *opt
+	o.ManagedTxns = true
+	o.NumVersionsToKeep = 1
+	db, err = Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	require.Equal(t, utils.ErrManagedTxn, db.Set(utils.NewEntry([]byte("k"), []byte("v"))))
+	require.Equal(t, utils.ErrInvalidRequest, db.SetAt(utils.NewEntry([]byte("k"), []byte("v")), 0))
+
+	// 版本号可以乱序写入
+	key := []byte("replicated")
+	for _, version := range []uint64{30, 10, 20} {
+		require.NoError(t, db.SetAt(utils.NewEntry(key, []byte(fmt.Sprintf("v%d", version))), version))
+	}
+	require.NoError(t, db.SetAt(&utils.Entry{Key: key, Meta: utils.BitDelete}, 40))
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.SetAt(utils.NewEntry([]byte(fmt.Sprintf("other%02d", i)), []byte("v")), 25))
+	}
+
+	_, err = db.GetAt(key, 5)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+	for ts, want := range map[uint64]string{10: "v10", 15: "v10", 20: "v20", 39: "v30"} {
+		e, err := db.GetAt(key, ts)
+		require.NoError(t, err)
+		require.Equal(t, want, string(e.Value))
+	}
+	_, err = db.GetAt(key, 40)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+	// Get 读取已经写入的最大版本
+	_, err = db.Get(key)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	iter := db.NewIteratorAt(&utils.Options{IsAsc: true, Prefix: key}, 25)
+	iter.Rewind()
+	require.True(t, iter.Valid())
+	require.Equal(t, []byte("v20"), iter.Item().Entry().Value)
+	require.Equal(t, uint64(20), iter.Item().Entry().Version)
+	require.NoError(t, iter.Close())
+
+	iter = db.NewIteratorAt(&utils.Options{IsAsc: true, Prefix: []byte("other")}, 24)
+	iter.Rewind()
+	require.False(t, iter.Valid())
+	require.NoError(t, iter.Close())
+
+	require.Zero(t, db.discardTs())
+	db.SetDiscardTs(20)
+	require.Equal(t, uint64(20), db.discardTs())
+}
+
+// 托管模式下乱序写入的版本在重启之后都要重放，不能按LSM中的最大版本过滤
+func TestManagedReplayOutOfOrder(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ManagedTxns = true
+	db, err := Open(&o)
+	require.NoError(t, err)
+	require.NoError(t, db.SetAt(utils.NewEntry([]byte("k1"), []byte("v10")), 10))
+	// 较小的版本写入了vlog，写入LSM之前崩溃
+	req := &request{Entries: []*utils.Entry{{Key: utils.KeyWithTs([]byte("k2"), 5), Value: []byte("v5")}}}
+	require.NoError(t, db.vlog.write([]*request{req}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(&o)
+	require.NoError(t, err)
+	for key, want := range map[string]string{"k1": "v10", "k2": "v5"} {
+		e, err := db.GetAt([]byte(key), 10)
+		require.NoError(t, err, key)
+		require.Equal(t, want, string(e.Value))
+	}
+
+	// DropAll 之前的数据由vlog的head跳过，不会被重放
+	require.NoError(t, db.DropAll())
+	require.NoError(t, db.SetAt(utils.NewEntry([]byte("k3"), []byte("v1")), 1))
+	require.NoError(t, db.Close())
+	db, err = Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	for _, key := range []string{"k1", "k2"} {
+		_, err = db.GetAt([]byte(key), 10)
+		require.Equal(t, utils.ErrKeyNotFound, err, key)
+	}
+	e, err := db.GetAt([]byte("k3"), 10)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(e.Value))
+}
@@ -0,0 +1,150 @@
+package jkv
+
+import (
+	"bytes"
+
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// Merge 写入一个合并操作数，不需要先读取旧值，读取时通过 Options.MergeOperator 与更早的版本合并
+// 适用于计数器、追加列表等读改写的场景，多个 Merge 之间不会产生冲突
+func (db *DB) Merge(key, operand []byte) error {
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	if err := txn.Merge(key, operand); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// Merge 在事务中写入一个合并操作数，事务中同一个key只保留一个写入，因此会与之前未提交的写入合并
+func (txn *Txn) Merge(key, operand []byte) error {
+	op := txn.db.opt.MergeOperator
+	if op == nil {
+		return utils.ErrNoMergeOperator
+	}
+	// value 为nil的entry会被当作删除
+	e := &utils.Entry{
+		Key:   key,
+		Value: append([]byte{}, operand...),
+		Meta:  utils.BitMergeOperand,
+	}
+	if prev, has := txn.pendingWrites[string(key)]; has {
+		switch {
+		case prev.Meta&utils.BitMergeOperand > 0:
+			// 结合律保证可以先合并两个操作数
+			e.Value = lsm.MergeValues(op, key, prev.Value, [][]byte{operand})
+		case prev.IsDeletedOrExpired():
+			e = &utils.Entry{Key: key, Value: lsm.MergeValues(op, key, nil, [][]byte{operand})}
+		default:
+			e = &utils.Entry{
+				Key:       key,
+				Value:     lsm.MergeValues(op, key, prev.Value, [][]byte{operand}),
+				ExpiresAt: prev.ExpiresAt,
+			}
+		}
+	}
+	return txn.modify(e)
+}
+
+// mergePending 把事务中未提交的合并操作数合并到快照中的值上
+func (txn *Txn) mergePending(key []byte, pending *utils.Entry) (*utils.Entry, error) {
+	op := txn.db.opt.MergeOperator
+	if op == nil {
+		return nil, utils.ErrNoMergeOperator
+	}
+	txn.addReadKey(key)
+	var existing []byte
+	e, err := txn.db.get(key, txn.readTs)
+	switch {
+	case err == nil:
+		existing = e.Value
+	case err != utils.ErrKeyNotFound:
+		return nil, err
+	}
+	return &utils.Entry{
+		Key:     key,
+		Value:   lsm.MergeValues(op, key, existing, [][]byte{pending.Value}),
+		Version: txn.readTs,
+	}, nil
+}
+
+// getMerged key 在 readTs 时刻可见的最新版本是合并操作数时，通过迭代器在同一个快照中读取更早的版本并合并
+// 两次单独的查询之间压缩可能会改变sst，迭代器持有sst的引用可以保证看到的版本是一致的
+func (db *DB) getMerged(key []byte, readTs uint64) (*utils.Entry, error) {
+	it := lsm.NewMergeIterator(db.lsm.NewIterators(&utils.Options{IsAsc: true}), false)
+	defer it.Close()
+	it.Seek(utils.KeyWithTs(key, readTs))
+	if !it.Valid() || !bytes.Equal(utils.ParseKey(it.Item().Entry().Key), key) {
+		return nil, utils.ErrKeyNotFound
+	}
+	e := it.Item().Entry()
+	res := &utils.Entry{
+		Key:       key,
+		ExpiresAt: e.ExpiresAt,
+		Meta:      e.Meta &^ (utils.BitValuePointer | utils.BitMergeOperand),
+		Version:   utils.ParseTs(e.Key),
+	}
+	if e.Meta&utils.BitMergeOperand == 0 {
+		// 与 lsm.Get 的结果之间发生了压缩，合并操作数已经被合并为完整的值
+		if e.IsDeletedOrExpired() {
+			return nil, utils.ErrKeyNotFound
+		}
+		value, err := db.readValue(e)
+		if err != nil {
+			return nil, err
+		}
+		res.Value = value
+		return res, nil
+	}
+	value, err := db.readMerged(key, it)
+	if err != nil {
+		return nil, err
+	}
+	res.Value = value
+	return res, nil
+}
+
+// readMerged 从 it 当前位置的合并操作数开始，依次读取同一个key更早的版本，直到遇到完整的值、删除标记或者没有更早的版本
+// 返回合并后的值，it 停在第一个没有参与合并的位置
+func (db *DB) readMerged(key []byte, it utils.Iterator) ([]byte, error) {
+	op := db.opt.MergeOperator
+	if op == nil {
+		return nil, utils.ErrNoMergeOperator
+	}
+	var operands [][]byte
+	var existing []byte
+	for ; it.Valid(); it.Next() {
+		e := it.Item().Entry()
+		if !bytes.Equal(utils.ParseKey(e.Key), key) || e.IsDeletedOrExpired() {
+			break
+		}
+		value, err := db.readValue(e)
+		if err != nil {
+			return nil, err
+		}
+		if e.Meta&utils.BitMergeOperand == 0 {
+			existing = value
+			it.Next()
+			break
+		}
+		operands = append(operands, value)
+	}
+	return lsm.MergeValues(op, key, existing, operands), nil
+}
+
+// readValue 返回 e 的值的副本，值指针会从 vlog 中读取
+func (db *DB) readValue(e *utils.Entry) ([]byte, error) {
+	if !utils.IsValuePtr(e) {
+		return append([]byte{}, e.Value...), nil
+	}
+	var vp utils.ValuePtr
+	vp.Decode(e.Value)
+	result, cb, err := db.vlog.read(&vp)
+	defer utils.RunCallback(cb)
+	if err != nil {
+		return nil, err
+	}
+	return utils.SafeCopy(nil, result), nil
+}
@@ -0,0 +1,121 @@
+package jkv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// counterOperator 把8字节的操作数累加到已有的值上
+type counterOperator struct{}
+
+func (counterOperator) Merge(key, existing, operand []byte) []byte {
+	var sum uint64
+	if len(existing) == 8 {
+		sum = binary.BigEndian.Uint64(existing)
+	}
+	res := make([]byte, 8)
+	binary.BigEndian.PutUint64(res, sum+binary.BigEndian.Uint64(operand))
+	return res
+}
+
+func counter(n uint64) []byte {
+	res := make([]byte, 8)
+	binary.BigEndian.PutUint64(res, n)
+	return res
+}
+
+func TestMerge(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.MergeOperator = counterOperator{}
+	db, err := Open(&o)
+	require.NoError(t, err)
+
+	// 操作数分布在 memtable 和多个sst中
+	for round := 1; round <= 5; round++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("counter%03d", i))
+			if round == 1 && i%2 == 0 {
+				require.NoError(t, db.Set(utils.NewEntry(key, counter(100))))
+				continue
+			}
+			require.NoError(t, db.Merge(key, counter(uint64(round))))
+		}
+	}
+	want := func(i int) []byte {
+		if i%2 == 0 {
+			return counter(100 + 2 + 3 + 4 + 5)
+		}
+		return counter(1 + 2 + 3 + 4 + 5)
+	}
+	check := func(db *DB) {
+		for i := 0; i < 50; i++ {
+			e, err := db.Get([]byte(fmt.Sprintf("counter%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, want(i), e.Value)
+			require.Zero(t, e.Meta&utils.BitMergeOperand)
+		}
+		iter := db.NewIterator(&utils.Options{IsAsc: true})
+		defer func() { _ = iter.Close() }()
+		i := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			e := iter.Item().Entry()
+			require.Equal(t, []byte(fmt.Sprintf("counter%03d", i)), e.Key)
+			require.Equal(t, want(i), e.Value)
+			i++
+		}
+		require.Equal(t, 50, i)
+	}
+	check(db)
+	require.NoError(t, db.Close())
+	db, err = Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	check(db)
+
+	// 删除之后重新从空值开始合并
+	key := []byte("counter000")
+	require.NoError(t, db.Del(key))
+	require.NoError(t, db.Merge(key, counter(7)))
+	e, err := db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, counter(7), e.Value)
+
+	// 事务中的合并操作数与快照中的值以及之前未提交的写入合并
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	require.NoError(t, txn.Merge(key, counter(1)))
+	require.NoError(t, txn.Merge(key, counter(2)))
+	e, err = txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, counter(10), e.Value)
+	require.NoError(t, txn.Set(key, counter(1)))
+	require.NoError(t, txn.Merge(key, counter(2)))
+	require.Equal(t, byte(0), txn.pendingWrites[string(key)].Meta)
+	require.NoError(t, txn.Commit())
+	e, err = db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, counter(3), e.Value)
+
+	// 只写入合并操作数的事务之间不会冲突
+	t1, t2 := db.NewTransaction(true), db.NewTransaction(true)
+	require.NoError(t, t1.Merge(key, counter(1)))
+	require.NoError(t, t2.Merge(key, counter(1)))
+	require.NoError(t, t1.Commit())
+	require.NoError(t, t2.Commit())
+	e, err = db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, counter(5), e.Value)
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.Equal(t, utils.ErrNoMergeOperator, db.Merge([]byte("key"), counter(1)))
+}
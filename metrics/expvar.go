@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+)
+
+// PublishExpvar 把所有指标以 name 为名字发布到 expvar，通过 /debug/vars 查看
+// expvar 是进程全局的，同一个名字只能发布一次，重复发布时返回错误
+func (r *Registry) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("metrics: expvar %q already published", name)
+	}
+	expvar.Publish(name, expvar.Func(r.expvarValue))
+	return nil
+}
+
+// expvarValue 每次读取 expvar 时重新收集，计数器和瞬时值直接输出数值，直方图输出分桶信息
+func (r *Registry) expvarValue() interface{} {
+	vars := make(map[string]interface{})
+	r.each(func(m interface{}) {
+		switch m := m.(type) {
+		case *Counter:
+			vars[m.name] = m.Value()
+		case *Gauge:
+			vars[m.name] = m.Value()
+		case *Histogram:
+			s := m.Snapshot()
+			buckets := make(map[string]uint64, len(s.Buckets))
+			for i, le := range s.Buckets {
+				buckets[formatFloat(le)] = s.Counts[i]
+			}
+			vars[m.name] = map[string]interface{}{
+				"count":   s.Count,
+				"sum":     s.Sum.Seconds(),
+				"buckets": buckets,
+			}
+		}
+	})
+	return vars
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// 所有的指标都可以为 nil，nil 指标的操作为空操作，未开启统计时热路径上没有额外开销
+
+// Counter 只增不减的计数器
+type Counter struct {
+	desc
+	v uint64
+}
+
+// Inc 计数加一
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add 计数增加 n
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value 当前的计数
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge 可以任意设置的瞬时值
+type Gauge struct {
+	desc
+	v int64
+}
+
+// Set 设置当前值
+func (g *Gauge) Set(v int64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreInt64(&g.v, v)
+}
+
+// Add 当前值增加 n，n 可以为负数
+func (g *Gauge) Add(n int64) {
+	if g == nil {
+		return
+	}
+	atomic.AddInt64(&g.v, n)
+}
+
+// Value 当前值
+func (g *Gauge) Value() int64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&g.v)
+}
+
+// DefLatencyBuckets 默认的延迟分桶上界，单位为秒
+var DefLatencyBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// Histogram 延迟直方图，每个桶单独计数，导出时再累加成 Prometheus 要求的累积分布
+type Histogram struct {
+	desc
+	buckets []float64 // 每个桶的上界，单位为秒，升序
+	counts  []uint64  // 最后一个是 +Inf 桶
+	count   uint64
+	sum     int64 // 纳秒
+}
+
+func newHistogram(d desc, buckets []float64) *Histogram {
+	return &Histogram{
+		desc:    d,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe 记录一次耗时
+func (h *Histogram) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	s := d.Seconds()
+	i := 0
+	for i < len(h.buckets) && s > h.buckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Since 记录从 start 开始到现在的耗时，一般配合 defer 使用
+func (h *Histogram) Since(start time.Time) {
+	if h == nil {
+		return
+	}
+	h.Observe(time.Since(start))
+}
+
+// HistogramSnapshot 直方图某一时刻的数据
+type HistogramSnapshot struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []float64 // 桶的上界，与 Counts 一一对应，最后一个为 +Inf
+	Counts  []uint64  // 小于等于对应上界的累积次数
+}
+
+// Snapshot 返回直方图的快照，各个桶是分别原子读取的，并发写入时 Count 与各桶之间可能有微小的偏差
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	if h == nil {
+		return HistogramSnapshot{}
+	}
+	s := HistogramSnapshot{
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+		Buckets: append(append([]float64{}, h.buckets...), math.Inf(1)),
+		Counts:  make([]uint64, len(h.counts)),
+	}
+	var cum uint64
+	for i := range h.counts {
+		cum += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = cum
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+// Package metrics jkv 的运行指标，可以通过 expvar 或 Prometheus 文本格式导出
+//
+//	m := metrics.New("jkv")
+//	opt.Metrics = m
+//	_ = m.PublishExpvar("jkv")
+//	http.Handle("/metrics", m.Handler())
+package metrics
+
+// Metrics jkv 各个模块使用的指标集合
+// 零值的 Metrics 所有指标都是 nil，相当于关闭统计
+type Metrics struct {
+	*Registry
+
+	Gets       *Counter
+	GetLatency *Histogram
+	Sets       *Counter   // 写入的entry数量，包含删除和事务提交
+	SetLatency *Histogram // 写请求从进入写队列到写入完成的耗时
+
+	Iterators           *Counter
+	IteratorSeekLatency *Histogram // Seek 和 Rewind 的耗时
+
+	PendingWrites *Gauge
+
+	Flushes      *Counter
+	FlushLatency *Histogram
+
+	Compactions       *Counter
+	CompactionLatency *Histogram
+
+	VlogGCRuns    *Counter
+	VlogGCLatency *Histogram
+
+	BlockCacheHits   *Counter
+	BlockCacheMisses *Counter
+}
+
+// New 创建并注册全部指标，namespace 会作为指标名的前缀
+func New(namespace string) *Metrics {
+	r := NewRegistry(namespace)
+	return &Metrics{
+		Registry: r,
+
+		Gets:       r.NewCounter("gets_total", "Number of Get calls."),
+		GetLatency: r.NewHistogram("get_latency_seconds", "Latency of Get calls.", nil),
+		Sets:       r.NewCounter("sets_total", "Number of entries written, including deletes."),
+		SetLatency: r.NewHistogram("set_latency_seconds", "Latency of write requests from enqueue to completion.", nil),
+
+		Iterators:           r.NewCounter("iterators_total", "Number of iterators created."),
+		IteratorSeekLatency: r.NewHistogram("iterator_seek_latency_seconds", "Latency of iterator Seek and Rewind.", nil),
+
+		PendingWrites: r.NewGauge("pending_writes", "Number of write requests waiting to be written."),
+
+		Flushes:      r.NewCounter("flushes_total", "Number of memtables flushed to level 0."),
+		FlushLatency: r.NewHistogram("flush_latency_seconds", "Latency of memtable flushes.", nil),
+
+		Compactions:       r.NewCounter("compactions_total", "Number of compactions finished."),
+		CompactionLatency: r.NewHistogram("compaction_latency_seconds", "Latency of compactions.", nil),
+
+		VlogGCRuns:    r.NewCounter("vlog_gc_runs_total", "Number of value log GC runs."),
+		VlogGCLatency: r.NewHistogram("vlog_gc_latency_seconds", "Latency of value log GC runs.", nil),
+
+		BlockCacheHits:   r.NewCounter("block_cache_hits_total", "Number of block cache hits."),
+		BlockCacheMisses: r.NewCounter("block_cache_misses_total", "Number of block cache misses."),
+	}
+}
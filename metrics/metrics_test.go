@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilMetrics(t *testing.T) {
+	// 零值的 Metrics 不做任何统计，也不会 panic
+	m := &Metrics{}
+	m.Gets.Inc()
+	m.PendingWrites.Set(3)
+	m.GetLatency.Since(time.Now())
+	require.Zero(t, m.Gets.Value())
+	require.Zero(t, m.PendingWrites.Value())
+	require.Zero(t, m.GetLatency.Snapshot().Count)
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry("")
+	h := r.NewHistogram("latency", "", []float64{0.001, 0.01})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+	s := h.Snapshot()
+	require.Equal(t, uint64(3), s.Count)
+	require.Equal(t, []uint64{1, 2, 3}, s.Counts)
+	require.Equal(t, time.Second+5500*time.Microsecond, s.Sum)
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	m := New("jkv")
+	m.Gets.Add(2)
+	m.PendingWrites.Set(5)
+	m.GetLatency.Observe(time.Millisecond)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, prometheusContentType, w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# HELP jkv_gets_total Number of Get calls.",
+		"# TYPE jkv_gets_total counter",
+		"jkv_gets_total 2",
+		"# TYPE jkv_pending_writes gauge",
+		"jkv_pending_writes 5",
+		"# TYPE jkv_get_latency_seconds histogram",
+		`jkv_get_latency_seconds_bucket{le="0.0005"} 0`,
+		`jkv_get_latency_seconds_bucket{le="0.001"} 1`,
+		`jkv_get_latency_seconds_bucket{le="+Inf"} 1`,
+		"jkv_get_latency_seconds_sum 0.001",
+		"jkv_get_latency_seconds_count 1",
+	} {
+		require.Contains(t, strings.Split(body, "\n"), line)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	m := New("jkv")
+	m.Sets.Add(7)
+	require.NoError(t, m.PublishExpvar("jkv_test"))
+	require.Error(t, m.PublishExpvar("jkv_test"))
+
+	var vars map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("jkv_test").String()), &vars))
+	require.Equal(t, float64(7), vars["jkv_sets_total"])
+	require.Contains(t, vars, "jkv_flush_latency_seconds")
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	r := NewRegistry("jkv")
+	r.NewCounter("gets_total", "")
+	require.Panics(t, func() { r.NewGauge("gets_total", "") })
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler 以 Prometheus 文本格式导出所有指标
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		_ = r.WritePrometheus(w)
+	})
+}
+
+// WritePrometheus 把所有指标以 Prometheus 文本格式写入 w
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	r.each(func(m interface{}) {
+		switch m := m.(type) {
+		case *Counter:
+			writeHeader(bw, m.desc, "counter")
+			fmt.Fprintf(bw, "%s %d\n", m.name, m.Value())
+		case *Gauge:
+			writeHeader(bw, m.desc, "gauge")
+			fmt.Fprintf(bw, "%s %d\n", m.name, m.Value())
+		case *Histogram:
+			writeHeader(bw, m.desc, "histogram")
+			s := m.Snapshot()
+			for i, le := range s.Buckets {
+				fmt.Fprintf(bw, "%s_bucket{le=\"%s\"} %d\n", m.name, formatFloat(le), s.Counts[i])
+			}
+			fmt.Fprintf(bw, "%s_sum %s\n", m.name, formatFloat(s.Sum.Seconds()))
+			fmt.Fprintf(bw, "%s_count %d\n", m.name, s.Count)
+		}
+	})
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, d desc, typ string) {
+	if d.help != "" {
+		help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+		fmt.Fprintf(w, "# HELP %s %s\n", d.name, help)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, typ)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
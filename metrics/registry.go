@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+)
+
+type desc struct {
+	name string
+	help string
+}
+
+// Name 指标的全名，包含命名空间
+func (d desc) Name() string { return d.name }
+
+// Registry 按注册顺序保存一组指标，用于统一导出
+type Registry struct {
+	sync.RWMutex
+	namespace string
+	metrics   []interface{} // *Counter, *Gauge, *Histogram
+	names     map[string]struct{}
+}
+
+// NewRegistry 创建一个指标注册表，所有指标名都会加上 namespace 前缀
+func NewRegistry(namespace string) *Registry {
+	return &Registry{namespace: namespace, names: make(map[string]struct{})}
+}
+
+func (r *Registry) register(name, help string) desc {
+	if r.namespace != "" {
+		name = r.namespace + "_" + name
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", name))
+	}
+	r.names[name] = struct{}{}
+	return desc{name: name, help: help}
+}
+
+func (r *Registry) add(m interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounter 注册一个计数器
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{desc: r.register(name, help)}
+	r.add(c)
+	return c
+}
+
+// NewGauge 注册一个瞬时值
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: r.register(name, help)}
+	r.add(g)
+	return g
+}
+
+// NewHistogram 注册一个延迟直方图，buckets 为空时使用 DefLatencyBuckets
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefLatencyBuckets
+	}
+	h := newHistogram(r.register(name, help), buckets)
+	r.add(h)
+	return h
+}
+
+// each 按注册顺序遍历所有指标
+func (r *Registry) each(fn func(m interface{})) {
+	r.RLock()
+	ms := r.metrics
+	r.RUnlock()
+	for _, m := range ms {
+		fn(m)
+	}
+}
@@ -1,11 +1,18 @@
 package jkv
 
-import "github.com/vvvvjvvvv/jkv/utils"
+import (
+	"github.com/vvvvjvvvv/jkv/lsm"
+	"github.com/vvvvjvvvv/jkv/metrics"
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
 
 // Options jkv 总的配置文件
 type Options struct {
 	ValueThreshold      int64
 	WorkDir             string
+	ValueDir            string // vlog 文件所在的目录，为空时与 WorkDir 相同
 	MemTableSize        int64
 	SSTableMaxSz        int64
 	MaxBatchCount       int64
@@ -15,15 +22,71 @@ type Options struct {
 	ValueLogMaxEntries  uint32
 	LogRotatesToFlush   int32
 	MaxTableSize        int64
+
+	// Compression sst中block的压缩算法，修改后只影响新生成的sst，已有的sst仍然可以读取
+	Compression          pb.CompressionType
+	ZSTDCompressionLevel int // zstd 的压缩级别，0 表示使用 zstd 的默认级别
+
+	// EncryptionKey 主密钥，长度为 16、24 或 32 字节，分别对应 AES-128、AES-192 和 AES-256
+	// 为空时不加密；启用加密之后每次打开都需要提供相同的主密钥，更换主密钥使用 RotateEncryptionKey
+	EncryptionKey []byte
+
+	// CompactionFilter 在压缩时按照业务规则删除或者改写数据，为空时不过滤
+	CompactionFilter lsm.CompactionFilter
+	// MergeOperator 使用 Merge 写入时必须设置，读取和压缩时用于合并操作数
+	MergeOperator lsm.MergeOperator
+	// NumVersionsToKeep 每个key最多保留的版本数，压缩时清理没有读事务使用的更早版本，小于等于0时保留所有版本
+	NumVersionsToKeep int
+	// ManagedTxns 托管模式，版本号由调用方通过 SetAt 指定，事务提交会返回 ErrManagedTxn
+	// 读取使用 GetAt、NewTransactionAt 和 NewIteratorAt，可以清理的旧版本由 SetDiscardTs 指定
+	ManagedTxns bool
+	// ReadOnly 只读打开，用于分析或者排查问题时打开数据库的副本
+	// 打开时不会截断 wal、重写 MANIFEST 或者删除任何文件，也不启动压缩、vlog GC 和 discard stats 的持久化
+	// wal 中的数据只重放到内存表中；所有的写入都返回 ErrReadOnly，目录上加的是共享锁，可以同时被多个只读实例打开
+	ReadOnly bool
+	// InMemory 纯内存模式，内存表、wal、vlog 和 sst 都只保存在内存中，不会创建任何文件，也不会刷盘
+	// 刷盘和压缩仍然会执行，行为与磁盘上的引擎一致；关闭之后数据随之丢失，适合测试和缓存
+	// 不能与 ReadOnly、EncryptionKey 同时使用，Checkpoint 和 IngestExternalFiles 返回 ErrInMemory
+	InMemory bool
+	// SyncWrites 每批写入在返回之前把vlog和wal刷盘，掉电之后不会丢失已经返回成功的写入
+	// 为false时写入只在内存表刷盘、vlog切换文件和关闭时落盘，掉电可能丢失最近的写入
+	SyncWrites bool
+	// FS 访问数据文件、MANIFEST、KEYREGISTRY 和目录锁使用的文件系统，为nil时使用 vfs.OS
+	// 可以使用 vfs.NewMem 创建的内存文件系统，或者包装 vfs.OS 实现统计、配额和故障注入
+	FS vfs.FS
+
+	// Metrics 运行指标，为空时不统计，通过 metrics.New 创建后可以导出到 expvar 和 Prometheus
+	Metrics *metrics.Metrics
+
+	// ColumnFamilies 列族的名称和配置，每个列族有独立的内存表和sst，可以单独设置 BlockSize、BloomFalsePositive、TTL 等
+	// 所有列族共用 wal、vlog 和 manifest，因此一个事务可以原子地写入多个列族
+	// 配置中为零值的字段使用默认列族的配置，已经写入数据的列族在重新打开时必须继续配置
+	ColumnFamilies map[string]*lsm.Options
 }
 
 // NewDefaultOptions 返回默认的options
 func NewDefaultOptions() *Options {
 	opt := &Options{
-		WorkDir:      "./work_test",
-		MemTableSize: 1024,
-		SSTableMaxSz: 1 << 30,
+		WorkDir:       "./work_test",
+		MemTableSize:  1024,
+		SSTableMaxSz:  1 << 30,
+		MaxBatchCount: utils.KVWriteChCapacity,
+		MaxBatchSize:  utils.Mi,
 	}
 	opt.ValueThreshold = utils.DefaultValueThreshold
+	opt.NumVersionsToKeep = 1
 	return opt
 }
+
+// fs 返回访问文件使用的文件系统
+func (opt *Options) fs() vfs.FS {
+	return vfs.Default(opt.FS)
+}
+
+// valueDir 返回vlog文件所在的目录
+func (opt *Options) valueDir() string {
+	if opt.ValueDir == "" {
+		return opt.WorkDir
+	}
+	return opt.ValueDir
+}
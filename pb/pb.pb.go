@@ -22,6 +22,34 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type CompressionType int32
+
+const (
+	CompressionType_NONE   CompressionType = 0
+	CompressionType_SNAPPY CompressionType = 1
+	CompressionType_ZSTD   CompressionType = 2
+)
+
+var CompressionType_name = map[int32]string{
+	0: "NONE",
+	1: "SNAPPY",
+	2: "ZSTD",
+}
+
+var CompressionType_value = map[string]int32{
+	"NONE":   0,
+	"SNAPPY": 1,
+	"ZSTD":   2,
+}
+
+func (x CompressionType) String() string {
+	return proto.EnumName(CompressionType_name, int32(x))
+}
+
+func (CompressionType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_f80abaa17e25ccc8, []int{0}
+}
+
 type ManifestChange_Operation int32
 
 const (
@@ -234,6 +262,7 @@ type ManifestChange struct {
 	Op                   ManifestChange_Operation `protobuf:"varint,2,opt,name=Op,proto3,enum=pb.ManifestChange_Operation" json:"Op,omitempty"`
 	Level                uint32                   `protobuf:"varint,3,opt,name=Level,proto3" json:"Level,omitempty"`
 	Checksum             []byte                   `protobuf:"bytes,4,opt,name=Checksum,proto3" json:"Checksum,omitempty"`
+	ColumnFamily         string                   `protobuf:"bytes,5,opt,name=ColumnFamily,proto3" json:"ColumnFamily,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}                 `json:"-"`
 	XXX_unrecognized     []byte                   `json:"-"`
 	XXX_sizecache        int32                    `json:"-"`
@@ -300,15 +329,23 @@ func (m *ManifestChange) GetChecksum() []byte {
 	return nil
 }
 
+func (m *ManifestChange) GetColumnFamily() string {
+	if m != nil {
+		return m.ColumnFamily
+	}
+	return ""
+}
+
 type TableIndex struct {
-	Offsets              []*BlockOffset `protobuf:"bytes,1,rep,name=offsets,proto3" json:"offsets,omitempty"`
-	BloomFilter          []byte         `protobuf:"bytes,2,opt,name=bloom_filter,json=bloomFilter,proto3" json:"bloom_filter,omitempty"`
-	MaxVersion           uint64         `protobuf:"varint,3,opt,name=max_version,json=maxVersion,proto3" json:"max_version,omitempty"`
-	KeyCount             uint32         `protobuf:"varint,4,opt,name=key_count,json=keyCount,proto3" json:"key_count,omitempty"`
-	StaleDataSize        uint32         `protobuf:"varint,5,opt,name=stale_data_size,json=staleDataSize,proto3" json:"stale_data_size,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	Offsets              []*BlockOffset  `protobuf:"bytes,1,rep,name=offsets,proto3" json:"offsets,omitempty"`
+	BloomFilter          []byte          `protobuf:"bytes,2,opt,name=bloom_filter,json=bloomFilter,proto3" json:"bloom_filter,omitempty"`
+	MaxVersion           uint64          `protobuf:"varint,3,opt,name=max_version,json=maxVersion,proto3" json:"max_version,omitempty"`
+	KeyCount             uint32          `protobuf:"varint,4,opt,name=key_count,json=keyCount,proto3" json:"key_count,omitempty"`
+	StaleDataSize        uint32          `protobuf:"varint,5,opt,name=stale_data_size,json=staleDataSize,proto3" json:"stale_data_size,omitempty"`
+	Compression          CompressionType `protobuf:"varint,6,opt,name=compression,proto3,enum=pb.CompressionType" json:"compression,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
 }
 
 func (m *TableIndex) Reset()         { *m = TableIndex{} }
@@ -379,6 +416,13 @@ func (m *TableIndex) GetStaleDataSize() uint32 {
 	return 0
 }
 
+func (m *TableIndex) GetCompression() CompressionType {
+	if m != nil {
+		return m.Compression
+	}
+	return CompressionType_NONE
+}
+
 type BlockOffset struct {
 	Key                  []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
 	Offset               uint32   `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
@@ -443,6 +487,7 @@ func (m *BlockOffset) GetLen() uint32 {
 }
 
 func init() {
+	proto.RegisterEnum("pb.CompressionType", CompressionType_name, CompressionType_value)
 	proto.RegisterEnum("pb.ManifestChange_Operation", ManifestChange_Operation_name, ManifestChange_Operation_value)
 	proto.RegisterType((*KV)(nil), "pb.KV")
 	proto.RegisterType((*KVList)(nil), "pb.KVList")
@@ -455,38 +500,41 @@ func init() {
 func init() { proto.RegisterFile("pb.proto", fileDescriptor_f80abaa17e25ccc8) }
 
 var fileDescriptor_f80abaa17e25ccc8 = []byte{
-	// 488 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x52, 0x5d, 0x6e, 0xda, 0x40,
-	0x10, 0xce, 0x1a, 0x62, 0x60, 0xf8, 0x09, 0x5d, 0x55, 0x91, 0xd5, 0xb4, 0x94, 0xba, 0x52, 0x45,
-	0xa5, 0x88, 0x87, 0xf4, 0x04, 0x84, 0x50, 0x09, 0x41, 0x84, 0xb4, 0x41, 0xbc, 0x5a, 0x6b, 0x18,
-	0x1a, 0xcb, 0xc6, 0xb6, 0xbc, 0x8b, 0x05, 0x39, 0x48, 0xd5, 0x0b, 0xf4, 0x1e, 0x7d, 0xec, 0x63,
-	0x8f, 0x50, 0xd1, 0x8b, 0x54, 0x1e, 0xec, 0xa8, 0x51, 0xf3, 0x36, 0xdf, 0x37, 0xb3, 0xa3, 0x6f,
-	0xbf, 0x6f, 0xa0, 0x1a, 0xbb, 0xfd, 0x38, 0x89, 0x74, 0xc4, 0x8d, 0xd8, 0xb5, 0xbf, 0x32, 0x30,
-	0x26, 0x0b, 0xde, 0x86, 0x92, 0x8f, 0x7b, 0x8b, 0x75, 0x59, 0xaf, 0x21, 0xb2, 0x92, 0xbf, 0x84,
-	0xd3, 0x54, 0x06, 0x5b, 0xb4, 0x0c, 0xe2, 0x8e, 0x80, 0x5f, 0x40, 0x6d, 0xab, 0x30, 0x71, 0x36,
-	0xa8, 0xa5, 0x55, 0xa2, 0x4e, 0x35, 0x23, 0x6e, 0x51, 0x4b, 0x6e, 0x41, 0x25, 0xc5, 0x44, 0x79,
-	0x51, 0x68, 0x95, 0xbb, 0xac, 0x57, 0x16, 0x05, 0xe4, 0x6f, 0x00, 0x70, 0x17, 0x7b, 0x09, 0x2a,
-	0x47, 0x6a, 0xeb, 0x94, 0x9a, 0xb5, 0x9c, 0x19, 0x68, 0xce, 0xa1, 0x4c, 0x0b, 0x4d, 0x5a, 0x48,
-	0xb5, 0xdd, 0x05, 0x73, 0xb2, 0x98, 0x7a, 0x4a, 0xf3, 0x73, 0x30, 0xfc, 0xd4, 0x62, 0xdd, 0x52,
-	0xaf, 0x7e, 0x65, 0xf6, 0x63, 0xb7, 0x3f, 0x59, 0x08, 0xc3, 0x4f, 0xed, 0x01, 0xbc, 0xb8, 0x95,
-	0xa1, 0xb7, 0x46, 0xa5, 0x87, 0xf7, 0x32, 0xfc, 0x82, 0x77, 0xa8, 0xf9, 0x25, 0x54, 0x96, 0x04,
-	0x54, 0xfe, 0x82, 0x67, 0x2f, 0x9e, 0xce, 0x89, 0x62, 0xc4, 0xfe, 0xce, 0xa0, 0xf5, 0xb4, 0xc7,
-	0x5b, 0x60, 0x8c, 0x57, 0x64, 0x44, 0x59, 0x18, 0xe3, 0x15, 0xbf, 0x04, 0x63, 0x16, 0x93, 0x09,
-	0xad, 0xab, 0xd7, 0xff, 0xef, 0xea, 0xcf, 0x62, 0x4c, 0xa4, 0xf6, 0xa2, 0x50, 0x18, 0xb3, 0x38,
-	0x73, 0x6d, 0x8a, 0x29, 0x06, 0xe4, 0x4d, 0x53, 0x1c, 0x01, 0x7f, 0x05, 0xd5, 0xe1, 0x3d, 0x2e,
-	0x7d, 0xb5, 0xdd, 0x90, 0x33, 0x0d, 0xf1, 0x88, 0xed, 0xf7, 0x50, 0x7b, 0x5c, 0xc1, 0x01, 0xcc,
-	0xa1, 0x18, 0x0d, 0xe6, 0xa3, 0xf6, 0x49, 0x56, 0xdf, 0x8c, 0xa6, 0xa3, 0xf9, 0xa8, 0xcd, 0xec,
-	0x1f, 0x0c, 0x60, 0x2e, 0xdd, 0x00, 0xc7, 0xe1, 0x0a, 0x77, 0xfc, 0x23, 0x54, 0xa2, 0xf5, 0x5a,
-	0xa1, 0x2e, 0x3e, 0x79, 0x96, 0x09, 0xbb, 0x0e, 0xa2, 0xa5, 0x3f, 0x23, 0x5e, 0x14, 0x7d, 0xfe,
-	0x0e, 0x1a, 0x6e, 0x10, 0x45, 0x1b, 0x67, 0xed, 0x05, 0x1a, 0x93, 0x3c, 0xcd, 0x3a, 0x71, 0x9f,
-	0x89, 0xe2, 0x6f, 0xa1, 0xbe, 0x91, 0x3b, 0xa7, 0x88, 0xae, 0x44, 0x5f, 0x87, 0x8d, 0xdc, 0x2d,
-	0xf2, 0xf4, 0x2e, 0xa0, 0xe6, 0xe3, 0xde, 0x59, 0x46, 0xdb, 0x50, 0x93, 0xfe, 0xa6, 0xa8, 0xfa,
-	0xb8, 0x1f, 0x66, 0x98, 0x7f, 0x80, 0x33, 0xa5, 0x65, 0x80, 0xce, 0x4a, 0x6a, 0xe9, 0x28, 0xef,
-	0x01, 0x29, 0xdf, 0xa6, 0x68, 0x12, 0x7d, 0x23, 0xb5, 0xbc, 0xf3, 0x1e, 0xd0, 0x1e, 0x43, 0xfd,
-	0x1f, 0x81, 0xcf, 0x1c, 0xdc, 0x39, 0x98, 0x47, 0xd1, 0xa4, 0xb1, 0x29, 0x72, 0x94, 0x4d, 0x06,
-	0x18, 0xe6, 0x86, 0x66, 0xe5, 0x75, 0xfb, 0xe7, 0xa1, 0xc3, 0x7e, 0x1d, 0x3a, 0xec, 0xf7, 0xa1,
-	0xc3, 0xbe, 0xfd, 0xe9, 0x9c, 0xb8, 0x26, 0x1d, 0xf4, 0xa7, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff,
-	0x12, 0x5e, 0xfc, 0x61, 0xdc, 0x02, 0x00, 0x00,
+	// 541 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x53, 0xed, 0x6e, 0x12, 0x41,
+	0x14, 0xed, 0x2c, 0x74, 0x0b, 0x97, 0x52, 0xd6, 0xd1, 0x34, 0x1b, 0xab, 0x88, 0x6b, 0x62, 0xd0,
+	0x34, 0x24, 0xd6, 0xf8, 0x00, 0x14, 0x30, 0x21, 0x50, 0x68, 0x06, 0x42, 0xa2, 0x7f, 0x36, 0xb3,
+	0x70, 0xb1, 0x9b, 0xfd, 0xcc, 0xce, 0x40, 0xa0, 0x0f, 0x62, 0x7c, 0x01, 0xdf, 0xc5, 0x9f, 0x3e,
+	0x82, 0xc1, 0x87, 0xf0, 0xaf, 0xd9, 0x61, 0xc1, 0x56, 0xfd, 0x77, 0xcf, 0xb9, 0x77, 0xee, 0xcc,
+	0x39, 0x67, 0x17, 0x0a, 0xb1, 0xd3, 0x88, 0x93, 0x48, 0x46, 0x54, 0x8b, 0x1d, 0xeb, 0x33, 0x01,
+	0xad, 0x37, 0xa1, 0x06, 0xe4, 0x3c, 0x5c, 0x9b, 0xa4, 0x46, 0xea, 0xc7, 0x2c, 0x2d, 0xe9, 0x23,
+	0x38, 0x5c, 0x72, 0x7f, 0x81, 0xa6, 0xa6, 0xb8, 0x2d, 0xa0, 0x67, 0x50, 0x5c, 0x08, 0x4c, 0xec,
+	0x00, 0x25, 0x37, 0x73, 0xaa, 0x53, 0x48, 0x89, 0x2b, 0x94, 0x9c, 0x9a, 0x70, 0xb4, 0xc4, 0x44,
+	0xb8, 0x51, 0x68, 0xe6, 0x6b, 0xa4, 0x9e, 0x67, 0x3b, 0x48, 0x9f, 0x02, 0xe0, 0x2a, 0x76, 0x13,
+	0x14, 0x36, 0x97, 0xe6, 0xa1, 0x6a, 0x16, 0x33, 0xa6, 0x29, 0x29, 0x85, 0xbc, 0x5a, 0xa8, 0xab,
+	0x85, 0xaa, 0xb6, 0x6a, 0xa0, 0xf7, 0x26, 0x7d, 0x57, 0x48, 0x7a, 0x0a, 0x9a, 0xb7, 0x34, 0x49,
+	0x2d, 0x57, 0x2f, 0x5d, 0xe8, 0x8d, 0xd8, 0x69, 0xf4, 0x26, 0x4c, 0xf3, 0x96, 0x56, 0x13, 0x1e,
+	0x5c, 0xf1, 0xd0, 0x9d, 0xa3, 0x90, 0xad, 0x1b, 0x1e, 0x7e, 0xc2, 0x11, 0x4a, 0x7a, 0x0e, 0x47,
+	0x53, 0x05, 0x44, 0x76, 0x82, 0xa6, 0x27, 0xee, 0xcf, 0xb1, 0xdd, 0x88, 0xf5, 0x95, 0xc0, 0xc9,
+	0xfd, 0x1e, 0x3d, 0x01, 0xad, 0x3b, 0x53, 0x46, 0xe4, 0x99, 0xd6, 0x9d, 0xd1, 0x73, 0xd0, 0x86,
+	0xb1, 0x32, 0xe1, 0xe4, 0xe2, 0xc9, 0xbf, 0xbb, 0x1a, 0xc3, 0x18, 0x13, 0x2e, 0xdd, 0x28, 0x64,
+	0xda, 0x30, 0x4e, 0x5d, 0xeb, 0xe3, 0x12, 0x7d, 0xe5, 0x4d, 0x99, 0x6d, 0x01, 0x7d, 0x0c, 0x85,
+	0xd6, 0x0d, 0x4e, 0x3d, 0xb1, 0x08, 0x94, 0x33, 0xc7, 0x6c, 0x8f, 0xad, 0x17, 0x50, 0xdc, 0xaf,
+	0xa0, 0x00, 0x7a, 0x8b, 0x75, 0x9a, 0xe3, 0x8e, 0x71, 0x90, 0xd6, 0xed, 0x4e, 0xbf, 0x33, 0xee,
+	0x18, 0xc4, 0xfa, 0x45, 0x00, 0xc6, 0xdc, 0xf1, 0xb1, 0x1b, 0xce, 0x70, 0x45, 0x5f, 0xc1, 0x51,
+	0x34, 0x9f, 0x0b, 0x94, 0x3b, 0x91, 0x95, 0xf4, 0x61, 0x97, 0x7e, 0x34, 0xf5, 0x86, 0x8a, 0x67,
+	0xbb, 0x3e, 0x7d, 0x0e, 0xc7, 0x8e, 0x1f, 0x45, 0x81, 0x3d, 0x77, 0x7d, 0x89, 0x49, 0x96, 0x66,
+	0x49, 0x71, 0xef, 0x15, 0x45, 0x9f, 0x41, 0x29, 0xe0, 0x2b, 0x7b, 0x17, 0x5d, 0x4e, 0x49, 0x87,
+	0x80, 0xaf, 0x26, 0x59, 0x7a, 0x67, 0x50, 0xf4, 0x70, 0x6d, 0x4f, 0xa3, 0x45, 0x28, 0xd5, 0xfb,
+	0xcb, 0xac, 0xe0, 0xe1, 0xba, 0x95, 0x62, 0xfa, 0x12, 0x2a, 0x42, 0x72, 0x1f, 0xed, 0x19, 0x97,
+	0xdc, 0x16, 0xee, 0x2d, 0xaa, 0x7c, 0xcb, 0xac, 0xac, 0xe8, 0x36, 0x97, 0x7c, 0xe4, 0xde, 0x22,
+	0x7d, 0x07, 0xa5, 0x69, 0x14, 0xc4, 0x09, 0x0a, 0x75, 0x8b, 0xae, 0x0c, 0x7d, 0x98, 0xbe, 0xbb,
+	0xf5, 0x87, 0x1e, 0xaf, 0x63, 0x64, 0x77, 0xe7, 0xac, 0x2e, 0x94, 0xee, 0xe8, 0xfa, 0xcf, 0x77,
+	0x7a, 0x0a, 0xfa, 0x56, 0xab, 0x92, 0x56, 0x66, 0x7a, 0xb4, 0x9f, 0xf4, 0x31, 0xcc, 0x72, 0x48,
+	0xcb, 0xd7, 0x6f, 0xa0, 0xf2, 0xd7, 0x55, 0xb4, 0x00, 0xf9, 0xc1, 0x70, 0x90, 0xb9, 0x3d, 0x1a,
+	0x34, 0xaf, 0xaf, 0x3f, 0x18, 0x24, 0x65, 0x3f, 0x8e, 0xc6, 0x6d, 0x43, 0xbb, 0x34, 0xbe, 0x6d,
+	0xaa, 0xe4, 0xfb, 0xa6, 0x4a, 0x7e, 0x6c, 0xaa, 0xe4, 0xcb, 0xcf, 0xea, 0x81, 0xa3, 0xab, 0x5f,
+	0xe7, 0xed, 0xef, 0x01, 0x00, 0x1b, 0x23, 0x33, 0x53, 0x46, 0x03, 0x00, 0x00,
 }
 
 func (m *KV) Marshal() (dAtA []byte, err error) {
@@ -660,6 +708,13 @@ func (m *ManifestChange) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.ColumnFamily) > 0 {
+		i -= len(m.ColumnFamily)
+		copy(dAtA[i:], m.ColumnFamily)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.ColumnFamily)))
+		i--
+		dAtA[i] = 0x2a
+	}
 	if len(m.Checksum) > 0 {
 		i -= len(m.Checksum)
 		copy(dAtA[i:], m.Checksum)
@@ -709,6 +764,11 @@ func (m *TableIndex) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Compression != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.Compression))
+		i--
+		dAtA[i] = 0x30
+	}
 	if m.StaleDataSize != 0 {
 		i = encodeVarintPb(dAtA, i, uint64(m.StaleDataSize))
 		i--
@@ -892,6 +952,10 @@ func (m *ManifestChange) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovPb(uint64(l))
 	}
+	l = len(m.ColumnFamily)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -923,6 +987,9 @@ func (m *TableIndex) Size() (n int) {
 	if m.StaleDataSize != 0 {
 		n += 1 + sovPb(uint64(m.StaleDataSize))
 	}
+	if m.Compression != 0 {
+		n += 1 + sovPb(uint64(m.Compression))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1472,6 +1539,38 @@ func (m *ManifestChange) Unmarshal(dAtA []byte) error {
 				m.Checksum = []byte{}
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ColumnFamily", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ColumnFamily = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
@@ -1648,6 +1747,25 @@ func (m *TableIndex) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Compression", wireType)
+			}
+			m.Compression = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Compression |= CompressionType(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
@@ -0,0 +1,202 @@
+package jkv
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// subscriberBufferSize 每个订阅者最多缓存的通知数量，缓冲区满时会阻塞分发
+const subscriberBufferSize = 1000
+
+// publisher 把写入LSM的数据按照key前缀分发给订阅者
+// 写入协程只负责复制数据，分发在单独的协程中进行，两者之间通过有限的缓冲区连接
+type publisher struct {
+	sync.Mutex
+	pubCh       chan []*pb.KV
+	subscribers map[uint64]*subscriber
+	nextID      uint64
+	closer      *utils.Closer
+}
+
+type subscriber struct {
+	id       uint64
+	prefixes [][]byte
+	sendCh   chan *pb.KVList
+	// done 订阅结束时关闭，分发协程不再向 sendCh 发送
+	done chan struct{}
+}
+
+func newPublisher() *publisher {
+	p := &publisher{
+		pubCh:       make(chan []*pb.KV, utils.KVWriteChCapacity),
+		subscribers: make(map[uint64]*subscriber),
+		closer:      utils.NewCloser(),
+	}
+	p.closer.Add(1)
+	go p.listen()
+	return p
+}
+
+// Subscribe 订阅key前缀匹配 prefixes 中任意一个的写入，prefixes 为空时订阅所有的key
+// 数据写入LSM之后按照写入的顺序批量回调 cb，KV 中带有写入的版本号，被删除的key的 Meta 带有 utils.BitDelete
+// 只会通知注册之后的写入，cb 返回错误或者 ctx 结束时返回对应的错误，DB 关闭时返回nil
+// 缓冲区满时会阻塞写入，因此 cb 需要尽快返回，并且不能在 cb 中写入DB，cb 中也不能修改收到的 KV
+func (db *DB) Subscribe(ctx context.Context, prefixes [][]byte, cb func(kvs *pb.KVList) error) error {
+	if cb == nil {
+		return utils.ErrInvalidRequest
+	}
+	s := db.pub.newSubscriber(prefixes)
+	defer db.pub.deleteSubscriber(s)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.pub.closer.CloseSignal:
+			return nil
+		case list := <-s.sendCh:
+			// 把已经到达的通知合并为一次回调
+			for n := len(s.sendCh); n > 0; n-- {
+				list.Kv = append(list.Kv, (<-s.sendCh).Kv...)
+			}
+			if err := cb(list); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *publisher) newSubscriber(prefixes [][]byte) *subscriber {
+	p.Lock()
+	defer p.Unlock()
+	s := &subscriber{
+		id:     p.nextID,
+		sendCh: make(chan *pb.KVList, subscriberBufferSize),
+		done:   make(chan struct{}),
+	}
+	for _, prefix := range prefixes {
+		s.prefixes = append(s.prefixes, utils.SafeCopy(nil, prefix))
+	}
+	p.subscribers[s.id] = s
+	p.nextID++
+	return s
+}
+
+func (p *publisher) deleteSubscriber(s *subscriber) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.subscribers, s.id)
+	close(s.done)
+}
+
+func (s *subscriber) match(key []byte) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// collect 复制订阅者关心的entry，只能在写入协程中调用
+// 大的value写入LSM时会被替换为值指针，因此需要在写入LSM之前调用
+func (p *publisher) collect(reqs []*request) []*pb.KV {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.subscribers) == 0 {
+		return nil
+	}
+	var kvs []*pb.KV
+	for _, r := range reqs {
+		if r.skipPublish {
+			continue
+		}
+		for _, e := range r.Entries {
+			key := utils.ParseKey(e.Key)
+			if bytes.HasPrefix(key, jkvPrefix) || !p.matchLocked(key) {
+				continue
+			}
+			kvs = append(kvs, &pb.KV{
+				Key:       utils.SafeCopy(nil, key),
+				Value:     utils.SafeCopy(nil, e.Value),
+				Version:   utils.ParseTs(e.Key),
+				ExpiresAt: e.ExpiresAt,
+				Meta:      []byte{e.Meta &^ utils.BitValuePointer},
+			})
+		}
+	}
+	return kvs
+}
+
+func (p *publisher) matchLocked(key []byte) bool {
+	for _, s := range p.subscribers {
+		if s.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// send 在数据写入LSM之后把 collect 的结果交给分发协程
+func (p *publisher) send(kvs []*pb.KV) {
+	if len(kvs) == 0 {
+		return
+	}
+	select {
+	case p.pubCh <- kvs:
+	case <-p.closer.CloseSignal:
+	}
+}
+
+func (p *publisher) listen() {
+	defer p.closer.Done()
+	for {
+		select {
+		case <-p.closer.CloseSignal:
+			return
+		case kvs := <-p.pubCh:
+			// 合并已经到达的写入，批量分发
+			for n := len(p.pubCh); n > 0; n-- {
+				kvs = append(kvs, <-p.pubCh...)
+			}
+			p.publish(kvs)
+		}
+	}
+}
+
+func (p *publisher) publish(kvs []*pb.KV) {
+	p.Lock()
+	subscribers := make([]*subscriber, 0, len(p.subscribers))
+	for _, s := range p.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	p.Unlock()
+	for _, s := range subscribers {
+		list := &pb.KVList{}
+		for _, kv := range kvs {
+			if s.match(kv.Key) {
+				list.Kv = append(list.Kv, kv)
+			}
+		}
+		if len(list.Kv) == 0 {
+			continue
+		}
+		// 发送时不能持有锁，否则退出的订阅者无法注销
+		select {
+		case s.sendCh <- list:
+		case <-s.done:
+		case <-p.closer.CloseSignal:
+			return
+		}
+	}
+}
+
+func (p *publisher) close() {
+	p.closer.Close()
+}
@@ -0,0 +1,85 @@
+package jkv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/pb"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestSubscribe(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ValueThreshold = 32
+	db, err := Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan *pb.KV, 1000)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- db.Subscribe(ctx, [][]byte{[]byte("user/"), []byte("order/")}, func(kvs *pb.KVList) error {
+			for _, kv := range kvs.Kv {
+				received <- kv
+			}
+			return nil
+		})
+	}()
+	waitSubscribers := func(n int) {
+		require.Eventually(t, func() bool {
+			db.pub.Lock()
+			defer db.pub.Unlock()
+			return len(db.pub.subscribers) == n
+		}, time.Second, 10*time.Millisecond)
+	}
+	waitSubscribers(1)
+
+	// 大的value写入vlog，通知中仍然是真实的值
+	bigValue := bytes.Repeat([]byte("v"), 64)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("user/%03d", i)), []byte(fmt.Sprintf("val%03d", i)))))
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("other/%03d", i)), []byte("ignored"))))
+	}
+	require.NoError(t, db.Set(utils.NewEntry([]byte("order/big"), bigValue)))
+	require.NoError(t, db.Del([]byte("user/000")))
+	big, err := db.Get([]byte("order/big"))
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		kv := <-received
+		require.Equal(t, []byte(fmt.Sprintf("user/%03d", i)), kv.Key)
+		require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), kv.Value)
+		require.NotZero(t, kv.Version)
+	}
+	kv := <-received
+	require.Equal(t, []byte("order/big"), kv.Key)
+	require.Equal(t, bigValue, kv.Value)
+	require.Equal(t, big.Version, kv.Version)
+	require.Equal(t, byte(0), kv.Meta[0])
+	kv = <-received
+	require.Equal(t, []byte("user/000"), kv.Key)
+	require.NotZero(t, kv.Meta[0]&utils.BitDelete)
+	require.Greater(t, kv.Version, big.Version)
+	require.Len(t, received, 0)
+
+	cancel()
+	require.Equal(t, context.Canceled, <-errCh)
+	waitSubscribers(0)
+
+	// 回调返回错误时结束订阅
+	cbErr := fmt.Errorf("stop")
+	go func() {
+		errCh <- db.Subscribe(context.Background(), nil, func(kvs *pb.KVList) error {
+			return cbErr
+		})
+	}()
+	waitSubscribers(1)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("any"), []byte("value"))))
+	require.Equal(t, cbErr, <-errCh)
+}
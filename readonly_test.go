@@ -0,0 +1,115 @@
+package jkv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestReadOnly(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%d", i)))))
+	}
+	require.NoError(t, db.Del([]byte("key000")))
+	require.NoError(t, db.Close())
+
+	// 记录数据目录中所有文件的内容，只读打开前后应该完全相同
+	snapshot := func() map[string][]byte {
+		files, err := ioutil.ReadDir(opt.WorkDir)
+		require.NoError(t, err)
+		res := make(map[string][]byte)
+		for _, f := range files {
+			if f.Name() == utils.LockFileName {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(opt.WorkDir, f.Name()))
+			require.NoError(t, err)
+			res[f.Name()] = data
+		}
+		return res
+	}
+	before := snapshot()
+	wals, err := filepath.Glob(filepath.Join(opt.WorkDir, "*.wal"))
+	require.NoError(t, err)
+	require.NotEmpty(t, wals)
+
+	o := *opt
+	o.ReadOnly = true
+	db, err = Open(&o)
+	require.NoError(t, err)
+	// 多个只读实例可以同时打开，但不能再以读写模式打开
+	other, err := Open(&o)
+	require.NoError(t, err)
+	_, err = Open(opt)
+	require.Equal(t, utils.ErrDirLocked, errors.Cause(err))
+
+	// 只在wal中的数据也可以读到
+	for i := 1; i < 100; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%d", i)), e.Value)
+	}
+	_, err = db.Get([]byte("key000"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+	count := 0
+	iter := other.NewIterator(&utils.Options{IsAsc: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	require.NoError(t, iter.Close())
+	require.Equal(t, 99, count)
+
+	require.Equal(t, utils.ErrReadOnly, db.Set(utils.NewEntry([]byte("key001"), []byte("new"))))
+	require.Equal(t, utils.ErrReadOnly, db.Del([]byte("key001")))
+	require.Equal(t, utils.ErrReadOnly, db.DropAll())
+	require.Equal(t, utils.ErrReadOnly, db.RunValueLogGC(0.5))
+	require.NoError(t, other.Close())
+	require.NoError(t, db.Close())
+	require.Equal(t, before, snapshot())
+
+	// 关闭之后可以重新以读写模式打开
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+// 只读打开不会创建数据目录和LOCK文件
+func TestReadOnlyNoCreate(t *testing.T) {
+	clearDir()
+	o := *opt
+	o.ReadOnly = true
+	o.WorkDir = filepath.Join(opt.WorkDir, "missing")
+	_, err := Open(&o)
+	require.Error(t, err)
+	_, err = os.Stat(o.WorkDir)
+	require.True(t, os.IsNotExist(err))
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("val"))))
+	require.NoError(t, db.Close())
+	// 没有LOCK文件的目录(比如只读介质上的拷贝)也可以只读打开
+	lockPath := filepath.Join(opt.WorkDir, utils.LockFileName)
+	require.NoError(t, os.Remove(lockPath))
+	o.WorkDir = opt.WorkDir
+	db, err = Open(&o)
+	require.NoError(t, err)
+	e, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), e.Value)
+	// 没有LOCK文件时只读实例依然锁住了目录，读写打开会失败
+	_, err = Open(opt)
+	require.Equal(t, utils.ErrDirLocked, errors.Cause(err))
+	require.NoError(t, db.Close())
+	_, err = os.Stat(lockPath)
+	require.True(t, os.IsNotExist(err))
+}
@@ -1,33 +1,42 @@
 package jkv
 
-import "github.com/vvvvjvvvv/jkv/utils"
+import (
+	"sync/atomic"
 
+	"github.com/vvvvjvvvv/jkv/lsm"
+)
+
+// Stats DB 运行状态的快照，由 Info 按需收集
+// LSM 部分的字段参考 lsm.Stats，这里补充 vlog 的统计信息
 type Stats struct {
-	closer   *utils.Closer
-	EntryNum int64 // 存储多少个kv数据
-}
+	lsm.Stats
+	EntryNum int64 // sst 中存储的kv数量，包含旧版本和删除标记，不包含内存表
 
-// Close
-func (s *Stats) close() error {
-	return nil
+	VlogFiles        int    // vlog 文件数量
+	VlogDiscardBytes int64  // vlog 中可以被 GC 回收的字节数
+	VlogBytesRead    uint64 // 从 vlog 中读取的字节数
+	VlogBytesWritten uint64 // 写入 vlog 的字节数
 }
 
-// StartStats
-func (s *Stats) StartStats() {
-	defer s.closer.Done()
-	for {
-		select {
-		case <-s.closer.CloseSignal:
-			return
-		}
-		// stats logic...
+// newStats 从 lsm 和 vlog 中收集统计信息，计数器都是原子读取的，不会阻塞读写
+func newStats(db *DB) *Stats {
+	s := &Stats{Stats: *db.lsm.Stats()}
+	for _, ls := range s.Levels {
+		s.EntryNum += int64(ls.NumKeys)
 	}
-}
 
-// NewStats
-func newStats(opt *Options) *Stats {
-	s := &Stats{}
-	s.closer = utils.NewCloser()
-	s.EntryNum = 1 // 这里直接写
+	vlog := db.vlog
+	vlog.filesLock.RLock()
+	s.VlogFiles = len(vlog.filesMap)
+	vlog.filesLock.RUnlock()
+
+	vlog.lfDiscardStats.RLock()
+	for _, discard := range vlog.lfDiscardStats.m {
+		s.VlogDiscardBytes += discard
+	}
+	vlog.lfDiscardStats.RUnlock()
+
+	s.VlogBytesRead = atomic.LoadUint64(&vlog.bytesRead)
+	s.VlogBytesWritten = atomic.LoadUint64(&vlog.bytesWritten)
 	return s
 }
@@ -0,0 +1,74 @@
+package jkv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/metrics"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestInfo(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	for i := 0; i < 100; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), e.Value)
+	}
+
+	s := db.Info()
+	require.Len(t, s.Levels, 7)
+	var numTables int
+	for _, ls := range s.Levels {
+		numTables += ls.NumTables
+	}
+	require.Greater(t, numTables, 0)
+	require.Greater(t, s.EntryNum, int64(0))
+	require.Greater(t, s.BytesWritten, uint64(0))
+	require.Greater(t, s.BlockCacheHits+s.BlockCacheMisses, uint64(0))
+	require.Greater(t, s.VlogFiles, 0)
+	require.Greater(t, s.VlogBytesWritten, uint64(0))
+	require.Greater(t, s.VlogBytesRead, uint64(0))
+
+	// 每次调用都会重新收集统计信息
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key100"), []byte("val100"))))
+	require.Greater(t, db.Info().VlogBytesWritten, s.VlogBytesWritten)
+}
+
+func TestMetrics(t *testing.T) {
+	clearDir()
+	m := metrics.New("jkv")
+	o := *opt
+	o.Metrics = m
+	db, err := Open(&o)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%03d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	_, err = db.Get([]byte("key001"))
+	require.NoError(t, err)
+	iter := db.NewIterator(&utils.Options{})
+	iter.Rewind()
+	require.NoError(t, iter.Close())
+
+	require.Equal(t, uint64(100), m.Sets.Value())
+	require.Equal(t, uint64(100), m.SetLatency.Snapshot().Count)
+	require.Equal(t, uint64(1), m.Gets.Value())
+	require.Equal(t, uint64(1), m.Iterators.Value())
+	require.Equal(t, uint64(1), m.IteratorSeekLatency.Snapshot().Count)
+	require.Greater(t, m.Flushes.Value(), uint64(0))
+	require.Equal(t, m.Flushes.Value(), m.FlushLatency.Snapshot().Count)
+	require.Greater(t, m.BlockCacheHits.Value()+m.BlockCacheMisses.Value(), uint64(0))
+}
@@ -0,0 +1,390 @@
+package jkv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+// oracle 负责分配事务的读写时间戳，并在提交时做冲突检测
+// 读时间戳是最近一次已提交事务的时间戳，提交时间戳单调递增
+type oracle struct {
+	sync.Mutex // For nextTxnTs and committedTxns.
+
+	// writeChLock 保证事务按照提交时间戳的顺序写入 writeCh
+	writeChLock sync.Mutex
+	nextTxnTs   uint64
+
+	// txnMark 追踪提交时间戳的完成情况，readTs 需要等待之前的提交全部落地
+	txnMark *utils.WaterMark
+	// readMark 追踪仍在进行中的读事务，用于清理 committedTxns
+	readMark *utils.WaterMark
+
+	// committedTxns 保存最近提交的事务写过的key，用于检测读写冲突
+	committedTxns []committedTxn
+	// lastCleanupTs 上一次清理 committedTxns 时的读水位线
+	lastCleanupTs uint64
+}
+
+type committedTxn struct {
+	ts uint64
+	// conflictKeys 事务写过的key的指纹
+	conflictKeys map[uint64]struct{}
+}
+
+func newOracle(nextTxnTs uint64) *oracle {
+	orc := &oracle{
+		nextTxnTs: nextTxnTs,
+		txnMark:   utils.NewWaterMark("jkv.TxnTimestamp"),
+		readMark:  utils.NewWaterMark("jkv.PendingReads"),
+	}
+	orc.txnMark.SetDoneUntil(nextTxnTs - 1)
+	orc.readMark.SetDoneUntil(nextTxnTs - 1)
+	return orc
+}
+
+func (o *oracle) readTs() uint64 {
+	o.Lock()
+	readTs := o.nextTxnTs - 1
+	o.readMark.Begin(readTs)
+	o.Unlock()
+
+	// 等待所有提交时间戳 <= readTs 的事务写入完成，保证快照的完整性
+	utils.Panic(o.txnMark.WaitForMark(context.Background(), readTs))
+	return readTs
+}
+
+// hasConflict 检查在 txn 的读时间戳之后提交的事务是否修改过 txn 读过的key
+func (o *oracle) hasConflict(txn *Txn) bool {
+	if len(txn.reads) == 0 {
+		return false
+	}
+	for _, committedTxn := range o.committedTxns {
+		// 在读时间戳之前提交的事务已经包含在快照中了
+		if committedTxn.ts <= txn.readTs {
+			continue
+		}
+		for _, ro := range txn.reads {
+			if _, has := committedTxn.conflictKeys[ro]; has {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o *oracle) newCommitTs(txn *Txn) (uint64, bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.hasConflict(txn) {
+		return 0, true
+	}
+
+	o.doneRead(txn)
+	o.cleanupCommittedTransactions()
+
+	ts := o.nextTxnTs
+	o.nextTxnTs++
+	o.txnMark.Begin(ts)
+
+	o.committedTxns = append(o.committedTxns, committedTxn{
+		ts:           ts,
+		conflictKeys: txn.conflictKeys,
+	})
+	return ts, false
+}
+
+// advanceTs 保证之后分配的时间戳都大于 ts，用于导入自带版本号的数据
+func (o *oracle) advanceTs(ts uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if ts < o.nextTxnTs {
+		return
+	}
+	o.nextTxnTs = ts + 1
+	// 新的读时间戳为 ts，需要水位线推进到 ts 才能读取
+	o.txnMark.Begin(ts)
+	o.txnMark.Done(ts)
+}
+
+// nextTs 分配一个不属于任何事务的提交时间戳，例如导入外部sst，写入完成后需要调用 doneCommit
+func (o *oracle) nextTs() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	ts := o.nextTxnTs
+	o.nextTxnTs++
+	o.txnMark.Begin(ts)
+	return ts
+}
+
+func (o *oracle) doneRead(txn *Txn) {
+	if !txn.doneRead {
+		txn.doneRead = true
+		o.readMark.Done(txn.readTs)
+	}
+}
+
+// cleanupCommittedTransactions 清理所有活跃读事务都已经能看到的提交记录，调用方需要持有锁
+func (o *oracle) cleanupCommittedTransactions() {
+	maxReadTs := o.readMark.DoneUntil()
+	if maxReadTs <= o.lastCleanupTs {
+		return
+	}
+	o.lastCleanupTs = maxReadTs
+
+	tmp := o.committedTxns[:0]
+	for _, txn := range o.committedTxns {
+		if txn.ts <= maxReadTs {
+			continue
+		}
+		tmp = append(tmp, txn)
+	}
+	o.committedTxns = tmp
+}
+
+// discardAtOrBelow 返回所有活跃读事务的读时间戳都不小于的时间戳，压缩时可以清理在此之前被覆盖的版本
+func (o *oracle) discardAtOrBelow() uint64 {
+	return o.readMark.DoneUntil()
+}
+
+func (o *oracle) doneCommit(cts uint64) {
+	o.txnMark.Done(cts)
+}
+
+// Txn 表示一个事务，读操作基于 readTs 时刻的快照，写操作缓存在内存中直到 Commit
+type Txn struct {
+	readTs   uint64
+	commitTs uint64
+
+	update bool // update 为 false 时是只读事务
+
+	reads        []uint64 // 读过的key的指纹，用于冲突检测
+	readsLock    sync.Mutex
+	conflictKeys map[uint64]struct{}
+
+	pendingWrites map[string]*utils.Entry
+	// cond 条件写入的前置条件，提交时由写入协程检查
+	cond *writeCondition
+
+	size      int64
+	count     int64
+	discarded bool
+	doneRead  bool
+
+	db *DB
+}
+
+// NewTransaction 创建一个新的事务，update 为 false 时创建只读事务
+// 事务使用完成后必须调用 Discard
+func (db *DB) NewTransaction(update bool) *Txn {
+	return db.newTransaction(update, false)
+}
+
+// newTransaction writeOnly 为 true 时事务只写不读，不需要等待读时间戳，用于 WriteBatch
+func (db *DB) newTransaction(update, writeOnly bool) *Txn {
+	txn := &Txn{
+		update: update,
+		db:     db,
+	}
+	if update {
+		txn.pendingWrites = make(map[string]*utils.Entry)
+		txn.conflictKeys = make(map[uint64]struct{})
+	}
+	if writeOnly {
+		txn.doneRead = true
+		return txn
+	}
+	txn.readTs = db.orc.readTs()
+	return txn
+}
+
+// ReadTs 返回事务的读时间戳
+func (txn *Txn) ReadTs() uint64 {
+	return txn.readTs
+}
+
+// Get 读取快照中key对应的最新版本，如果事务内有未提交的写入则优先返回
+func (txn *Txn) Get(key []byte) (*utils.Entry, error) {
+	if len(key) == 0 {
+		return nil, utils.ErrEmptyKey
+	} else if txn.discarded {
+		return nil, utils.ErrDiscardedTxn
+	}
+
+	if txn.update {
+		if e, has := txn.pendingWrites[string(key)]; has && bytes.Equal(key, e.Key) {
+			if e.IsDeletedOrExpired() {
+				return nil, utils.ErrKeyNotFound
+			}
+			if e.Meta&utils.BitMergeOperand > 0 {
+				return txn.mergePending(key, e)
+			}
+			// 读到了自己的写入，不需要记录到冲突检测中
+			return &utils.Entry{
+				Key:       key,
+				Value:     e.Value,
+				ExpiresAt: e.ExpiresAt,
+				Meta:      e.Meta,
+				Version:   txn.readTs,
+			}, nil
+		}
+		txn.addReadKey(key)
+	}
+	return txn.db.get(key, txn.readTs)
+}
+
+func (txn *Txn) addReadKey(key []byte) {
+	fp := utils.MemHash(key)
+	txn.readsLock.Lock()
+	txn.reads = append(txn.reads, fp)
+	txn.readsLock.Unlock()
+}
+
+// Set 在事务中写入一个kv
+func (txn *Txn) Set(key, value []byte) error {
+	return txn.SetEntry(utils.NewEntry(key, value))
+}
+
+// SetEntry 在事务中写入一个entry，可以携带过期时间
+func (txn *Txn) SetEntry(e *utils.Entry) error {
+	return txn.modify(e)
+}
+
+// Delete 在事务中删除一个key
+func (txn *Txn) Delete(key []byte) error {
+	e := &utils.Entry{
+		Key:  key,
+		Meta: utils.BitDelete,
+	}
+	return txn.modify(e)
+}
+
+func (txn *Txn) modify(e *utils.Entry) error {
+	switch {
+	case !txn.update:
+		return utils.ErrReadOnlyTxn
+	case txn.discarded:
+		return utils.ErrDiscardedTxn
+	case len(e.Key) == 0:
+		return utils.ErrEmptyKey
+	}
+
+	if err := txn.checkSize(e); err != nil {
+		return err
+	}
+	txn.conflictKeys[utils.MemHash(e.Key)] = struct{}{}
+	txn.pendingWrites[string(e.Key)] = e
+	return nil
+}
+
+// checkSize 保证整个事务可以放进一个写请求中
+func (txn *Txn) checkSize(e *utils.Entry) error {
+	count := txn.count + 1
+	// Extra bytes for the version in key.
+	size := txn.size + int64(e.EstimateSize(int(txn.db.opt.ValueThreshold))) + 10
+	if count >= txn.db.opt.MaxBatchCount || size >= txn.db.opt.MaxBatchSize {
+		return utils.ErrTxnTooBig
+	}
+	txn.count, txn.size = count, size
+	return nil
+}
+
+// Commit 提交事务，如果读过的key在读时间戳之后被其他事务修改过则返回 ErrConflict
+func (txn *Txn) Commit() error {
+	if txn.discarded {
+		return utils.ErrDiscardedTxn
+	}
+	defer txn.Discard()
+	if len(txn.pendingWrites) == 0 {
+		return nil // Nothing to do.
+	}
+
+	req, commitTs, err := txn.commitAndSend()
+	if err != nil {
+		return err
+	}
+	err = req.Wait()
+	txn.db.orc.doneCommit(commitTs)
+	return err
+}
+
+// CommitWith 异步提交事务，写入完成后在另一个协程中调用 cb
+func (txn *Txn) CommitWith(cb func(error)) {
+	utils.CondPanic(cb == nil, errors.New("Nil callback provided to CommitWith"))
+	if txn.discarded {
+		go cb(utils.ErrDiscardedTxn)
+		return
+	}
+	defer txn.Discard()
+	if len(txn.pendingWrites) == 0 {
+		go cb(nil)
+		return
+	}
+
+	req, commitTs, err := txn.commitAndSend()
+	if err != nil {
+		go cb(err)
+		return
+	}
+	go func() {
+		err := req.Wait()
+		txn.db.orc.doneCommit(commitTs)
+		cb(err)
+	}()
+}
+
+func (txn *Txn) commitAndSend() (*request, uint64, error) {
+	if txn.db.opt.ReadOnly {
+		return nil, 0, utils.ErrReadOnly
+	}
+	// 托管模式下版本号由调用方分配，只能通过 SetAt 写入
+	if txn.db.opt.ManagedTxns {
+		return nil, 0, utils.ErrManagedTxn
+	}
+	orc := txn.db.orc
+	// 持有 writeChLock 保证按照提交时间戳的顺序写入
+	orc.writeChLock.Lock()
+	defer orc.writeChLock.Unlock()
+
+	commitTs, conflict := orc.newCommitTs(txn)
+	if conflict {
+		return nil, 0, utils.ErrConflict
+	}
+	txn.commitTs = commitTs
+
+	entries := make([]*utils.Entry, 0, len(txn.pendingWrites))
+	for _, e := range txn.pendingWrites {
+		entries = append(entries, &utils.Entry{
+			Key:       utils.KeyWithTs(e.Key, commitTs),
+			Value:     e.Value,
+			ExpiresAt: txn.db.expiresAt(e),
+			Meta:      e.Meta,
+		})
+	}
+
+	if txn.cond != nil {
+		// 提交时间戳之前的写入都已经在写入协程中完成了
+		txn.cond.readTs = commitTs - 1
+	}
+	req, err := txn.db.sendRequest(entries, txn.cond, false)
+	if err != nil {
+		orc.doneCommit(commitTs)
+		return nil, 0, err
+	}
+	return req, commitTs, nil
+}
+
+// Discard 丢弃事务，释放读时间戳。已经提交的事务调用 Discard 是安全的
+func (txn *Txn) Discard() {
+	if txn.discarded {
+		return
+	}
+	txn.discarded = true
+	txn.db.orc.Lock()
+	txn.db.orc.doneRead(txn)
+	txn.db.orc.Unlock()
+}
@@ -0,0 +1,195 @@
+package jkv
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+)
+
+func TestTxnSnapshotIsolation(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	key := []byte("txn-key")
+	require.NoError(t, db.Set(utils.NewEntry(key, []byte("v1"))))
+
+	// 读事务开始之后的写入对它不可见
+	reader := db.NewTransaction(false)
+	defer reader.Discard()
+	require.NoError(t, db.Set(utils.NewEntry(key, []byte("v2"))))
+
+	e, err := reader.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), e.Value)
+	require.Equal(t, reader.ReadTs(), e.Version)
+
+	e, err = db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), e.Value)
+
+	// 只读事务不允许写入
+	require.Equal(t, utils.ErrReadOnlyTxn, reader.Set(key, []byte("v3")))
+}
+
+func TestTxnReadYourWrites(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	key := []byte("txn-key")
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	require.NoError(t, txn.Set(key, []byte("pending")))
+	e, err := txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("pending"), e.Value)
+
+	// 未提交的写入对其他事务不可见
+	_, err = db.Get(key)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	require.NoError(t, txn.Delete(key))
+	_, err = txn.Get(key)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	require.NoError(t, txn.Commit())
+	require.Equal(t, utils.ErrDiscardedTxn, txn.Set(key, []byte("again")))
+	_, err = db.Get(key)
+	require.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+func TestTxnConflict(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	key := []byte("counter")
+	require.NoError(t, db.Set(utils.NewEntry(key, []byte("0"))))
+
+	txn1 := db.NewTransaction(true)
+	defer txn1.Discard()
+	txn2 := db.NewTransaction(true)
+	defer txn2.Discard()
+
+	_, err = txn1.Get(key)
+	require.NoError(t, err)
+	_, err = txn2.Get(key)
+	require.NoError(t, err)
+
+	require.NoError(t, txn1.Set(key, []byte("1")))
+	require.NoError(t, txn2.Set(key, []byte("2")))
+
+	// 先提交的事务成功，后提交的事务读过的key已经被修改，提交失败
+	require.NoError(t, txn1.Commit())
+	require.Equal(t, utils.ErrConflict, txn2.Commit())
+
+	e, err := db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), e.Value)
+
+	// 只写不读的事务不会产生冲突
+	txn3 := db.NewTransaction(true)
+	defer txn3.Discard()
+	require.NoError(t, db.Set(utils.NewEntry(key, []byte("3"))))
+	require.NoError(t, txn3.Set(key, []byte("4")))
+	require.NoError(t, txn3.Commit())
+}
+
+func TestTxnVersionsAfterReopen(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%d", i%10), fmt.Sprintf("val%d", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	readTs := db.NewTransaction(false).ReadTs()
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	require.GreaterOrEqual(t, txn.ReadTs(), readTs)
+	for i := 90; i < 100; i++ {
+		key, val := fmt.Sprintf("key%d", i%10), fmt.Sprintf("val%d", i)
+		e, err := txn.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(val), e.Value)
+	}
+}
+
+// TestTxnReplayPartialCommit 模拟写入LSM时在事务的两个entry之间崩溃，重启之后事务的其余entry从vlog重放
+func TestTxnReplayPartialCommit(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("before"), []byte("v0"))))
+
+	ts := db.orc.nextTs()
+	req := &request{Entries: []*utils.Entry{
+		{Key: utils.KeyWithTs([]byte("txn-a"), ts), Value: []byte("va")},
+		{Key: utils.KeyWithTs([]byte("txn-b"), ts), Value: []byte("vb")},
+	}}
+	require.NoError(t, db.vlog.write([]*request{req}))
+	require.NoError(t, db.writeToLSM(&request{Entries: req.Entries[:1], Ptrs: req.Ptrs[:1]}))
+	db.orc.doneCommit(ts)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	for _, key := range []string{"txn-a", "txn-b"} {
+		e, err := db.Get([]byte(key))
+		require.NoError(t, err, key)
+		require.Equal(t, "v"+key[len(key)-1:], string(e.Value))
+		require.Equal(t, ts, e.Version)
+	}
+}
+
+// vlog中只写入了一部分的事务在重放时被丢弃，并且从事务的开头截断，之后的写入可以正常重放
+func TestTxnReplayTornVlog(t *testing.T) {
+	clearDir()
+	db, err := Open(opt)
+	require.NoError(t, err)
+	ts := db.orc.nextTs()
+	req := &request{Entries: []*utils.Entry{
+		{Key: utils.KeyWithTs([]byte("txn-a"), ts), Value: []byte("va")},
+		{Key: utils.KeyWithTs([]byte("txn-b"), ts), Value: []byte("vb")},
+	}}
+	require.NoError(t, db.vlog.write([]*request{req}))
+	db.orc.doneCommit(ts)
+	last := req.Ptrs[1]
+	path := db.vlog.fpath(last.Fid)
+	require.NoError(t, db.Close())
+	// 第二个entry只写入了一半
+	require.NoError(t, os.Truncate(path, int64(last.Offset+last.Len/2)))
+
+	check := func(db *DB) {
+		for _, key := range []string{"txn-a", "txn-b"} {
+			_, err := db.Get([]byte(key))
+			require.Equal(t, utils.ErrKeyNotFound, err, key)
+		}
+	}
+	db, err = Open(opt)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("after"), []byte("v"))))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	check(db)
+	e, err := db.Get([]byte("after"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), e.Value)
+}
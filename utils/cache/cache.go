@@ -3,6 +3,7 @@ package cache
 import (
 	"container/list"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/cespare/xxhash"
@@ -17,6 +18,8 @@ type Cache struct {
 	t         int32        // 统计总共的访问次数
 	threshold int32        // 数据保鲜的阈值
 	data      map[uint64]*list.Element
+	hits      uint64 // 命中次数，Get 只持有读锁，需要原子操作
+	misses    uint64 // 未命中次数
 }
 
 type Options struct {
@@ -130,6 +133,7 @@ func (c *Cache) get(key interface{}) (interface{}, bool) {
 	if !ok {
 		c.door.Allow(uint32(keyHash))
 		c.c.Increment(keyHash)
+		atomic.AddUint64(&c.misses, 1)
 		return nil, false
 	}
 
@@ -137,8 +141,10 @@ func (c *Cache) get(key interface{}) (interface{}, bool) {
 	if item.conflict != conflictHash {
 		c.door.Allow(uint32(keyHash))
 		c.c.Increment(keyHash)
+		atomic.AddUint64(&c.misses, 1)
 		return nil, false
 	}
+	atomic.AddUint64(&c.hits, 1)
 	c.door.Allow(uint32(keyHash))
 	c.c.Increment(item.key)
 
@@ -153,6 +159,11 @@ func (c *Cache) get(key interface{}) (interface{}, bool) {
 	return v, true
 }
 
+// Metrics 返回缓存的命中和未命中次数
+func (c *Cache) Metrics() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
 func (c *Cache) Del(key interface{}) (interface{}, bool) {
 	c.m.Lock()
 	defer c.m.Unlock()
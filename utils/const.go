@@ -15,6 +15,9 @@ const (
 const (
 	ManifestFilename                  = "MANIFEST"
 	ManifestRewriteFilename           = "REWRITEMANIFEST"
+	KeyRegistryFileName               = "KEYREGISTRY"
+	KeyRegistryRewriteFileName        = "REWRITE-KEYREGISTRY"
+	LockFileName                      = "LOCK"
 	ManifestDeletionsRewriteThreshold = 10000
 	ManifestDeletionsRatio            = 10
 	DefaultFileFlag                   = os.O_RDWR | os.O_CREATE | os.O_APPEND
@@ -41,4 +44,8 @@ var (
 const (
 	BitDelete       byte = 1 << 0 // Set if the key has been deleted.
 	BitValuePointer byte = 1 << 1 // Set if the value is NOT stored directly next to key.
+	BitMergeOperand byte = 1 << 2 // Set if the value is a merge operand rather than a full value.
+	// BitTxn 和 BitFinTxn 只出现在vlog中，标记同一个请求(事务)的entry，重放时只重放完整的事务
+	BitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
+	BitFinTxn byte = 1 << 7 // Set if the entry is the last entry of a txn.
 )
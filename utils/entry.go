@@ -73,7 +73,7 @@ func (e *Entry) Entry() *Entry {
 }
 
 func (e *Entry) IsDeletedOrExpired() bool {
-	if e.Value == nil {
+	if e.Value == nil || e.Meta&BitDelete > 0 {
 		return true
 	}
 
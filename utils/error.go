@@ -40,6 +40,11 @@ var (
 	ErrDeleteVlogFile = errors.New("Delete vlog file")
 	ErrNoRoom         = errors.New("No room for write")
 
+	// ErrInvalidEncryptionKey is returned if length of encryption key is invalid.
+	ErrInvalidEncryptionKey = errors.New("Encryption key's length should be either 16, 24, or 32 bytes")
+	// ErrEncryptionKeyMismatch is returned when the master key does not match the key registry.
+	ErrEncryptionKeyMismatch = errors.New("Encryption key mismatch")
+
 	// ErrInvalidRequest is returned if the user request is invalid.
 	ErrInvalidRequest = errors.New("Invalid request")
 	// ErrNoRewrite is returned if a call for value log GC doesn't result in a log file rewrite.
@@ -48,8 +53,71 @@ var (
 	// ErrRejected is returned if a value log GC is called either while another GC is running, or
 	// after DB::Close has been called.
 	ErrRejected = errors.New("Value log GC request rejected")
+
+	// ErrConflict is returned when a transaction conflicts with another transaction. This can
+	// happen if the read rows had been updated concurrently by another transaction.
+	ErrConflict = errors.New("Transaction Conflict. Please retry")
+	// ErrReadOnlyTxn is returned if an update function is called on a read-only transaction.
+	ErrReadOnlyTxn = errors.New("No sets or deletes are allowed in a read-only transaction")
+	// ErrDiscardedTxn is returned if a previously discarded transaction is re-used.
+	ErrDiscardedTxn = errors.New("This transaction has been discarded. Create a new one")
+	// ErrCommitAfterFinish is returned if a write batch is used after Flush or Commit.
+	ErrCommitAfterFinish = errors.New("Batch commit not permitted after finish")
+	// ErrDirLocked is returned if the directory is already locked by another DB instance.
+	ErrDirLocked = errors.New("Cannot acquire directory lock, another process is using this directory")
+	// ErrNoMergeOperator is returned if Merge is called or a merge operand is read without a MergeOperator.
+	ErrNoMergeOperator = errors.New("No MergeOperator is set in options")
+	// ErrConditionFailed is returned if the condition of a conditional write is not satisfied.
+	ErrConditionFailed = errors.New("Condition of the conditional write failed")
+	// ErrColumnFamilyNotFound is returned if a column family is used without being configured in options.
+	ErrColumnFamilyNotFound = errors.New("Column family not found")
+	// ErrInvalidColumnFamily is returned if a column family name is empty or contains '/'.
+	ErrInvalidColumnFamily = errors.New("Invalid column family name")
+	// ErrManagedTxn is returned if a transaction is committed in managed mode.
+	ErrManagedTxn = errors.New("Invalid API request in managed mode, use SetAt instead")
+	// ErrNotManagedTxn is returned if a managed mode API is called without ManagedTxns.
+	ErrNotManagedTxn = errors.New("Invalid API request in not-managed mode")
+	// ErrReadOnly is returned if a write or any other mutating API is called on a DB opened with ReadOnly.
+	ErrReadOnly = errors.New("Write operations are not allowed, DB is opened in read-only mode")
+	// ErrInMemory is returned if an API or option that needs files on disk is used with InMemory.
+	ErrInMemory = errors.New("Operation is not supported in InMemory mode")
+)
+
+// 加载出错的文件类型
+const (
+	FileKindManifest    = "MANIFEST"
+	FileKindWAL         = "WAL"
+	FileKindVlog        = "VLOG"
+	FileKindSST         = "SST"
+	FileKindKeyRegistry = "KEYREGISTRY"
 )
 
+// FileError 打开DB时加载某个文件失败，可以通过 errors.As 获取出错的文件，
+// 通过 errors.Cause 获取底层的错误，例如 ErrBadMagic、ErrChecksumMismatch
+type FileError struct {
+	Kind string // 文件类型，FileKindManifest/FileKindWAL/FileKindVlog/FileKindSST/FileKindKeyRegistry
+	Path string
+	Err  error
+}
+
+// NewFileError 返回一个 FileError，err 为nil时返回nil
+func NewFileError(kind, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FileError{Kind: kind, Path: path, Err: err}
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("failed to load %s file %s: %v", e.Kind, e.Path, e.Err)
+}
+
+// Unwrap 兼容标准库的 errors.Is/errors.As
+func (e *FileError) Unwrap() error { return e.Err }
+
+// Cause 兼容 github.com/pkg/errors 的 errors.Cause
+func (e *FileError) Cause() error { return e.Err }
+
 // Panic 如果err不为nil 则panic
 func Panic(err error) {
 	if err != nil {
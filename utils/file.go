@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"hash/crc32"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -12,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/vvvvjvvvv/jkv/vfs"
 )
 
 // FID 根据file name 获取其fid
@@ -35,11 +35,6 @@ func FileNameSSTable(dir string, id uint64) string {
 	return filepath.Join(dir, fmt.Sprintf("%05d.sst", id))
 }
 
-// openDir opens a directory ofr syncing.
-func openDir(path string) (*os.File, error) {
-	return os.Open(path)
-}
-
 func VlogFilePath(dirPath string, fid uint32) string {
 	return fmt.Sprintf("%s%s%05d.vlog", dirPath, string(os.PathSeparator), fid)
 }
@@ -48,21 +43,12 @@ func VlogFilePath(dirPath string, fid uint32) string {
 // in order to guarantee the file is visible (if the system crashes). (See the man page for fsync,
 // or see https://github.com/coreos/etcd/issues/6368 for an example.)
 func SyncDir(dir string) error {
-	f, err := openDir(dir)
-	if err != nil {
-		return errors.Wrapf(err, "While opening directory: %s.", dir)
-	}
-	err = f.Sync()
-	closeErr := f.Close()
-	if err != nil {
-		return errors.Wrapf(err, "While syncing directory: %s.", dir)
-	}
-	return errors.Wrapf(closeErr, "While closing directory: %s.", dir)
+	return vfs.OS.Sync(dir)
 }
 
 // LoadIDMap Get the id of all sst files in the current folder
-func LoadIDMap(dir string) map[uint64]struct{} {
-	fileInfos, err := ioutil.ReadDir(dir)
+func LoadIDMap(fs vfs.FS, dir string) map[uint64]struct{} {
+	fileInfos, err := vfs.Default(fs).ReadDir(dir)
 	Err(err)
 	idMap := make(map[uint64]struct{})
 	for _, info := range fileInfos {
@@ -91,6 +77,9 @@ func CompareKeys(key1, key2 []byte) int {
 
 // VerifyChecksum crc32
 func VerifyChecksum(data []byte, expected []byte) error {
+	if len(expected) != 8 {
+		return errors.Wrapf(ErrChecksumMismatch, "invalid checksum length: %d", len(expected))
+	}
 	actual := uint64(crc32.Checksum(data, CastagnoliCrcTable))
 	expectedU64 := BytesToU64(expected)
 	if actual != expectedU64 {
@@ -1,5 +1,7 @@
 package utils
 
+import "bytes"
+
 type Iterator interface {
 	Next()
 	Valid() bool
@@ -14,6 +16,52 @@ type Item interface {
 }
 
 type Options struct {
-	Prefix []byte // 指定的前缀
-	IsAsc  bool   // 是否升序
+	Prefix     []byte // 指定的前缀
+	IsAsc      bool   // 是否升序
+	LowerBound []byte // 迭代的下界(包含)，为空表示不限制
+	UpperBound []byte // 迭代的上界(不包含)，为空表示不限制
+	// AllVersions 为 true 时返回每个key所有可见的版本，包括删除标记和已经过期的版本，同一个key的版本从新到旧排列
+	AllVersions bool
+}
+
+// KeyInRange 判断不带版本号的key是否落在 Prefix/LowerBound/UpperBound 限定的范围内
+func (opt *Options) KeyInRange(key []byte) bool {
+	if len(opt.Prefix) > 0 && !bytes.HasPrefix(key, opt.Prefix) {
+		return false
+	}
+	if len(opt.LowerBound) > 0 && bytes.Compare(key, opt.LowerBound) < 0 {
+		return false
+	}
+	if len(opt.UpperBound) > 0 && bytes.Compare(key, opt.UpperBound) >= 0 {
+		return false
+	}
+	return true
+}
+
+// SeekStart 返回迭代开始的位置，即 Prefix 和 LowerBound 中较大的一个
+func (opt *Options) SeekStart() []byte {
+	start := opt.Prefix
+	if bytes.Compare(opt.LowerBound, start) > 0 {
+		start = opt.LowerBound
+	}
+	return start
+}
+
+// RangeMayOverlap 判断不带版本号的key区间 [minKey, maxKey] 是否可能包含满足条件的key
+func (opt *Options) RangeMayOverlap(minKey, maxKey []byte) bool {
+	if len(opt.Prefix) > 0 {
+		if bytes.Compare(maxKey, opt.Prefix) < 0 {
+			return false
+		}
+		if bytes.Compare(minKey, opt.Prefix) > 0 && !bytes.HasPrefix(minKey, opt.Prefix) {
+			return false
+		}
+	}
+	if len(opt.LowerBound) > 0 && bytes.Compare(maxKey, opt.LowerBound) < 0 {
+		return false
+	}
+	if len(opt.UpperBound) > 0 && bytes.Compare(minKey, opt.UpperBound) >= 0 {
+		return false
+	}
+	return true
 }
@@ -47,3 +47,15 @@ func KeyWithTs(key []byte, ts uint64) []byte {
 func SafeCopy(a, src []byte) []byte {
 	return append(a[:0], src...)
 }
+
+// MemHash 基于 runtime.memhash 计算 hash，用于事务冲突检测的key指纹
+// NOTE: hash种子在每个进程中都不同，不能用于持久化
+func MemHash(data []byte) uint64 {
+	ss := (*stringStruct)(unsafe.Pointer(&data))
+	return uint64(memhash(ss.str, 0, uintptr(ss.len)))
+}
+
+type stringStruct struct {
+	str unsafe.Pointer
+	len int
+}
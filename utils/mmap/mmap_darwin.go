@@ -1,24 +1,43 @@
 package mmap
 
-import "os"
+import (
+	"os"
+	"syscall"
+	"unsafe"
 
-func Mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
-	return mmap(fd, writable, size)
+	"golang.org/x/sys/unix"
+)
+
+// Mmap uses the mmap system call to memory-map a file. If writable is true,
+// memory protection of the pages is set so that they may be written to as well.
+func mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
+	mtype := unix.PROT_READ
+	if writable {
+		mtype |= unix.PROT_WRITE
+	}
+	return unix.Mmap(int(fd.Fd()), 0, int(size), mtype, unix.MAP_SHARED)
 }
 
 // Munmap unmaps a previously mapped slice.
-func Munmap(b []byte) error {
-	return munmap(b)
+func munmap(b []byte) error {
+	return unix.Munmap(b)
 }
 
-// Madvise uses the madvise system call to give advise about the use of memory
-// when using a slice that is memory-mapped to a file. Set the readahead flag to
-// false if page references are expected in random order.
-func Madvise(b []byte, readahead bool) error {
-	return madvise(b, readahead)
+// This is required because the unix package does not support the madvise system call on OS X.
+func madvise(b []byte, readahead bool) error {
+	advice := unix.MADV_NORMAL
+	if !readahead {
+		advice = unix.MADV_RANDOM
+	}
+
+	_, _, e1 := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)), uintptr(advice))
+	if e1 != 0 {
+		return e1
+	}
+	return nil
 }
 
-// Msync would call sync on the mmapped data.
-func Msync(b []byte) error {
-	return msync(b)
+func msync(b []byte) error {
+	return unix.Msync(b, unix.MS_SYNC)
 }
@@ -377,6 +377,7 @@ func (s *Skiplist) Search(key []byte) ValueStruct {
 
 	valOffset, valSize := n.getValueOffset()
 	vs := s.arena.getVal(valOffset, valSize)
+	vs.Version = ParseTs(nextKey)
 	return vs
 }
 
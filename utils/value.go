@@ -129,11 +129,10 @@ func IsDeletedOrExpired(meta byte, expiresAt uint64) bool {
 }
 
 func DiscardEntry(e, vs *Entry) bool {
-	// TODO 版本这个信息应该被弱化掉 在后面上MVCC或者多版本查询的时候再考虑
-	// if vs.Version != ParseTs(e.Key) {
-	// 	// Version not found. Discard.
-	// 	return true
-	// }
+	if vs.Version != ParseTs(e.Key) {
+		// Version not found. Discard.
+		return true
+	}
 	if IsDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
 		return true
 	}
@@ -64,6 +64,7 @@ func WalCodec(buf *bytes.Buffer, e *Entry) int {
 	h := WalHeader{
 		KeyLen:    uint32(len(e.Key)),
 		ValueLen:  uint32(len(e.Value)),
+		Meta:      e.Meta,
 		ExpiresAt: e.ExpiresAt,
 	}
 
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// WaterMark 用于追踪一组单调递增的索引(例如事务时间戳)的完成情况。
+// 每个索引都需要先 Begin 再 Done，doneUntil 表示所有小于等于它的已开始索引都已经完成，
+// oracle 借助它来保证读时间戳之前的提交全部落地，以及回收不再需要的冲突检测信息。
+type WaterMark struct {
+	sync.Mutex
+	Name      string
+	doneUntil uint64
+	lastIndex uint64
+	indices   uint64Heap
+	pending   map[uint64]int
+	waiters   map[uint64][]chan struct{}
+}
+
+// NewWaterMark _
+func NewWaterMark(name string) *WaterMark {
+	return &WaterMark{
+		Name:    name,
+		pending: make(map[uint64]int),
+		waiters: make(map[uint64][]chan struct{}),
+	}
+}
+
+// Begin 标记一个索引开始
+func (w *WaterMark) Begin(index uint64) {
+	w.Lock()
+	defer w.Unlock()
+	if index > w.lastIndex {
+		w.lastIndex = index
+	}
+	prev, present := w.pending[index]
+	if !present {
+		heap.Push(&w.indices, index)
+	}
+	w.pending[index] = prev + 1
+}
+
+// Done 标记一个索引完成
+func (w *WaterMark) Done(index uint64) {
+	w.Lock()
+	defer w.Unlock()
+	prev, present := w.pending[index]
+	if !present {
+		heap.Push(&w.indices, index)
+	}
+	w.pending[index] = prev - 1
+	w.process()
+}
+
+// DoneUntil 返回当前的水位线
+func (w *WaterMark) DoneUntil() uint64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.doneUntil
+}
+
+// SetDoneUntil 直接设置水位线，仅在初始化时使用
+func (w *WaterMark) SetDoneUntil(val uint64) {
+	w.Lock()
+	defer w.Unlock()
+	w.doneUntil = val
+	if val > w.lastIndex {
+		w.lastIndex = val
+	}
+}
+
+// LastIndex 返回最后一个开始的索引
+func (w *WaterMark) LastIndex() uint64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.lastIndex
+}
+
+// WaitForMark 阻塞直到水位线达到 index
+func (w *WaterMark) WaitForMark(ctx context.Context, index uint64) error {
+	w.Lock()
+	if w.doneUntil >= index {
+		w.Unlock()
+		return nil
+	}
+	waitCh := make(chan struct{})
+	w.waiters[index] = append(w.waiters[index], waitCh)
+	w.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-waitCh:
+		return nil
+	}
+}
+
+// process 从最小的索引开始推进水位线，调用方需要持有锁
+func (w *WaterMark) process() {
+	until := w.doneUntil
+	for len(w.indices) > 0 {
+		min := w.indices[0]
+		if done := w.pending[min]; done > 0 {
+			break // len(indices) will be > 0.
+		}
+		// Even if done is called multiple times causing it to become
+		// negative, we should still pop the index.
+		heap.Pop(&w.indices)
+		delete(w.pending, min)
+		until = min
+	}
+	if until <= w.doneUntil {
+		return
+	}
+	w.doneUntil = until
+	for idx, toNotify := range w.waiters {
+		if idx > until {
+			continue
+		}
+		for _, ch := range toNotify {
+			close(ch)
+		}
+		delete(w.waiters, idx)
+	}
+}
+
+// uint64Heap 是 container/heap 使用的小顶堆
+type uint64Heap []uint64
+
+func (u uint64Heap) Len() int            { return len(u) }
+func (u uint64Heap) Less(i, j int) bool  { return u[i] < u[j] }
+func (u uint64Heap) Swap(i, j int)       { u[i], u[j] = u[j], u[i] }
+func (u *uint64Heap) Push(x interface{}) { *u = append(*u, x.(uint64)) }
+func (u *uint64Heap) Pop() interface{} {
+	old := *u
+	n := len(old)
+	x := old[n-1]
+	*u = old[0 : n-1]
+	return x
+}
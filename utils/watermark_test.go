@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaterMark(t *testing.T) {
+	w := NewWaterMark("test")
+	w.SetDoneUntil(1)
+	w.Begin(2)
+	w.Begin(3)
+	w.Begin(4)
+	require.Equal(t, uint64(4), w.LastIndex())
+
+	// 3 先完成，但是 2 还没有完成，水位线不能推进
+	w.Done(3)
+	require.Equal(t, uint64(1), w.DoneUntil())
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- w.WaitForMark(context.Background(), 3)
+	}()
+	w.Done(2)
+	require.Equal(t, uint64(3), w.DoneUntil())
+	require.NoError(t, <-waited)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, w.WaitForMark(ctx, 4))
+	w.Done(4)
+	require.Equal(t, uint64(4), w.DoneUntil())
+}
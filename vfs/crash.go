@@ -0,0 +1,144 @@
+package vfs
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// ErrCrashed Crash 之后、Reset 之前的所有操作，以及崩溃之前打开的文件返回这个错误
+var ErrCrashed = errors.New("file system crashed")
+
+const crashPageSize = 4096
+
+// NewStrictMem 创建一个可以模拟掉电的内存文件系统
+// 文件的数据只有在 File.Sync 之后才会落盘，新建、删除和重命名的文件只有在 FS.Sync 它所在的目录之后才会落盘，
+// 目录本身在 MkdirAll 时直接落盘。调用 Crash 模拟掉电，再调用 Reset 得到重启之后看到的文件系统
+func NewStrictMem() *MemFS {
+	fs := NewMem()
+	fs.strict = true
+	fs.durable = make(map[string]*memNode)
+	return fs
+}
+
+// Crash 模拟掉电，之后除了关闭文件和释放锁之外的操作都返回 ErrCrashed，直到调用 Reset
+// 崩溃之后仍然可以关闭之前打开的DB，关闭过程中的写入不会影响落盘的数据
+func (fs *MemFS) Crash() {
+	if !fs.strict {
+		panic("vfs: Crash called on a MemFS not created by NewStrictMem")
+	}
+	fs.mu.Lock()
+	fs.crashed = true
+	fs.mu.Unlock()
+}
+
+// Reset 把文件系统恢复到掉电之后重启时的状态：只保留已经同步的目录项，已经同步的数据总是保留
+// 没有同步的修改按页随机保留、丢弃或者只写入了开头的一部分，文件的尺寸随机保留同步时或者崩溃时的值
+// rnd 为nil时丢弃所有没有同步的修改；崩溃之前打开的文件和持有的锁全部失效
+func (fs *MemFS) Reset(rnd *rand.Rand) {
+	if !fs.strict {
+		panic("vfs: Reset called on a MemFS not created by NewStrictMem")
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files = make(map[string]*memNode, len(fs.durable))
+	torn := make(map[*memNode]bool)
+	for name, node := range fs.durable {
+		// 硬链接的多个文件名共享数据，只需要处理一次
+		if !torn[node] {
+			node.Lock()
+			node.data = tear(node.synced, node.data, rnd)
+			node.synced = append(node.synced[:0], node.data...)
+			node.Unlock()
+			torn[node] = true
+		}
+		fs.files[name] = node
+		for d := filepath.Dir(name); !fs.isDir(d); d = filepath.Dir(d) {
+			fs.dirs[d] = struct{}{}
+		}
+	}
+	fs.locks = make(map[string]int)
+	fs.crashed = false
+	fs.gen++
+}
+
+// syncDir 记录 dir 中当前的目录项，调用方需要持有 fs 的锁
+func (fs *MemFS) syncDir(dir string) {
+	for name := range fs.durable {
+		if _, ok := fs.files[name]; !ok && filepath.Dir(name) == dir {
+			delete(fs.durable, name)
+		}
+	}
+	for name, node := range fs.files {
+		if filepath.Dir(name) == dir {
+			fs.durable[name] = node
+		}
+	}
+}
+
+// checkCrashed 调用方需要持有 fs 的锁
+func (fs *MemFS) checkCrashed(op, name string) error {
+	if fs.crashed {
+		return &os.PathError{Op: op, Path: name, Err: ErrCrashed}
+	}
+	return nil
+}
+
+// checkFile 崩溃之后以及崩溃之前打开的文件不能再读写
+func (fs *MemFS) checkFile(op string, f *memFile) error {
+	if !fs.strict {
+		return nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed || f.gen != fs.gen {
+		return &os.PathError{Op: op, Path: f.name, Err: ErrCrashed}
+	}
+	return nil
+}
+
+// tear 返回掉电之后文件的内容，synced 为最近一次同步的数据，cur 为掉电时的数据
+func tear(synced, cur []byte, rnd *rand.Rand) []byte {
+	if rnd == nil {
+		return append([]byte(nil), synced...)
+	}
+	size := len(synced)
+	if len(cur) != len(synced) && rnd.Intn(2) == 0 {
+		size = len(cur)
+	}
+	// 文件扩大的部分在没有写入时为0
+	data := make([]byte, size)
+	copy(data, synced)
+	for off := 0; off < size && off < len(cur); off += crashPageSize {
+		end := off + crashPageSize
+		if end > size {
+			end = size
+		}
+		if end > len(cur) {
+			end = len(cur)
+		}
+		// 只在修改过的范围内撕裂，否则小的追加写入几乎不会被撕裂
+		lo, hi := off, end
+		for lo < hi && data[lo] == cur[lo] {
+			lo++
+		}
+		for hi > lo && data[hi-1] == cur[hi-1] {
+			hi--
+		}
+		if lo == hi {
+			continue
+		}
+		switch rnd.Intn(3) {
+		case 0:
+			// 这一页没有写入
+		case 1:
+			copy(data[lo:hi], cur[lo:hi])
+		case 2:
+			// 页只写入了一部分，修改的数据只有前面一段落盘
+			n := lo + rnd.Intn(hi-lo)
+			copy(data[lo:n], cur[lo:n])
+		}
+	}
+	return data
+}
@@ -0,0 +1,103 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, fs FS, name string) []byte {
+	f, err := fs.Open(name, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	return data
+}
+
+func TestStrictMemCrash(t *testing.T) {
+	fs := NewStrictMem()
+	require.NoError(t, fs.MkdirAll("db", 0755))
+	f, err := fs.Create("db/a")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("synced"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	_, err = f.Write([]byte(" lost"))
+	require.NoError(t, err)
+	// 目录没有同步的文件在崩溃之后消失
+	g, err := fs.Create("db/b")
+	require.NoError(t, err)
+	require.NoError(t, g.Sync())
+	require.NoError(t, fs.Sync("db"))
+	require.NoError(t, fs.Rename("db/b", "db/c"))
+
+	fs.Crash()
+	_, err = f.Write([]byte("x"))
+	require.True(t, errors.Is(err, ErrCrashed))
+	_, err = fs.Open("db/a", os.O_RDONLY, 0)
+	require.True(t, errors.Is(err, ErrCrashed))
+	require.NoError(t, f.Close())
+
+	fs.Reset(nil)
+	require.Equal(t, "synced", string(readFile(t, fs, "db/a")))
+	_, err = fs.Stat("db/b")
+	require.NoError(t, err)
+	_, err = fs.Stat("db/c")
+	require.True(t, os.IsNotExist(err))
+	// 崩溃之前打开的文件已经失效
+	_, err = g.Write([]byte("x"))
+	require.True(t, errors.Is(err, ErrCrashed))
+
+	// 没有同步的修改随机落盘，已经同步的数据总是保留
+	synced := bytes.Repeat([]byte{1}, 3*crashPageSize)
+	cur := bytes.Repeat([]byte{2}, 5*crashPageSize+100)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		data := tear(synced, cur, rnd)
+		require.Contains(t, []int{len(synced), len(cur)}, len(data))
+		for off, b := range data {
+			switch {
+			case b == 2:
+			case off < len(synced):
+				require.Equal(t, byte(1), b)
+			default:
+				require.Equal(t, byte(0), b)
+			}
+		}
+	}
+}
+
+func TestErrorFS(t *testing.T) {
+	fs := NewErrorFS(NewMem())
+	f, err := fs.Create("a")
+	require.NoError(t, err)
+	g, err := fs.Create("b.log")
+	require.NoError(t, err)
+	fs.FailWrite(2, "*.log")
+	_, err = f.Write([]byte("a"))
+	require.NoError(t, err)
+	_, err = g.Write([]byte("a"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("b"))
+	require.NoError(t, err)
+	_, err = g.Write([]byte("b"))
+	require.True(t, errors.Is(err, ErrInjected))
+	// 只注入一次，注入的写入不会修改文件
+	_, err = g.Write([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, "ac", string(readFile(t, fs, "b.log")))
+
+	fs.FailSync(1, "")
+	require.True(t, errors.Is(f.Sync(), ErrInjected))
+	require.NoError(t, f.Sync())
+	fs.FailSync(1, "")
+	require.True(t, errors.Is(fs.Sync("."), ErrInjected))
+	require.NoError(t, f.Close())
+	require.NoError(t, g.Close())
+}
@@ -0,0 +1,122 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrInjected ErrorFS 注入的错误
+var ErrInjected = errors.New("injected error")
+
+// ErrorFS 包装另一个文件系统，让某个文件的第 N 次写入或者同步失败，用于测试出错时的行为
+// 写入包括 File 的 Write、WriteAt 和 Truncate，同步包括 File.Sync 和 FS.Sync；注入的操作不会修改底层文件
+// 打开的文件不是 *os.File，因此即使包装的是 OS 也不会使用mmap
+type ErrorFS struct {
+	FS
+	writes injector
+	syncs  injector
+}
+
+// NewErrorFS 包装 fs，初始时不注入错误
+func NewErrorFS(fs FS) *ErrorFS {
+	return &ErrorFS{FS: Default(fs)}
+}
+
+// FailWrite 从现在开始，文件名匹配 pattern 的第 n 次写入返回 ErrInjected，只注入一次
+// pattern 的语法与 filepath.Match 相同，只匹配文件名，为空时匹配所有文件；n 小于等于0时取消注入
+func (fs *ErrorFS) FailWrite(n int, pattern string) {
+	fs.writes.set(n, pattern)
+}
+
+// FailSync 与 FailWrite 相同，注入的是文件和目录的同步，同步目录时匹配的是目录名
+func (fs *ErrorFS) FailSync(n int, pattern string) {
+	fs.syncs.set(n, pattern)
+}
+
+type injector struct {
+	sync.Mutex
+	n       int // 距离注入错误还剩的操作次数，小于等于0时不注入
+	pattern string
+}
+
+func (in *injector) set(n int, pattern string) {
+	in.Lock()
+	defer in.Unlock()
+	in.n, in.pattern = n, pattern
+}
+
+// maybeFail 匹配的操作计数减一，正好减到0时注入错误
+func (in *injector) maybeFail(op, name string) error {
+	in.Lock()
+	defer in.Unlock()
+	if in.n <= 0 {
+		return nil
+	}
+	if in.pattern != "" {
+		if ok, _ := filepath.Match(in.pattern, filepath.Base(name)); !ok {
+			return nil
+		}
+	}
+	if in.n--; in.n == 0 {
+		return &os.PathError{Op: op, Path: name, Err: ErrInjected}
+	}
+	return nil
+}
+
+func (fs *ErrorFS) Open(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FS.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &errorFile{File: f, fs: fs}, nil
+}
+
+func (fs *ErrorFS) Create(name string) (File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &errorFile{File: f, fs: fs}, nil
+}
+
+func (fs *ErrorFS) Sync(dir string) error {
+	if err := fs.syncs.maybeFail("sync", dir); err != nil {
+		return err
+	}
+	return fs.FS.Sync(dir)
+}
+
+type errorFile struct {
+	File
+	fs *ErrorFS
+}
+
+func (f *errorFile) Write(p []byte) (int, error) {
+	if err := f.fs.writes.maybeFail("write", f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *errorFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.writes.maybeFail("write", f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *errorFile) Truncate(size int64) error {
+	if err := f.fs.writes.maybeFail("truncate", f.Name()); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *errorFile) Sync() error {
+	if err := f.fs.syncs.maybeFail("sync", f.Name()); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
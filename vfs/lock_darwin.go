@@ -0,0 +1,24 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile 对 f 加flock排他锁，readOnly 为 true 时加共享锁
+func lockFile(f *os.File, readOnly bool) error {
+	// LOCK_NB 加锁失败时立即返回，而不是阻塞等待另一个实例退出
+	how := syscall.LOCK_EX
+	if readOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return errors.Wrapf(ErrLocked, "file: %s", f.Name())
+		}
+		return errors.Wrapf(err, "cannot lock file: %s", f.Name())
+	}
+	return nil
+}
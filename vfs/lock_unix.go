@@ -0,0 +1,28 @@
+//go:build linux || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build linux dragonfly freebsd netbsd openbsd solaris
+
+package vfs
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// lockFile 对 f 加flock排他锁，readOnly 为 true 时加共享锁
+// 目录只能以只读方式打开，fcntl 不能对它加写锁，因此统一使用flock
+func lockFile(f *os.File, readOnly bool) error {
+	// LOCK_NB 加锁失败时立即返回，而不是阻塞等待另一个实例退出
+	how := unix.LOCK_EX
+	if readOnly {
+		how = unix.LOCK_SH
+	}
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		if err == unix.EWOULDBLOCK {
+			return errors.Wrapf(ErrLocked, "file: %s", f.Name())
+		}
+		return errors.Wrapf(err, "cannot lock file: %s", f.Name())
+	}
+	return nil
+}
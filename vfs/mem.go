@@ -0,0 +1,474 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS 只保存在内存中的文件系统，进程退出后数据随之丢失
+// 与 InMemory 模式不同，MemFS 中的文件在关闭DB之后仍然存在，可以用同一个 MemFS 重新打开DB
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]struct{}
+	locks map[string]int // 共享锁的持有者数量，-1 表示排他锁
+
+	// 以下字段只在 NewStrictMem 创建的文件系统中使用，见 crash.go
+	strict  bool
+	durable map[string]*memNode // 最近一次 Sync 目录时落盘的目录项
+	crashed bool
+	gen     int // 每次 Reset 加一，之前打开的文件全部失效
+}
+
+// NewMem 创建一个空的内存文件系统
+func NewMem() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  make(map[string]struct{}),
+		locks: make(map[string]int),
+	}
+}
+
+// memNode 文件的数据，硬链接的多个文件名共享同一个 memNode
+type memNode struct {
+	sync.RWMutex
+	data    []byte
+	synced  []byte // 最近一次 Sync 落盘的数据，只在严格模式下记录
+	modTime time.Time
+}
+
+// isDir 调用方需要持有 fs 的锁，根目录总是存在
+func (fs *MemFS) isDir(name string) bool {
+	if filepath.Dir(name) == name {
+		return true
+	}
+	_, ok := fs.dirs[name]
+	return ok
+}
+
+func (fs *MemFS) Open(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("open", name); err != nil {
+		return nil, err
+	}
+	if fs.isDir(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	node, ok := fs.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok && !fs.isDir(filepath.Dir(name)):
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	f := &memFile{
+		fs:       fs,
+		gen:      fs.gen,
+		name:     name,
+		node:     node,
+		readable: flag&os.O_WRONLY == 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}
+	if f.writable && flag&os.O_TRUNC != 0 {
+		node.Lock()
+		node.resize(0)
+		node.Unlock()
+	}
+	return f, nil
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	return fs.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Rename 只支持重命名文件，目标文件存在时会被替换
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("rename", oldname); err != nil {
+		return err
+	}
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if fs.isDir(newname) || !fs.isDir(filepath.Dir(newname)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+// Remove 删除文件或者空目录，已经打开的文件仍然可以读写
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("remove", name); err != nil {
+		return err
+	}
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, ok := fs.dirs[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(fs.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("link", oldname); err != nil {
+		return err
+	}
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.files[newname]; ok || fs.isDir(newname) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if !fs.isDir(filepath.Dir(newname)) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("stat", name); err != nil {
+		return nil, err
+	}
+	return fs.stat(name)
+}
+
+func (fs *MemFS) stat(name string) (os.FileInfo, error) {
+	if node, ok := fs.files[name]; ok {
+		return node.stat(name), nil
+	}
+	if fs.isDir(name) {
+		return &memFileInfo{name: filepath.Base(name), mode: os.ModeDir | 0755}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("open", dir); err != nil {
+		return nil, err
+	}
+	if !fs.isDir(dir) {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	names := fs.children(dir)
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		fi, err := fs.stat(name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+// children 返回 dir 中所有文件和子目录的路径
+func (fs *MemFS) children(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	for name := range fs.dirs {
+		if filepath.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("mkdir", dir); err != nil {
+		return err
+	}
+	for d := dir; !fs.isDir(d); d = filepath.Dir(d) {
+		if _, ok := fs.files[d]; ok {
+			return &os.PathError{Op: "mkdir", Path: d, Err: syscall.ENOTDIR}
+		}
+		fs.dirs[d] = struct{}{}
+	}
+	return nil
+}
+
+// Lock 只在同一个 MemFS 内生效，与 OS 一样，释放锁时不删除文件
+func (fs *MemFS) Lock(name string, readOnly bool) (io.Closer, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	isDir := fs.isDir(name)
+	fs.mu.Unlock()
+	if !isDir {
+		flag := os.O_RDWR | os.O_CREATE
+		if readOnly {
+			flag = os.O_RDONLY
+		}
+		f, err := fs.Open(name, flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+		_ = f.Close()
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := fs.locks[name]
+	if n < 0 || (n > 0 && !readOnly) {
+		return nil, ErrLocked
+	}
+	if readOnly {
+		fs.locks[name] = n + 1
+	} else {
+		fs.locks[name] = -1
+	}
+	return &memLock{fs: fs, name: name, readOnly: readOnly}, nil
+}
+
+// Sync 内存文件系统的目录项不需要落盘，严格模式下记录 dir 中当前的目录项，崩溃之后恢复到这个状态
+func (fs *MemFS) Sync(dir string) error {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkCrashed("sync", dir); err != nil {
+		return err
+	}
+	if !fs.isDir(dir) {
+		return &os.PathError{Op: "sync", Path: dir, Err: os.ErrNotExist}
+	}
+	if fs.strict {
+		fs.syncDir(dir)
+	}
+	return nil
+}
+
+type memLock struct {
+	fs       *MemFS
+	name     string
+	readOnly bool
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if l.readOnly {
+		if l.fs.locks[l.name]--; l.fs.locks[l.name] == 0 {
+			delete(l.fs.locks, l.name)
+		}
+		return nil
+	}
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+// resize 调整文件的尺寸，扩大的部分填充0，调用方需要持有 node 的锁
+func (n *memNode) resize(size int64) {
+	if int64(cap(n.data)) >= size {
+		old := len(n.data)
+		n.data = n.data[:size]
+		for i := old; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+	} else {
+		// 按倍数扩容，避免追加写入时反复拷贝
+		c := 2 * int64(cap(n.data))
+		if c < size {
+			c = size
+		}
+		data := make([]byte, size, c)
+		copy(data, n.data)
+		n.data = data
+	}
+	n.modTime = time.Now()
+}
+
+func (n *memNode) stat(name string) os.FileInfo {
+	n.RLock()
+	defer n.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: 0666, modTime: n.modTime}
+}
+
+// memFile MemFS 中打开的文件
+type memFile struct {
+	fs       *MemFS
+	gen      int // 打开文件时 fs 的 gen，崩溃之后打开的文件全部失效
+	name     string
+	node     *memNode
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	case write && !f.writable, !write && !f.readable:
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return f.fs.checkFile(op, f)
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.node.RLock()
+	defer f.node.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.append {
+		f.node.RLock()
+		f.offset = int64(len(f.node.data))
+		f.node.RUnlock()
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.resize(end)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.node.RLock()
+		offset += int64(len(f.node.data))
+		f.node.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.node.stat(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	if err := f.fs.checkFile("sync", f); err != nil {
+		return err
+	}
+	if f.fs.strict {
+		f.node.Lock()
+		f.node.synced = append(f.node.synced[:0], f.node.data...)
+		f.node.Unlock()
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	f.node.resize(size)
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
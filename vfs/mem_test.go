@@ -0,0 +1,104 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMem()
+	_, err := fs.Create("a/b/f")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, fs.MkdirAll("a/b", 0755))
+
+	f, err := fs.Open("a/b/f", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte(" world"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(5))
+	require.NoError(t, f.Close())
+	require.Error(t, f.Sync())
+
+	// 硬链接共享数据，重命名之后链接仍然有效
+	require.NoError(t, fs.Link("a/b/f", "a/g"))
+	require.True(t, os.IsExist(fs.Link("a/b/f", "a/g")))
+	require.NoError(t, fs.Rename("a/b/f", "a/b/h"))
+	_, err = fs.Stat("a/b/f")
+	require.True(t, os.IsNotExist(err))
+	f, err = fs.Open("a/g", os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("H"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = fs.Open("a/b/h", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(data))
+	_, err = f.Write([]byte("x"))
+	require.Error(t, err)
+	_, err = f.Seek(1, io.SeekStart)
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	n, err := f.Read(buf)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, "ello", string(buf[:n]))
+	require.NoError(t, f.Close())
+
+	infos, err := fs.ReadDir("a")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, "b", infos[0].Name())
+	require.True(t, infos[0].IsDir())
+	require.Equal(t, "g", infos[1].Name())
+	require.Equal(t, int64(5), infos[1].Size())
+	require.Error(t, fs.Remove("a/b"))
+	require.NoError(t, fs.Remove("a/b/h"))
+	require.NoError(t, fs.Remove("a/b"))
+
+	// 共享锁不会创建LOCK文件
+	_, err = fs.Lock("a/LOCK", true)
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Stat("a/LOCK")
+	require.True(t, os.IsNotExist(err))
+	w, err := fs.Lock("a/LOCK", false)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// 共享锁可以同时持有，排他锁与其他锁互斥
+	r1, err := fs.Lock("a/LOCK", true)
+	require.NoError(t, err)
+	r2, err := fs.Lock("a/LOCK", true)
+	require.NoError(t, err)
+	_, err = fs.Lock("a/LOCK", false)
+	require.Equal(t, ErrLocked, err)
+	require.NoError(t, r1.Close())
+	require.NoError(t, r2.Close())
+	w, err = fs.Lock("a/LOCK", false)
+	require.NoError(t, err)
+	_, err = fs.Lock("a/LOCK", true)
+	require.Equal(t, ErrLocked, err)
+	require.NoError(t, w.Close())
+	// 释放锁之后LOCK文件仍然保留
+	_, err = fs.Stat("a/LOCK")
+	require.NoError(t, err)
+
+	// 目录本身也可以加锁，不会创建文件
+	r1, err = fs.Lock("a", true)
+	require.NoError(t, err)
+	_, err = fs.Lock("a", false)
+	require.Equal(t, ErrLocked, err)
+	require.NoError(t, r1.Close())
+	w, err = fs.Lock("a", false)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	fi, err := fs.Stat("a")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+}
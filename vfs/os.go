@@ -0,0 +1,107 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// OS 直接读写磁盘文件的文件系统，打开的文件为 *os.File
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Open(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// 避免返回包含nil指针的非nil接口
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs osFS) Create(name string) (File, error) {
+	return fs.Open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (osFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+// Lock 使用 flock 锁住文件或目录，文件的排他锁会把持有锁的进程号写入文件
+// 释放锁时不删除文件：另一个进程可能已经打开了这个文件并在等待加锁，删除之后它和新建文件的进程会同时持有锁
+func (osFS) Lock(name string, readOnly bool) (io.Closer, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	fi, err := os.Stat(name)
+	isDir := err == nil && fi.IsDir()
+	if readOnly || isDir {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(name, flag, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open lock file: %s", name)
+	}
+	if err = lockFile(f, readOnly); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if readOnly || isDir {
+		return &osLock{f: f}, nil
+	}
+	// 记录持有锁的进程，方便排查问题
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "cannot write pid to lock file: %s", name)
+	}
+	return &osLock{f: f}, nil
+}
+
+// Sync 通过目录的 fd 调用 fsync
+func (osFS) Sync(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "While opening directory: %s.", dir)
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "While syncing directory: %s.", dir)
+	}
+	return errors.Wrapf(closeErr, "While closing directory: %s.", dir)
+}
+
+// osLock 持有LOCK文件的锁
+type osLock struct {
+	f *os.File
+}
+
+// Close 关闭文件即释放锁，LOCK文件保留在目录中
+func (l *osLock) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,58 @@
+// Package vfs 抽象了 jkv 用到的文件系统操作
+// 默认使用 OS 读写磁盘文件，也可以使用 NewMem 创建的内存文件系统，
+// 或者在 FS 外面包装一层，实现统计、配额、故障注入等功能
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrLocked 文件已经被其他持有者锁住时由 FS.Lock 返回
+var ErrLocked = errors.New("file is locked")
+
+// File jkv 读写的文件，*os.File 实现了这个接口
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	// Sync 保证已经写入的数据落盘，故障注入的文件系统在崩溃时会丢弃没有 Sync 的数据
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS jkv 访问文件系统的接口，路径的语义与 os 包相同
+type FS interface {
+	// Open 以 flag 打开文件，语义与 os.OpenFile 相同
+	Open(name string, flag int, perm os.FileMode) (File, error)
+	// Create 创建或者清空文件，以读写模式打开
+	Create(name string) (File, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	// Link 创建硬链接，两个文件名共享同一份数据
+	Link(oldname, newname string) error
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir 返回目录中的文件和子目录，按名称排序
+	ReadDir(dir string) ([]os.FileInfo, error)
+	MkdirAll(dir string, perm os.FileMode) error
+	// Lock 锁住 name 对应的文件，文件不存在时创建；readOnly 为 true 时加共享锁，不会创建文件，文件不存在时返回 os.ErrNotExist
+	// name 为目录时锁住目录本身
+	// 已经被其他持有者锁住时返回 ErrLocked，关闭返回的 io.Closer 释放锁
+	Lock(name string, readOnly bool) (io.Closer, error)
+	// Sync 保证目录项(新建/删除/重命名的文件)落盘
+	Sync(dir string) error
+}
+
+// Default 返回 fs，fs 为nil时返回 OS
+func Default(fs FS) FS {
+	if fs == nil {
+		return OS
+	}
+	return fs
+}
@@ -0,0 +1,75 @@
+package jkv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/vvvvjvvvv/jkv/utils"
+	"github.com/vvvvjvvvv/jkv/vfs"
+)
+
+func TestMemFS(t *testing.T) {
+	clearDir()
+	fs := vfs.NewMem()
+	o := *opt
+	o.WorkDir = filepath.Join(opt.WorkDir, "memfs")
+	o.FS = fs
+	o.ValueThreshold = 32
+	db, err := Open(&o)
+	require.NoError(t, err)
+	// 目录锁在同一个 MemFS 内生效
+	_, err = Open(&o)
+	require.Equal(t, utils.ErrDirLocked, errors.Cause(err))
+
+	// 较大的value写入vlog，写入足够多的数据使内存表刷成sst
+	val := func(i, round int) []byte {
+		if i%2 == 0 {
+			return bytes.Repeat([]byte(fmt.Sprintf("v%d-%d", i, round)), 10)
+		}
+		return []byte(fmt.Sprintf("v%d-%d", i, round))
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), val(i, round))))
+		}
+	}
+	require.NoError(t, db.Del([]byte("key000")))
+	require.NotZero(t, db.Info().Levels[0].NumTables)
+	require.NoError(t, db.Close())
+
+	// 文件只存在于 MemFS 中
+	_, err = os.Stat(o.WorkDir)
+	require.True(t, os.IsNotExist(err))
+	files, err := fs.ReadDir(o.WorkDir)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	check := func(o *Options) {
+		db, err := Open(o)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, db.Close()) }()
+		_, err = db.Get([]byte("key000"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		for i := 1; i < 500; i++ {
+			e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, val(i, 2), e.Value)
+		}
+		require.Equal(t, 499, countKeys(db))
+	}
+	// 使用同一个 MemFS 重新打开，数据从 wal、vlog 和 sst 中恢复
+	check(&o)
+
+	db, err = Open(&o)
+	require.NoError(t, err)
+	cpOpt := o
+	cpOpt.WorkDir = filepath.Join(opt.WorkDir, "memfs-checkpoint")
+	require.NoError(t, db.Checkpoint(cpOpt.WorkDir))
+	require.NoError(t, db.Close())
+	check(&cpOpt)
+}
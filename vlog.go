@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
@@ -25,7 +24,7 @@ import (
 
 const discardStatsFlushThreshold = 100
 
-var lfDiscardStatsKey = []byte("!jvvvv!discard") // For storing lfDiscardStats
+var lfDiscardStatsKey = append(append([]byte{}, jkvPrefix...), "discard"...) // For storing lfDiscardStats
 
 // valueLog
 type valueLog struct {
@@ -45,6 +44,8 @@ type valueLog struct {
 	opt               Options
 	garbageCh         chan struct{}
 	lfDiscardStats    *lfDiscardStats
+	bytesRead         uint64 // 统计信息，必须使用原子操作
+	bytesWritten      uint64
 }
 
 func (vlog *valueLog) newValuePtr(e *utils.Entry) (*utils.ValuePtr, error) {
@@ -58,42 +59,79 @@ func (vlog *valueLog) newValuePtr(e *utils.Entry) (*utils.ValuePtr, error) {
 	err := vlog.write([]*request{req})
 	return req.Ptrs[0], err
 }
-func (vlog *valueLog) open(db *DB, ptr *utils.ValuePtr, replayFn utils.LogEntry) error {
-	vlog.lfDiscardStats.closer.Add(1)
-	go vlog.flushDiscardStats()
+
+// open 打开并重放vlog文件，失败时返回 utils.FileError 并关闭已经打开的文件
+func (vlog *valueLog) open(db *DB, ptr *utils.ValuePtr, replayFn utils.LogEntry) (err error) {
 	if err := vlog.populateFilesMap(); err != nil {
-		return err
+		return utils.NewFileError(utils.FileKindVlog, vlog.dirPath, err)
+	}
+	// 只读模式下不重放也不截断vlog，写入LSM的数据都已经记录在wal中
+	if vlog.opt.ReadOnly {
+		return vlog.openReadOnly()
 	}
 	// If no files are found, then create a new file.
 	if len(vlog.filesMap) == 0 {
-		_, err := vlog.createVlogFile(0)
-		return utils.WarpErr("Error while creating log file in valueLog.open", err)
+		if _, err := vlog.createVlogFile(0); err != nil {
+			return utils.NewFileError(utils.FileKindVlog, vlog.fpath(0),
+				utils.WarpErr("Error while creating log file in valueLog.open", err))
+		}
+		vlog.db.vhead = &utils.ValuePtr{}
+		vlog.startFlushDiscardStats()
+		return nil
 	}
+	var (
+		opened     []*file.LogFile
+		lastOffset uint32
+	)
+	defer func() {
+		if err != nil {
+			for _, lf := range opened {
+				_ = lf.Close()
+			}
+		}
+	}()
 	fids := vlog.sortedFids()
 	for _, fid := range fids {
 		lf, ok := vlog.filesMap[fid]
-		utils.CondPanic(!ok, fmt.Errorf("vlog.filesMap[fid] fid not found"))
-		var err error
-		if err = lf.Open(
+		if !ok {
+			return fmt.Errorf("vlog.filesMap[fid] fid not found")
+		}
+		dk, err := vlog.dataKeyForOpen(fid)
+		if err != nil {
+			return utils.NewFileError(utils.FileKindVlog, vlog.fpath(fid), err)
+		}
+		if err := lf.Open(
 			&file.Options{
 				FID:      uint64(fid),
 				FileName: vlog.fpath(fid),
 				Dir:      vlog.dirPath,
 				Path:     vlog.dirPath,
+				Flag:     os.O_CREATE | os.O_RDWR,
 				MaxSz:    2 * vlog.db.opt.ValueLogFileSize,
+				DataKey:  dk,
+				FS:       vlog.opt.FS,
 			}); err != nil {
-			return errors.Wrapf(err, "Open existing file: %q", lf.FileName())
+			return utils.NewFileError(utils.FileKindVlog, vlog.fpath(fid),
+				errors.Wrap(err, "Open existing file"))
 		}
 		var offset uint32
 		// 从head处开始重放vlog日志，而不是从第一条日志
-		// head 相当于一个快照
-		if fid == ptr.Fid {
+		// head 相当于一个快照，head 之前的文件不需要重放
+		switch {
+		case fid < ptr.Fid && fid < vlog.maxFid:
+			opened = append(opened, lf)
+			if err := lf.Init(); err != nil {
+				return utils.NewFileError(utils.FileKindVlog, lf.FileName(), err)
+			}
+			continue
+		case fid == ptr.Fid:
 			offset = ptr.Offset + ptr.Len
 		}
 		fmt.Printf("Replaying file id: %d at offset: %d\n", fid, offset)
 		now := time.Now()
 		// 重放日志
-		if err := vlog.replayLog(lf, offset, replayFn); err != nil {
+		endOffset, err := vlog.replayLog(lf, offset, replayFn)
+		if err != nil {
 			// Log file is corrupted. Delete it.
 			if err == utils.ErrDeleteVlogFile {
 				delete(vlog.filesMap, fid)
@@ -102,40 +140,79 @@ func (vlog *valueLog) open(db *DB, ptr *utils.ValuePtr, replayFn utils.LogEntry)
 					return errors.Wrapf(err, "failed to close vlog file %s", lf.FileName())
 				}
 				path := vlog.fpath(lf.FID)
-				if err := os.Remove(path); err != nil {
+				if err := vlog.opt.fs().Remove(path); err != nil {
 					return errors.Wrapf(err, "failed to delete empty value log file: %q", path)
 				}
+				if err := vlog.db.registry.Delete(utils.FileKindVlog, uint64(lf.FID)); err != nil {
+					return err
+				}
 				continue
 			}
-			return err
+			_ = lf.Close()
+			return utils.NewFileError(utils.FileKindVlog, lf.FileName(), err)
 		}
+		opened = append(opened, lf)
 		fmt.Printf("Replay took: %s\n", time.Since(now))
+		if fid == vlog.maxFid {
+			lastOffset = endOffset
+		}
 
 		if fid < vlog.maxFid {
 			// This file has been replayed. It can now be mmapped.
 			// For maxFid, the mmap would be done by the specially written code below.
 			if err := lf.Init(); err != nil {
-				return err
+				return utils.NewFileError(utils.FileKindVlog, lf.FileName(), err)
 			}
 		}
 	}
-	// Seek to the end to start writing.
-	last, ok := vlog.filesMap[vlog.maxFid]
-	utils.CondPanic(!ok, errors.New("vlog.filesMap[vlog.maxFid] not found"))
-	lastOffset, err := last.Seek(0, io.SeekEnd)
-	if err != nil {
-		return errors.Wrapf(err, fmt.Sprintf("file.Seek to end path:[%s]", last.FileName()))
+	// 从最后一条有效日志之后开始写入
+	// 空文件在打开时会被扩展到 2*ValueLogFileSize，不能直接 seek 到文件末尾
+	if _, ok := vlog.filesMap[vlog.maxFid]; !ok {
+		return errors.New("vlog.filesMap[vlog.maxFid] not found")
 	}
-	vlog.writableLogOffset = uint32(lastOffset)
+	vlog.writableLogOffset = lastOffset
 
 	// head的设计起到check point的作用
-	vlog.db.vhead = &utils.ValuePtr{Fid: vlog.maxFid, Offset: uint32(lastOffset)}
+	vlog.db.vhead = &utils.ValuePtr{Fid: vlog.maxFid, Offset: lastOffset}
 	if err := vlog.populateDiscardStats(); err != nil {
 		_ = fmt.Errorf("Failed to populate discard stats: %s\n", err)
 	}
+	vlog.startFlushDiscardStats()
+	return nil
+}
+
+// openReadOnly 只读打开所有的vlog文件，不会新建、截断或删除文件，也不启动 discard stats 的持久化协程
+func (vlog *valueLog) openReadOnly() error {
+	opened := make([]*file.LogFile, 0, len(vlog.filesMap))
+	for _, fid := range vlog.sortedFids() {
+		lf := vlog.filesMap[fid]
+		if err := lf.Open(&file.Options{
+			FID:      uint64(fid),
+			FileName: vlog.fpath(fid),
+			Dir:      vlog.dirPath,
+			Path:     vlog.dirPath,
+			Flag:     os.O_RDONLY,
+			DataKey:  vlog.db.registry.DataKey(utils.FileKindVlog, uint64(fid)),
+			FS:       vlog.opt.FS,
+		}); err != nil {
+			for _, lf := range opened {
+				_ = lf.Close()
+			}
+			return utils.NewFileError(utils.FileKindVlog, vlog.fpath(fid),
+				errors.Wrap(err, "Open existing file"))
+		}
+		opened = append(opened, lf)
+	}
+	vlog.db.vhead = &utils.ValuePtr{Fid: vlog.maxFid}
 	return nil
 }
 
+// startFlushDiscardStats vlog 打开成功之后启动 discard stats 的持久化协程
+func (vlog *valueLog) startFlushDiscardStats() {
+	vlog.lfDiscardStats.closer.Add(1)
+	go vlog.flushDiscardStats()
+}
+
 // Read reads the value log at a given location.
 // TODO: Make this read private.
 func (vlog *valueLog) read(vp *utils.ValuePtr) ([]byte, func(), error) {
@@ -146,6 +223,7 @@ func (vlog *valueLog) read(vp *utils.ValuePtr) ([]byte, func(), error) {
 	if err != nil {
 		return nil, cb, err
 	}
+	atomic.AddUint64(&vlog.bytesRead, uint64(len(buf)))
 
 	if vlog.opt.VerifyValueChecksum {
 		hash := crc32.New(utils.CastagnoliCrcTable)
@@ -168,6 +246,7 @@ func (vlog *valueLog) read(vp *utils.ValuePtr) ([]byte, func(), error) {
 		return nil, nil, errors.Errorf("Invalid read: Len: %d read at:[%d:%d]",
 			len(kv), h.KLen, h.KLen+h.VLen)
 	}
+	kv = lf.DecryptKV(kv[:h.KLen+h.VLen], vp.Offset)
 	return kv[h.KLen : h.KLen+h.VLen], cb, nil
 }
 
@@ -194,6 +273,7 @@ func (vlog *valueLog) write(reqs []*request) error {
 			return errors.Wrapf(err, "Unable to write to value log file: %q", curlf.FileName())
 		}
 		buf.Reset()
+		atomic.AddUint64(&vlog.bytesWritten, uint64(len(data)))
 		atomic.AddUint32(&vlog.writableLogOffset, uint32(len(data)))
 		curlf.AddSize(vlog.writableLogOffset)
 		return nil
@@ -205,18 +285,11 @@ func (vlog *valueLog) write(reqs []*request) error {
 		// 切分vlog文件
 		if vlog.woffset() > uint32(vlog.opt.ValueLogFileSize) ||
 			vlog.numEntriesWritten > vlog.opt.ValueLogMaxEntries {
-			if err := curlf.DoneWriting(vlog.woffset()); err != nil {
-				return err
-			}
-
-			newid := atomic.AddUint32(&vlog.maxFid, 1)
-			utils.CondPanic(newid <= 0, fmt.Errorf("newid has overflown uint32: %v", newid))
-			newlf, err := vlog.createVlogFile(newid)
+			newlf, err := vlog.rotate(curlf)
 			if err != nil {
 				return err
 			}
 			curlf = newlf
-			atomic.AddInt32(&vlog.db.logRotates, 1)
 		}
 		return nil
 	}
@@ -224,9 +297,12 @@ func (vlog *valueLog) write(reqs []*request) error {
 		b := reqs[i]
 		b.Ptrs = b.Ptrs[:0]
 		var written int
+		// 多个entry的请求作为一个事务写入：value写入LSM的entry也写入vlog，并用 BitTxn/BitFinTxn 标记事务的边界，
+		// 写入LSM的过程中崩溃时，重放vlog可以补全事务；vlog中不完整的事务在重放时被丢弃
+		txn := len(b.Entries) > 1
 		for j := range b.Entries {
 			e := b.Entries[j]
-			if vlog.db.shouldWriteValueToLSM(e) {
+			if !txn && vlog.db.shouldWriteValueToLSM(e) {
 				b.Ptrs = append(b.Ptrs, &utils.ValuePtr{})
 				continue
 			}
@@ -235,7 +311,16 @@ func (vlog *valueLog) write(reqs []*request) error {
 			p.Fid = curlf.FID
 			// Use the offset including buffer length so far.
 			p.Offset = vlog.woffset() + uint32(buf.Len())
+			meta := e.Meta
+			if txn {
+				if j == len(b.Entries)-1 {
+					e.Meta |= utils.BitFinTxn
+				} else {
+					e.Meta |= utils.BitTxn
+				}
+			}
 			plen, err := curlf.EncodeEntry(e, &buf, p.Offset) // Now encode the entry into buffer.
+			e.Meta = meta
 			if err != nil {
 				return err
 			}
@@ -274,7 +359,7 @@ func (vlog *valueLog) close() error {
 	for id, f := range vlog.filesMap {
 		f.Lock.Lock() // We won’t release the lock.
 		maxFid := vlog.maxFid
-		if id == maxFid {
+		if id == maxFid && !vlog.opt.ReadOnly {
 			// truncate writable log file to correct offset.
 			if truncErr := f.Truncate(int64(vlog.woffset())); truncErr != nil && err == nil {
 				err = truncErr
@@ -362,7 +447,10 @@ func (vlog *valueLog) rewrite(f *file.LogFile) error {
 			fmt.Printf("Processing entry %d\n", count)
 		}
 
-		vs, err := vlog.db.lsm.Get(e.Key)
+		vs, err := vlog.db.lsm.Get(utils.KeyWithTs(utils.ParseKey(e.Key), math.MaxUint64))
+		if err == utils.ErrKeyNotFound {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -502,7 +590,13 @@ func (vlog *valueLog) deleteLogFile(lf *file.LogFile) error {
 	lf.Lock.Lock()
 	defer lf.Lock.Unlock()
 	utils.Err(lf.Close())
-	return os.Remove(lf.FileName())
+	if lf.InMemory() {
+		return nil
+	}
+	if err := vlog.opt.fs().Remove(lf.FileName()); err != nil {
+		return err
+	}
+	return vlog.db.registry.Delete(utils.FileKindVlog, uint64(lf.FID))
 }
 
 // validateWrites  可以检查当前的req是否能写入vlog日志，一个vlog日志最大4GB
@@ -591,8 +685,12 @@ func (vlog *valueLog) woffset() uint32 {
 
 func (vlog *valueLog) populateFilesMap() error {
 	vlog.filesMap = make(map[uint32]*file.LogFile)
+	// 内存模式下没有已经存在的vlog文件
+	if vlog.opt.InMemory {
+		return nil
+	}
 
-	files, err := ioutil.ReadDir(vlog.dirPath)
+	files, err := vlog.opt.fs().ReadDir(vlog.dirPath)
 	if err != nil {
 		return utils.WarpErr(fmt.Sprintf("Unable to open log dir. path[%s]", vlog.dirPath), err)
 	}
@@ -632,18 +730,28 @@ func (vlog *valueLog) createVlogFile(fid uint32) (*file.LogFile, error) {
 		Lock: sync.RWMutex{},
 	}
 
-	var err error
-	utils.Panic2(nil, lf.Open(&file.Options{
+	// 数据密钥需要在文件写入之前持久化
+	dk, err := vlog.db.registry.NewDataKey(utils.FileKindVlog, uint64(fid))
+	if err != nil {
+		return nil, err
+	}
+	if err = lf.Open(&file.Options{
 		FID:      uint64(fid),
 		FileName: path,
 		Dir:      vlog.dirPath,
 		Path:     vlog.dirPath,
+		Flag:     os.O_CREATE | os.O_RDWR,
 		MaxSz:    2 * vlog.db.opt.ValueLogFileSize,
-	}))
+		DataKey:  dk,
+		InMemory: vlog.opt.InMemory,
+		FS:       vlog.opt.FS,
+	}); err != nil {
+		return nil, err
+	}
 
 	removeFile := func() {
 		// 如果处理出错 则直接删除文件
-		utils.Err(os.Remove(lf.FileName()))
+		utils.Err(vlog.opt.fs().Remove(lf.FileName()))
 	}
 
 	if err = lf.Bootstrap(); err != nil {
@@ -651,9 +759,12 @@ func (vlog *valueLog) createVlogFile(fid uint32) (*file.LogFile, error) {
 		return nil, err
 	}
 
-	if err = utils.SyncDir(vlog.dirPath); err != nil {
-		removeFile()
-		return nil, utils.WarpErr(fmt.Sprintf("Sync value log dir[%s]", vlog.dirPath), err)
+	// 内存文件不需要同步目录
+	if !vlog.opt.InMemory {
+		if err = vlog.opt.fs().Sync(vlog.dirPath); err != nil {
+			removeFile()
+			return nil, utils.WarpErr(fmt.Sprintf("Sync value log dir[%s]", vlog.dirPath), err)
+		}
 	}
 	vlog.filesLock.Lock()
 	vlog.filesMap[fid] = lf
@@ -665,6 +776,71 @@ func (vlog *valueLog) createVlogFile(fid uint32) (*file.LogFile, error) {
 	return lf, nil
 }
 
+// dataKeyForOpen 返回打开已有vlog文件时使用的数据密钥
+// 空的可写文件总是使用新的数据密钥，checkpoint 中的这个文件与原库共享了密钥，继续使用会导致两边重复使用同一段密钥流
+func (vlog *valueLog) dataKeyForOpen(fid uint32) (*file.DataKey, error) {
+	if fid == vlog.maxFid && vlog.db.registry != nil {
+		fi, err := vlog.opt.fs().Stat(vlog.fpath(fid))
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() == 0 {
+			return vlog.db.registry.NewDataKey(utils.FileKindVlog, uint64(fid))
+		}
+	}
+	return vlog.db.registry.DataKey(utils.FileKindVlog, uint64(fid)), nil
+}
+
+// rotate 结束当前文件的写入，并创建一个新的文件用于写入，与 write 一样不是并发安全的
+func (vlog *valueLog) rotate(curlf *file.LogFile) (*file.LogFile, error) {
+	if err := curlf.DoneWriting(vlog.woffset()); err != nil {
+		return nil, err
+	}
+
+	newid := atomic.AddUint32(&vlog.maxFid, 1)
+	utils.CondPanic(newid <= 0, fmt.Errorf("newid has overflown uint32: %v", newid))
+	newlf, err := vlog.createVlogFile(newid)
+	if err != nil {
+		// 新文件没有创建成功，继续写入当前文件，否则之后的写入找不到 maxFid 对应的文件
+		atomic.AddUint32(&vlog.maxFid, ^uint32(0))
+		return nil, err
+	}
+	atomic.AddInt32(&vlog.db.logRotates, 1)
+	return newlf, nil
+}
+
+// checkpoint 把所有已经写完的vlog文件硬链接到 dir，调用方需要保证期间没有写入
+// 正在写入的文件会先切换到新文件，保证链接的文件之后不会再被修改，调用方需要暂停 GC
+func (vlog *valueLog) checkpoint(dir string) error {
+	vlog.filesLock.RLock()
+	curlf := vlog.filesMap[vlog.maxFid]
+	vlog.filesLock.RUnlock()
+	if vlog.woffset() > utils.VlogHeaderSize {
+		if _, err := vlog.rotate(curlf); err != nil {
+			return err
+		}
+	}
+
+	vlog.filesLock.RLock()
+	maxFid := vlog.maxFid
+	fids := vlog.sortedFids()
+	vlog.filesLock.RUnlock()
+	for _, fid := range fids {
+		if fid == maxFid {
+			continue
+		}
+		if err := vlog.opt.fs().Link(vlog.fpath(fid), utils.VlogFilePath(dir, fid)); err != nil {
+			return errors.Wrapf(err, "while linking vlog file %d", fid)
+		}
+	}
+	// checkpoint 需要一个独立的可写文件，否则打开之后会追加写到与原库共享的文件中
+	f, err := vlog.opt.fs().Open(utils.VlogFilePath(dir, maxFid), os.O_CREATE|os.O_EXCL|os.O_RDWR, utils.DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // sortedFids returns the file id's not pending deletion, sorted.  Assumes we have shared access to
 // filesMap.
 func (vlog *valueLog) sortedFids() []uint32 {
@@ -684,14 +860,15 @@ func (vlog *valueLog) sortedFids() []uint32 {
 	return ret
 }
 
-func (vlog *valueLog) replayLog(lf *file.LogFile, offset uint32, replayFn utils.LogEntry) error {
+// replayLog 重放 lf 中从 offset 开始的日志，返回最后一条有效日志的结束位置
+func (vlog *valueLog) replayLog(lf *file.LogFile, offset uint32, replayFn utils.LogEntry) (uint32, error) {
 	// Alright, let's iterate now.
 	endOffset, err := vlog.iterate(lf, offset, replayFn)
 	if err != nil {
-		return errors.Wrapf(err, "Unable to replay logfile:[%s]", lf.FileName())
+		return 0, errors.Wrapf(err, "Unable to replay logfile:[%s]", lf.FileName())
 	}
 	if int64(endOffset) == int64(lf.Size()) {
-		return nil
+		return endOffset, nil
 	}
 
 	// TODO: 如果vlog日志损坏怎么办? 当前默认是截断损坏的数据
@@ -704,17 +881,17 @@ func (vlog *valueLog) replayLog(lf *file.LogFile, offset uint32, replayFn utils.
 
 	if endOffset <= utils.VlogHeaderSize {
 		if lf.FID != vlog.maxFid {
-			return utils.ErrDeleteVlogFile
+			return 0, utils.ErrDeleteVlogFile
 		}
-		return lf.Bootstrap()
+		return endOffset, lf.Bootstrap()
 	}
 
 	fmt.Printf("Truncating vlog file %s to offset: %d\n", lf.FileName(), endOffset)
 	if err := lf.Truncate(int64(endOffset)); err != nil {
-		return utils.WarpErr(
+		return 0, utils.WarpErr(
 			fmt.Sprintf("Truncation needed at offset %d. Can be done manually as well.", endOffset), err)
 	}
-	return nil
+	return endOffset, nil
 }
 
 // iterate iterates over log file. It doesn't not allocate new memory for every kv pair.
@@ -729,11 +906,12 @@ func (vlog *valueLog) iterate(lf *file.LogFile, offset uint32, fn utils.LogEntry
 	}
 
 	// We're not at the end of the file. Let's Seek to the offset and start reading.
-	if _, err := lf.Seek(int64(offset), io.SeekStart); err != nil {
+	r, err := lf.NewReader(int64(offset))
+	if err != nil {
 		return 0, errors.Wrapf(err, "Unable to seek, name:%s", lf.FileName())
 	}
 
-	reader := bufio.NewReader(lf.FD())
+	reader := bufio.NewReader(r)
 	read := &safeRead{
 		k:            make([]byte, 10),
 		v:            make([]byte, 10),
@@ -742,6 +920,11 @@ func (vlog *valueLog) iterate(lf *file.LogFile, offset uint32, fn utils.LogEntry
 	}
 
 	var validEndOffset uint32 = offset
+	// 事务的entry先缓存起来，读到事务的最后一个entry之后再一起交给 fn
+	var (
+		txnEntries []*utils.Entry
+		txnPtrs    []*utils.ValuePtr
+	)
 
 loop:
 	for {
@@ -763,13 +946,34 @@ loop:
 
 		vp.Offset = e.Offset
 		vp.Fid = lf.FID
+		meta := e.Meta
+		e.Meta &^= utils.BitTxn | utils.BitFinTxn
+		switch {
+		case meta&utils.BitTxn > 0:
+			txnEntries = append(txnEntries, e)
+			txnPtrs = append(txnPtrs, &vp)
+			continue
+		case meta&utils.BitFinTxn > 0:
+			txnEntries = append(txnEntries, e)
+			txnPtrs = append(txnPtrs, &vp)
+		case len(txnEntries) > 0:
+			// 事务中间出现了不属于事务的entry，之后的数据不可信
+			break loop
+		default:
+			txnEntries = append(txnEntries[:0], e)
+			txnPtrs = append(txnPtrs[:0], &vp)
+		}
+		// 不完整的事务不会被重放，截断时也会被截掉
 		validEndOffset = read.recordOffset
-		if err := fn(e, &vp); err != nil {
-			if err == utils.ErrStop {
-				break
+		for i := range txnEntries {
+			if err := fn(txnEntries[i], txnPtrs[i]); err != nil {
+				if err == utils.ErrStop {
+					break loop
+				}
+				return 0, utils.WarpErr(fmt.Sprintf("Iteration function %s", lf.FileName()), err)
 			}
-			return 0, utils.WarpErr(fmt.Sprintf("Iteration function %s", lf.FileName()), err)
 		}
+		txnEntries, txnPtrs = txnEntries[:0], txnPtrs[:0]
 	}
 	return validEndOffset, nil
 }
@@ -814,8 +1018,6 @@ func (r *safeRead) Entry(reader io.Reader) (*utils.Entry, error) {
 		return nil, err
 	}
 
-	e.Key = buf[:h.KLen]
-	e.Value = buf[h.KLen:]
 	var crcBuf [crc32.Size]byte
 	if _, err := io.ReadFull(reader, crcBuf[:]); err != nil {
 		if err == io.EOF {
@@ -827,6 +1029,9 @@ func (r *safeRead) Entry(reader io.Reader) (*utils.Entry, error) {
 	if crc != tee.Sum32() {
 		return nil, utils.ErrTruncate
 	}
+	buf = r.lf.DecryptKV(buf, r.recordOffset)
+	e.Key = buf[:h.KLen]
+	e.Value = buf[h.KLen:]
 	e.Meta = h.Meta
 	e.ExpiresAt = h.ExpiresAt
 	return e, nil
@@ -836,7 +1041,10 @@ func (r *safeRead) Entry(reader io.Reader) (*utils.Entry, error) {
 func (vlog *valueLog) populateDiscardStats() error {
 	key := utils.KeyWithTs(lfDiscardStatsKey, math.MaxUint64)
 	var statsMap map[uint32]int64
-	vs, err := vlog.db.Get(key)
+	vs, err := vlog.db.lsm.Get(key)
+	if err == utils.ErrKeyNotFound {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -873,11 +1081,10 @@ func (vlog *valueLog) fpath(fid uint32) string {
 	return utils.VlogFilePath(vlog.dirPath, fid)
 }
 
-// initVLog
+// initVLog 初始化vlog结构，LSM初始化完成后再调用 open 重放
 func (db *DB) initVLog() {
-	vp, _ := db.getHead()
 	vlog := &valueLog{
-		dirPath:          db.opt.WorkDir,
+		dirPath:          db.opt.valueDir(),
 		filesToBeDeleted: make([]uint32, 0),
 		lfDiscardStats: &lfDiscardStats{
 			m:         make(map[uint32]int64),
@@ -888,20 +1095,38 @@ func (db *DB) initVLog() {
 	vlog.db = db
 	vlog.opt = *db.opt
 	vlog.garbageCh = make(chan struct{}, 1)
-	if err := vlog.open(db, vp, db.replayFunction()); err != nil {
-		utils.Panic(err)
-	}
 	db.vlog = vlog
 }
 
-// getHead prints all the head pointer in the DB and return the max value.
-func (db *DB) getHead() (*utils.ValuePtr, uint64) {
+// getHead 返回LSM中记录的vlog head，没有记录时返回零值，从头开始重放
+// 旧版本的数据目录中head记录在 legacyHead 下
+func (db *DB) getHead() (*utils.ValuePtr, error) {
 	var vptr utils.ValuePtr
-	return &vptr, 0
+	for _, key := range [][]byte{head, legacyHead} {
+		val, err := db.lsm.Get(utils.KeyWithTs(key, math.MaxUint64))
+		if err == utils.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Retrieving head from on-disk LSM")
+		}
+		// 内部key head 一定是value ptr，长度不对说明数据已经损坏
+		if len(val.Value) != len(vptr.Encode()) {
+			return nil, errors.Wrapf(utils.ErrBadChecksum, "invalid value log head %x", val.Value)
+		}
+		vptr.Decode(val.Value)
+		break
+	}
+	return &vptr, nil
 }
 func (db *DB) replayFunction() func(*utils.Entry, *utils.ValuePtr) error {
-	toLSM := func(k []byte, vs utils.ValueStruct) {
-		db.lsm.Set(&utils.Entry{
+	// 版本号小于LSM中最大版本的entry已经写入过LSM了，不需要重复写入
+	// 等于最大版本的entry可能属于写入LSM时崩溃的事务，只写入了一部分，需要重放；同一个版本重复写入是幂等的
+	// 托管模式下版本号由调用方指定、可以乱序写入，较小的版本可能在较大的版本之后写入，因此全部重放
+	maxVersion := db.lsm.MaxVersion()
+	managed := db.opt.ManagedTxns
+	toLSM := func(k []byte, vs utils.ValueStruct) error {
+		return db.lsm.Set(&utils.Entry{
 			Key:       k,
 			Value:     vs.Value,
 			ExpiresAt: vs.ExpiresAt,
@@ -925,6 +1150,9 @@ func (db *DB) replayFunction() func(*utils.Entry, *utils.ValuePtr) error {
 		// and the head is not updated, we will end up replaying all the
 		// files starting from file zero, again.
 		db.updateHead([]*utils.ValuePtr{vp})
+		if !managed && utils.ParseTs(nk) < maxVersion {
+			return nil
+		}
 
 		v := utils.ValueStruct{
 			Value:     nv,
@@ -932,8 +1160,7 @@ func (db *DB) replayFunction() func(*utils.Entry, *utils.ValuePtr) error {
 			ExpiresAt: e.ExpiresAt,
 		}
 		// This entry is from a rewrite or via SetEntryAt(..).
-		toLSM(nk, v)
-		return nil
+		return toLSM(nk, v)
 	}
 }
 
@@ -948,7 +1175,8 @@ func (db *DB) updateHead(ptrs []*utils.ValuePtr) {
 			break
 		}
 	}
-	if ptr.IsZero() {
+	// 所有的value都写入了LSM
+	if ptr == nil || ptr.IsZero() {
 		return
 	}
 
@@ -1059,6 +1287,26 @@ func (vlog *valueLog) flushDiscardStats() {
 	}
 }
 
+// discardAll 将除了正在写入的文件之外的所有vlog文件标记为可以全部丢弃，用于 DropAll 之后的GC
+func (vlog *valueLog) discardAll() {
+	stats := make(map[uint32]int64)
+	vlog.filesLock.RLock()
+	for fid, lf := range vlog.filesMap {
+		if fid != vlog.maxFid {
+			stats[fid] = lf.Size()
+		}
+	}
+	vlog.filesLock.RUnlock()
+	if len(stats) == 0 {
+		return
+	}
+	vlog.lfDiscardStats.Lock()
+	for fid, size := range stats {
+		vlog.lfDiscardStats.m[fid] = size
+	}
+	vlog.lfDiscardStats.Unlock()
+}
+
 // 请求池
 var requestPool = sync.Pool{
 	New: func() interface{} {
@@ -1075,6 +1323,12 @@ type request struct {
 	Wg   sync.WaitGroup
 	Err  error
 	ref  int32
+
+	enqueuedAt time.Time // 进入写队列的时间，用于统计写入延迟
+	// cond 不为nil时只有满足条件才会写入，否则返回 utils.ErrConditionFailed
+	cond *writeCondition
+	// skipPublish 为 true 时写入不会通知订阅者
+	skipPublish bool
 }
 
 func (req *request) reset() {
@@ -1083,6 +1337,8 @@ func (req *request) reset() {
 	req.Wg = sync.WaitGroup{}
 	req.Err = nil
 	req.ref = 0
+	req.cond = nil
+	req.skipPublish = false
 }
 
 // GC 部分
@@ -1196,7 +1452,12 @@ func (vlog *valueLog) sample(samp *sampler, discardRatio float64) (*reason, erro
 		r.total += esz
 		r.count++
 
-		entry, err := vlog.db.Get(e.Key)
+		// 查询该key的最新版本，被新版本覆盖的旧值都是可以回收的
+		entry, err := vlog.db.lsm.Get(utils.KeyWithTs(utils.ParseKey(e.Key), math.MaxUint64))
+		if err == utils.ErrKeyNotFound {
+			r.discard += esz
+			return nil
+		}
 		if err != nil {
 			return err
 		}
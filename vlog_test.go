@@ -27,10 +27,10 @@ func TestVlogBase(t *testing.T) {
 	// 清理目录
 	clearDir()
 	// 打开DB
-	db := Open(opt)
+	db, err := Open(opt)
+	require.NoError(t, err)
 	defer db.Close()
 	log := db.vlog
-	var err error
 	// 创建一个简单的kv entry对象
 	const val1 = "sampleval012345678901234567890123"
 	const val2 = "samplevalb012345678901234567890123"
@@ -99,7 +99,8 @@ func clearDir() {
 func TestValueGC(t *testing.T) {
 	clearDir()
 	opt.ValueLogFileSize = 1 << 20
-	kv := Open(opt)
+	kv, err := Open(opt)
+	require.NoError(t, err)
 	defer kv.Close()
 	sz := 32 << 10
 	kvList := []*utils.Entry{}